@@ -3,3 +3,8 @@ module github.com/manzil-infinity180/dns-server-resolver
 go 1.23.5
 
 require golang.org/x/net v0.34.0
+
+require (
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+)
@@ -1,15 +1,115 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/manzil-infinity180/dns-server-resolver/pkg/dns"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// startQUIC serves DNS over QUIC; nil unless built with -tags doq, see
+// main_doq.go.
+var startQUIC func(cfg dns.Config)
+
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+
+	cfg := dns.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = dns.LoadConfig(*configPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := dns.Configure(cfg); err != nil {
+		panic(err)
+	}
+
+	if cfg.CacheFile != "" {
+		loaded, err := dns.LoadCacheFile(cfg.CacheFile)
+		if err != nil {
+			fmt.Printf("could not warm cache from %s: %s\n", cfg.CacheFile, err)
+		} else {
+			fmt.Printf("Warmed cache with %d entries from %s\n", loaded, cfg.CacheFile)
+		}
+		stop := make(chan struct{})
+		if cfg.CacheSaveInterval > 0 {
+			go dns.PersistCache(cfg.CacheFile, time.Duration(cfg.CacheSaveInterval), stop)
+		}
+		go saveCacheOnShutdown(cfg.CacheFile, stop)
+	}
+
+	if cfg.DNSSEC && cfg.TrustAnchorStateFile != "" {
+		go dns.MaintainTrustAnchors(nil)
+	}
+
+	if len(cfg.Forwarders)+len(cfg.ForwardZones) > 0 && cfg.ForwardHealthInterval > 0 {
+		go dns.MaintainForwarders(nil)
+	}
+
+	// keeps the secondary zones up to date; without any it only sleeps
+	go dns.MaintainZones(nil)
+	go reloadZonesOnHangup()
+
+	if cfg.AdminListen != "" {
+		go func() {
+			fmt.Printf("Starting admin API on %s...\n", cfg.AdminListen)
+			if err := http.ListenAndServe(cfg.AdminListen, dns.NewAdminHandler()); err != nil {
+				fmt.Printf("admin API stopped: %s\n", err)
+			}
+		}()
+	}
+
+	if cfg.TLSListen != "" {
+		listener, err := dns.ListenTLS(cfg.TLSListen, cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			fmt.Printf("Starting DNS over TLS on %s...\n", cfg.TLSListen)
+			if err := dns.ServeTLS(listener); err != nil {
+				fmt.Printf("DNS over TLS stopped: %s\n", err)
+			}
+		}()
+	}
+
+	if cfg.QUICListen != "" {
+		if startQUIC == nil {
+			panic("quic_listen is set but DNS over QUIC is not built in, rebuild with -tags doq")
+		}
+		startQUIC(cfg)
+	}
+
+	if cfg.DoHListen != "" {
+		go func() {
+			fmt.Printf("Starting DNS over HTTPS on %s...\n", cfg.DoHListen)
+			server := dns.NewDoHServer(cfg.DoHListen, cfg.DoHHTTP2)
+			if err := server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+				fmt.Printf("DNS over HTTPS stopped: %s\n", err)
+			}
+		}()
+	}
+
+	// TCP as RFC 7766 asks, zone transfers included
+	tcpListener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		if err := dns.ServeTCP(tcpListener); err != nil {
+			fmt.Printf("DNS over TCP stopped: %s\n", err)
+		}
+	}()
 
 	fmt.Printf("Starting DNS Server...\n")
-	packetConn, err := net.ListenPacket("udp", ":53")
+	packetConn, err := net.ListenPacket("udp", cfg.Listen)
 	if err != nil {
 		panic(err)
 	}
@@ -26,3 +126,32 @@ func main() {
 	}
 
 }
+
+// reloadZonesOnHangup reads the zone files again on every SIGHUP, so an
+// edited primary zone gets journaled and its secondaries notified.
+func reloadZonesOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := dns.ReloadZones(); err != nil {
+			fmt.Printf("%s, keeping the zones as they were\n", err)
+			continue
+		}
+		fmt.Printf("Reloaded zones\n")
+	}
+}
+
+// saveCacheOnShutdown dumps the cache when the process is asked to stop so the
+// next start begins with a warm cache.
+func saveCacheOnShutdown(path string, stop chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	close(stop)
+	if err := dns.SaveCacheFile(path); err != nil {
+		fmt.Printf("saving cache to %s failed: %s\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Saved cache to %s\n", path)
+	os.Exit(0)
+}
@@ -0,0 +1,24 @@
+//go:build doq
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/manzil-infinity180/dns-server-resolver/pkg/dns"
+)
+
+func init() {
+	startQUIC = func(cfg dns.Config) {
+		endpoint, err := dns.ListenQUIC(cfg.QUICListen, cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			fmt.Printf("Starting DNS over QUIC on %s...\n", cfg.QUICListen)
+			if err := dns.ServeQUIC(endpoint); err != nil {
+				fmt.Printf("DNS over QUIC stopped: %s\n", err)
+			}
+		}()
+	}
+}
@@ -1,9 +1,12 @@
 package rfc
 
 import (
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 )
 
 type OpCode uint16
@@ -26,16 +29,38 @@ type RecordType uint16
 
 // DNS Record Types
 const (
-	TypeA     RecordType = 1  // Host address
-	TypeNS    RecordType = 2  // Authoritative name server
-	TypeCNAME RecordType = 5  // Canonical name for an alias
-	TypeSOA   RecordType = 6  // Start of authority zone
-	TypePTR   RecordType = 12 // Domain name pointer
-	TypeMX    RecordType = 15 // Mail exchange
-	TypeTXT   RecordType = 16 // Text strings
-	TypeAAAA  RecordType = 28 // IPv6 host address
+	TypeA      RecordType = 1  // Host address
+	TypeNS     RecordType = 2  // Authoritative name server
+	TypeCNAME  RecordType = 5  // Canonical name for an alias
+	TypeSOA    RecordType = 6  // Start of authority zone
+	TypePTR    RecordType = 12 // Domain name pointer
+	TypeMX     RecordType = 15 // Mail exchange
+	TypeTXT    RecordType = 16 // Text strings
+	TypeAAAA   RecordType = 28 // IPv6 host address
+	TypeSRV    RecordType = 33 // Server selection (RFC 2782)
+	TypeDS     RecordType = 43 // Delegation signer (RFC 4034)
+	TypeDNSKEY RecordType = 48 // DNSSEC public key (RFC 4034)
 )
 
+// typeNames holds the mnemonics of the types above and of the common ones
+// this package has no RDATA type for; those are read and written in the
+// RFC 3597 generic form.
+var typeNames = map[RecordType]string{
+	TypeA: "A", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypePTR: "PTR", 13: "HINFO",
+	TypeMX: "MX", TypeTXT: "TXT", TypeAAAA: "AAAA", TypeSRV: "SRV", 35: "NAPTR", 39: "DNAME",
+	41: "OPT", TypeDS: "DS", 44: "SSHFP", 46: "RRSIG", 47: "NSEC", TypeDNSKEY: "DNSKEY",
+	50: "NSEC3", 51: "NSEC3PARAM", 52: "TLSA", 64: "SVCB", 65: "HTTPS", 251: "IXFR",
+	252: "AXFR", 255: "ANY", 257: "CAA",
+}
+
+// String returns the mnemonic of t, TYPEnnn (RFC 3597) for types without one.
+func (t RecordType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
 // RecordClass represents the class of DNS resource record
 type RecordClass uint16
 
@@ -47,6 +72,16 @@ const (
 	ClassHS RecordClass = 4 // Hesiod
 )
 
+var classNames = map[RecordClass]string{ClassIN: "IN", ClassCS: "CS", ClassCH: "CH", ClassHS: "HS"}
+
+// String returns the mnemonic of c, CLASSnnn (RFC 3597) for other classes.
+func (c RecordClass) String() string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", uint16(c))
+}
+
 // QType represents the type in a DNS question
 type QType uint16
 
@@ -115,13 +150,78 @@ func (d RDataNS) String() string {
 }
 
 type RDataTXT struct {
-	TxtData string // one or more character strings
+	TxtData string // one or more character strings, each preceded by its length, as in the RDATA
+}
+
+// NewRDataTXT makes an RDataTXT of txt, one character string each. Strings
+// longer than 255 octets are split.
+func NewRDataTXT(txt ...string) RDataTXT {
+	var b strings.Builder
+	for _, s := range txt {
+		for {
+			chunk := s[:min(len(s), 255)]
+			b.WriteByte(byte(len(chunk)))
+			b.WriteString(chunk)
+			if s = s[len(chunk):]; s == "" {
+				break
+			}
+		}
+	}
+	return RDataTXT{TxtData: b.String()}
+}
+
+// Strings returns the character strings of d.
+func (d RDataTXT) Strings() ([]string, error) {
+	var txt []string
+	for rest := d.TxtData; rest != ""; rest = rest[1+int(rest[0]):] {
+		if 1+int(rest[0]) > len(rest) {
+			return nil, fmt.Errorf("character string runs past the end of the RDATA")
+		}
+		txt = append(txt, rest[1:1+int(rest[0])])
+	}
+	return txt, nil
+}
+
+// Presentation returns d as in a master file: its character strings
+// quoted, or the generic form if the RDATA is malformed.
+func (d RDataTXT) Presentation() string {
+	txt, err := d.Strings()
+	if err != nil || len(txt) == 0 {
+		return RDataUnknown{Data: []byte(d.TxtData)}.String()
+	}
+	quoted := make([]string, len(txt))
+	for i, s := range txt {
+		quoted[i] = quoteCharacterString(s)
+	}
+	return strings.Join(quoted, " ")
 }
 
 func (d RDataTXT) String() string {
 	return d.TxtData
 }
 
+type RDataPTR struct {
+	PtrDName string // <domain-name> which points to some location in the domain name space
+}
+
+func (d RDataPTR) String() string {
+	return d.PtrDName
+}
+
+type RDataSOA struct {
+	MName   string // <domain-name> of the name server that was the original or primary source of data for this zone
+	RName   string // <domain-name> which specifies the mailbox of the person responsible for this zone
+	Serial  uint32 // version number of the original copy of the zone
+	Refresh uint32 // time interval before the zone should be refreshed
+	Retry   uint32 // time interval that should elapse before a failed refresh should be retried
+	Expire  uint32 // upper limit on the time interval that can elapse before the zone is no longer authoritative
+	Minimum uint32 // minimum TTL field that should be exported with any RR from this zone
+}
+
+func (d RDataSOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", d.MName, d.RName, d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+}
+
 type RDataA struct {
 	Address string // host internet address
 }
@@ -138,6 +238,52 @@ func (d RDataAAAA) String() string {
 	return d.Address
 }
 
+type RDataSRV struct { // RFC 2782
+	Priority uint16 // lower values are tried first
+	Weight   uint16 // relative weight among targets of the same priority
+	Port     uint16 // port of the service on the target
+	Target   string // <domain-name> of the target host
+}
+
+func (d RDataSRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, d.Target)
+}
+
+type RDataDS struct { // RFC 4034 section 5
+	KeyTag     uint16 // key tag of the DNSKEY record referred to
+	Algorithm  uint8  // algorithm of that DNSKEY
+	DigestType uint8  // algorithm used to make Digest
+	Digest     []byte // digest of the DNSKEY record
+}
+
+func (d RDataDS) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToUpper(hex.EncodeToString(d.Digest)))
+}
+
+type RDataDNSKEY struct { // RFC 4034 section 2
+	Flags     uint16 // 256 for a zone key, 257 with the secure entry point bit
+	Protocol  uint8  // always 3
+	Algorithm uint8  // public key algorithm
+	PublicKey []byte // the key, in the algorithm's format
+}
+
+func (d RDataDNSKEY) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Flags, d.Protocol, d.Algorithm, base64.StdEncoding.EncodeToString(d.PublicKey))
+}
+
+// RDataUnknown is RDATA of a type this package does not know, kept as it
+// came off the wire (RFC 3597).
+type RDataUnknown struct {
+	Data []byte
+}
+
+func (d RDataUnknown) String() string {
+	if len(d.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(d.Data), hex.EncodeToString(d.Data))
+}
+
 type Message struct {
 	Header     MessageHeader    // always present
 	Question   []QuestionEntry  // question for name server
@@ -171,39 +317,56 @@ type ResourceRecord struct {
 	RData    fmt.Stringer // variable-length string of octets describing resource, format varies by TYPE and CLASS
 }
 
-func parseDomainName(fullMessage []byte, bytes []byte) (string, []byte) {
-	domainName := ""
-	for {
-		length := bytes[0]
-
-		isCompressed := length&0b1100_0000 > 0
-		if isCompressed {
-			pointer := (bytes[0] << 2) + bytes[1]
-
-			resolvedPointer, _ := parseDomainName(fullMessage, fullMessage[pointer:])
-			domainName += resolvedPointer
-
-			bytes = bytes[2:]
-
-			break
+// maxPointers bounds the compression pointers followed in one name, so a
+// loop of them ends.
+const maxPointers = 127
+
+// readDomainName reads the domain name at the start of b, following
+// compression pointers into fullMessage, and returns the bytes after it. A
+// label or pointer that runs past the end of its data is an error.
+func readDomainName(fullMessage []byte, b []byte) (string, []byte, error) {
+	var name strings.Builder
+	var rest []byte
+	for pointers := 0; ; {
+		if len(b) == 0 {
+			return "", nil, fmt.Errorf("domain name runs past the end of its data")
 		}
-
-		bytes = bytes[1:]
-
-		if length == 0 {
-			break
+		length := int(b[0])
+		switch {
+		case length&0b1100_0000 == 0b1100_0000:
+			if len(b) < 2 {
+				return "", nil, fmt.Errorf("compression pointer runs past the end of its data")
+			}
+			pointer := int(binary.BigEndian.Uint16(b[0:2]) & 0x3fff)
+			if pointers++; pointers > maxPointers || pointer >= len(fullMessage) {
+				return "", nil, fmt.Errorf("bad compression pointer %d", pointer)
+			}
+			if rest == nil {
+				rest = b[2:]
+			}
+			b = fullMessage[pointer:]
+			continue
+		case length&0b1100_0000 != 0:
+			return "", nil, fmt.Errorf("unknown label type %#x", length&0b1100_0000)
+		case length == 0:
+			if rest == nil {
+				rest = b[1:]
+			}
+			return name.String(), rest, nil
+		case 1+length > len(b):
+			return "", nil, fmt.Errorf("label of %d octets runs past the end of its data", length)
 		}
-
-		label := bytes[0:length]
-
-		domainName += string(label)
-		domainName += "."
-
-		bytes = bytes[length:]
+		name.Write(b[1 : 1+length])
+		name.WriteByte('.')
+		b = b[1+length:]
 	}
-	fmt.Printf("== domain == %v", domainName)
-	fmt.Printf("== bytes == %v", bytes)
-	return domainName, bytes
+}
+
+// parseDomainName is readDomainName for the parsers that do not check for
+// errors yet.
+func parseDomainName(fullMessage []byte, bytes []byte) (string, []byte) {
+	domainName, rest, _ := readDomainName(fullMessage, bytes)
+	return domainName, rest
 }
 
 // transparently handles empty sections
@@ -279,13 +442,113 @@ func parseResourceRecords(fullMessage []byte, messageBytes []byte, numRecords ui
 			resourceRecords[i].RData = RDataNS{
 				NsdName: nsDomainName,
 			}
+		case TypePTR:
+			var ptrDomainName string
+			ptrDomainName, messageBytes = parseDomainName(fullMessage, messageBytes)
+
+			resourceRecords[i].RData = RDataPTR{
+				PtrDName: ptrDomainName,
+			}
+		case TypeSOA:
+			rData, rest, err := splitRData(messageBytes, resourceRecords[i].RDLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			messageBytes = rest
+			// two names of at least the root label each, then five 32-bit
+			// fields
+			if len(rData) < 22 {
+				return nil, nil, fmt.Errorf("SOA RDATA of %d octets is too short", len(rData))
+			}
+
+			soa := RDataSOA{}
+			if soa.MName, rData, err = readDomainName(fullMessage, rData); err != nil {
+				return nil, nil, fmt.Errorf("SOA MNAME: %w", err)
+			}
+			if soa.RName, rData, err = readDomainName(fullMessage, rData); err != nil {
+				return nil, nil, fmt.Errorf("SOA RNAME: %w", err)
+			}
+			if len(rData) != 20 {
+				return nil, nil, fmt.Errorf("SOA RDATA has %d octets after the names, want 20", len(rData))
+			}
+			soa.Serial = binary.BigEndian.Uint32(rData[0:4])
+			soa.Refresh = binary.BigEndian.Uint32(rData[4:8])
+			soa.Retry = binary.BigEndian.Uint32(rData[8:12])
+			soa.Expire = binary.BigEndian.Uint32(rData[12:16])
+			soa.Minimum = binary.BigEndian.Uint32(rData[16:20])
+
+			resourceRecords[i].RData = soa
 		case TypeTXT:
-			rDataStr := string(messageBytes[0:resourceRecords[i].RDLength])
-			messageBytes = messageBytes[resourceRecords[i].RDLength:]
+			rData, rest, err := splitRData(messageBytes, resourceRecords[i].RDLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			messageBytes = rest
 
 			resourceRecords[i].RData = RDataTXT{
-				TxtData: rDataStr,
+				TxtData: string(rData),
+			}
+		case TypeSRV:
+			rData, rest, err := splitRData(messageBytes, resourceRecords[i].RDLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			messageBytes = rest
+			// priority, weight and port, then at least the root label
+			if len(rData) < 7 {
+				return nil, nil, fmt.Errorf("SRV RDATA of %d octets is too short", len(rData))
+			}
+
+			srv := RDataSRV{
+				Priority: binary.BigEndian.Uint16(rData[0:2]),
+				Weight:   binary.BigEndian.Uint16(rData[2:4]),
+				Port:     binary.BigEndian.Uint16(rData[4:6]),
+			}
+			if srv.Target, _, err = readDomainName(fullMessage, rData[6:]); err != nil {
+				return nil, nil, fmt.Errorf("SRV target: %w", err)
+			}
+
+			resourceRecords[i].RData = srv
+		case TypeDS:
+			rData, rest, err := splitRData(messageBytes, resourceRecords[i].RDLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			messageBytes = rest
+			if len(rData) < 4 {
+				return nil, nil, fmt.Errorf("DS RDATA of %d octets is too short", len(rData))
 			}
+
+			resourceRecords[i].RData = RDataDS{
+				KeyTag:     binary.BigEndian.Uint16(rData[0:2]),
+				Algorithm:  rData[2],
+				DigestType: rData[3],
+				Digest:     append([]byte(nil), rData[4:]...),
+			}
+		case TypeDNSKEY:
+			rData, rest, err := splitRData(messageBytes, resourceRecords[i].RDLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			messageBytes = rest
+			if len(rData) < 4 {
+				return nil, nil, fmt.Errorf("DNSKEY RDATA of %d octets is too short", len(rData))
+			}
+
+			resourceRecords[i].RData = RDataDNSKEY{
+				Flags:     binary.BigEndian.Uint16(rData[0:2]),
+				Protocol:  rData[2],
+				Algorithm: rData[3],
+				PublicKey: append([]byte(nil), rData[4:]...),
+			}
+		default:
+			rData, rest, err := splitRData(messageBytes, resourceRecords[i].RDLength)
+			if err != nil {
+				return nil, nil, err
+			}
+			messageBytes = rest
+
+			resourceRecords[i].RData = RDataUnknown{Data: append([]byte(nil), rData...)}
 		}
 	}
 	fmt.Printf("== resourceRecords == %v", resourceRecords)
@@ -293,6 +556,15 @@ func parseResourceRecords(fullMessage []byte, messageBytes []byte, numRecords ui
 	return resourceRecords, messageBytes, nil
 }
 
+// splitRData cuts the rdLength octets of RDATA off the front of
+// messageBytes. The RDATA cannot be read past its end.
+func splitRData(messageBytes []byte, rdLength uint16) ([]byte, []byte, error) {
+	if int(rdLength) > len(messageBytes) {
+		return nil, nil, fmt.Errorf("RDLENGTH %d runs past the end of the message", rdLength)
+	}
+	return messageBytes[:rdLength:rdLength], messageBytes[rdLength:], nil
+}
+
 func parseMessage(messageBytes []byte) (Message, error) {
 	fullMessage := messageBytes
 
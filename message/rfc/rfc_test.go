@@ -68,6 +68,82 @@ func TestDomainNameCompression(t *testing.T) {
 	}
 }
 
+func TestTXTParsing(t *testing.T) {
+	rdata := "\x0bv=spf1 -all\x08say \"hi\""
+	parsed, err := parseMessage(createAnswerMessage(TypeTXT, uint16(len(rdata)), []byte(rdata)))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	txt, ok := parsed.Answer[0].RData.(RDataTXT)
+	if !ok {
+		t.Fatalf("Expected RDataTXT, got %T", parsed.Answer[0].RData)
+	}
+	if txt.TxtData != rdata {
+		t.Errorf("Expected the raw RDATA %q, got %q", rdata, txt.TxtData)
+	}
+	strs, err := txt.Strings()
+	if err != nil || len(strs) != 2 || strs[0] != "v=spf1 -all" || strs[1] != `say "hi"` {
+		t.Errorf("Unexpected character strings %q, %v", strs, err)
+	}
+	if got, want := txt.Presentation(), `"v=spf1 -all" "say \"hi\""`; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if got := NewRDataTXT("v=spf1 -all", `say "hi"`); got != txt {
+		t.Errorf("NewRDataTXT gave %q", got.TxtData)
+	}
+	if got := (RDataTXT{TxtData: "\x05abc"}).Presentation(); got != `\# 4 05616263` {
+		t.Errorf("Expected the generic form for malformed RDATA, got %s", got)
+	}
+}
+
+func TestShortRDataIsAnError(t *testing.T) {
+	tests := []struct {
+		name     string
+		rrType   RecordType
+		rdLength uint16
+		rdata    []byte
+	}{
+		{"SOA without timers", TypeSOA, 2, []byte{0, 0}},
+		{"SOA cut short", TypeSOA, 22, append([]byte{1, 'a', 0, 0}, make([]byte, 18)...)},
+		{"SOA name past the RDATA", TypeSOA, 22, append([]byte{30, 'a', 0}, make([]byte, 19)...)},
+		{"SRV without target", TypeSRV, 6, []byte{0, 1, 0, 2, 0, 3}},
+		{"SRV target past the RDATA", TypeSRV, 8, []byte{0, 1, 0, 2, 0, 3, 40, 'a'}},
+		{"DS without digest type", TypeDS, 3, []byte{0, 1, 8}},
+		{"DNSKEY without algorithm", TypeDNSKEY, 3, []byte{1, 0, 3}},
+		{"RDLENGTH past the end", TypeDNSKEY, 100, []byte{1, 0, 3, 8}},
+	}
+	for _, test := range tests {
+		if _, err := parseMessage(createAnswerMessage(test.rrType, test.rdLength, test.rdata)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+// Helper function to create a response with one answer for example.com
+// carrying rdata, whatever rdLength says
+func createAnswerMessage(rrType RecordType, rdLength uint16, rdata []byte) []byte {
+	var buf bytes.Buffer
+
+	header := []byte{
+		0x04, 0xd2, // ID = 1234
+		0x81, 0x80, // Flags: QR=1, RD=1, RA=1
+		0x00, 0x00, // QDCOUNT = 0
+		0x00, 0x01, // ANCOUNT = 1
+		0x00, 0x00, // NSCOUNT = 0
+		0x00, 0x00, // ARCOUNT = 0
+	}
+	buf.Write(header)
+
+	writeDomainName(&buf, "example.com")
+	binary.Write(&buf, binary.BigEndian, uint16(rrType))
+	binary.Write(&buf, binary.BigEndian, uint16(ClassIN))
+	binary.Write(&buf, binary.BigEndian, uint32(300)) // TTL
+	binary.Write(&buf, binary.BigEndian, rdLength)    // RDLENGTH
+	buf.Write(rdata)
+
+	return buf.Bytes()
+}
+
 // Helper function to create a test DNS message
 func createTestMessage() []byte {
 	var buf bytes.Buffer
@@ -0,0 +1,687 @@
+package rfc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Master files (RFC 1035 section 5): one record per entry, with the owner
+// left blank to repeat the previous one, "@" for the origin, and names not
+// ending in a dot taken relative to it. Parentheses let an entry run over
+// several lines, ";" starts a comment. $ORIGIN and $TTL change the origin
+// and the default TTL (RFC 2308), $INCLUDE reads another file in place.
+//
+// Records come out with absolute names, TTLs in seconds and RDLength left
+// zero, it only means something on the wire. Types without an RDATA type
+// here are read and written in the RFC 3597 generic form, "\# 4 c0000201".
+
+// maxIncludeDepth bounds nested $INCLUDEs, so a file including itself
+// fails instead of recursing forever.
+const maxIncludeDepth = 8
+
+var (
+	errNoTTL          = errors.New("no TTL and no $TTL before it")
+	errUnbalanced     = errors.New("unbalanced parentheses")
+	errUnterminated   = errors.New("unterminated quoted string")
+	errIncludeTooDeep = errors.New("$INCLUDE nested too deep")
+)
+
+// ParseError is a master file entry that could not be read.
+type ParseError struct {
+	File string // empty for text not read from a file
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseZone reads master file text from r, with origin as the initial
+// $ORIGIN. $INCLUDE paths are taken relative to the working directory.
+func ParseZone(r io.Reader, origin string) ([]ResourceRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &zoneParser{origin: fqdn(origin)}
+	if err := p.parse(string(data), "", ".", 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// ParseZoneFile reads the master file at path, with origin as the initial
+// $ORIGIN. $INCLUDE paths are taken relative to the including file.
+func ParseZoneFile(path, origin string) ([]ResourceRecord, error) {
+	p := &zoneParser{origin: fqdn(origin)}
+	if err := p.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// String renders rr as a master file line: owner, TTL, class, type and
+// RDATA separated by tabs.
+func (rr ResourceRecord) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", rr.Name, rr.TTL, rr.Class, rr.Type, rr.PresentationData())
+}
+
+// PresentationData returns the RDATA of rr as in a master file.
+func (rr ResourceRecord) PresentationData() string {
+	switch d := rr.RData.(type) {
+	case nil:
+		return RDataUnknown{}.String()
+	case RDataTXT:
+		// its String is the RDATA as it came off the wire
+		return d.Presentation()
+	}
+	return rr.RData.String()
+}
+
+// WriteZone writes records to w one per line, in the form ParseZone reads.
+func WriteZone(w io.Writer, records []ResourceRecord) error {
+	bw := bufio.NewWriter(w)
+	for _, rr := range records {
+		if _, err := fmt.Fprintln(bw, rr.String()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// zoneToken is one field of an entry; quoted tells "a b" from a b.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneLine is one entry of a master file, however many lines it spans.
+type zoneLine struct {
+	tokens     []zoneToken
+	blankOwner bool // starts with white space: the previous owner's
+	line       int
+}
+
+// lexZone splits master file text into entries. Escapes are kept as
+// written, what they mean depends on the field.
+func lexZone(data string) ([]zoneLine, error) {
+	var (
+		lines     []zoneLine
+		current   zoneLine
+		token     strings.Builder
+		inToken   bool
+		depth     int
+		line      = 1
+		lineStart = true
+	)
+	current.line = line
+	endToken := func(quoted bool) {
+		if inToken || quoted {
+			current.tokens = append(current.tokens, zoneToken{text: token.String(), quoted: quoted})
+		}
+		token.Reset()
+		inToken = false
+	}
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if lineStart {
+			current.blankOwner = c == ' ' || c == '\t'
+			lineStart = false
+		}
+		switch c {
+		case '\\':
+			token.WriteByte(c)
+			if i+1 < len(data) {
+				i++
+				token.WriteByte(data[i])
+			}
+			inToken = true
+		case '"':
+			endToken(false)
+			j := i + 1
+			for ; j < len(data) && data[j] != '"'; j++ {
+				if data[j] == '\\' && j+1 < len(data) {
+					token.WriteByte(data[j])
+					j++
+				} else if data[j] == '\n' {
+					line++
+				}
+				token.WriteByte(data[j])
+			}
+			if j == len(data) {
+				return nil, &ParseError{Line: current.line, Err: errUnterminated}
+			}
+			endToken(true)
+			i = j
+		case ';':
+			endToken(false)
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case '(':
+			endToken(false)
+			depth++
+		case ')':
+			endToken(false)
+			if depth--; depth < 0 {
+				return nil, &ParseError{Line: line, Err: errUnbalanced}
+			}
+		case ' ', '\t', '\r':
+			endToken(false)
+		case '\n':
+			endToken(false)
+			line++
+			if depth == 0 {
+				if len(current.tokens) > 0 {
+					lines = append(lines, current)
+				}
+				current = zoneLine{line: line}
+				lineStart = true
+			}
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+	endToken(false)
+	if depth != 0 {
+		return nil, &ParseError{Line: current.line, Err: errUnbalanced}
+	}
+	if len(current.tokens) > 0 {
+		lines = append(lines, current)
+	}
+	return lines, nil
+}
+
+// zoneParser turns master file entries into records.
+type zoneParser struct {
+	origin    string
+	ttl       uint32 // $TTL
+	hasTTL    bool
+	lastTTL   uint32 // what the previous record had, the RFC 1035 default
+	hasLast   bool
+	lastOwner string
+	records   []ResourceRecord
+}
+
+func (p *zoneParser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return errIncludeTooDeep
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return p.parse(string(data), path, filepath.Dir(path), depth)
+}
+
+func (p *zoneParser) parse(data, file, dir string, depth int) error {
+	lines, err := lexZone(data)
+	if err != nil {
+		err.(*ParseError).File = file
+		return err
+	}
+	for _, l := range lines {
+		if err := p.entry(l, dir, depth); err != nil {
+			var inner *ParseError
+			if errors.As(err, &inner) {
+				// from an included file, which knows where better
+				return err
+			}
+			return &ParseError{File: file, Line: l.line, Err: err}
+		}
+	}
+	return nil
+}
+
+func (p *zoneParser) entry(l zoneLine, dir string, depth int) error {
+	fields := l.tokens
+	switch strings.ToUpper(fields[0].text) {
+	case "$ORIGIN":
+		if len(fields) != 2 {
+			return fmt.Errorf("$ORIGIN takes one name")
+		}
+		origin := absoluteName(fields[1].text, p.origin)
+		if err := checkName(origin); err != nil {
+			return err
+		}
+		p.origin = origin
+		return nil
+	case "$TTL":
+		if len(fields) != 2 {
+			return fmt.Errorf("$TTL takes one TTL")
+		}
+		ttl, err := parseTTL(fields[1].text)
+		if err != nil {
+			return err
+		}
+		p.ttl, p.hasTTL = ttl, true
+		return nil
+	case "$INCLUDE":
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("$INCLUDE takes a file and an optional origin")
+		}
+		path := fields[1].text
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		// the included file may change the origin for itself only
+		saved := p.origin
+		if len(fields) == 3 {
+			p.origin = absoluteName(fields[2].text, p.origin)
+		}
+		err := p.parseFile(path, depth+1)
+		p.origin = saved
+		return err
+	}
+
+	owner := p.lastOwner
+	if !l.blankOwner {
+		owner = absoluteName(fields[0].text, p.origin)
+		if err := checkName(owner); err != nil {
+			return err
+		}
+		fields = fields[1:]
+	}
+	if owner == "" {
+		return fmt.Errorf("no owner name")
+	}
+	p.lastOwner = owner
+
+	// TTL and class come in either order, both optional
+	var ttl uint32
+	hasTTL, class := false, ClassIN
+	for len(fields) > 0 {
+		if t, err := parseTTL(fields[0].text); err == nil && !hasTTL {
+			ttl, hasTTL = t, true
+		} else if c, ok := parseClass(fields[0].text); ok {
+			class = c
+		} else {
+			break
+		}
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("no record type")
+	}
+	rrtype, err := parseType(fields[0].text)
+	if err != nil {
+		return err
+	}
+	rdata, err := parseRData(rrtype, fields[1:], p.origin)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", owner, rrtype, err)
+	}
+	switch {
+	case hasTTL:
+	case p.hasTTL:
+		ttl = p.ttl
+	case p.hasLast:
+		ttl = p.lastTTL
+	default:
+		// only an SOA brings its own: the minimum (RFC 1035)
+		soa, ok := rdata.(RDataSOA)
+		if !ok {
+			return errNoTTL
+		}
+		ttl = soa.Minimum
+	}
+	p.lastTTL, p.hasLast = ttl, true
+	p.records = append(p.records, ResourceRecord{Name: owner, Type: rrtype, Class: class, TTL: ttl, RData: rdata})
+	return nil
+}
+
+// fqdn adds the final dot name may be missing.
+func fqdn(name string) string {
+	if name == "" || !strings.HasSuffix(name, ".") || strings.HasSuffix(name, `\.`) {
+		return name + "."
+	}
+	return name
+}
+
+// absoluteName makes name absolute: "@" is origin, a name without a final
+// dot is relative to it.
+func absoluteName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, ".") && !strings.HasSuffix(name, `\.`):
+		return name
+	case origin == ".":
+		return name + "."
+	}
+	return name + "." + origin
+}
+
+// checkName turns down absolute names with empty or overlong labels.
+func checkName(name string) error {
+	if name == "." {
+		return nil
+	}
+	if len(name) > 255 {
+		return fmt.Errorf("%q is longer than 255 octets", name)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			return fmt.Errorf("%q has an empty label", name)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("%q has a label longer than 63 octets", name)
+		}
+	}
+	return nil
+}
+
+// parseTTL reads a TTL in seconds, or with BIND's units as in "1h30m".
+func parseTTL(s string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+	var total, n uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			n, digits = n*10+uint64(c-'0'), true
+			continue
+		}
+		unit := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}[c]
+		if unit == 0 || !digits {
+			return 0, fmt.Errorf("bad TTL %q", s)
+		}
+		total, n, digits = total+n*unit, 0, false
+	}
+	if digits || total > 1<<31-1 || s == "" {
+		return 0, fmt.Errorf("bad TTL %q", s)
+	}
+	return uint32(total), nil
+}
+
+func parseClass(s string) (RecordClass, bool) {
+	for c, name := range classNames {
+		if strings.EqualFold(s, name) {
+			return c, true
+		}
+	}
+	if n, ok := strings.CutPrefix(strings.ToUpper(s), "CLASS"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return RecordClass(v), true
+		}
+	}
+	return 0, false
+}
+
+// parseType reads a type mnemonic or the TYPEnnn form.
+func parseType(s string) (RecordType, error) {
+	for t, name := range typeNames {
+		if strings.EqualFold(s, name) {
+			return t, nil
+		}
+	}
+	if n, ok := strings.CutPrefix(strings.ToUpper(s), "TYPE"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return RecordType(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
+
+// parseRData reads the RDATA fields of a record of type t.
+func parseRData(t RecordType, fields []zoneToken, origin string) (fmt.Stringer, error) {
+	if len(fields) > 0 && fields[0].text == `\#` && !fields[0].quoted {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("generic RDATA without a length")
+		}
+		length, err := strconv.Atoi(fields[1].text)
+		if err != nil {
+			return nil, fmt.Errorf("generic RDATA length: %w", err)
+		}
+		var hexData strings.Builder
+		for _, f := range fields[2:] {
+			hexData.WriteString(f.text)
+		}
+		data, err := hex.DecodeString(hexData.String())
+		if err != nil || len(data) != length {
+			return nil, fmt.Errorf("generic RDATA is not %d octets of hex", length)
+		}
+		return RDataUnknown{Data: data}, nil
+	}
+	text := make([]string, len(fields))
+	for i, f := range fields {
+		text[i] = f.text
+	}
+	want := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("want %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+	name := func(s string) (string, error) {
+		name := absoluteName(s, origin)
+		return name, checkName(name)
+	}
+	number := func(s, what string, bits int) (uint64, error) {
+		v, err := strconv.ParseUint(s, 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", what, err)
+		}
+		return v, nil
+	}
+	switch t {
+	case TypeA:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(text[0]).To4()
+		if ip == nil || strings.Contains(text[0], ":") {
+			return nil, fmt.Errorf("%q is not an IPv4 address", text[0])
+		}
+		return RDataA{Address: ip.String()}, nil
+	case TypeAAAA:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(text[0])
+		if ip == nil || !strings.Contains(text[0], ":") {
+			return nil, fmt.Errorf("%q is not an IPv6 address", text[0])
+		}
+		return RDataAAAA{Address: ip.String()}, nil
+	case TypeNS, TypeCNAME, TypePTR:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		target, err := name(text[0])
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case TypeNS:
+			return RDataNS{NsdName: target}, nil
+		case TypeCNAME:
+			return RDataCNAME{CName: target}, nil
+		}
+		return RDataPTR{PtrDName: target}, nil
+	case TypeMX:
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		pref, err := number(text[0], "preference", 16)
+		if err != nil {
+			return nil, err
+		}
+		exchange, err := name(text[1])
+		if err != nil {
+			return nil, err
+		}
+		return RDataMX{Preference: uint16(pref), Exchange: exchange}, nil
+	case TypeSRV:
+		if err := want(4); err != nil {
+			return nil, err
+		}
+		var values [3]uint16
+		for i, what := range []string{"priority", "weight", "port"} {
+			v, err := number(text[i], what, 16)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = uint16(v)
+		}
+		target, err := name(text[3])
+		if err != nil {
+			return nil, err
+		}
+		return RDataSRV{Priority: values[0], Weight: values[1], Port: values[2], Target: target}, nil
+	case TypeSOA:
+		if err := want(7); err != nil {
+			return nil, err
+		}
+		mname, err := name(text[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := name(text[1])
+		if err != nil {
+			return nil, err
+		}
+		serial, err := number(text[2], "serial", 32)
+		if err != nil {
+			return nil, err
+		}
+		var timers [4]uint32
+		for i := range timers {
+			if timers[i], err = parseTTL(text[3+i]); err != nil {
+				return nil, err
+			}
+		}
+		return RDataSOA{MName: mname, RName: rname, Serial: uint32(serial),
+			Refresh: timers[0], Retry: timers[1], Expire: timers[2], Minimum: timers[3]}, nil
+	case TypeTXT:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no character strings")
+		}
+		txt := make([]string, len(fields))
+		for i, s := range text {
+			unescaped, err := unescape(s)
+			if err != nil {
+				return nil, err
+			}
+			if len(unescaped) > 255 {
+				return nil, fmt.Errorf("character string longer than 255 octets")
+			}
+			txt[i] = unescaped
+		}
+		return NewRDataTXT(txt...), nil
+	case TypeDS:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("want at least 4 fields, got %d", len(fields))
+		}
+		tag, err := number(text[0], "key tag", 16)
+		if err != nil {
+			return nil, err
+		}
+		alg, err := number(text[1], "algorithm", 8)
+		if err != nil {
+			return nil, err
+		}
+		digestType, err := number(text[2], "digest type", 8)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(text[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("digest: %w", err)
+		}
+		return RDataDS{KeyTag: uint16(tag), Algorithm: uint8(alg), DigestType: uint8(digestType), Digest: digest}, nil
+	case TypeDNSKEY:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("want at least 4 fields, got %d", len(fields))
+		}
+		flags, err := number(text[0], "flags", 16)
+		if err != nil {
+			return nil, err
+		}
+		protocol, err := number(text[1], "protocol", 8)
+		if err != nil {
+			return nil, err
+		}
+		alg, err := number(text[2], "algorithm", 8)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(text[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("public key: %w", err)
+		}
+		return RDataDNSKEY{Flags: uint16(flags), Protocol: uint8(protocol), Algorithm: uint8(alg), PublicKey: key}, nil
+	}
+	return nil, fmt.Errorf(`type not supported, use the \# generic form`)
+}
+
+// quoteCharacterString quotes s for a master file, escaping quotes,
+// backslashes and anything not printable ASCII.
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// unescape resolves \X and \DDD in a character string.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+			v, _ := strconv.Atoi(s[i+1 : i+4])
+			if v > 255 {
+				return "", fmt.Errorf(`bad escape \%s`, s[i+1:i+4])
+			}
+			b.WriteByte(byte(v))
+			i += 3
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("dangling backslash")
+		}
+		i++
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
@@ -0,0 +1,165 @@
+package rfc
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseZone(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hosts.db"), []byte("www A 192.0.2.80\n@ AAAA 2001:DB8::80\n"), 0o644); err != nil {
+		t.Fatalf("write include: %s", err)
+	}
+	zone := `
+$TTL 1h
+@	IN SOA ns1 hostmaster.example.com. (
+		2024010101 ; serial
+		3h 15m 1w
+		300 )
+	NS	ns1
+	NS	ns2.example.net.
+ns1	300 IN A 192.0.2.53
+	IN 600 AAAA 2001:db8::53
+mail	MX	10 mail.example.com.
+txt	TXT	"hello world" "semi;colon" say\ \"hi\" \065
+_sip._udp SRV 1 2 5060 sip
+$ORIGIN sub
+host	A	192.0.2.1
+$INCLUDE ` + filepath.Join(dir, "hosts.db") + ` web.example.com.
+after	TYPE65534 \# 3 0a0B0c
+	CH	TXT	"chaos"
+`
+	records, err := ParseZone(strings.NewReader(zone), "example.com")
+	if err != nil {
+		t.Fatalf("ParseZone: %s", err)
+	}
+	want := []string{
+		"example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2024010101 10800 900 604800 300",
+		"example.com.\t3600\tIN\tNS\tns1.example.com.",
+		"example.com.\t3600\tIN\tNS\tns2.example.net.",
+		"ns1.example.com.\t300\tIN\tA\t192.0.2.53",
+		"ns1.example.com.\t600\tIN\tAAAA\t2001:db8::53",
+		"mail.example.com.\t3600\tIN\tMX\t10 mail.example.com.",
+		"txt.example.com.\t3600\tIN\tTXT\t\"hello world\" \"semi;colon\" \"say \\\"hi\\\"\" \"A\"",
+		"_sip._udp.example.com.\t3600\tIN\tSRV\t1 2 5060 sip.example.com.",
+		"host.sub.example.com.\t3600\tIN\tA\t192.0.2.1",
+		"www.web.example.com.\t3600\tIN\tA\t192.0.2.80",
+		"web.example.com.\t3600\tIN\tAAAA\t2001:db8::80",
+		"after.sub.example.com.\t3600\tIN\tTYPE65534\t\\# 3 0a0b0c",
+		"after.sub.example.com.\t3600\tCH\tTXT\t\"chaos\"",
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %v", len(records), len(want), records)
+	}
+	for i, rr := range records {
+		if got := rr.String(); got != want[i] {
+			t.Fatalf("record %d: got %q, want %q", i, got, want[i])
+		}
+	}
+	txt, err := records[6].RData.(RDataTXT).Strings()
+	if err != nil || !reflect.DeepEqual(txt, []string{"hello world", "semi;colon", `say "hi"`, "A"}) {
+		t.Fatalf("got character strings %q, %v", txt, err)
+	}
+}
+
+func TestZoneRoundTrip(t *testing.T) {
+	records := []ResourceRecord{
+		{Name: "example.com.", Type: TypeSOA, Class: ClassIN, TTL: 3600, RData: RDataSOA{MName: "ns1.example.com.", RName: "hostmaster.example.com.", Serial: 7, Refresh: 7200, Retry: 900, Expire: 1209600, Minimum: 300}},
+		{Name: "example.com.", Type: TypeNS, Class: ClassIN, TTL: 3600, RData: RDataNS{NsdName: "ns1.example.com."}},
+		{Name: "example.com.", Type: TypeMX, Class: ClassIN, TTL: 3600, RData: RDataMX{Preference: 10, Exchange: "mail.example.com."}},
+		{Name: "www.example.com.", Type: TypeA, Class: ClassIN, TTL: 300, RData: RDataA{Address: "192.0.2.1"}},
+		{Name: "www.example.com.", Type: TypeAAAA, Class: ClassIN, TTL: 300, RData: RDataAAAA{Address: "2001:db8::1"}},
+		{Name: "alias.example.com.", Type: TypeCNAME, Class: ClassIN, TTL: 300, RData: RDataCNAME{CName: "www.example.com."}},
+		{Name: "1.2.0.192.in-addr.arpa.", Type: TypePTR, Class: ClassIN, TTL: 300, RData: RDataPTR{PtrDName: "www.example.com."}},
+		{Name: "example.com.", Type: TypeTXT, Class: ClassIN, TTL: 300, RData: NewRDataTXT("v=spf1 -all", "tab\there", `back\slash "quoted"`, "", "\xff")},
+		{Name: "_sip._udp.example.com.", Type: TypeSRV, Class: ClassIN, TTL: 300, RData: RDataSRV{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com."}},
+		{Name: "sub.example.com.", Type: TypeDS, Class: ClassIN, TTL: 300, RData: RDataDS{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: []byte{0xde, 0xad, 0xbe, 0xef}}},
+		{Name: "example.com.", Type: TypeDNSKEY, Class: ClassIN, TTL: 300, RData: RDataDNSKEY{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte("not really a key")}},
+		{Name: "example.com.", Type: 46, Class: ClassIN, TTL: 300, RData: RDataUnknown{Data: []byte{1, 2, 3}}},
+		{Name: "empty.example.com.", Type: 65280, Class: ClassIN, TTL: 300, RData: RDataUnknown{}},
+	}
+	var buf bytes.Buffer
+	if err := WriteZone(&buf, records); err != nil {
+		t.Fatalf("WriteZone: %s", err)
+	}
+	parsed, err := ParseZone(&buf, ".")
+	if err != nil {
+		t.Fatalf("ParseZone: %s\n%s", err, buf.String())
+	}
+	if len(parsed) != len(records) {
+		t.Fatalf("got %d records back, want %d", len(parsed), len(records))
+	}
+	for i := range records {
+		want := records[i]
+		if u, ok := want.RData.(RDataUnknown); ok && u.Data == nil {
+			want.RData = RDataUnknown{Data: []byte{}}
+		}
+		if !reflect.DeepEqual(parsed[i], want) {
+			t.Fatalf("record %d: got %#v, want %#v", i, parsed[i], want)
+		}
+	}
+	txt, err := parsed[7].RData.(RDataTXT).Strings()
+	if err != nil || !reflect.DeepEqual(txt, []string{"v=spf1 -all", "tab\there", `back\slash "quoted"`, "", "\xff"}) {
+		t.Fatalf("got character strings %q, %v", txt, err)
+	}
+}
+
+func TestParseZoneTTLDefaults(t *testing.T) {
+	// no $TTL: the SOA minimum first, then whatever the last record had
+	records, err := ParseZone(strings.NewReader("@ SOA ns hm 1 2 3 4 500\nwww A 192.0.2.1\nftp 60 A 192.0.2.2\nmx A 192.0.2.3\n"), "example.com.")
+	if err != nil {
+		t.Fatalf("ParseZone: %s", err)
+	}
+	for i, ttl := range []uint32{500, 500, 60, 60} {
+		if records[i].TTL != ttl {
+			t.Fatalf("record %d has TTL %d, want %d", i, records[i].TTL, ttl)
+		}
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	dir := t.TempDir()
+	loop := filepath.Join(dir, "loop.db")
+	if err := os.WriteFile(loop, []byte("$INCLUDE loop.db\n"), 0o644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	for _, text := range []string{
+		"www A 192.0.2.1\n",                        // no TTL anywhere
+		"$TTL 1h\nwww A 192.0.2.1 (\n",             // unbalanced
+		"$TTL 1h\nwww TXT \"open\n",                // unterminated
+		"$TTL 1h\nwww A 2001:db8::1\n",             // wrong family
+		"$TTL 1h\nwww MX mail.example.com.\n",      // missing preference
+		"$TTL 1x\n",                                // bad unit
+		"$TTL 1h\nwww HINFO \"pc\" \"unix\"\n",     // no RDATA type for it
+		"$TTL 1h\nwww TYPE1 \\# 4 c00002\n",        // short generic data
+		"$TTL 1h\n$INCLUDE " + loop + "\n",         // includes itself
+		"$TTL 1h\nwww TXT \"\\256\"\n",             // escape out of range
+		"$TTL 1h\nwww SOA ns hm 1 2 3 4\n",         // short SOA
+		"$TTL 1h\nwww 300 300 A 192.0.2.1\n",       // two TTLs
+		"$TTL 1h\nwww A 192.0.2.1 ) ( \n",          // closes first
+		"$TTL 1h\n$ORIGIN\n",                       // no origin
+		"$TTL 1h\nwww 300\n",                       // no type
+		"$TTL 1h\nwww NS ns..example.com.\n",       // empty label
+		"$TTL 1h\nwww SRV 1 2 port srv.example.\n", // bad port
+		"$TTL 1h\nwww BOGUS 1\n",                   // no such type
+	} {
+		if records, err := ParseZone(strings.NewReader(text), "example.com."); err == nil {
+			t.Fatalf("accepted %q as %v", text, records)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.db")
+	if err := os.WriteFile(bad, []byte("$TTL 1h\n\nwww A 192.0.2.1\nftp A nowhere\n"), 0o644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	_, err := ParseZoneFile(bad, "example.com.")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != bad || parseErr.Line != 4 {
+		t.Fatalf("got %v, want an error at %s:4", err, bad)
+	}
+}
@@ -0,0 +1,214 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Access control: clients are matched against the ACL rules in order and
+// the first rule whose networks contain them decides. "allow" gives full
+// recursion, "cache-only" answers only what is already cached, "refuse"
+// answers REFUSED and "deny" drops the query without a word. With no rules
+// everybody may recurse; with rules, clients none of them match are
+// refused. All of this happens before anything is sent upstream.
+//
+// A rule may also name a view: local host records its clients see in place
+// of what the rest of the world sees (split horizon).
+
+// ACL actions.
+const (
+	ACLAllow     = "allow"
+	ACLCacheOnly = "cache-only"
+	ACLRefuse    = "refuse"
+	ACLDeny      = "deny"
+)
+
+// ACLRule grants the clients in Networks (IPs or CIDRs) Action, and the
+// local data of View.
+type ACLRule struct {
+	Networks []string `json:"networks"`
+	Action   string   `json:"action"`
+	View     string   `json:"view,omitempty"`
+}
+
+// View is local data for the clients of the ACL rules naming it: Hosts maps
+// names to the IPv4 and IPv6 addresses answered for them, with TTL.
+type View struct {
+	Hosts map[string][]string `json:"hosts"`
+	TTL   uint32              `json:"ttl"` // zero means 300 seconds
+}
+
+type aclRule struct {
+	nets   []*net.IPNet
+	action string
+	view   *view
+}
+
+type view struct {
+	name  string
+	hosts map[string][]net.IP
+	ttl   uint32
+}
+
+// ACLStats counts queries by the action taken on them.
+type ACLStats struct {
+	Allowed   uint64 `json:"allowed"`
+	CacheOnly uint64 `json:"cache_only"`
+	Refused   uint64 `json:"refused"`
+	Denied    uint64 `json:"denied"`
+	Local     uint64 `json:"local"` // answered from a view
+	Zone      uint64 `json:"zone"`  // answered from an authoritative zone
+}
+
+var aclCounters struct {
+	allowed, cacheOnly, refused, denied, local, zone atomic.Uint64
+}
+
+// ACLResults returns the access control counters.
+func ACLResults() ACLStats {
+	return ACLStats{
+		Allowed:   aclCounters.allowed.Load(),
+		CacheOnly: aclCounters.cacheOnly.Load(),
+		Refused:   aclCounters.refused.Load(),
+		Denied:    aclCounters.denied.Load(),
+		Local:     aclCounters.local.Load(),
+		Zone:      aclCounters.zone.Load(),
+	}
+}
+
+// compileACL checks the rules and views of a config and turns them into
+// their matching form.
+func compileACL(rules []ACLRule, views map[string]View) ([]aclRule, error) {
+	compiled := make(map[string]*view, len(views))
+	for name, v := range views {
+		cv := &view{name: name, hosts: make(map[string][]net.IP, len(v.Hosts)), ttl: v.TTL}
+		if cv.ttl == 0 {
+			cv.ttl = 300
+		}
+		for host, addrs := range v.Hosts {
+			if _, err := dnsmessage.NewName(canonicalName(host)); err != nil {
+				return nil, fmt.Errorf("view %s: host %q: %w", name, host, err)
+			}
+			for _, addr := range addrs {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					return nil, fmt.Errorf("view %s: host %s: %q is not an IP address", name, host, addr)
+				}
+				cv.hosts[canonicalName(host)] = append(cv.hosts[canonicalName(host)], ip)
+			}
+		}
+		compiled[name] = cv
+	}
+	acl := make([]aclRule, 0, len(rules))
+	for i, rule := range rules {
+		switch rule.Action {
+		case ACLAllow, ACLCacheOnly, ACLRefuse, ACLDeny:
+		default:
+			return nil, fmt.Errorf("acl rule %d: action must be allow, cache-only, refuse or deny, not %q", i, rule.Action)
+		}
+		nets, err := parseNets(rule.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+		compiledRule := aclRule{nets: nets, action: rule.Action}
+		if rule.View != "" {
+			if compiledRule.view = compiled[rule.View]; compiledRule.view == nil {
+				return nil, fmt.Errorf("acl rule %d: no view %q", i, rule.View)
+			}
+		}
+		acl = append(acl, compiledRule)
+	}
+	return acl, nil
+}
+
+// aclFor returns what client may do, and its view if it has one.
+func (c Config) aclFor(client net.IP) (string, *view) {
+	if len(c.acl) == 0 {
+		return ACLAllow, nil
+	}
+	if client != nil {
+		for _, rule := range c.acl {
+			for _, n := range rule.nets {
+				if n.Contains(client) {
+					return rule.action, rule.view
+				}
+			}
+		}
+	}
+	return ACLRefuse, nil
+}
+
+// answer returns the view's answer to question, nil if the name is not
+// one of its hosts.
+func (v *view) answer(question dnsmessage.Question) *dnsmessage.Message {
+	if v == nil {
+		return nil
+	}
+	addrs, ok := v.hosts[canonicalName(question.Name.String())]
+	if !ok {
+		return nil
+	}
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	for _, ip := range addrs {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: v.ttl}
+		switch ip4 := ip.To4(); {
+		case ip4 != nil && question.Type == dnsmessage.TypeA:
+			header.Type = dnsmessage.TypeA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+		case ip4 == nil && question.Type == dnsmessage.TypeAAAA:
+			header.Type = dnsmessage.TypeAAAA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip)}})
+		}
+	}
+	// no addresses of the asked type leaves a NODATA answer
+	return msg
+}
+
+// refused is the answer to a client the ACL turns away.
+func refused(question dnsmessage.Question) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused},
+		Questions: []dnsmessage.Question{question},
+	}
+	addEDE(msg, edeProhibited, "")
+	return msg
+}
+
+// answerClient answers question for a client the ACL let in with action,
+// returning nil when the query is to be dropped. checkingDisabled is the CD
+// bit of the query.
+func answerClient(question dnsmessage.Question, action string, v *view, checkingDisabled bool) (*dnsmessage.Message, error) {
+	switch action {
+	case ACLDeny:
+		aclCounters.denied.Add(1)
+		return nil, nil
+	case ACLRefuse:
+		aclCounters.refused.Add(1)
+		return refused(question), nil
+	}
+	if local := v.answer(question); local != nil {
+		debugf("answered %s from view %s", questionString(question), v.name)
+		aclCounters.local.Add(1)
+		return local, nil
+	}
+	if authoritative := authZones.answer(question); authoritative != nil {
+		aclCounters.zone.Add(1)
+		return authoritative, nil
+	}
+	if action == ACLCacheOnly {
+		aclCounters.cacheOnly.Add(1)
+		if cached, ok, _ := resolverCache.lookup(question); ok {
+			return cached, nil
+		}
+		debugf("refusing %s to a cache-only client", questionString(question))
+		return refused(question), nil
+	}
+	aclCounters.allowed.Add(1)
+	if checkingDisabled {
+		return resolveUnchecked(question)
+	}
+	return resolve(question)
+}
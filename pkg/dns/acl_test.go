@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestACLRules(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {
+		cfg.ACL = []ACLRule{
+			{Networks: []string{"10.0.0.0/8"}, Action: ACLAllow, View: "internal"},
+			{Networks: []string{"192.0.2.0/24"}, Action: ACLCacheOnly},
+			{Networks: []string{"198.51.100.66"}, Action: ACLDeny},
+			{Networks: []string{"198.51.100.0/24"}, Action: ACLAllow},
+		}
+		cfg.Views = map[string]View{"internal": {Hosts: map[string][]string{"intranet.example.com": {"10.1.1.1", "fd00::1"}}}}
+	})
+	cfg := CurrentConfig()
+	cfg.Views["internal"].Hosts["intranet.example.com"][0] = "10.9.9.9"
+	if CurrentConfig().Views["internal"].Hosts["intranet.example.com"][0] != "10.1.1.1" {
+		t.Fatalf("changing the views of CurrentConfig changed the running config")
+	}
+
+	tests := []struct {
+		client string
+		action string
+		view   bool
+	}{
+		{"10.20.30.40", ACLAllow, true},
+		{"192.0.2.7", ACLCacheOnly, false},
+		{"198.51.100.66", ACLDeny, false}, // first match wins
+		{"198.51.100.67", ACLAllow, false},
+		{"203.0.113.1", ACLRefuse, false}, // matches nothing
+		{"2001:db8::1", ACLRefuse, false},
+	}
+	for _, test := range tests {
+		action, view := cfg.aclFor(net.ParseIP(test.client))
+		if action != test.action || (view != nil) != test.view {
+			t.Fatalf("%s: got %s view=%v, want %s view=%v", test.client, action, view != nil, test.action, test.view)
+		}
+	}
+
+	if action, _ := DefaultConfig().aclFor(net.ParseIP("203.0.113.1")); action != ACLAllow {
+		t.Fatalf("without rules everybody should be allowed, got %s", action)
+	}
+}
+
+func TestACLValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []ACLRule
+		views map[string]View
+	}{
+		{"bad action", []ACLRule{{Networks: []string{"10.0.0.0/8"}, Action: "maybe"}}, nil},
+		{"bad network", []ACLRule{{Networks: []string{"10.0.0.0/33"}, Action: ACLAllow}}, nil},
+		{"missing view", []ACLRule{{Networks: []string{"10.0.0.0/8"}, Action: ACLAllow, View: "nope"}}, nil},
+		{"bad address", nil, map[string]View{"v": {Hosts: map[string][]string{"a.example": {"10.0.0.300"}}}}},
+	}
+	for _, test := range tests {
+		cfg := DefaultConfig()
+		cfg.ACL, cfg.Views = test.rules, test.views
+		if err := cfg.validate(); err == nil {
+			t.Fatalf("%s: expected a validation error", test.name)
+		}
+	}
+}
+
+func TestACLAnswers(t *testing.T) {
+	// nothing answers on the root server, so a query sent upstream would fail
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.ACL = []ACLRule{
+			{Networks: []string{"10.0.0.0/8"}, Action: ACLCacheOnly, View: "internal"},
+			{Networks: []string{"192.0.2.1"}, Action: ACLDeny},
+		}
+		cfg.Views = map[string]View{"internal": {Hosts: map[string][]string{"intranet.example.com.": {"10.1.1.1", "fd00::1"}}, TTL: 60}}
+	})
+	cached := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(cached, answerFor(cached))
+	before := ACLResults()
+
+	query := func(client string, question dnsmessage.Question) *dnsmessage.Message {
+		t.Helper()
+		conn := &recordingConn{}
+		msg := dnsmessage.Message{Header: dnsmessage.Header{ID: 7, RecursionDesired: true}, Questions: []dnsmessage.Question{question}}
+		buf, err := msg.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		if err := handlePacket(conn, &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, buf); err != nil {
+			t.Fatalf("handlePacket: %s", err)
+		}
+		if len(conn.replies) == 0 {
+			return nil
+		}
+		return &conn.replies[0]
+	}
+
+	if r := query("203.0.113.9", cached); r == nil || r.Header.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("unknown client not refused: %+v", r)
+	}
+	if r := query("192.0.2.1", cached); r != nil {
+		t.Fatalf("denied client got a reply")
+	}
+	if r := query("10.0.0.5", cached); r == nil || r.Header.RCode != dnsmessage.RCodeSuccess || len(r.Answers) != 1 {
+		t.Fatalf("cache-only client did not get the cached answer: %+v", r)
+	}
+	if r := query("10.0.0.5", testQuestion("uncached.example.com.", dnsmessage.TypeA)); r == nil || r.Header.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("cache-only client not refused for an uncached name: %+v", r)
+	}
+	r := query("10.0.0.5", testQuestion("intranet.example.com.", dnsmessage.TypeAAAA))
+	if r == nil || !r.Header.Authoritative || len(r.Answers) != 1 || r.Answers[0].Header.TTL != 60 ||
+		r.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA != [16]byte(net.ParseIP("fd00::1")) {
+		t.Fatalf("view answer wrong: %+v", r)
+	}
+
+	after := ACLResults()
+	if after.Refused != before.Refused+1 || after.Denied != before.Denied+1 || after.CacheOnly != before.CacheOnly+2 || after.Local != before.Local+1 {
+		t.Fatalf("unexpected counters %+v, before %+v", after, before)
+	}
+}
@@ -0,0 +1,223 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// NewAdminHandler serves the admin API used to inspect and steer a running
+// resolver:
+//
+//	GET    /config                    running configuration
+//	GET    /cache?name=&suffix=true   dump cache entries
+//	DELETE /cache?name=&suffix=true   flush cache entries and the validated NSEC ranges
+//	GET    /cache/stats               cache hit, miss and prefetch counters
+//	GET    /cache/zone                cache in master file format
+//	POST   /cache/save                dump the cache to the configured cache_file
+//	GET    /infra                     RTT statistics per nameserver
+//	GET    /forwarders                health and RTT of the forwarders
+//	GET    /validation                upstream replies discarded as possible spoofs
+//	GET    /dnssec                    secure, insecure, bogus and synthesised answer counters
+//	GET    /zones                     serials and transfer counters of the authoritative zones
+//	POST   /zones/reload              read the master files of the primary zones again
+//	GET    /acl                       queries allowed, refused and dropped by the ACL
+//	GET    /rrl                       response rate limiting counters
+//	GET    /cookies                   DNS cookie counters
+//	GET    /trustanchors              trust anchor keys tracked under RFC 5011
+//	GET    /nta                       negative trust anchors
+//	PUT    /nta?name=&lifetime=1h     add a negative trust anchor, no lifetime means permanent
+//	DELETE /nta?name=                 remove a negative trust anchor
+//	GET    /loglevel                  current log level
+//	PUT    /loglevel?level=debug      change the log level
+//	GET    /resolve?name=&type=       resolve upstream and return the trace
+//
+// It has no authentication of its own, so bind it to a loopback or otherwise
+// trusted address.
+func NewAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, CurrentConfig())
+	})
+	mux.HandleFunc("GET /cache", func(w http.ResponseWriter, r *http.Request) {
+		name, suffix := r.URL.Query().Get("name"), r.URL.Query().Get("suffix") == "true"
+		writeJSON(w, http.StatusOK, resolverCache.Entries(name, suffix))
+	})
+	mux.HandleFunc("DELETE /cache", func(w http.ResponseWriter, r *http.Request) {
+		name, suffix := r.URL.Query().Get("name"), r.URL.Query().Get("suffix") == "true"
+		removed := resolverCache.Flush(name, suffix)
+		// NSEC ranges could go on answering for the flushed names
+		aggressiveNSEC.flush()
+		infof("admin: flushed %d cache entries for %q (suffix=%t)", removed, name, suffix)
+		writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+	})
+	mux.HandleFunc("GET /cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, resolverCache.Stats())
+	})
+	mux.HandleFunc("GET /cache/zone", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := resolverCache.WriteZone(w); err != nil {
+			warnf("admin: write cache zone: %s", err)
+		}
+	})
+	mux.HandleFunc("POST /cache/save", func(w http.ResponseWriter, r *http.Request) {
+		path := runningConfig().CacheFile
+		if path == "" {
+			writeError(w, http.StatusConflict, errNoCacheFile)
+			return
+		}
+		if err := SaveCacheFile(path); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"saved": path})
+	})
+	mux.HandleFunc("GET /infra", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, InfraStats())
+	})
+	mux.HandleFunc("GET /forwarders", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ForwarderResults())
+	})
+	mux.HandleFunc("GET /validation", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ResponseValidationStats())
+	})
+	mux.HandleFunc("GET /dnssec", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, DNSSECResults())
+	})
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ZoneResults())
+	})
+	mux.HandleFunc("POST /zones/reload", func(w http.ResponseWriter, r *http.Request) {
+		if err := ReloadZones(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		infof("admin: reloaded the authoritative zones")
+		writeJSON(w, http.StatusOK, ZoneResults())
+	})
+	mux.HandleFunc("GET /acl", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ACLResults())
+	})
+	mux.HandleFunc("GET /rrl", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, RRLResults())
+	})
+	mux.HandleFunc("GET /cookies", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, CookieResults())
+	})
+	mux.HandleFunc("GET /trustanchors", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, TrustAnchorKeys())
+	})
+	mux.HandleFunc("GET /nta", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, NegativeTrustAnchors())
+	})
+	mux.HandleFunc("PUT /nta", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if _, err := dnsmessage.NewName(canonicalName(name)); name == "" || err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("name must be a domain name"))
+			return
+		}
+		var lifetime time.Duration
+		if s := r.URL.Query().Get("lifetime"); s != "" {
+			var err error
+			if lifetime, err = time.ParseDuration(s); err != nil || lifetime < 0 {
+				writeError(w, http.StatusBadRequest, errors.New("lifetime must be a positive duration"))
+				return
+			}
+		}
+		AddNegativeTrustAnchor(name, lifetime)
+		writeJSON(w, http.StatusOK, NegativeTrustAnchors())
+	})
+	mux.HandleFunc("DELETE /nta", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if !RemoveNegativeTrustAnchor(name) {
+			writeError(w, http.StatusNotFound, errors.New("no negative trust anchor for "+name))
+			return
+		}
+		writeJSON(w, http.StatusOK, NegativeTrustAnchors())
+	})
+	mux.HandleFunc("GET /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"level": GetLogLevel().String()})
+	})
+	mux.HandleFunc("PUT /loglevel", func(w http.ResponseWriter, r *http.Request) {
+		level, err := ParseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		SetLogLevel(level)
+		writeJSON(w, http.StatusOK, map[string]string{"level": level.String()})
+	})
+	mux.HandleFunc("GET /resolve", handleAdminResolve)
+	return mux
+}
+
+type resolveResult struct {
+	RCode         string   `json:"rcode"`
+	Authoritative bool     `json:"authoritative"`
+	Answers       []Record `json:"answers"`
+	Authorities   []Record `json:"authorities"`
+	Additionals   []Record `json:"additionals"`
+	Trace         *Trace   `json:"trace"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// handleAdminResolve always asks upstream, walking the hierarchy from the
+// root or through the forwarders, ignoring the cache, so the trace shows
+// what resolution looks like right now. The fresh
+// answer then replaces whatever was cached.
+func handleAdminResolve(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, errMissingName)
+		return
+	}
+	qname, err := dnsmessage.NewName(canonicalName(name))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	qtype, err := parseType(r.URL.Query().Get("type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+
+	trace := NewTrace(question)
+	response, err := recurse(question, trace, false)
+	result := resolveResult{Trace: trace}
+	if err != nil {
+		result.Error = err.Error()
+		writeJSON(w, http.StatusBadGateway, result)
+		return
+	}
+	resolverCache.Set(question, response)
+	result.RCode = rcodeString(response.Header.RCode)
+	result.Authoritative = response.Header.Authoritative
+	result.Answers = recordsOf(response.Answers)
+	result.Authorities = recordsOf(response.Authorities)
+	result.Additionals = recordsOf(response.Additionals)
+	writeJSON(w, http.StatusOK, result)
+}
+
+var (
+	errMissingName = errors.New("missing name parameter")
+	errNoCacheFile = errors.New("no cache_file configured")
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		warnf("admin: encode response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
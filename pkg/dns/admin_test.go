@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminResolveAndCache(t *testing.T) {
+	useTestHierarchy(t)
+	server := httptest.NewServer(NewAdminHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/resolve?name=www.example.com&type=A")
+	if err != nil {
+		t.Fatalf("GET /resolve: %s", err)
+	}
+	var result resolveResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	resp.Body.Close()
+	if result.RCode != "NOERROR" || len(result.Answers) != 1 || result.Answers[0].Data != "192.0.2.1" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(result.Trace.Steps) != 3 {
+		t.Fatalf("expected 3 trace steps, got %d", len(result.Trace.Steps))
+	}
+
+	resp, err = http.Get(server.URL + "/cache?name=example.com&suffix=true")
+	if err != nil {
+		t.Fatalf("GET /cache: %s", err)
+	}
+	var entries []CacheEntry
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if len(entries) != 1 || entries[0].Name != "www.example.com." {
+		t.Fatalf("unexpected cache dump %+v", entries)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/cache?name=www.example.com", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /cache: %s", err)
+	}
+	resp.Body.Close()
+	if resolverCache.Len() != 0 {
+		t.Fatalf("expected cache to be flushed")
+	}
+
+	if stats := InfraStats(); len(stats) == 0 {
+		t.Fatalf("expected infra stats to be recorded")
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	defer SetLogLevel(GetLogLevel())
+	server := httptest.NewServer(NewAdminHandler())
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/loglevel?level=debug", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT /loglevel: %s", err)
+	}
+	resp.Body.Close()
+	if GetLogLevel() != LevelDebug {
+		t.Fatalf("expected debug level, got %s", GetLogLevel())
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/loglevel?level=loud", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown level, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,525 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Local authoritative zones are loaded from master files, or transferred
+// from a primary, and answered before anything else: with AA set, NXDOMAIN
+// and NODATA carrying the zone's SOA (RFC 2308), referrals with glue for
+// the subzones delegated away, and wildcards expanded (RFC 4592). CNAMEs
+// are followed as far as they stay in the zone.
+
+// AuthZone is a zone we are authoritative for, read from the master file
+// File with Name as its initial $ORIGIN. With Primaries set we are a
+// secondary for it instead: the zone is transferred from them, and File,
+// if set, keeps the last copy across restarts.
+type AuthZone struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+
+	Primaries     []string `json:"primaries"`      // IP addresses, port 53 unless given
+	AllowTransfer []string `json:"allow_transfer"` // IPs and CIDRs that may AXFR or IXFR the zone
+	Notify        []string `json:"notify"`         // secondaries to NOTIFY of a new serial
+	Journal       string   `json:"journal"`        // keeps the differences IXFR is served from
+}
+
+// maxZoneCNAMEs bounds a CNAME chain followed inside a zone.
+const maxZoneCNAMEs = 8
+
+var errNoSOA = errors.New("no SOA record at the zone apex")
+
+// authZone is the data of one zone.
+type authZone struct {
+	origin  string // canonical name of the apex
+	soa     dnsmessage.Resource
+	records []dnsmessage.Resource                                // all of them, the SOA first
+	rrsets  map[string]map[dnsmessage.Type][]dnsmessage.Resource // by canonical owner
+	names   map[string]bool                                      // owners and the empty non-terminals above them
+}
+
+// newAuthZone builds the zone origin out of records, skipping those that
+// are not in it.
+func newAuthZone(origin string, records []dnsmessage.Resource) (*authZone, error) {
+	z := &authZone{
+		origin: canonicalName(origin),
+		rrsets: make(map[string]map[dnsmessage.Type][]dnsmessage.Resource),
+		names:  make(map[string]bool),
+	}
+	soas := 0
+	var others []dnsmessage.Resource
+	for _, r := range records {
+		owner := canonicalName(r.Header.Name.String())
+		if !inZone(owner, z.origin) {
+			warnf("zone %s: ignoring %s %s, it is out of zone", z.origin, owner, rfc.RecordType(r.Header.Type))
+			continue
+		}
+		if r.Header.Type == dnsmessage.TypeSOA {
+			if owner != z.origin {
+				return nil, fmt.Errorf("zone %s: SOA record at %s", z.origin, owner)
+			}
+			z.soa = r
+			soas++
+		} else {
+			others = append(others, r)
+		}
+		sets, ok := z.rrsets[owner]
+		if !ok {
+			sets = make(map[dnsmessage.Type][]dnsmessage.Resource)
+			z.rrsets[owner] = sets
+		}
+		sets[r.Header.Type] = append(sets[r.Header.Type], r)
+		for name := owner; !z.names[name]; name = parentName(name) {
+			z.names[name] = true
+			if name == z.origin {
+				break
+			}
+		}
+	}
+	if soas != 1 {
+		if soas == 0 {
+			return nil, fmt.Errorf("zone %s: %w", z.origin, errNoSOA)
+		}
+		return nil, fmt.Errorf("zone %s: %d SOA records", z.origin, soas)
+	}
+	z.records = append([]dnsmessage.Resource{z.soa}, others...)
+	for owner, sets := range z.rrsets {
+		if _, ok := sets[dnsmessage.TypeCNAME]; !ok {
+			continue
+		}
+		for t := range sets {
+			if t != dnsmessage.TypeCNAME && t != typeRRSIG && t != typeNSEC {
+				return nil, fmt.Errorf("zone %s: %s has a CNAME and other data", z.origin, owner)
+			}
+		}
+		if len(sets[dnsmessage.TypeCNAME]) > 1 {
+			return nil, fmt.Errorf("zone %s: %s has more than one CNAME", z.origin, owner)
+		}
+	}
+	return z, nil
+}
+
+func (z *authZone) serial() uint32 {
+	return z.soa.Body.(*dnsmessage.SOAResource).Serial
+}
+
+// inZone reports whether the canonical name is zone or below it.
+func inZone(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// parentName strips the first label off a canonical name.
+func parentName(name string) string {
+	if i := strings.Index(name, "."); i >= 0 && i < len(name)-1 {
+		return name[i+1:]
+	}
+	return "."
+}
+
+// answer answers question, which is in the zone.
+func (z *authZone) answer(question dnsmessage.Question) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, Authoritative: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	qname := question.Name
+	for hops := 0; ; hops++ {
+		name := canonicalName(qname.String())
+		if cut := z.delegation(name, question.Type); cut != "" {
+			if len(msg.Answers) == 0 {
+				z.referral(msg, cut)
+			}
+			return msg
+		}
+		sets, exists := z.node(name, qname)
+		if !exists {
+			msg.Header.RCode = dnsmessage.RCodeNameError
+			msg.Authorities = []dnsmessage.Resource{z.negativeSOA()}
+			return msg
+		}
+		if question.Type == dnsmessage.TypeALL && len(sets) > 0 {
+			for _, t := range sortedTypes(sets) {
+				msg.Answers = append(msg.Answers, sets[t]...)
+			}
+			return msg
+		}
+		if rrs := sets[question.Type]; len(rrs) > 0 {
+			msg.Answers = append(msg.Answers, rrs...)
+			z.addAdditionals(msg, rrs)
+			return msg
+		}
+		if cname := sets[dnsmessage.TypeCNAME]; len(cname) > 0 {
+			msg.Answers = append(msg.Answers, cname...)
+			target := cname[0].Body.(*dnsmessage.CNAMEResource).CNAME
+			if !inZone(canonicalName(target.String()), z.origin) || hops == maxZoneCNAMEs {
+				// the client resolves the rest
+				return msg
+			}
+			qname = target
+			continue
+		}
+		msg.Authorities = []dnsmessage.Resource{z.negativeSOA()}
+		return msg
+	}
+}
+
+// delegation returns the cut at or above name the zone delegates, "" if
+// name is not delegated away. The parent side answers DS at the cut.
+func (z *authZone) delegation(name string, qtype dnsmessage.Type) string {
+	var below []string
+	for n := name; n != z.origin; n = parentName(n) {
+		below = append(below, n)
+	}
+	for i := len(below) - 1; i >= 0; i-- {
+		if i == 0 && qtype == typeDS {
+			break
+		}
+		if len(z.rrsets[below[i]][dnsmessage.TypeNS]) > 0 {
+			return below[i]
+		}
+	}
+	return ""
+}
+
+// referral turns msg into a referral to the nameservers of cut.
+func (z *authZone) referral(msg *dnsmessage.Message, cut string) {
+	msg.Header.Authoritative = false
+	msg.Authorities = append(msg.Authorities, z.rrsets[cut][dnsmessage.TypeNS]...)
+	z.addAdditionals(msg, msg.Authorities)
+}
+
+// node returns the RRsets at name, synthesised from the wildcard of the
+// closest encloser if there is no such node, with qname as their owner.
+// An empty non-terminal exists without any RRsets.
+func (z *authZone) node(name string, qname dnsmessage.Name) (map[dnsmessage.Type][]dnsmessage.Resource, bool) {
+	if sets, ok := z.rrsets[name]; ok {
+		return sets, true
+	}
+	if z.names[name] {
+		return nil, true
+	}
+	encloser := parentName(name)
+	for !z.names[encloser] {
+		encloser = parentName(encloser)
+	}
+	wildcard, ok := z.rrsets["*."+encloser]
+	if !ok {
+		return nil, false
+	}
+	sets := make(map[dnsmessage.Type][]dnsmessage.Resource, len(wildcard))
+	for t, rrs := range wildcard {
+		for _, r := range rrs {
+			r.Header.Name = qname
+			sets[t] = append(sets[t], r)
+		}
+	}
+	return sets, true
+}
+
+// addAdditionals adds the in-zone addresses of the names rrs point at:
+// glue for NS records, the hosts of MX and SRV records.
+func (z *authZone) addAdditionals(msg *dnsmessage.Message, rrs []dnsmessage.Resource) {
+	for _, r := range rrs {
+		var target dnsmessage.Name
+		switch body := r.Body.(type) {
+		case *dnsmessage.NSResource:
+			target = body.NS
+		case *dnsmessage.MXResource:
+			target = body.MX
+		case *dnsmessage.SRVResource:
+			target = body.Target
+		default:
+			continue
+		}
+		sets := z.rrsets[canonicalName(target.String())]
+		msg.Additionals = append(msg.Additionals, sets[dnsmessage.TypeA]...)
+		msg.Additionals = append(msg.Additionals, sets[dnsmessage.TypeAAAA]...)
+	}
+}
+
+// negativeSOA is the SOA for the authority section of a negative answer,
+// its TTL capped by the SOA minimum (RFC 2308 section 3).
+func (z *authZone) negativeSOA() dnsmessage.Resource {
+	soa := z.soa
+	if minimum := soa.Body.(*dnsmessage.SOAResource).MinTTL; minimum < soa.Header.TTL {
+		soa.Header.TTL = minimum
+	}
+	return soa
+}
+
+func sortedTypes(sets map[dnsmessage.Type][]dnsmessage.Resource) []dnsmessage.Type {
+	types := make([]dnsmessage.Type, 0, len(sets))
+	for t := range sets {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// servedZone is a zone of the store with what it takes to keep it: the
+// data, the journal of its changes, and for a secondary when to check its
+// primaries again.
+type servedZone struct {
+	config  AuthZone
+	allow   []*net.IPNet
+	journal *zoneJournal
+
+	mu        sync.Mutex
+	data      *authZone // nil until a secondary's first transfer
+	refreshAt time.Time // secondaries only
+	expireAt  time.Time
+	counters  zoneCounters
+}
+
+func (sz *servedZone) secondary() bool {
+	return len(sz.config.Primaries) > 0
+}
+
+// current returns the data to answer from, nil if there is none or a
+// secondary's copy has expired.
+func (sz *servedZone) current() *authZone {
+	sz.mu.Lock()
+	defer sz.mu.Unlock()
+	if sz.secondary() && !sz.expireAt.IsZero() && time.Now().After(sz.expireAt) {
+		return nil
+	}
+	return sz.data
+}
+
+// mayTransfer reports whether allow_transfer lets client transfer the zone.
+func (sz *servedZone) mayTransfer(client net.IP) bool {
+	for _, n := range sz.allow {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneStore holds the zones we are authoritative for. The server has one,
+// authZones; a test can run another to transfer zones between the two.
+type zoneStore struct {
+	mu    sync.RWMutex
+	zones map[string]*servedZone // by canonical origin
+	wake  chan struct{}          // a NOTIFY asks for a refresh
+}
+
+var authZones = newZoneStore()
+
+func newZoneStore() *zoneStore {
+	return &zoneStore{wake: make(chan struct{}, 1)}
+}
+
+// validateAuthZones checks the authoritative zones of c, without loading
+// them.
+func (c Config) validateAuthZones() error {
+	seen := make(map[string]bool)
+	for _, az := range c.AuthZones {
+		name := canonicalName(az.Name)
+		if _, err := dnsmessage.NewName(name); err != nil {
+			return fmt.Errorf("auth zone %q: %w", az.Name, err)
+		}
+		if seen[name] {
+			return fmt.Errorf("auth zone %s is configured twice", name)
+		}
+		seen[name] = true
+		if az.File == "" && len(az.Primaries) == 0 {
+			return fmt.Errorf("auth zone %s has neither a file nor primaries", name)
+		}
+		for _, servers := range [][]string{az.Primaries, az.Notify} {
+			for _, server := range servers {
+				if _, _, err := splitServerAddr(server); err != nil {
+					return fmt.Errorf("auth zone %s: %w", name, err)
+				}
+			}
+		}
+		if _, err := parseNets(az.AllowTransfer); err != nil {
+			return fmt.Errorf("auth zone %s: allow_transfer: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// splitServerAddr reads the address of a primary or a secondary: an IP
+// address with an optional port, 53 by default.
+func splitServerAddr(addr string) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "53"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "", fmt.Errorf("server %q is not an IP address", addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, "", fmt.Errorf("server %q: bad port", addr)
+	}
+	return ip, port, nil
+}
+
+// load reads the zones of list: the master file of each primary zone, and
+// whatever copy a secondary already has. Zones s serves already keep their
+// journal, and a primary zone with a new serial gets the difference
+// journaled. Nothing in s changes until set.
+func (s *zoneStore) load(list []AuthZone) (map[string]*servedZone, error) {
+	zones := make(map[string]*servedZone, len(list))
+	for _, az := range list {
+		origin := canonicalName(az.Name)
+		old := s.served(origin)
+		sz := &servedZone{config: az}
+		sz.allow, _ = parseNets(az.AllowTransfer)
+		if old != nil && old.config.Journal == az.Journal {
+			sz.journal = old.journal
+		} else {
+			journal, err := loadJournal(az.Journal)
+			if err != nil {
+				return nil, fmt.Errorf("auth zone %s: %w", origin, err)
+			}
+			sz.journal = journal
+		}
+		var previous *authZone
+		if old != nil {
+			old.mu.Lock()
+			previous, sz.counters = old.data, old.counters
+			if old.secondary() == sz.secondary() {
+				sz.refreshAt, sz.expireAt = old.refreshAt, old.expireAt
+			}
+			old.mu.Unlock()
+		}
+
+		if sz.secondary() {
+			sz.data = previous
+			if sz.data == nil && az.File != "" {
+				// the copy of an earlier run, checked with the primaries first thing
+				if _, err := os.Stat(az.File); err == nil {
+					z, err := readZoneFile(az)
+					if err != nil {
+						return nil, err
+					}
+					sz.data = z
+					_, _, expire := z.timers()
+					sz.expireAt = time.Now().Add(expire)
+				}
+			}
+			zones[origin] = sz
+			continue
+		}
+		z, err := readZoneFile(az)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil && serialNewer(z.serial(), previous.serial()) {
+			if err := sz.journal.add(diffZones(previous, z)); err != nil {
+				warnf("zone %s: journal: %s", origin, err)
+			}
+		}
+		sz.data = z
+		zones[origin] = sz
+	}
+	return zones, nil
+}
+
+func readZoneFile(az AuthZone) (*authZone, error) {
+	records, err := parseZoneFile(az.File, az.Name)
+	if err != nil {
+		return nil, fmt.Errorf("auth zone %s: %w", canonicalName(az.Name), err)
+	}
+	z, err := newAuthZone(az.Name, records)
+	if err != nil {
+		return nil, err
+	}
+	infof("loaded zone %s, serial %d, %d records", z.origin, z.serial(), len(records))
+	return z, nil
+}
+
+// set replaces the zones of s with zones, as load returned them, and
+// notifies the secondaries of the primary zones whose serial went up.
+func (s *zoneStore) set(zones map[string]*servedZone) {
+	s.mu.Lock()
+	old := s.zones
+	s.zones = zones
+	s.mu.Unlock()
+	for origin, sz := range zones {
+		if sz.secondary() || old[origin] == nil {
+			continue
+		}
+		before, now := old[origin].current(), sz.current()
+		if before != nil && now != nil && serialNewer(now.serial(), before.serial()) {
+			go sendNotify(sz, now.soa)
+		}
+	}
+	if len(zones) > 0 {
+		// secondaries that are new want their first transfer
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ReloadZones reads the master files of the primary zones again, leaving
+// the rest of the configuration as it is. A zone whose serial went up has
+// the difference journaled and its secondaries notified; a file that does
+// not load leaves all zones as they were.
+func ReloadZones() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	zones, err := authZones.load(runningConfig().AuthZones)
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+	authZones.set(zones)
+	return nil
+}
+
+// served returns the zone named origin, nil if there is none.
+func (s *zoneStore) served(origin string) *servedZone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zones[origin]
+}
+
+// lookup returns the most specific zone holding name, nil if none does.
+func (s *zoneStore) lookup(name string) *servedZone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.zones) == 0 {
+		return nil
+	}
+	for name = canonicalName(name); ; name = parentName(name) {
+		if sz, ok := s.zones[name]; ok {
+			return sz
+		}
+		if name == "." {
+			return nil
+		}
+	}
+}
+
+// answer answers question from the zones, nil if it is in none of them. A
+// secondary without a live copy answers SERVFAIL.
+func (s *zoneStore) answer(question dnsmessage.Question) *dnsmessage.Message {
+	sz := s.lookup(question.Name.String())
+	if sz == nil {
+		return nil
+	}
+	z := sz.current()
+	if z == nil {
+		return &dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure},
+			Questions: []dnsmessage.Question{question},
+		}
+	}
+	return z.answer(question)
+}
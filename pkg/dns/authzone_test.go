@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const exampleZone = `$TTL 3600
+@		SOA	ns1 hostmaster 1 7200 900 1209600 300
+		NS	ns1
+		MX	10 mail
+ns1		A	192.0.2.53
+mail		A	192.0.2.25
+www		A	192.0.2.80
+alias		CNAME	www
+outside		CNAME	www.example.net.
+*.wild		A	192.0.2.99
+host.deep.ent	A	192.0.2.7
+sub		NS	ns.sub
+		NS	ns.example.net.
+		DS	12345 8 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+ns.sub		A	192.0.2.54
+`
+
+// useTestZone serves exampleZone as example.com.
+func useTestZone(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "example.com.db")
+	if err := os.WriteFile(path, []byte(exampleZone), 0o644); err != nil {
+		t.Fatalf("write zone: %s", err)
+	}
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.AuthZones = []AuthZone{{Name: "example.com", File: path}}
+	})
+}
+
+func TestAuthZoneAnswers(t *testing.T) {
+	useTestZone(t)
+	before := ACLResults()
+	for _, tc := range []struct {
+		name       string
+		qtype      dnsmessage.Type
+		rcode      dnsmessage.RCode
+		aa         bool
+		answers    []string
+		authority  []string
+		additional []string
+	}{
+		{"www.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{"192.0.2.80"}, nil, nil},
+		{"WWW.Example.COM.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{"192.0.2.80"}, nil, nil},
+		{"example.com.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, true, []string{"10 mail.example.com."}, nil, []string{"192.0.2.25"}},
+		{"alias.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{"www.example.com.", "192.0.2.80"}, nil, nil},
+		{"outside.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{"www.example.net."}, nil, nil},
+		// NODATA, with the SOA's TTL capped at its minimum
+		{"www.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, true, nil, []string{"SOA 300"}, nil},
+		{"nope.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, true, nil, []string{"SOA 300"}, nil},
+		// an empty non-terminal exists
+		{"deep.ent.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, nil, []string{"SOA 300"}, nil},
+		{"a.wild.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{"192.0.2.99"}, nil, nil},
+		{"b.c.wild.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, true, []string{"192.0.2.99"}, nil, nil},
+		{"a.wild.example.com.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, true, nil, []string{"SOA 300"}, nil},
+		// no wildcard below an existing name
+		{"x.host.deep.ent.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, true, nil, []string{"SOA 300"}, nil},
+		// the delegation, with glue from the zone only
+		{"www.sub.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, false, nil, []string{"ns.sub.example.com.", "ns.example.net."}, []string{"192.0.2.54"}},
+		{"sub.example.com.", dnsmessage.TypeNS, dnsmessage.RCodeSuccess, false, nil, []string{"ns.sub.example.com.", "ns.example.net."}, []string{"192.0.2.54"}},
+		{"sub.example.com.", typeDS, dnsmessage.RCodeSuccess, true, []string{"12345 8 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"}, nil, nil},
+	} {
+		question := testQuestion(tc.name, tc.qtype)
+		response, err := answerClient(question, ACLAllow, nil, false)
+		if err != nil {
+			t.Fatalf("%s: %s", questionString(question), err)
+		}
+		if response.Header.RCode != tc.rcode || response.Header.Authoritative != tc.aa {
+			t.Fatalf("%s: got %s AA=%t, want %s AA=%t", questionString(question), rcodeString(response.Header.RCode), response.Header.Authoritative, rcodeString(tc.rcode), tc.aa)
+		}
+		for section, got := range map[string][]dnsmessage.Resource{"answer": response.Answers, "authority": response.Authorities, "additional": response.Additionals} {
+			want := map[string][]string{"answer": tc.answers, "authority": tc.authority, "additional": tc.additional}[section]
+			if len(got) != len(want) {
+				t.Fatalf("%s: %s section %v, want %v", questionString(question), section, recordsOf(got), want)
+			}
+			for i, r := range got {
+				data := rfcRecord(r).PresentationData()
+				if r.Header.Type == dnsmessage.TypeSOA {
+					data = "SOA " + strconv.Itoa(int(r.Header.TTL))
+				}
+				if data != want[i] {
+					t.Fatalf("%s: %s section %v, want %v", questionString(question), section, recordsOf(got), want)
+				}
+			}
+		}
+		if tc.name == "b.c.wild.example.com." && response.Answers[0].Header.Name.String() != tc.name {
+			t.Fatalf("wildcard answer owned by %s", response.Answers[0].Header.Name)
+		}
+	}
+	if stats := ACLResults(); stats.Zone != before.Zone+15 || stats.Allowed != before.Allowed {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+
+	// names outside the zone still go upstream
+	if response := authZones.answer(testQuestion("www.example.net.", dnsmessage.TypeA)); response != nil {
+		t.Fatalf("answered %v for a name outside the zone", response)
+	}
+}
+
+func TestAuthZoneLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	for i, text := range []string{
+		"$TTL 1h\nwww A 192.0.2.1\n",                                  // no SOA
+		"$TTL 1h\n@ SOA ns hm 1 2 3 4 5\nwww SOA ns hm 1 2 3 4 5\n",   // SOA below the apex
+		"$TTL 1h\n@ SOA ns hm 1 2 3 4 5\nwww CNAME a\n A 192.0.2.1\n", // CNAME and other data
+		"$TTL 1h\n@ SOA ns hm 1 2 3 4 5\nwww A 300.0.0.1\n",           // does not parse
+		"$TTL 1h\n@ SOA ns hm 1 2 3 4 5\nwww CH TXT \"chaos\"\n",      // not IN
+	} {
+		path := filepath.Join(dir, "zone.db")
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatalf("write zone: %s", err)
+		}
+		cfg := DefaultConfig()
+		cfg.AuthZones = []AuthZone{{Name: "example.com.", File: path}}
+		if err := Configure(cfg); err == nil {
+			t.Fatalf("zone %d loaded", i)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.AuthZones = []AuthZone{{Name: "example.com", File: "a.db"}, {Name: "EXAMPLE.com.", File: "b.db"}}
+	if err := cfg.validate(); err == nil {
+		t.Fatalf("zone configured twice accepted")
+	}
+}
@@ -0,0 +1,36 @@
+package dns
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// isSubdomain reports whether child is parent or sits below it, comparing
+// whole labels without regard to case.
+func isSubdomain(child, parent string) bool {
+	child, parent = canonicalName(child), canonicalName(parent)
+	return parent == "." || child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+// isReferral reports whether an NS set owned by owner, handed out by a
+// server for zone, is a real delegation towards qname: it has to lead
+// strictly downwards from zone and still cover qname.
+func isReferral(owner, zone, qname string) bool {
+	return isSubdomain(owner, zone) && !strings.EqualFold(canonicalName(owner), canonicalName(zone)) &&
+		isSubdomain(qname, owner)
+}
+
+// inBailiwick drops records a server for zone has no authority to tell us
+// about.
+func inBailiwick(rrs []dnsmessage.Resource, zone string) []dnsmessage.Resource {
+	kept := make([]dnsmessage.Resource, 0, len(rrs))
+	for _, rr := range rrs {
+		if isSubdomain(rr.Header.Name.String(), zone) {
+			kept = append(kept, rr)
+		} else {
+			warnf("dropping out-of-bailiwick record %s from zone %s", rr.Header.Name.String(), zone)
+		}
+	}
+	return kept
+}
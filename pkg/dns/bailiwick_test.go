@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestIsReferral(t *testing.T) {
+	tests := []struct {
+		owner, zone, qname string
+		want               bool
+	}{
+		{"com.", ".", "www.example.com.", true},
+		{"example.com.", "com.", "www.example.com.", true},
+		{"EXAMPLE.com.", "com.", "www.example.com.", true},
+		{"example.org.", "com.", "www.example.com.", false}, // sideways
+		{"com.", "com.", "www.example.com.", false},         // not downwards
+		{"com.", "example.com.", "www.example.com.", false}, // upwards
+		{"other.com.", "com.", "www.example.com.", false},   // does not cover qname
+		{"ample.com.", "com.", "www.example.com.", false},   // label boundary
+	}
+	for _, test := range tests {
+		if got := isReferral(test.owner, test.zone, test.qname); got != test.want {
+			t.Errorf("isReferral(%q, %q, %q) = %t, want %t", test.owner, test.zone, test.qname, got, test.want)
+		}
+	}
+}
+
+// TestDnsQueryEnforcesBailiwick has the com. server hand out glue for a
+// nameserver under net., which it has no authority over, pointing at an
+// attacker. The glue must be ignored and the nameserver looked up through
+// net. instead; the final answer also carries an injected record for
+// another zone that must be dropped.
+func TestDnsQueryEnforcesBailiwick(t *testing.T) {
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": func(query dnsmessage.Message) dnsmessage.Message {
+			if strings.HasSuffix(query.Questions[0].Name.String(), ".net.") {
+				return referralTo("net.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 4})(query)
+			}
+			return referralTo("com.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 2})(query)
+		},
+		"127.0.0.2": referralTo("example.com.", "ns1.example.net.", [4]byte{127, 0, 0, 66}),
+		"127.0.0.4": func(query dnsmessage.Message) dnsmessage.Message {
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("ns1.example.net.", 300, [4]byte{127, 0, 0, 3})},
+			}
+		},
+		"127.0.0.3": func(query dnsmessage.Message) dnsmessage.Message {
+			return dnsmessage.Message{
+				Header: dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{
+					testA("www.example.com.", 300, [4]byte{192, 0, 2, 1}),
+					testA("www.google.com.", 300, [4]byte{6, 6, 6, 6}),
+				},
+			}
+		},
+		"127.0.0.66": func(query dnsmessage.Message) dnsmessage.Message {
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{6, 6, 6, 6})},
+			}
+		},
+	})
+	useTestConfig(t, func(cfg *Config) { cfg.RootServers = []string{"127.0.0.1"} })
+
+	response, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), nil)
+	if err != nil {
+		t.Fatalf("dnsQuery: %s", err)
+	}
+	if len(response.Answers) != 1 || rfcRecord(response.Answers[0]).PresentationData() != "192.0.2.1" {
+		t.Fatalf("out-of-bailiwick data got through: %v", response.Answers)
+	}
+}
+
+func TestDnsQueryRejectsSidewaysReferral(t *testing.T) {
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": referralTo("com.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 2}),
+		"127.0.0.2": referralTo("example.org.", "ns1.example.org.", [4]byte{127, 0, 0, 66}),
+	})
+	useTestConfig(t, func(cfg *Config) { cfg.RootServers = []string{"127.0.0.1"} })
+
+	if _, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), nil); err == nil {
+		t.Fatalf("expected a referral to example.org. for www.example.com. to be refused")
+	}
+}
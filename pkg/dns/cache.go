@@ -0,0 +1,526 @@
+package dns
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type cacheKey struct {
+	name  string // lower-cased, fully qualified
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+func keyOf(question dnsmessage.Question) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(question.Name.String()),
+		qtype: question.Type,
+		class: question.Class,
+	}
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	question    dnsmessage.Question
+	rcode       dnsmessage.RCode
+	secure      bool // DNSSEC validated, answered with the AD bit
+	answers     []dnsmessage.Resource
+	authorities []dnsmessage.Resource
+	additionals []dnsmessage.Resource
+	stored      time.Time
+	expires     time.Time
+	size        int64 // approximate memory held by the entry
+	hits        uint64
+	prefetching bool // a background refresh is already under way
+
+	lastFailure time.Time // last failed attempt to refresh an expired entry
+	refreshing  bool      // an expired entry is being refreshed
+}
+
+// prefetchWindow is the share of an entry's lifetime, at its end, during which
+// a hit on a popular entry triggers a background refresh.
+const prefetchWindow = 10 // percent
+
+// cacheShards is the number of independently locked parts of the cache, so
+// the goroutines handling packets don't all queue on one mutex.
+const cacheShards = 16
+
+// cacheEntryOverhead approximates the bookkeeping around each entry (map
+// slot, list element, slices) on top of its records.
+const cacheEntryOverhead = 256
+
+// cacheShard is a plain LRU: the front of lru is the most recently used
+// entry and eviction takes from the back.
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element // values are *cacheEntry
+	lru     *list.List
+	bytes   int64
+}
+
+// Cache keeps complete responses keyed by question. Entries live for the
+// smallest TTL found in the response. The cache is split into shards by
+// name; the entry and byte limits are divided evenly between them and each
+// shard evicts its least recently used entries once it is over its share.
+type Cache struct {
+	shards [cacheShards]cacheShard
+	now    func() time.Time // replaced by tests, only before the cache is in use
+
+	maxEntries atomic.Int64 // zero means unbounded
+	maxBytes   atomic.Int64 // zero means unbounded
+
+	// prefetchHits is how many hits make an entry popular enough to be
+	// refreshed before it expires; zero turns prefetching off.
+	prefetchHits atomic.Uint64
+	// staleWindow is how long expired entries are kept around to be served
+	// when fresh resolution fails (RFC 8767); zero turns serve-stale off.
+	staleWindow atomic.Int64
+
+	hits, misses, prefetches, staleServed, evictions atomic.Uint64
+}
+
+// CacheStats counts what the cache has been doing since start.
+type CacheStats struct {
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxEntries int64  `json:"max_entries"`
+	MaxBytes   int64  `json:"max_bytes"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Prefetches uint64 `json:"prefetches"`
+	Stale      uint64 `json:"stale"`     // expired answers served under RFC 8767
+	Evictions  uint64 `json:"evictions"` // entries dropped to stay within the limits
+}
+
+func NewCache() *Cache {
+	c := &Cache{now: time.Now}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[cacheKey]*list.Element)
+		c.shards[i].lru = list.New()
+	}
+	return c
+}
+
+// resolverCache is shared by every packet handled by the server.
+var resolverCache = NewCache()
+
+func (c *Cache) shard(key cacheKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.name))
+	return &c.shards[(h.Sum32()+uint32(key.qtype))%cacheShards]
+}
+
+// Get returns a copy of the cached response with TTLs counted down by the
+// time spent in the cache.
+func (c *Cache) Get(question dnsmessage.Question) (*dnsmessage.Message, bool) {
+	msg, ok, _ := c.lookup(question)
+	return msg, ok
+}
+
+// lookup is Get that also reports whether the caller should refresh the entry
+// in the background: it is popular and in the last prefetchWindow percent of
+// its lifetime. Only one caller is told to prefetch a given entry.
+func (c *Cache) lookup(question dnsmessage.Question) (msg *dnsmessage.Message, ok bool, prefetch bool) {
+	key := keyOf(question)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := c.now()
+	if !now.Before(entry.expires) {
+		if !now.Before(entry.expires.Add(time.Duration(c.staleWindow.Load()))) {
+			s.remove(elem)
+		}
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	c.hits.Add(1)
+	s.lru.MoveToFront(elem)
+	entry.hits++
+	lifetime := entry.expires.Sub(entry.stored)
+	remaining := entry.expires.Sub(now)
+	if hits := c.prefetchHits.Load(); hits > 0 && entry.hits >= hits && !entry.prefetching &&
+		remaining*100 <= lifetime*prefetchWindow {
+		entry.prefetching = true
+		c.prefetches.Add(1)
+		prefetch = true
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	return &dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: entry.rcode, AuthenticData: entry.secure},
+		Questions:   []dnsmessage.Question{question},
+		Answers:     agedCopy(entry.answers, elapsed),
+		Authorities: agedCopy(entry.authorities, elapsed),
+		Additionals: agedCopy(entry.additionals, elapsed),
+	}, true, prefetch
+}
+
+// staleAnswerTTL is the TTL given to stale records, as RFC 8767 section 4
+// recommends, so clients come back soon for fresh data.
+const staleAnswerTTL = 30
+
+// staleRefreshInterval is how long after a failed refresh the stale answer is
+// served straight away instead of trying upstream again (RFC 8767's "failure
+// recheck timer").
+const staleRefreshInterval = 30 * time.Second
+
+// stale returns an expired entry still inside the stale window, with every
+// TTL set to staleAnswerTTL. retry tells whether it is time to try
+// refreshing it again; only one caller at a time is told so, until it
+// calls refreshDone.
+func (c *Cache) stale(question dnsmessage.Question) (msg *dnsmessage.Message, retry bool, ok bool) {
+	key := keyOf(question)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := c.now()
+	if now.Before(entry.expires) || !now.Before(entry.expires.Add(time.Duration(c.staleWindow.Load()))) {
+		return nil, false, false
+	}
+	s.lru.MoveToFront(elem)
+	retry = !entry.refreshing && now.Sub(entry.lastFailure) >= staleRefreshInterval
+	if retry {
+		entry.refreshing = true
+	}
+	return &dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, RCode: entry.rcode, AuthenticData: entry.secure},
+		Questions:   []dnsmessage.Question{question},
+		Answers:     staleCopy(entry.answers),
+		Authorities: staleCopy(entry.authorities),
+		Additionals: staleCopy(entry.additionals),
+	}, retry, true
+}
+
+// servedStale counts a stale answer handed out.
+func (c *Cache) servedStale() {
+	c.staleServed.Add(1)
+}
+
+// refreshFailed remembers that upstream could not refresh an expired entry.
+func (c *Cache) refreshFailed(question dnsmessage.Question) {
+	key := keyOf(question)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*cacheEntry).lastFailure = c.now()
+	}
+}
+
+// refreshDone ends the refresh of an expired entry that stale started,
+// whether it got an answer or not.
+func (c *Cache) refreshDone(question dnsmessage.Question) {
+	key := keyOf(question)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+func staleCopy(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+	copied := agedCopy(rrs, 0)
+	for i := range copied {
+		copied[i].Header.TTL = staleAnswerTTL
+	}
+	return copied
+}
+
+// Set stores a response. Responses without any TTL to go by are not cached.
+func (c *Cache) Set(question dnsmessage.Question, msg *dnsmessage.Message) {
+	ttl, ok := responseTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := c.now()
+	c.insert(&cacheEntry{
+		key:         keyOf(question),
+		question:    question,
+		rcode:       msg.Header.RCode,
+		secure:      msg.Header.AuthenticData,
+		answers:     append([]dnsmessage.Resource(nil), msg.Answers...),
+		authorities: append([]dnsmessage.Resource(nil), msg.Authorities...),
+		additionals: append([]dnsmessage.Resource(nil), msg.Additionals...),
+		stored:      now,
+		expires:     now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// insert adds entry as the most recently used one in its shard and evicts
+// from the back of the shard until it is within its limits again.
+func (c *Cache) insert(entry *cacheEntry) {
+	entry.size = entrySize(entry)
+	s := c.shard(entry.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.entries[entry.key]; ok {
+		// a refreshed entry stays popular, so it can be prefetched again
+		entry.hits = old.Value.(*cacheEntry).hits
+		s.remove(old)
+	}
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	s.bytes += entry.size
+	c.evict(s)
+}
+
+// evict trims s to its share of the limits. The caller holds s.mu.
+func (c *Cache) evict(s *cacheShard) {
+	maxEntries, maxBytes := perShard(c.maxEntries.Load()), perShard(c.maxBytes.Load())
+	for s.lru.Len() > 0 &&
+		((maxEntries > 0 && int64(s.lru.Len()) > maxEntries) || (maxBytes > 0 && s.bytes > maxBytes)) {
+		s.remove(s.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func perShard(limit int64) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	return max(1, (limit+cacheShards-1)/cacheShards)
+}
+
+// remove drops elem from the shard. The caller holds s.mu.
+func (s *cacheShard) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.entries, entry.key)
+	s.bytes -= entry.size
+}
+
+// entrySize estimates the memory an entry holds: its records in wire format
+// plus a fixed overhead.
+func entrySize(entry *cacheEntry) int64 {
+	size := int64(cacheEntryOverhead + len(entry.key.name))
+	msg := dnsmessage.Message{
+		Answers:     entry.answers,
+		Authorities: entry.authorities,
+		Additionals: entry.additionals,
+	}
+	if packed, err := msg.Pack(); err == nil {
+		return size + int64(len(packed))
+	}
+	// records we can't pack still take room, count them at the UDP limit
+	return size + 512
+}
+
+// SetLimits bounds the cache by entry count and approximate bytes; zero
+// leaves that dimension unbounded. Shrinking the limits evicts right away.
+func (c *Cache) SetLimits(maxEntries, maxBytes int64) {
+	c.maxEntries.Store(maxEntries)
+	c.maxBytes.Store(maxBytes)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		c.evict(s)
+		s.mu.Unlock()
+	}
+}
+
+// responseTTL picks how long a response may be cached: the lowest TTL of
+// its answers, or for negative answers the SOA minimum (RFC 2308).
+func responseTTL(msg *dnsmessage.Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, answer := range msg.Answers {
+		if !found || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+			found = true
+		}
+	}
+	if found {
+		return ttl, true
+	}
+	for _, authority := range msg.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			return min(authority.Header.TTL, soa.MinTTL), true
+		}
+	}
+	return 0, false
+}
+
+func agedCopy(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return nil
+	}
+	aged := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		aged[i] = rr
+		if rr.Header.TTL > elapsed {
+			aged[i].Header.TTL = rr.Header.TTL - elapsed
+		} else {
+			aged[i].Header.TTL = 0
+		}
+	}
+	return aged
+}
+
+// each calls f for every entry, shard by shard, with that shard locked.
+func (c *Cache) each(f func(entry *cacheEntry)) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+			f(elem.Value.(*cacheEntry))
+		}
+		s.mu.Unlock()
+	}
+}
+
+// CacheEntry is the admin view of one cached response.
+type CacheEntry struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Class   string   `json:"class"`
+	RCode   string   `json:"rcode"`
+	TTL     uint32   `json:"ttl"` // seconds until the entry expires
+	Records []Record `json:"records"`
+}
+
+// Entries lists live entries whose name equals name or, when suffix is true,
+// falls under it. An empty name lists everything.
+func (c *Cache) Entries(name string, suffix bool) []CacheEntry {
+	entries := []CacheEntry{}
+	for _, live := range c.liveEntries(name, suffix) {
+		live.Records = recordsOf(live.rrs)
+		entries = append(entries, live.CacheEntry)
+	}
+	return entries
+}
+
+// liveEntry is a CacheEntry with its records still in dnsmessage form.
+type liveEntry struct {
+	CacheEntry
+	rrs []dnsmessage.Resource // answers, then authorities, TTLs aged
+}
+
+// liveEntries lists what Entries does, ordered by name and type.
+func (c *Cache) liveEntries(name string, suffix bool) []liveEntry {
+	now := c.now()
+	var entries []liveEntry
+	c.each(func(entry *cacheEntry) {
+		if !now.Before(entry.expires) || !nameMatches(entry.key.name, name, suffix) {
+			return
+		}
+		elapsed := uint32(now.Sub(entry.stored) / time.Second)
+		rrs := append(agedCopy(entry.answers, elapsed), agedCopy(entry.authorities, elapsed)...)
+		entries = append(entries, liveEntry{CacheEntry: CacheEntry{
+			Name:  entry.question.Name.String(),
+			Type:  rfc.RecordType(entry.key.qtype).String(),
+			Class: rfc.RecordClass(entry.key.class).String(),
+			RCode: rcodeString(entry.rcode),
+			TTL:   uint32(entry.expires.Sub(now) / time.Second),
+		}, rrs: rrs})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	return entries
+}
+
+// Flush removes entries matching name (or everything under it when suffix is
+// true) and reports how many were dropped.
+func (c *Cache) Flush(name string, suffix bool) int {
+	removed := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for key, elem := range s.entries {
+			if nameMatches(key.name, name, suffix) {
+				s.remove(elem)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// Stats returns the cache counters.
+func (c *Cache) Stats() CacheStats {
+	stats := CacheStats{
+		MaxEntries: c.maxEntries.Load(),
+		MaxBytes:   c.maxBytes.Load(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Prefetches: c.prefetches.Load(),
+		Stale:      c.staleServed.Load(),
+		Evictions:  c.evictions.Load(),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Entries += s.lru.Len()
+		stats.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// prefetchDone lets the entry of question be prefetched again, which
+// matters when the background refresh got no answer worth caching and the
+// old entry is still there.
+func (c *Cache) prefetchDone(question dnsmessage.Question) {
+	key := keyOf(question)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// SetPrefetchHits sets how many hits make an entry worth prefetching.
+func (c *Cache) SetPrefetchHits(hits uint64) {
+	c.prefetchHits.Store(hits)
+}
+
+// SetStaleWindow sets how long past expiry entries may still be served.
+func (c *Cache) SetStaleWindow(window time.Duration) {
+	c.staleWindow.Store(int64(window))
+}
+
+func (c *Cache) Len() int {
+	return c.Stats().Entries
+}
+
+func nameMatches(key, name string, suffix bool) bool {
+	if name == "" {
+		return true
+	}
+	name = canonicalName(name)
+	if key == name {
+		return true
+	}
+	return suffix && (name == "." || strings.HasSuffix(key, "."+name))
+}
+
+// canonicalName lower-cases a domain name and makes it fully qualified.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
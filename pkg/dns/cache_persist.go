@@ -0,0 +1,196 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*
+Cache dump format
+
+A dump is one JSON document:
+
+	{
+	  "version": 1,
+	  "saved_at": "2025-01-28T14:41:06Z",
+	  "entries": [
+	    {"expires_at": "2025-01-28T14:46:06Z", "message": "<base64>"}
+	  ]
+	}
+
+Every entry is the cached response packed as a regular DNS message (RFC 1035
+wire format, base64 encoded by encoding/json) holding the question, the
+rcode, the AD bit and all three record sections, with TTLs as they were at saved_at.
+Keeping the wire format means every record type survives the round trip,
+including ones this package has no presentation format for.
+
+On load, the time elapsed since saved_at is subtracted from every TTL and
+entries whose expires_at has passed are dropped.
+*/
+const cacheDumpVersion = 1
+
+type cacheDump struct {
+	Version int              `json:"version"`
+	SavedAt time.Time        `json:"saved_at"`
+	Entries []cacheDumpEntry `json:"entries"`
+}
+
+type cacheDumpEntry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Message   []byte    `json:"message"`
+}
+
+// Save writes every live entry to w in the cache dump format.
+func (c *Cache) Save(w io.Writer) error {
+	now := c.now()
+	dump := cacheDump{Version: cacheDumpVersion, SavedAt: now.UTC()}
+	var packErr error
+	c.each(func(entry *cacheEntry) {
+		if !now.Before(entry.expires) || packErr != nil {
+			return
+		}
+		elapsed := uint32(now.Sub(entry.stored) / time.Second)
+		msg := dnsmessage.Message{
+			Header:      dnsmessage.Header{Response: true, RCode: entry.rcode, AuthenticData: entry.secure},
+			Questions:   []dnsmessage.Question{entry.question},
+			Answers:     agedCopy(entry.answers, elapsed),
+			Authorities: agedCopy(entry.authorities, elapsed),
+			Additionals: agedCopy(entry.additionals, elapsed),
+		}
+		packed, err := msg.Pack()
+		if err != nil {
+			packErr = fmt.Errorf("pack cache entry %s: %w", questionString(entry.question), err)
+			return
+		}
+		dump.Entries = append(dump.Entries, cacheDumpEntry{ExpiresAt: entry.expires.UTC(), Message: packed})
+	})
+	if packErr != nil {
+		return packErr
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(dump)
+}
+
+// Load reads a dump written by Save and adds its entries to the cache, aged
+// by the time that passed since the dump was taken. It returns how many
+// entries were still alive.
+func (c *Cache) Load(r io.Reader) (int, error) {
+	var dump cacheDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return 0, fmt.Errorf("decode cache dump: %w", err)
+	}
+	if dump.Version != cacheDumpVersion {
+		return 0, fmt.Errorf("unsupported cache dump version %d", dump.Version)
+	}
+	now := c.now()
+	elapsed := uint32(0)
+	if now.After(dump.SavedAt) {
+		elapsed = uint32(now.Sub(dump.SavedAt) / time.Second)
+	}
+
+	loaded := 0
+	for _, dumped := range dump.Entries {
+		if !now.Before(dumped.ExpiresAt) {
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(dumped.Message); err != nil {
+			return loaded, fmt.Errorf("unpack cache entry: %w", err)
+		}
+		if len(msg.Questions) != 1 {
+			return loaded, fmt.Errorf("cache entry has %d questions", len(msg.Questions))
+		}
+		question := msg.Questions[0]
+		c.insert(&cacheEntry{
+			key:         keyOf(question),
+			question:    question,
+			rcode:       msg.Header.RCode,
+			secure:      msg.Header.AuthenticData,
+			answers:     agedCopy(msg.Answers, elapsed),
+			authorities: agedCopy(msg.Authorities, elapsed),
+			additionals: agedCopy(msg.Additionals, elapsed),
+			stored:      now,
+			expires:     dumped.ExpiresAt,
+		})
+		loaded++
+	}
+	return loaded, nil
+}
+
+// WriteZone exports the cache in master file presentation format for
+// debugging. Each cached response is introduced by a comment line naming the
+// question and rcode; the records follow with their remaining TTLs.
+func (c *Cache) WriteZone(w io.Writer) error {
+	for _, entry := range c.liveEntries("", false) {
+		if _, err := fmt.Fprintf(w, "; %s %s %s %s ttl=%d\n", entry.Name, entry.Class, entry.Type, entry.RCode, entry.TTL); err != nil {
+			return err
+		}
+		records := make([]rfc.ResourceRecord, len(entry.rrs))
+		for i, rr := range entry.rrs {
+			records[i] = rfcRecord(rr)
+		}
+		if err := rfc.WriteZone(w, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveCacheFile dumps the resolver cache to path. The dump is written to a
+// temporary file first and renamed into place so a crash never leaves a
+// half-written dump behind.
+func SaveCacheFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := resolverCache.Save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadCacheFile warms the resolver cache from a dump written by
+// SaveCacheFile. A missing file is not an error: there is simply nothing to
+// warm up from on the very first start.
+func LoadCacheFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return resolverCache.Load(f)
+}
+
+// PersistCache saves the cache to path every interval until stop is closed.
+func PersistCache(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := SaveCacheFile(path); err != nil {
+				warnf("saving cache to %s failed: %s", path, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
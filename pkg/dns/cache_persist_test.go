@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCacheSaveLoadAgesEntries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	saved := NewCache()
+	saved.now = clock
+	saved.Set(testQuestion("www.example.com.", dnsmessage.TypeA), &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+	})
+	saved.Set(testQuestion("short.example.com.", dnsmessage.TypeA), &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{testA("short.example.com.", 30, [4]byte{192, 0, 2, 2})},
+	})
+
+	var dump bytes.Buffer
+	if err := saved.Save(&dump); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	// restart 100 seconds later
+	now = now.Add(100 * time.Second)
+	loaded := NewCache()
+	loaded.now = clock
+	n, err := loaded.Load(&dump)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected only the long-lived entry to survive, loaded %d", n)
+	}
+	cached, ok := loaded.Get(testQuestion("www.example.com.", dnsmessage.TypeA))
+	if !ok {
+		t.Fatalf("expected www.example.com. to be warm")
+	}
+	if ttl := cached.Answers[0].Header.TTL; ttl != 200 {
+		t.Fatalf("expected TTL 200 after restart, got %d", ttl)
+	}
+}
+
+func TestCacheWriteZone(t *testing.T) {
+	cache := NewCache()
+	cache.Set(testQuestion("www.example.com.", dnsmessage.TypeA), &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+	})
+	var zone strings.Builder
+	if err := cache.WriteZone(&zone); err != nil {
+		t.Fatalf("WriteZone: %s", err)
+	}
+	if !strings.Contains(zone.String(), "www.example.com.\t300\tIN\tA\t192.0.2.1") {
+		t.Fatalf("unexpected zone output:\n%s", zone.String())
+	}
+}
+
+func TestCacheWriteZoneReadsBack(t *testing.T) {
+	cache := NewCache()
+	answers := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all", "say \"hi\"\n"}},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: typeDS, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.UnknownResource{Type: typeDS, Data: ds{KeyTag: 1, Algorithm: 13, DigestType: 2, Digest: []byte{0xab, 0xcd}}.rdata()},
+		},
+	}
+	cache.Set(testQuestion("example.com.", dnsmessage.TypeTXT), &dnsmessage.Message{Answers: answers[:1]})
+	cache.Set(testQuestion("example.com.", typeDS), &dnsmessage.Message{Answers: answers[1:]})
+	var zone strings.Builder
+	if err := cache.WriteZone(&zone); err != nil {
+		t.Fatalf("WriteZone: %s", err)
+	}
+
+	// the dump is a master file like any other
+	records, err := rfc.ParseZone(strings.NewReader(zone.String()), ".")
+	if err != nil {
+		t.Fatalf("ParseZone: %s\n%s", err, zone.String())
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records back from\n%s", len(records), zone.String())
+	}
+	for _, rec := range records {
+		rr, err := resourceOf(rec)
+		if err != nil {
+			t.Fatalf("resourceOf %s: %s", rec, err)
+		}
+		want := answers[0]
+		if rr.Header.Type == typeDS {
+			want = answers[1]
+		}
+		if !reflect.DeepEqual(rr, want) {
+			t.Fatalf("got %+v back, want %+v", rr, want)
+		}
+	}
+}
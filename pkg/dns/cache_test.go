@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCacheAgesTTL(t *testing.T) {
+	cache := NewCache()
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	cache.Set(question, &dnsmessage.Message{
+		Answers: []dnsmessage.Resource{testA("www.example.com.", 60, [4]byte{192, 0, 2, 1})},
+	})
+
+	now = now.Add(20 * time.Second)
+	cached, ok := cache.Get(question)
+	if !ok {
+		t.Fatalf("expected a cache hit")
+	}
+	if ttl := cached.Answers[0].Header.TTL; ttl != 40 {
+		t.Fatalf("expected TTL 40, got %d", ttl)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, ok := cache.Get(question); ok {
+		t.Fatalf("expected entry to expire")
+	}
+}
+
+func TestCacheFlushSuffix(t *testing.T) {
+	cache := NewCache()
+	for _, name := range []string{"www.example.com.", "mail.example.com.", "example.org."} {
+		cache.Set(testQuestion(name, dnsmessage.TypeA), &dnsmessage.Message{
+			Answers: []dnsmessage.Resource{testA(name, 60, [4]byte{192, 0, 2, 1})},
+		})
+	}
+
+	if entries := cache.Entries("example.com", true); len(entries) != 2 {
+		t.Fatalf("expected 2 entries under example.com, got %d", len(entries))
+	}
+	if removed := cache.Flush("www.example.com", false); removed != 1 {
+		t.Fatalf("expected 1 entry flushed, got %d", removed)
+	}
+	if removed := cache.Flush("com.", true); removed != 1 {
+		t.Fatalf("expected 1 entry flushed, got %d", removed)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("expected example.org. to survive, have %d entries", cache.Len())
+	}
+}
+
+func TestCachePrefetchesPopularEntries(t *testing.T) {
+	useTestHierarchy(t)
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	if _, err := resolve(question); err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+
+	// jump to the last 10% of the 300s TTL
+	now := time.Now().Add(275 * time.Second)
+	resolverCache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := resolve(question); err != nil {
+			t.Fatalf("resolve: %s", err)
+		}
+	}
+	if prefetches := resolverCache.Stats().Prefetches; prefetches != 1 {
+		t.Fatalf("expected exactly one prefetch, got %d", prefetches)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cached, ok := resolverCache.Get(question)
+		if ok && cached.Answers[0].Header.TTL == 300 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("entry was not refreshed in the background")
+}
+
+func TestCachePrefetchRetriesAfterFailure(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": func(query dnsmessage.Message) dnsmessage.Message {
+			if failing.Load() {
+				return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused}}
+			}
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+			}
+		},
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.PrefetchMinHits = 1
+	})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(question, &dnsmessage.Message{Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})}})
+	now := time.Now().Add(275 * time.Second)
+	resolverCache.now = func() time.Time { return now }
+
+	// the first prefetch fails, a later hit has to start another one
+	deadline := time.Now().Add(2 * time.Second)
+	for resolverCache.Stats().Prefetches < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no prefetch after the failed one, %+v", resolverCache.Stats())
+		}
+		if _, err := resolve(question); err != nil {
+			t.Fatalf("resolve: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	failing.Store(false)
+	for {
+		if _, err := resolve(question); err != nil {
+			t.Fatalf("resolve: %s", err)
+		}
+		cached, ok := resolverCache.Get(question)
+		if ok && cached.Answers[0].Header.TTL == 300 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry was not refreshed by the second prefetch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCache()
+	cache.SetLimits(2*cacheShards, 0) // two entries per shard
+
+	// find three names that land in the same shard
+	var names []string
+	first := cache.shard(keyOf(testQuestion("name0.example.", dnsmessage.TypeA)))
+	for i := 0; len(names) < 3; i++ {
+		name := fmt.Sprintf("name%d.example.", i)
+		if cache.shard(keyOf(testQuestion(name, dnsmessage.TypeA))) == first {
+			names = append(names, name)
+		}
+	}
+	set := func(name string) {
+		cache.Set(testQuestion(name, dnsmessage.TypeA), &dnsmessage.Message{
+			Answers: []dnsmessage.Resource{testA(name, 60, [4]byte{192, 0, 2, 1})},
+		})
+	}
+
+	set(names[0])
+	set(names[1])
+	cache.Get(testQuestion(names[0], dnsmessage.TypeA)) // names[1] is now least recently used
+	set(names[2])
+
+	if _, ok := cache.Get(testQuestion(names[1], dnsmessage.TypeA)); ok {
+		t.Fatalf("expected %s to be evicted", names[1])
+	}
+	for _, name := range []string{names[0], names[2]} {
+		if _, ok := cache.Get(testQuestion(name, dnsmessage.TypeA)); !ok {
+			t.Fatalf("expected %s to stay cached", name)
+		}
+	}
+	if evictions := cache.Stats().Evictions; evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %d", evictions)
+	}
+}
+
+func TestCacheByteLimit(t *testing.T) {
+	cache := NewCache()
+	const maxBytes = 16 * 1024
+	cache.SetLimits(0, maxBytes)
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		cache.Set(testQuestion(name, dnsmessage.TypeA), &dnsmessage.Message{
+			Answers: []dnsmessage.Resource{testA(name, 60, [4]byte{192, 0, 2, 1})},
+		})
+	}
+	stats := cache.Stats()
+	if stats.Bytes > maxBytes || stats.Evictions == 0 {
+		t.Fatalf("cache not bounded: %+v", stats)
+	}
+	if uint64(stats.Entries)+stats.Evictions != 500 {
+		t.Fatalf("entries and evictions don't add up: %+v", stats)
+	}
+}
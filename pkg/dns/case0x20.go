@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"crypto/rand"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS 0x20 (draft-vixie-dnsext-dns0x20): nameservers copy the question into
+// their reply byte for byte, so flipping the case of every letter at random
+// adds one bit an off-path attacker has to guess per letter of the name.
+
+// randomizeCase returns name with the case of each ASCII letter chosen at
+// random.
+func randomizeCase(name dnsmessage.Name) dnsmessage.Name {
+	bits := make([]byte, (name.Length+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	randomized := name
+	for i := 0; i < int(name.Length); i++ {
+		c := randomized.Data[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if bits[i/8]&(1<<(i%8)) != 0 {
+				randomized.Data[i] = c | 0x20 // lower
+			} else {
+				randomized.Data[i] = c &^ 0x20 // upper
+			}
+		}
+	}
+	return randomized
+}
+
+// useCaseRandomization tells whether queries to server get a randomised
+// name: 0x20 has to be switched on, and the server must be neither
+// configured as exempt nor caught not preserving case before.
+func useCaseRandomization(server net.IP) bool {
+	cfg := runningConfig()
+	if !cfg.QnameCaseRandomization || infra.caseInsensitive(server) {
+		return false
+	}
+	for _, exempt := range cfg.caseExempt {
+		if exempt.Contains(server) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreCase puts the name we asked for back into owner names that the
+// server echoed in randomised case, so caches and clients see it unchanged.
+func restoreCase(rrs []dnsmessage.Resource, original dnsmessage.Name) {
+	name := original.String()
+	for i := range rrs {
+		owner := rrs[i].Header.Name.String()
+		if len(owner) > len(name) {
+			continue
+		}
+		// only the name itself or one of its parents can carry our case
+		start := len(name) - len(owner)
+		if start > 0 && name[start-1] != '.' {
+			continue
+		}
+		if suffix := name[start:]; owner != suffix && strings.EqualFold(owner, suffix) {
+			if restored, err := dnsmessage.NewName(suffix); err == nil {
+				rrs[i].Header.Name = restored
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := dnsmessage.MustNewName("www.some-long-example-name.com.")
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		randomized := randomizeCase(name).String()
+		if !strings.EqualFold(randomized, name.String()) {
+			t.Fatalf("randomizeCase changed more than case: %s", randomized)
+		}
+		seen[randomized] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("case was not randomised: %v", seen)
+	}
+}
+
+func TestRestoreCase(t *testing.T) {
+	rrs := []dnsmessage.Resource{
+		testA("wWw.ExAmPlE.cOm.", 300, [4]byte{192, 0, 2, 1}),
+		testA("ExAmPlE.cOm.", 300, [4]byte{192, 0, 2, 2}),
+		testA("xExAmPlE.cOm.", 300, [4]byte{192, 0, 2, 3}), // not a parent of the name
+	}
+	restoreCase(rrs, dnsmessage.MustNewName("www.example.com."))
+	for i, want := range []string{"www.example.com.", "example.com.", "xExAmPlE.cOm."} {
+		if got := rrs[i].Header.Name.String(); got != want {
+			t.Errorf("record %d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+// TestCaseRandomizationFallback runs 0x20 against a hierarchy whose last
+// server lower-cases every name it echoes. The resolver has to notice, ask
+// it again without 0x20 and stop randomising for it.
+func TestCaseRandomizationFallback(t *testing.T) {
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": referralTo("com.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 2}),
+		"127.0.0.2": referralTo("example.com.", "ns1.example.com.", [4]byte{127, 0, 0, 33}),
+		"127.0.0.33": func(query dnsmessage.Message) dnsmessage.Message {
+			lower := dnsmessage.MustNewName(strings.ToLower(query.Questions[0].Name.String()))
+			query.Questions[0].Name = lower
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA(lower.String(), 300, [4]byte{192, 0, 2, 1})},
+			}
+		},
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.QnameCaseRandomization = true
+	})
+	t.Cleanup(func() {
+		infra.mu.Lock()
+		delete(infra.servers, "127.0.0.33")
+		infra.mu.Unlock()
+	})
+
+	before := ResponseValidationStats().CaseMismatch
+	question := testQuestion("www.Example.com.", dnsmessage.TypeA)
+	response, err := dnsQuery(getRootServers(), question, nil)
+	if err != nil {
+		t.Fatalf("dnsQuery: %s", err)
+	}
+	// the answer carries the name exactly as it was asked
+	if len(response.Answers) != 1 || response.Answers[0].Header.Name.String() != "www.Example.com." {
+		t.Fatalf("unexpected answers %v", response.Answers)
+	}
+	if !infra.caseInsensitive(net.ParseIP("127.0.0.33")) {
+		t.Fatalf("server not marked as case insensitive")
+	}
+	if ResponseValidationStats().CaseMismatch == before {
+		t.Fatalf("case mismatch was not counted")
+	}
+}
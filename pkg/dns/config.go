@@ -0,0 +1,401 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Duration is a time.Duration that reads and writes itself as a Go duration
+// string ("2s", "150ms") in the JSON config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config holds everything an operator can tune on the resolver.
+type Config struct {
+	Listen       string   `json:"listen"`        // address of the UDP server
+	AdminListen  string   `json:"admin_listen"`  // address of the admin HTTP API, empty disables it
+	RootServers  []string `json:"root_servers"`  // where iteration starts
+	QueryTimeout Duration `json:"query_timeout"` // how long to wait for one upstream server
+	LogLevel     string   `json:"log_level"`     // debug, info, warn or error
+
+	// DNS over TLS (RFC 7858) on TLSListen, usually ":853", with the PEM
+	// certificate and key in TLSCertFile and TLSKeyFile. Connections idle
+	// for TLSIdleTimeout are closed.
+	TLSListen      string   `json:"tls_listen"` // empty disables it
+	TLSCertFile    string   `json:"tls_cert_file"`
+	TLSKeyFile     string   `json:"tls_key_file"`
+	TLSIdleTimeout Duration `json:"tls_idle_timeout"`
+
+	// DNS over HTTPS (RFC 8484) at /dns-query on DoHListen, with the same
+	// certificate and key, over HTTP/2 too if DoHHTTP2 is set.
+	DoHListen string `json:"doh_listen"` // empty disables it
+	DoHHTTP2  bool   `json:"doh_http2"`
+
+	// DNS over QUIC (RFC 9250) on the UDP address QUICListen, usually
+	// ":853", with the same certificate, key and idle timeout. Only a
+	// build with -tags doq serves it.
+	QUICListen string `json:"quic_listen"` // empty disables it
+
+	// Forwarding mode: with Forwarders set, queries go with RD=1 to these
+	// upstream resolvers instead of being resolved from the root, in the
+	// order ForwardStrategy picks: sequential, random, fastest or parallel.
+	// Every ForwardHealthInterval each is checked, zero turns that off.
+	Forwarders            []Forwarder `json:"forwarders"`
+	ForwardStrategy       string      `json:"forward_strategy"`
+	ForwardHealthInterval Duration    `json:"forward_health_interval"`
+
+	// Per domain routing, ahead of both iteration and forwarding mode: the
+	// names under a forward zone go to its forwarders, those under a stub
+	// zone are iterated from its nameservers. The longest match wins.
+	ForwardZones []ForwardZone `json:"forward_zones"`
+	StubZones    []StubZone    `json:"stub_zones"`
+
+	// Zones we are authoritative for, loaded from master files and
+	// answered ahead of everything else, the cache included.
+	AuthZones []AuthZone `json:"auth_zones"`
+
+	// DNS 0x20: randomise the case of outgoing query names and insist the
+	// reply echoes it, except for servers listed (IPs or CIDRs) as not
+	// preserving case.
+	QnameCaseRandomization bool     `json:"qname_0x20"`
+	CaseExempt             []string `json:"qname_0x20_exempt"`
+	caseExempt             []*net.IPNet
+
+	// QNAME minimisation (RFC 9156): "off", "relaxed" (fall back to the
+	// full name when a server mishandles minimised queries) or "strict".
+	QnameMinimisation string `json:"qname_minimisation"`
+
+	// DNSSEC validation, starting from TrustAnchors: DS or DNSKEY records
+	// in master file format, the IANA root KSKs by default. TrustAnchorFile
+	// replaces them with a file of such records or IANA's root-anchors.xml.
+	// With TrustAnchorStateFile set, key rollovers are followed (RFC 5011)
+	// and remembered there. Names under NegativeTrustAnchors are not
+	// validated (RFC 7646). AggressiveNSEC answers from validated NSEC and
+	// NSEC3 records without asking upstream (RFC 8198).
+	DNSSEC               bool     `json:"dnssec"`
+	TrustAnchors         []string `json:"trust_anchors"`
+	TrustAnchorFile      string   `json:"trust_anchor_file"`
+	TrustAnchorStateFile string   `json:"trust_anchor_state_file"`
+	NegativeTrustAnchors []string `json:"negative_trust_anchors"`
+	AggressiveNSEC       bool     `json:"aggressive_nsec"`
+
+	// Who may query, first matching rule wins; see acl.go. Views hold
+	// local data for the clients of the rules naming them.
+	ACL   []ACLRule       `json:"acl"`
+	Views map[string]View `json:"views"`
+	acl   []aclRule
+
+	// Response Rate Limiting for UDP clients: identical responses to one
+	// netblock (RRLIPv4Prefix/RRLIPv6Prefix bits) beyond
+	// RRLResponsesPerSecond, or RRLErrorsPerSecond for NXDOMAIN and errors,
+	// are dropped, every RRLSlip-th of them sent truncated instead. A flood
+	// stays limited for RRLWindow after it stops. Zero responses per second
+	// disables it, RRLExempt lists clients (IPs or CIDRs) never limited.
+	RRLResponsesPerSecond int      `json:"rrl_responses_per_second"`
+	RRLErrorsPerSecond    int      `json:"rrl_errors_per_second"` // zero means the same as responses
+	RRLWindow             Duration `json:"rrl_window"`
+	RRLSlip               int      `json:"rrl_slip"` // zero drops everything, one truncates everything
+	RRLIPv4Prefix         int      `json:"rrl_ipv4_prefix"`
+	RRLIPv6Prefix         int      `json:"rrl_ipv6_prefix"`
+	RRLExempt             []string `json:"rrl_exempt"`
+
+	// DNS Cookies (RFC 7873) with clients and upstream servers. Server
+	// cookies are made with CookieSecret, 32 hex digits, which servers
+	// behind one anycast address should share; a random one by default.
+	DNSCookies   bool   `json:"dns_cookies"`
+	CookieSecret string `json:"cookie_secret"`
+
+	CacheMaxEntries   int64    `json:"cache_max_entries"`   // zero means unbounded
+	CacheMaxBytes     int64    `json:"cache_max_bytes"`     // approximate, zero means unbounded
+	CacheFile         string   `json:"cache_file"`          // where the cache is dumped on shutdown and loaded on start
+	CacheSaveInterval Duration `json:"cache_save_interval"` // also dump this often, zero only dumps on shutdown
+	PrefetchMinHits   uint64   `json:"prefetch_min_hits"`   // hits before an entry is refreshed ahead of expiry, zero disables
+
+	// Serve-stale (RFC 8767): expired answers are kept for StaleWindow and
+	// served when upstream fails or takes longer than StaleClientTimeout.
+	StaleWindow        Duration `json:"stale_window"`         // zero disables serve-stale
+	StaleClientTimeout Duration `json:"stale_client_timeout"` // how long a client waits before getting stale data
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:       ":53",
+		RootServers:  strings.Split(ROOT_SERVERS, ","),
+		QueryTimeout: Duration(2 * time.Second),
+		LogLevel:     "info",
+
+		TLSIdleTimeout: Duration(10 * time.Second),
+		DoHHTTP2:       true,
+
+		ForwardStrategy:       ForwardSequential,
+		ForwardHealthInterval: Duration(30 * time.Second),
+
+		QnameMinimisation: MinimiseRelaxed,
+
+		TrustAnchors:   append([]string(nil), rootTrustAnchors...),
+		AggressiveNSEC: true,
+
+		RRLWindow:     Duration(15 * time.Second),
+		RRLSlip:       2,
+		RRLIPv4Prefix: 24,
+		RRLIPv6Prefix: 56,
+
+		DNSCookies: true,
+
+		CacheMaxEntries: 100000,
+		CacheMaxBytes:   64 << 20,
+		PrefetchMinHits: 3,
+
+		StaleWindow:        Duration(24 * time.Hour),
+		StaleClientTimeout: Duration(1800 * time.Millisecond),
+	}
+}
+
+// LoadConfig reads a JSON config file; settings missing from the file keep
+// their default values.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	if len(c.RootServers) == 0 {
+		return fmt.Errorf("config: no root servers")
+	}
+	for _, server := range c.RootServers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("config: root server %q is not an IP address", server)
+		}
+	}
+	if c.QueryTimeout <= 0 {
+		return fmt.Errorf("config: query_timeout must be positive")
+	}
+	if c.TLSListen != "" && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return fmt.Errorf("config: tls_listen needs tls_cert_file and tls_key_file")
+	}
+	if c.DoHListen != "" && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return fmt.Errorf("config: doh_listen needs tls_cert_file and tls_key_file")
+	}
+	if c.QUICListen != "" && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return fmt.Errorf("config: quic_listen needs tls_cert_file and tls_key_file")
+	}
+	if c.TLSIdleTimeout <= 0 {
+		return fmt.Errorf("config: tls_idle_timeout must be positive")
+	}
+	for _, f := range c.Forwarders {
+		if _, err := newTransport(f); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	switch c.ForwardStrategy {
+	case ForwardSequential, ForwardRandom, ForwardFastest, ForwardParallel:
+	default:
+		return fmt.Errorf("config: forward_strategy must be sequential, random, fastest or parallel, not %q", c.ForwardStrategy)
+	}
+	if c.ForwardHealthInterval < 0 {
+		return fmt.Errorf("config: forward_health_interval must not be negative")
+	}
+	if err := c.validateZoneRoutes(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if err := c.validateAuthZones(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if c.StaleWindow < 0 || c.StaleClientTimeout < 0 {
+		return fmt.Errorf("config: stale_window and stale_client_timeout must not be negative")
+	}
+	if c.CacheMaxEntries < 0 || c.CacheMaxBytes < 0 {
+		return fmt.Errorf("config: cache limits must not be negative")
+	}
+	if c.CacheSaveInterval < 0 {
+		return fmt.Errorf("config: cache_save_interval must not be negative")
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch c.QnameMinimisation {
+	case MinimiseOff, MinimiseRelaxed, MinimiseStrict:
+	default:
+		return fmt.Errorf("config: qname_minimisation must be off, relaxed or strict, not %q", c.QnameMinimisation)
+	}
+	if _, err := parseNets(c.CaseExempt); err != nil {
+		return fmt.Errorf("config: qname_0x20_exempt: %w", err)
+	}
+	if c.RRLResponsesPerSecond < 0 || c.RRLErrorsPerSecond < 0 || c.RRLWindow < 0 || c.RRLSlip < 0 {
+		return fmt.Errorf("config: rrl settings must not be negative")
+	}
+	if c.RRLIPv4Prefix < 0 || c.RRLIPv4Prefix > 32 || c.RRLIPv6Prefix < 0 || c.RRLIPv6Prefix > 128 {
+		return fmt.Errorf("config: rrl_ipv4_prefix must be 0-32 and rrl_ipv6_prefix 0-128")
+	}
+	if _, err := parseNets(c.RRLExempt); err != nil {
+		return fmt.Errorf("config: rrl_exempt: %w", err)
+	}
+	if c.CookieSecret != "" {
+		if _, err := parseCookieSecret(c.CookieSecret); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	if _, err := compileACL(c.ACL, c.Views); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if _, err := parseTrustAnchors(c.TrustAnchors); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	for _, name := range c.NegativeTrustAnchors {
+		if _, err := dnsmessage.NewName(canonicalName(name)); err != nil {
+			return fmt.Errorf("config: negative trust anchor %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// parseNets reads a list of IP addresses and CIDR prefixes; a bare address
+// becomes a single-host prefix.
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR prefix", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+var (
+	// config is the running configuration. Configure installs a new one
+	// whole and nothing changes it afterwards, so the query path shares it
+	// through runningConfig instead of copying it.
+	config atomic.Pointer[Config]
+
+	// reloadMu keeps Configure and ReloadZones from reading the same zone
+	// file change twice, which would journal it twice.
+	reloadMu sync.Mutex
+)
+
+// Configure installs cfg as the running configuration.
+func Configure(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	// everything that can fail is read before any of it is applied, so a
+	// zone or anchor file that does not load leaves the running config alone
+	anchors, err := loadAnchors(cfg, time.Now())
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	zones, err := authZones.load(cfg.AuthZones)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	level, _ := ParseLogLevel(cfg.LogLevel)
+	SetLogLevel(level)
+	cfg.caseExempt, _ = parseNets(cfg.CaseExempt)
+	cfg.acl, _ = compileACL(cfg.ACL, cfg.Views)
+	responseLimiter.configure(cfg)
+	cookies.configure(cfg)
+	forwarders.configure("", cfg.ForwardStrategy, cfg.Forwarders)
+	zoneRoutes.configure(cfg)
+	authZones.set(zones)
+	trustAnchors.set(anchors)
+	// keys validated under the old anchors may not chain to the new ones
+	dnssecKeys.flush()
+	aggressiveNSEC.flush()
+
+	resolverCache.SetLimits(cfg.CacheMaxEntries, cfg.CacheMaxBytes)
+	resolverCache.SetPrefetchHits(cfg.PrefetchMinHits)
+	resolverCache.SetStaleWindow(time.Duration(cfg.StaleWindow))
+
+	cfg = cfg.clone()
+	config.Store(&cfg)
+	return nil
+}
+
+func init() {
+	cfg := DefaultConfig()
+	config.Store(&cfg)
+}
+
+// runningConfig returns the running configuration without copying it. It is
+// shared: callers must not modify it.
+func runningConfig() *Config {
+	return config.Load()
+}
+
+// CurrentConfig returns a copy of the running configuration.
+func CurrentConfig() Config {
+	cfg := runningConfig().clone()
+	cfg.LogLevel = GetLogLevel().String()
+	return cfg
+}
+
+// clone copies c deep enough that changing the copy leaves c alone.
+func (c Config) clone() Config {
+	cfg := c
+	cfg.RootServers = append([]string(nil), c.RootServers...)
+	cfg.Forwarders = append([]Forwarder(nil), c.Forwarders...)
+	cfg.ForwardZones = append([]ForwardZone(nil), c.ForwardZones...)
+	cfg.StubZones = append([]StubZone(nil), c.StubZones...)
+	cfg.AuthZones = append([]AuthZone(nil), c.AuthZones...)
+	cfg.TrustAnchors = append([]string(nil), c.TrustAnchors...)
+	cfg.NegativeTrustAnchors = append([]string(nil), c.NegativeTrustAnchors...)
+	cfg.RRLExempt = append([]string(nil), c.RRLExempt...)
+	cfg.ACL = append([]ACLRule(nil), c.ACL...)
+	if c.Views != nil {
+		cfg.Views = make(map[string]View, len(c.Views))
+		for name, v := range c.Views {
+			hosts := make(map[string][]string, len(v.Hosts))
+			for host, addrs := range v.Hosts {
+				hosts[host] = append([]string(nil), addrs...)
+			}
+			cfg.Views[name] = View{Hosts: hosts, TTL: v.TTL}
+		}
+	}
+	return cfg
+}
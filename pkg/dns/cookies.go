@@ -0,0 +1,380 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS Cookies (RFC 7873) let both ends of a UDP exchange recognise each
+// other. A client sends a client cookie, the server answers with a server
+// cookie made from it and the client's address, and the pair goes into
+// every later query. A client that presents a valid server cookie cannot be
+// a spoofed source, so it is not rate limited. Towards upstream servers the
+// cookie is the other way round: once a server has answered with our
+// client cookie, a reply without it is a forgery.
+//
+// Server cookies are in the interoperable format of RFC 9018, so servers
+// sharing cookie_secret accept each other's cookies.
+
+// ednsOptionCookie is the EDNS0 option code of DNS Cookies.
+const ednsOptionCookie = 10
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16 // RFC 9018: version, reserved, timestamp, hash
+	maxCookieLen    = clientCookieLen + 32
+
+	cookieVersion = 1
+	// a server cookie is good for an hour, and may come from a clock up to
+	// five minutes ahead (RFC 9018 section 4.3)
+	cookieLifetime  = time.Hour
+	cookieClockSkew = 5 * time.Minute
+)
+
+// rcodeBadCookie is the extended RCODE of a server that wants a fresh cookie.
+const rcodeBadCookie dnsmessage.RCode = 23
+
+// CookieStats counts the cookies clients presented and what upstream did
+// with ours.
+type CookieStats struct {
+	ClientOnly        uint64 `json:"client_only"`         // queries with just a client cookie
+	Valid             uint64 `json:"valid"`               // queries with a valid server cookie
+	Invalid           uint64 `json:"invalid"`             // wrong or expired server cookie
+	Malformed         uint64 `json:"malformed"`           // answered FORMERR
+	UpstreamBadCookie uint64 `json:"upstream_bad_cookie"` // BADCOOKIE replies from upstream
+	UpstreamServers   int    `json:"upstream_servers"`    // servers seen to support cookies
+}
+
+var cookieCounters struct {
+	clientOnly, valid, invalid, malformed, upstreamBadCookie atomic.Uint64
+}
+
+var (
+	errCookieMalformed = errors.New("malformed cookie option")
+	errCookieMismatch  = errors.New("response cookie does not match ours")
+	errCookieMissing   = errors.New("response has no cookie from a server that sends them")
+)
+
+type upstreamCookie struct {
+	server []byte // last server cookie it gave us
+}
+
+type cookieJar struct {
+	mu           sync.Mutex
+	random       [16]byte // server secret when none is configured
+	secret       [16]byte // server cookie secret
+	clientSecret [16]byte
+	upstream     map[string]*upstreamCookie
+}
+
+var cookies = newCookieJar()
+
+func newCookieJar() *cookieJar {
+	j := &cookieJar{upstream: make(map[string]*upstreamCookie)}
+	rand.Read(j.random[:])
+	rand.Read(j.clientSecret[:])
+	j.secret = j.random
+	return j
+}
+
+// parseCookieSecret reads the 128 bit cookie_secret, hex encoded.
+func parseCookieSecret(s string) ([16]byte, error) {
+	var secret [16]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(secret) {
+		return secret, fmt.Errorf("cookie_secret must be %d hex digits", 2*len(secret))
+	}
+	copy(secret[:], b)
+	return secret, nil
+}
+
+func (j *cookieJar) configure(cfg Config) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.secret = j.random
+	if cfg.CookieSecret != "" {
+		j.secret, _ = parseCookieSecret(cfg.CookieSecret)
+	}
+}
+
+// queryCookie returns the cookie option of a client's OPT record, nil when
+// it sent none.
+func queryCookie(opt *dnsmessage.Resource) ([]byte, error) {
+	data := cookieOption(opt)
+	if data == nil {
+		return nil, nil
+	}
+	// a client cookie alone, or with a server cookie of 8 to 32 octets
+	if len(data) != clientCookieLen && (len(data) < clientCookieLen+8 || len(data) > maxCookieLen) {
+		return nil, errCookieMalformed
+	}
+	return data, nil
+}
+
+func cookieOption(opt *dnsmessage.Resource) []byte {
+	if opt == nil {
+		return nil
+	}
+	body, ok := opt.Body.(*dnsmessage.OPTResource)
+	if !ok {
+		return nil
+	}
+	for _, o := range body.Options {
+		if o.Code == ednsOptionCookie {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+// serverCookie makes the RFC 9018 server cookie for a client cookie from
+// client at now.
+func (j *cookieJar) serverCookie(client net.IP, clientCookie []byte, now time.Time) []byte {
+	cookie := make([]byte, serverCookieLen)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+	j.mu.Lock()
+	secret := j.secret
+	j.mu.Unlock()
+	binary.LittleEndian.PutUint64(cookie[8:], cookieHash(secret, client, clientCookie, cookie[:8]))
+	return cookie
+}
+
+// cookieHash is SipHash-2-4 over client cookie | version | reserved |
+// timestamp | client IP.
+func cookieHash(secret [16]byte, client net.IP, clientCookie, header []byte) uint64 {
+	if ip4 := client.To4(); ip4 != nil {
+		client = ip4
+	}
+	msg := make([]byte, 0, len(clientCookie)+len(header)+len(client))
+	msg = append(append(append(msg, clientCookie...), header...), client...)
+	return sipHash24(secret, msg)
+}
+
+// verify reports whether the server cookie in cookie is one we made for
+// client recently.
+func (j *cookieJar) verify(client net.IP, cookie []byte, now time.Time) bool {
+	if len(cookie) != clientCookieLen+serverCookieLen || client == nil {
+		return false
+	}
+	server := cookie[clientCookieLen:]
+	if server[0] != cookieVersion {
+		return false
+	}
+	// serial number arithmetic, so the timestamp survives 2106
+	age := time.Duration(int32(uint32(now.Unix())-binary.BigEndian.Uint32(server[4:8]))) * time.Second
+	if age > cookieLifetime || age < -cookieClockSkew {
+		return false
+	}
+	j.mu.Lock()
+	secret := j.secret
+	j.mu.Unlock()
+	return binary.LittleEndian.Uint64(server[8:]) == cookieHash(secret, client, cookie[:clientCookieLen], server[:8])
+}
+
+// checkClient looks at the cookie a client sent: it returns the cookie, or
+// nil when there is none or cookies are off, whether it carries a valid
+// server cookie, and an error if the option is malformed.
+func (j *cookieJar) checkClient(cfg *Config, client net.IP, opt *dnsmessage.Resource, now time.Time) ([]byte, bool, error) {
+	if !cfg.DNSCookies {
+		return nil, false, nil
+	}
+	cookie, err := queryCookie(opt)
+	switch {
+	case err != nil:
+		cookieCounters.malformed.Add(1)
+		return nil, false, err
+	case cookie == nil:
+		return nil, false, nil
+	case len(cookie) == clientCookieLen:
+		cookieCounters.clientOnly.Add(1)
+		return cookie, false, nil
+	case j.verify(client, cookie, now):
+		cookieCounters.valid.Add(1)
+		return cookie, true, nil
+	}
+	cookieCounters.invalid.Add(1)
+	return cookie, false, nil
+}
+
+// addCookie gives the client a fresh server cookie along with its own
+// client cookie. msg must already have its OPT record.
+func (j *cookieJar) addCookie(msg *dnsmessage.Message, client net.IP, cookie []byte, now time.Time) {
+	opt := findOPT(msg.Additionals)
+	if opt == nil || client == nil {
+		return
+	}
+	data := append(append([]byte(nil), cookie[:clientCookieLen]...), j.serverCookie(client, cookie[:clientCookieLen], now)...)
+	setOption(opt, dnsmessage.Option{Code: ednsOptionCookie, Data: data})
+}
+
+// setOption puts option into opt in place of any other of its code, without
+// touching an options slice that may be shared.
+func setOption(opt *dnsmessage.Resource, option dnsmessage.Option) {
+	var options []dnsmessage.Option
+	for _, o := range opt.Body.(*dnsmessage.OPTResource).Options {
+		if o.Code != option.Code {
+			options = append(options, o)
+		}
+	}
+	opt.Body = &dnsmessage.OPTResource{Options: append(options, option)}
+}
+
+// formErr is the answer to a query we could not make sense of.
+func formErr(question dnsmessage.Question) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeFormatError},
+		Questions: []dnsmessage.Question{question},
+	}
+}
+
+// clientCookie is the client cookie we use towards server: stable for the
+// life of the process, different for every server (RFC 7873 section 4.1).
+func (j *cookieJar) clientCookie(server net.IP) []byte {
+	h := sha256.New()
+	h.Write(j.clientSecret[:])
+	h.Write(server.To16())
+	return h.Sum(nil)[:clientCookieLen]
+}
+
+// withCookie returns message with our cookie for server, and the server
+// cookie it last gave us, in its OPT record.
+func (j *cookieJar) withCookie(message dnsmessage.Message, server net.IP) dnsmessage.Message {
+	if findOPT(message.Additionals) == nil || !runningConfig().DNSCookies {
+		return message
+	}
+	data := j.clientCookie(server)
+	j.mu.Lock()
+	if state := j.upstream[server.String()]; state != nil {
+		data = append(data, state.server...)
+	}
+	j.mu.Unlock()
+	message.Additionals = append([]dnsmessage.Resource(nil), message.Additionals...)
+	setOption(findOPT(message.Additionals), dnsmessage.Option{Code: ednsOptionCookie, Data: data})
+	return message
+}
+
+// accept checks the cookie of a reply from server and remembers the server
+// cookie in it. Over UDP, a server that has sent us cookies before must keep
+// doing so.
+func (j *cookieJar) accept(server net.IP, answer []byte, udp bool) error {
+	if !runningConfig().DNSCookies {
+		return nil
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(answer); err != nil {
+		return err
+	}
+	opt, err := queryOPT(&p)
+	if err != nil {
+		validation.malformed.Add(1)
+		return err
+	}
+	cookie := cookieOption(opt)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state := j.upstream[server.String()]
+	if cookie == nil {
+		if udp && state != nil {
+			validation.cookieMismatch.Add(1)
+			return errCookieMissing
+		}
+		return nil
+	}
+	if len(cookie) < clientCookieLen+8 || len(cookie) > maxCookieLen || !bytes.Equal(cookie[:clientCookieLen], j.clientCookie(server)) {
+		validation.cookieMismatch.Add(1)
+		return errCookieMismatch
+	}
+	if state == nil {
+		debugf("%s supports DNS cookies", server)
+		state = &upstreamCookie{}
+		j.upstream[server.String()] = state
+	}
+	state.server = append([]byte(nil), cookie[clientCookieLen:]...)
+	return nil
+}
+
+// badCookie reports whether answer is a BADCOOKIE error, which asks us to
+// repeat the query with the server cookie it carries.
+func badCookie(answer []byte) bool {
+	var p dnsmessage.Parser
+	header, err := p.Start(answer)
+	if err != nil || header.RCode != rcodeBadCookie&0xf {
+		return false
+	}
+	opt, err := queryOPT(&p)
+	if err != nil || opt == nil {
+		return false
+	}
+	if opt.Header.ExtendedRCode(header.RCode) != rcodeBadCookie {
+		return false
+	}
+	cookieCounters.upstreamBadCookie.Add(1)
+	return true
+}
+
+// CookieResults returns the DNS cookie counters.
+func CookieResults() CookieStats {
+	cookies.mu.Lock()
+	servers := len(cookies.upstream)
+	cookies.mu.Unlock()
+	return CookieStats{
+		ClientOnly:        cookieCounters.clientOnly.Load(),
+		Valid:             cookieCounters.valid.Load(),
+		Invalid:           cookieCounters.invalid.Load(),
+		Malformed:         cookieCounters.malformed.Load(),
+		UpstreamBadCookie: cookieCounters.upstreamBadCookie.Load(),
+		UpstreamServers:   servers,
+	}
+}
+
+// sipHash24 is SipHash-2-4 with a 128 bit key, the hash RFC 9018 puts in
+// server cookies.
+func sipHash24(key [16]byte, msg []byte) uint64 {
+	k0, k1 := binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:])
+	v0, v1 := k0^0x736f6d6570736575, k1^0x646f72616e646f6d
+	v2, v3 := k0^0x6c7967656e657261, k1^0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	length := len(msg)
+	for ; len(msg) >= 8; msg = msg[8:] {
+		compress(binary.LittleEndian.Uint64(msg))
+	}
+	var last [8]byte
+	copy(last[:], msg)
+	last[7] = byte(length)
+	compress(binary.LittleEndian.Uint64(last[:]))
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
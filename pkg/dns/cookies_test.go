@@ -0,0 +1,205 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSipHash24(t *testing.T) {
+	var key [16]byte
+	msg := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+		if i < len(msg) {
+			msg[i] = byte(i)
+		}
+	}
+	// test vectors from the SipHash paper
+	if got := sipHash24(key, nil); got != 0x726fdb47dd0e0e31 {
+		t.Fatalf("empty message: got %#x", got)
+	}
+	if got := sipHash24(key, msg); got != 0xa129ca6149be45e5 {
+		t.Fatalf("15 byte message: got %#x", got)
+	}
+}
+
+// cookieQuery packs a query for question carrying cookie.
+func cookieQuery(t *testing.T, question dnsmessage.Question, cookie []byte) []byte {
+	t.Helper()
+	opt := newOPT()
+	opt.Body = &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: ednsOptionCookie, Data: cookie}}}
+	query := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 7, RecursionDesired: true},
+		Questions:   []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{opt},
+	}
+	buf, err := query.Pack()
+	if err != nil {
+		t.Fatalf("pack: %s", err)
+	}
+	return buf
+}
+
+func TestServerCookies(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RRLResponsesPerSecond = 1
+		cfg.RRLSlip = 1
+	})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(question, answerFor(question))
+	client := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}
+	clientCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	conn := &recordingConn{}
+	if err := handlePacket(conn, client, cookieQuery(t, question, clientCookie)); err != nil {
+		t.Fatalf("handlePacket: %s", err)
+	}
+	cookie := cookieOption(findOPT(conn.replies[0].Additionals))
+	if len(cookie) != clientCookieLen+serverCookieLen || !bytes.Equal(cookie[:clientCookieLen], clientCookie) || cookie[clientCookieLen] != cookieVersion {
+		t.Fatalf("unexpected cookie %x", cookie)
+	}
+
+	// with a valid server cookie the client is past the rate limit
+	for i := 0; i < 3; i++ {
+		if err := handlePacket(conn, client, cookieQuery(t, question, cookie)); err != nil {
+			t.Fatalf("handlePacket: %s", err)
+		}
+	}
+	for _, reply := range conn.replies[1:] {
+		if reply.Header.Truncated || len(reply.Answers) != 1 {
+			t.Fatalf("cookie client was rate limited: %+v", reply.Header)
+		}
+	}
+
+	// the cookie only works from the address it was made for
+	if cookies.verify(net.ParseIP("203.0.113.8"), cookie, time.Now()) {
+		t.Fatalf("cookie accepted from another client")
+	}
+	if cookies.verify(client.IP, cookie, time.Now().Add(cookieLifetime+time.Minute)) {
+		t.Fatalf("expired cookie accepted")
+	}
+	forged := append([]byte(nil), cookie...)
+	forged[len(forged)-1] ^= 1
+	if cookies.verify(client.IP, forged, time.Now()) {
+		t.Fatalf("forged cookie accepted")
+	}
+
+	conn.replies = nil
+	if err := handlePacket(conn, client, cookieQuery(t, question, cookie[:10])); err != nil {
+		t.Fatalf("handlePacket: %s", err)
+	}
+	if conn.replies[0].Header.RCode != dnsmessage.RCodeFormatError {
+		t.Fatalf("malformed cookie got %s", conn.replies[0].Header.RCode)
+	}
+}
+
+func TestServerCookieSharedSecret(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) { cfg.CookieSecret = "e5e973e5a6b2a43f48e7dc849e37bfcf" })
+	client, now := net.ParseIP("2001:db8::53"), time.Now()
+	clientCookie := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	cookie := append(append([]byte(nil), clientCookie...), cookies.serverCookie(client, clientCookie, now)...)
+
+	// another server with the same secret takes the cookie
+	other := newCookieJar()
+	cfg := CurrentConfig()
+	other.configure(cfg)
+	if !other.verify(client, cookie, now) {
+		t.Fatalf("cookie rejected by a server sharing the secret")
+	}
+	cfg.CookieSecret = ""
+	other.configure(cfg)
+	if other.verify(client, cookie, now) {
+		t.Fatalf("cookie accepted by a server with another secret")
+	}
+}
+
+// cookieServer answers www.example.com. A, first with a BADCOOKIE error if
+// badCookieFirst, and echoes client cookies until forge or silent is set.
+type cookieServer struct {
+	badCookieFirst, forge, silent atomic.Bool
+	queries                       atomic.Int32
+}
+
+func (s *cookieServer) handle(query dnsmessage.Message) dnsmessage.Message {
+	n := s.queries.Add(1)
+	cookie := cookieOption(findOPT(query.Additionals))
+	reply := dnsmessage.Message{
+		Header:  dnsmessage.Header{Authoritative: true},
+		Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+	}
+	if s.silent.Load() || len(cookie) < clientCookieLen {
+		return reply
+	}
+	serverCookie := []byte("server-cookie-01")
+	data := append(append([]byte(nil), cookie[:clientCookieLen]...), serverCookie...)
+	if s.forge.Load() {
+		data[0] ^= 0xff
+	}
+	opt := upstreamOPT(false)
+	if s.badCookieFirst.Load() && n == 1 {
+		opt.Header.SetEDNS0(ednsUpstreamSize, rcodeBadCookie, false)
+		reply.Header.RCode = rcodeBadCookie & 0xf
+		reply.Answers = nil
+	} else if s.badCookieFirst.Load() && !bytes.HasSuffix(cookie, serverCookie) {
+		reply.Header.RCode = dnsmessage.RCodeServerFailure
+	}
+	opt.Body = &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: ednsOptionCookie, Data: data}}}
+	reply.Additionals = []dnsmessage.Resource{opt}
+	return reply
+}
+
+func TestUpstreamCookies(t *testing.T) {
+	server := &cookieServer{}
+	startTestServers(t, map[string]testHandler{"127.0.0.1": server.handle})
+	useTestConfig(t, func(cfg *Config) { cfg.QueryTimeout = Duration(200 * time.Millisecond) })
+	servers := []net.IP{net.ParseIP("127.0.0.1")}
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+
+	// a server that never sent a cookie may answer without one
+	server.silent.Store(true)
+	if _, _, err := outgoingDnsQuery(servers, question, nil); err != nil {
+		t.Fatalf("query without cookies: %s", err)
+	}
+	server.silent.Store(false)
+	if _, _, err := outgoingDnsQuery(servers, question, nil); err != nil {
+		t.Fatalf("query with cookies: %s", err)
+	}
+	if CookieResults().UpstreamServers != 1 {
+		t.Fatalf("server cookie not remembered: %+v", CookieResults())
+	}
+
+	// from now on replies need our cookie
+	before := ResponseValidationStats().CookieMismatch
+	server.forge.Store(true)
+	if _, _, err := outgoingDnsQuery(servers, question, nil); err == nil {
+		t.Fatalf("reply with a forged cookie accepted")
+	}
+	server.forge.Store(false)
+	server.silent.Store(true)
+	if _, _, err := outgoingDnsQuery(servers, question, nil); err == nil {
+		t.Fatalf("reply without a cookie accepted")
+	}
+	if got := ResponseValidationStats().CookieMismatch - before; got != 2 {
+		t.Fatalf("counted %d cookie mismatches, want 2", got)
+	}
+}
+
+func TestUpstreamBadCookieRetried(t *testing.T) {
+	server := &cookieServer{}
+	server.badCookieFirst.Store(true)
+	startTestServers(t, map[string]testHandler{"127.0.0.1": server.handle})
+	useTestConfig(t, func(cfg *Config) {})
+
+	_, header, err := outgoingDnsQuery([]net.IP{net.ParseIP("127.0.0.1")}, testQuestion("www.example.com.", dnsmessage.TypeA), nil)
+	if err != nil {
+		t.Fatalf("outgoingDnsQuery: %s", err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess || server.queries.Load() != 2 {
+		t.Fatalf("got %s after %d queries", header.RCode, server.queries.Load())
+	}
+}
@@ -0,0 +1,591 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSSEC (RFC 4033-4035) records are not known to dnsmessage, so they come
+// out of the parser as UnknownResource with their RDATA untouched. The names
+// inside them are never compressed (RFC 4034 section 6.2), which lets us
+// read them straight from those bytes.
+
+// DNSSEC record types.
+const (
+	typeDS         dnsmessage.Type = 43
+	typeRRSIG      dnsmessage.Type = 46
+	typeNSEC       dnsmessage.Type = 47
+	typeDNSKEY     dnsmessage.Type = 48
+	typeNSEC3      dnsmessage.Type = 50
+	typeNSEC3PARAM dnsmessage.Type = 51
+)
+
+// DNSKEY flags (RFC 4034 section 2.1.1, RFC 5011 section 3).
+const (
+	dnskeyZone   = 0x0100
+	dnskeyRevoke = 0x0080
+	dnskeySEP    = 0x0001
+)
+
+// DNSSEC algorithm numbers we can verify.
+const (
+	algRSASHA256       = 8
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS digest types.
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+var (
+	errNoSignature    = errors.New("no usable RRSIG")
+	errBadSignature   = errors.New("RRSIG does not verify")
+	errSignatureTime  = errors.New("RRSIG is outside its validity period")
+	errShortRData     = errors.New("RDATA too short")
+	errCompressedName = errors.New("compressed name in DNSSEC RDATA")
+)
+
+type dnskey struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func parseDNSKEY(data []byte) (dnskey, error) {
+	if len(data) < 4 {
+		return dnskey{}, errShortRData
+	}
+	return dnskey{
+		Flags:     binary.BigEndian.Uint16(data),
+		Protocol:  data[2],
+		Algorithm: data[3],
+		PublicKey: data[4:],
+	}, nil
+}
+
+func (k dnskey) rdata() []byte {
+	data := make([]byte, 4, 4+len(k.PublicKey))
+	binary.BigEndian.PutUint16(data, k.Flags)
+	data[2], data[3] = k.Protocol, k.Algorithm
+	return append(data, k.PublicKey...)
+}
+
+// keyTag is the checksum of RFC 4034 appendix B that RRSIG and DS records
+// use to point at a key.
+func (k dnskey) keyTag() uint16 {
+	var sum uint32
+	for i, b := range k.rdata() {
+		if i&1 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16
+	return uint16(sum)
+}
+
+// usable reports whether the key may sign zone data: a DNSSEC zone key that
+// has not been revoked.
+func (k dnskey) usable() bool {
+	return k.Protocol == 3 && k.Flags&dnskeyZone != 0 && k.Flags&dnskeyRevoke == 0
+}
+
+type ds struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func parseDS(data []byte) (ds, error) {
+	if len(data) < 4 {
+		return ds{}, errShortRData
+	}
+	return ds{
+		KeyTag:     binary.BigEndian.Uint16(data),
+		Algorithm:  data[2],
+		DigestType: data[3],
+		Digest:     data[4:],
+	}, nil
+}
+
+func (d ds) rdata() []byte {
+	data := make([]byte, 4, 4+len(d.Digest))
+	binary.BigEndian.PutUint16(data, d.KeyTag)
+	data[2], data[3] = d.Algorithm, d.DigestType
+	return append(data, d.Digest...)
+}
+
+// supported reports whether we could check a key against this DS at all.
+func (d ds) supported() bool {
+	return supportedAlgorithm(d.Algorithm) && dsDigest(d.DigestType, "", dnskey{}) != nil
+}
+
+// matches reports whether key, owned by owner, is the key d refers to.
+func (d ds) matches(owner string, key dnskey) bool {
+	if d.KeyTag != key.keyTag() || d.Algorithm != key.Algorithm {
+		return false
+	}
+	digest := dsDigest(d.DigestType, owner, key)
+	return digest != nil && bytes.Equal(digest, d.Digest)
+}
+
+// dsDigest computes the DS digest of key (RFC 4034 section 5.1.4), nil for
+// digest types we don't implement.
+func dsDigest(digestType uint8, owner string, key dnskey) []byte {
+	data := append(nameWire(owner), key.rdata()...)
+	switch digestType {
+	case digestSHA1:
+		sum := sha1.Sum(data)
+		return sum[:]
+	case digestSHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case digestSHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	}
+	return nil
+}
+
+type rrsig struct {
+	TypeCovered dnsmessage.Type
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+
+	// signed is the RDATA up to the signature with the signer name in
+	// canonical form, the first part of the data the signature covers.
+	signed []byte
+}
+
+func parseRRSIG(data []byte) (rrsig, error) {
+	if len(data) < 18 {
+		return rrsig{}, errShortRData
+	}
+	signer, off, err := readName(data, 18)
+	if err != nil {
+		return rrsig{}, err
+	}
+	return rrsig{
+		TypeCovered: dnsmessage.Type(binary.BigEndian.Uint16(data)),
+		Algorithm:   data[2],
+		Labels:      data[3],
+		OriginalTTL: binary.BigEndian.Uint32(data[4:]),
+		Expiration:  binary.BigEndian.Uint32(data[8:]),
+		Inception:   binary.BigEndian.Uint32(data[12:]),
+		KeyTag:      binary.BigEndian.Uint16(data[16:]),
+		SignerName:  signer,
+		Signature:   data[off:],
+		signed:      append(append([]byte(nil), data[:18]...), nameWire(signer)...),
+	}, nil
+}
+
+// validAt compares in serial number arithmetic (RFC 1982) as RFC 4034
+// section 3.1.5 asks, so signatures keep working across 2106.
+func (s rrsig) validAt(now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-s.Inception) >= 0 && int32(s.Expiration-t) >= 0
+}
+
+type nsec struct {
+	NextDomain string
+	Types      typeBitmap
+}
+
+func parseNSEC(data []byte) (nsec, error) {
+	next, off, err := readName(data, 0)
+	if err != nil {
+		return nsec{}, err
+	}
+	return nsec{NextDomain: next, Types: typeBitmap(data[off:])}, nil
+}
+
+// NSEC3 flags
+const nsec3OptOut = 0x01
+
+type nsec3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         typeBitmap
+}
+
+func parseNSEC3(data []byte) (nsec3, error) {
+	if len(data) < 5 {
+		return nsec3{}, errShortRData
+	}
+	saltEnd := 5 + int(data[4])
+	if len(data) < saltEnd+1 {
+		return nsec3{}, errShortRData
+	}
+	hashEnd := saltEnd + 1 + int(data[saltEnd])
+	if len(data) < hashEnd {
+		return nsec3{}, errShortRData
+	}
+	return nsec3{
+		HashAlgorithm: data[0],
+		Flags:         data[1],
+		Iterations:    binary.BigEndian.Uint16(data[2:]),
+		Salt:          data[5:saltEnd],
+		NextHashed:    data[saltEnd+1 : hashEnd],
+		Types:         typeBitmap(data[hashEnd:]),
+	}, nil
+}
+
+// typeBitmap is the windowed type bit map of NSEC and NSEC3 records
+// (RFC 4034 section 4.1.2).
+type typeBitmap []byte
+
+func (b typeBitmap) has(t dnsmessage.Type) bool {
+	window, bit := byte(t>>8), int(t&0xff)
+	for len(b) >= 2 {
+		w, n := b[0], int(b[1])
+		if len(b) < 2+n {
+			return false
+		}
+		if w == window {
+			return bit/8 < n && b[2+bit/8]&(0x80>>(bit%8)) != 0
+		}
+		b = b[2+n:]
+	}
+	return false
+}
+
+func (b typeBitmap) types() []dnsmessage.Type {
+	var types []dnsmessage.Type
+	for len(b) >= 2 {
+		w, n := int(b[0]), int(b[1])
+		if len(b) < 2+n {
+			break
+		}
+		for i := 0; i < n*8; i++ {
+			if b[2+i/8]&(0x80>>(i%8)) != 0 {
+				types = append(types, dnsmessage.Type(w<<8|i))
+			}
+		}
+		b = b[2+n:]
+	}
+	return types
+}
+
+// readName reads an uncompressed wire format name starting at off.
+func readName(data []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(data) {
+			return "", 0, errShortRData
+		}
+		n := int(data[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n&0xc0 != 0 {
+			return "", 0, errCompressedName
+		}
+		if off+n > len(data) {
+			return "", 0, errShortRData
+		}
+		labels = append(labels, string(data[off:off+n]))
+		off += n
+	}
+	return strings.Join(labels, ".") + ".", off, nil
+}
+
+// nameWire returns name in canonical wire format: lower case and
+// uncompressed (RFC 4034 section 6.2).
+func nameWire(name string) []byte {
+	name = strings.TrimSuffix(canonicalName(name), ".")
+	if name == "" {
+		return []byte{0}
+	}
+	var wire []byte
+	for _, label := range strings.Split(name, ".") {
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	return append(wire, 0)
+}
+
+// canonicalRData encodes body the way RFC 4034 section 6.2 wants it signed:
+// embedded names of the RFC 1035 types in lower case and nothing compressed.
+func canonicalRData(body dnsmessage.ResourceBody) ([]byte, error) {
+	var data []byte
+	u16 := func(v uint16) { data = binary.BigEndian.AppendUint16(data, v) }
+	u32 := func(v uint32) { data = binary.BigEndian.AppendUint32(data, v) }
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		data = append(data, b.A[:]...)
+	case *dnsmessage.AAAAResource:
+		data = append(data, b.AAAA[:]...)
+	case *dnsmessage.NSResource:
+		data = nameWire(b.NS.String())
+	case *dnsmessage.CNAMEResource:
+		data = nameWire(b.CNAME.String())
+	case *dnsmessage.PTRResource:
+		data = nameWire(b.PTR.String())
+	case *dnsmessage.MXResource:
+		u16(b.Pref)
+		data = append(data, nameWire(b.MX.String())...)
+	case *dnsmessage.SRVResource:
+		u16(b.Priority)
+		u16(b.Weight)
+		u16(b.Port)
+		data = append(data, nameWire(b.Target.String())...)
+	case *dnsmessage.SOAResource:
+		data = append(nameWire(b.NS.String()), nameWire(b.MBox.String())...)
+		u32(b.Serial)
+		u32(b.Refresh)
+		u32(b.Retry)
+		u32(b.Expire)
+		u32(b.MinTTL)
+	case *dnsmessage.TXTResource:
+		for _, txt := range b.TXT {
+			data = append(data, byte(len(txt)))
+			data = append(data, txt...)
+		}
+	case *dnsmessage.UnknownResource:
+		data = append(data, b.Data...)
+	default:
+		return nil, fmt.Errorf("cannot put %T in canonical form", body)
+	}
+	return data, nil
+}
+
+// signedData builds what sig signs over rrs: the RRSIG RDATA without the
+// signature followed by the RRset in canonical form and order (RFC 4034
+// section 3.1.8.1).
+func signedData(sig rrsig, rrs []dnsmessage.Resource) ([]byte, error) {
+	owner := canonicalName(rrs[0].Header.Name.String())
+	if labels := countLabels(owner); int(sig.Labels) < labels {
+		// expanded from a wildcard: signed as the wildcard owner
+		owner = "*." + lastLabels(owner, int(sig.Labels))
+		if sig.Labels == 0 {
+			owner = "*."
+		}
+	}
+	prefix := nameWire(owner)
+	prefix = binary.BigEndian.AppendUint16(prefix, uint16(rrs[0].Header.Type))
+	prefix = binary.BigEndian.AppendUint16(prefix, uint16(rrs[0].Header.Class))
+	prefix = binary.BigEndian.AppendUint32(prefix, sig.OriginalTTL)
+
+	rdatas := make([][]byte, 0, len(rrs))
+	for _, rr := range rrs {
+		rdata, err := canonicalRData(rr.Body)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	data := append([]byte(nil), sig.signed...)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue // duplicates are signed once
+		}
+		data = append(data, prefix...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case algRSASHA256, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+		return true
+	}
+	return false
+}
+
+// verify checks signature over data with key.
+func (k dnskey) verify(data, signature []byte) error {
+	switch k.Algorithm {
+	case algRSASHA256:
+		pub, err := rsaPublicKey(k.PublicKey)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(data)
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return errBadSignature
+		}
+		return nil
+	case algECDSAP256SHA256:
+		digest := sha256.Sum256(data)
+		return verifyECDSA(elliptic.P256(), k.PublicKey, digest[:], signature)
+	case algECDSAP384SHA384:
+		digest := sha512.Sum384(data)
+		return verifyECDSA(elliptic.P384(), k.PublicKey, digest[:], signature)
+	case algED25519:
+		if len(k.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(k.PublicKey, data, signature) {
+			return errBadSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported DNSSEC algorithm %d", k.Algorithm)
+}
+
+// rsaPublicKey decodes the RFC 3110 key format: exponent length, exponent,
+// modulus.
+func rsaPublicKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 3 {
+		return nil, errShortRData
+	}
+	explen, off := int(key[0]), 1
+	if explen == 0 {
+		explen, off = int(binary.BigEndian.Uint16(key[1:])), 3
+	}
+	if explen > 4 || len(key) <= off+explen {
+		return nil, errors.New("unsupported RSA public key")
+	}
+	e := 0
+	for _, b := range key[off : off+explen] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[off+explen:]), E: e}, nil
+}
+
+// verifyECDSA checks an RFC 6605 signature: the key is X|Y and the
+// signature r|s, each as long as the curve size.
+func verifyECDSA(curve elliptic.Curve, key, digest, signature []byte) error {
+	size := (curve.Params().BitSize + 7) / 8
+	if len(key) != 2*size || len(signature) != 2*size {
+		return errBadSignature
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(key[:size]),
+		Y:     new(big.Int).SetBytes(key[size:]),
+	}
+	r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+	if !ecdsa.Verify(pub, digest, r, s) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// rrset is one RRset from a message section with the RRSIGs covering it.
+type rrset struct {
+	name    string
+	rrtype  dnsmessage.Type
+	records []dnsmessage.Resource
+	sigs    []rrsig
+}
+
+// rrsetsOf splits a message section into RRsets and hands each the RRSIGs
+// from the same section that cover it.
+func rrsetsOf(rrs []dnsmessage.Resource) []*rrset {
+	var sets []*rrset
+	find := func(name string, t dnsmessage.Type) *rrset {
+		for _, set := range sets {
+			if set.name == name && set.rrtype == t {
+				return set
+			}
+		}
+		return nil
+	}
+	for _, rr := range rrs {
+		if rr.Header.Type == typeRRSIG || rr.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		name := canonicalName(rr.Header.Name.String())
+		set := find(name, rr.Header.Type)
+		if set == nil {
+			set = &rrset{name: name, rrtype: rr.Header.Type}
+			sets = append(sets, set)
+		}
+		set.records = append(set.records, rr)
+	}
+	for _, rr := range rrs {
+		body, ok := rr.Body.(*dnsmessage.UnknownResource)
+		if rr.Header.Type != typeRRSIG || !ok {
+			continue
+		}
+		sig, err := parseRRSIG(body.Data)
+		if err != nil {
+			continue
+		}
+		if set := find(canonicalName(rr.Header.Name.String()), sig.TypeCovered); set != nil {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+// verify checks that at least one RRSIG made by zone with one of keys
+// covers the set. The signature that did it is returned.
+func (set *rrset) verify(zone string, keys []dnskey, now time.Time) (rrsig, error) {
+	err := errNoSignature
+	for _, sig := range set.sigs {
+		if !strings.EqualFold(canonicalName(sig.SignerName), canonicalName(zone)) ||
+			!isSubdomain(set.name, zone) || int(sig.Labels) > countLabels(strings.TrimPrefix(set.name, "*.")) {
+			continue
+		}
+		if !sig.validAt(now) {
+			err = errSignatureTime
+			continue
+		}
+		data, dataErr := signedData(sig, set.records)
+		if dataErr != nil {
+			err = dataErr
+			continue
+		}
+		for _, key := range keys {
+			if key.Algorithm != sig.Algorithm || key.keyTag() != sig.KeyTag || !key.usable() {
+				continue
+			}
+			if err = key.verify(data, sig.Signature); err == nil {
+				return sig, nil
+			}
+		}
+	}
+	return rrsig{}, fmt.Errorf("%s %s: %w", set.name, rfc.RecordType(set.rrtype), err)
+}
+
+// expanded reports whether sig was made for a wildcard that the set's
+// owner name was synthesised from.
+func (set *rrset) expanded(sig rrsig) bool {
+	return int(sig.Labels) < countLabels(set.name)
+}
+
+// unknownData returns the raw RDATA of a record dnsmessage did not parse.
+func unknownData(rr dnsmessage.Resource) []byte {
+	if body, ok := rr.Body.(*dnsmessage.UnknownResource); ok {
+		return body.Data
+	}
+	return nil
+}
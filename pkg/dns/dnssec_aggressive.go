@@ -0,0 +1,358 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Aggressive use of the DNSSEC-validated cache (RFC 8198): the NSEC and
+// NSEC3 records of a secure negative answer prove a whole range of names
+// absent, not just the one asked about. Keeping them lets us answer
+// NXDOMAIN for any name in the range, NODATA for types an NSEC does not
+// list, and expand wildcards we have seen, without asking the authoritative
+// servers, which is what a random subdomain flood would otherwise make us do
+// for every single query.
+
+// maxDenialSets bounds the number of validated RRsets kept for synthesis.
+const maxDenialSets = 10000
+
+type denialKey struct {
+	name   string
+	rrtype dnsmessage.Type
+}
+
+// denialSet is a validated RRset together with the RRSIGs it came with, so
+// synthesised answers can carry them to clients that validate themselves.
+type denialSet struct {
+	set     *rrset
+	rrs     []dnsmessage.Resource
+	expires time.Time
+}
+
+// denialZone holds what we know about one signed zone: its SOA for the
+// negative TTL, its NSEC or NSEC3 records and the wildcards seen expanded.
+type denialZone struct {
+	soa  *denialSet
+	sets map[denialKey]*denialSet
+}
+
+type denialCache struct {
+	mu    sync.Mutex
+	zones map[string]*denialZone
+	count int
+}
+
+var aggressiveNSEC = &denialCache{zones: make(map[string]*denialZone)}
+
+func (c *denialCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zones, c.count = make(map[string]*denialZone), 0
+}
+
+// signaturesOf picks the RRSIGs covering set out of a message section.
+func signaturesOf(section []dnsmessage.Resource, set *rrset) []dnsmessage.Resource {
+	var sigs []dnsmessage.Resource
+	for _, rr := range section {
+		if rr.Header.Type != typeRRSIG || canonicalName(rr.Header.Name.String()) != set.name {
+			continue
+		}
+		if sig, err := parseRRSIG(unknownData(rr)); err == nil && sig.TypeCovered == set.rrtype {
+			sigs = append(sigs, rr)
+		}
+	}
+	return sigs
+}
+
+// withSignatures returns the records of set followed by their RRSIGs from
+// section.
+func withSignatures(set *rrset, section []dnsmessage.Resource) []dnsmessage.Resource {
+	return append(append([]dnsmessage.Resource(nil), set.records...), signaturesOf(section, set)...)
+}
+
+func minTTL(rrs []dnsmessage.Resource) uint32 {
+	ttl := ^uint32(0)
+	for _, rr := range rrs {
+		ttl = min(ttl, rr.Header.TTL)
+	}
+	return ttl
+}
+
+// zone returns the entry for zone, creating it. Called with c.mu held.
+func (c *denialCache) zone(zone string) *denialZone {
+	z, ok := c.zones[zone]
+	if !ok {
+		z = &denialZone{sets: make(map[denialKey]*denialSet)}
+		c.zones[zone] = z
+	}
+	return z
+}
+
+// store adds a set, making room by dropping expired ones when full. Called
+// with c.mu held.
+func (c *denialCache) store(z *denialZone, key denialKey, entry *denialSet, now time.Time) {
+	if _, ok := z.sets[key]; !ok {
+		if c.count >= maxDenialSets {
+			c.expire(now)
+		}
+		if c.count >= maxDenialSets {
+			debugf("aggressive NSEC cache full, not keeping %s %s", key.name, rfc.RecordType(key.rrtype))
+			return
+		}
+		c.count++
+	}
+	z.sets[key] = entry
+}
+
+func (c *denialCache) expire(now time.Time) {
+	for name, z := range c.zones {
+		for key, entry := range z.sets {
+			if now.After(entry.expires) {
+				delete(z.sets, key)
+				c.count--
+			}
+		}
+		if len(z.sets) == 0 && (z.soa == nil || now.After(z.soa.expires)) {
+			delete(c.zones, name)
+		}
+	}
+}
+
+// learn keeps the SOA and the NSEC or NSEC3 RRsets among sets, which were
+// validated with the keys of zone. section is the authority section they
+// came from. Denial records live no longer than the SOA's negative TTL
+// (RFC 8198 section 5.4).
+func (c *denialCache) learn(zone string, sets []*rrset, section []dnsmessage.Resource, now time.Time) {
+	zone = canonicalName(zone)
+	if len(nsecRecords(sets)) == 0 && len(nsec3Records(sets)) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	z := c.zone(zone)
+	for _, set := range sets {
+		if set.rrtype != dnsmessage.TypeSOA || set.name != zone {
+			continue
+		}
+		ttl := minTTL(set.records)
+		if soa, ok := set.records[0].Body.(*dnsmessage.SOAResource); ok {
+			ttl = min(ttl, soa.MinTTL)
+		}
+		z.soa = &denialSet{set: set, rrs: withSignatures(set, section), expires: now.Add(time.Duration(ttl) * time.Second)}
+	}
+	for _, set := range sets {
+		if set.rrtype != typeNSEC && set.rrtype != typeNSEC3 {
+			continue
+		}
+		expires := now.Add(time.Duration(minTTL(set.records)) * time.Second)
+		if z.soa != nil && z.soa.expires.Before(expires) {
+			expires = z.soa.expires
+		}
+		entry := &denialSet{set: set, rrs: withSignatures(set, section), expires: expires}
+		c.store(z, denialKey{set.name, set.rrtype}, entry, now)
+	}
+}
+
+// learnWildcard keeps an answer set that sig shows was expanded from a
+// wildcard, under the wildcard's own name.
+func (c *denialCache) learnWildcard(zone string, set *rrset, sig rrsig, section []dnsmessage.Resource, now time.Time) {
+	owner := "*." + lastLabels(set.name, int(sig.Labels))
+	name, err := dnsmessage.NewName(owner)
+	if err != nil {
+		return
+	}
+	var rrs []dnsmessage.Resource
+	for _, rr := range withSignatures(set, section) {
+		rr.Header.Name = name
+		rrs = append(rrs, rr)
+	}
+	wildcard := &rrset{name: owner, rrtype: set.rrtype, records: rrs[:len(set.records)], sigs: set.sigs}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &denialSet{set: wildcard, rrs: rrs, expires: now.Add(time.Duration(minTTL(set.records)) * time.Second)}
+	c.store(c.zone(canonicalName(zone)), denialKey{owner, set.rrtype}, entry, now)
+}
+
+// live returns the unexpired entry for key.
+func (z *denialZone) live(key denialKey, now time.Time) *denialSet {
+	if entry, ok := z.sets[key]; ok && !now.After(entry.expires) {
+		return entry
+	}
+	return nil
+}
+
+func (z *denialZone) denialSets(now time.Time) []*rrset {
+	var sets []*rrset
+	for key, entry := range z.sets {
+		if (key.rrtype == typeNSEC || key.rrtype == typeNSEC3) && !now.After(entry.expires) {
+			sets = append(sets, entry.set)
+		}
+	}
+	return sets
+}
+
+// synthesize answers question from validated denial records if they settle
+// it, and returns nil otherwise.
+func (c *denialCache) synthesize(question dnsmessage.Question, now time.Time) *dnsmessage.Message {
+	qname := canonicalName(question.Name.String())
+	if trustAnchors.negativeFor(qname, now) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	zone := ""
+	for name := range c.zones {
+		if isSubdomain(qname, name) && countLabels(name) >= countLabels(zone) {
+			zone = name
+		}
+	}
+	z := c.zones[zone]
+	if z == nil {
+		return nil
+	}
+	sets := z.denialSets(now)
+	var s synthesis
+	if records := nsecRecords(sets); len(records) > 0 {
+		s = z.fromNSEC(records, qname, question.Type, now)
+	} else {
+		s = z.fromNSEC3(nsec3Records(sets), zone, qname, question.Type, now)
+	}
+	if len(s.proof) == 0 {
+		return nil
+	}
+	if s.wildcard == nil && (z.soa == nil || now.After(z.soa.expires)) {
+		// a negative answer needs the SOA for its TTL
+		return nil
+	}
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: s.rcode, AuthenticData: true}}
+	if s.wildcard != nil {
+		msg.Answers = countedDown(s.wildcard.rrs, s.wildcard.expires, now)
+		for i := range msg.Answers {
+			msg.Answers[i].Header.Name = question.Name
+		}
+	} else {
+		msg.Authorities = countedDown(z.soa.rrs, z.soa.expires, now)
+	}
+	for _, proof := range s.proof {
+		msg.Authorities = append(msg.Authorities, countedDown(proof.rrs, proof.expires, now)...)
+	}
+	dnssecCounters.synthesized.Add(1)
+	return msg
+}
+
+// synthesis is the outcome of looking a name up in the denial records: the
+// records proving the answer, none if they don't settle the question, and
+// the wildcard set it expands, if any.
+type synthesis struct {
+	rcode    dnsmessage.RCode
+	proof    []*denialSet
+	wildcard *denialSet
+}
+
+func (z *denialZone) fromNSEC(records []nsecRecord, qname string, qtype dnsmessage.Type, now time.Time) synthesis {
+	set := func(owner string) *denialSet { return z.live(denialKey{owner, typeNSEC}, now) }
+	for _, r := range records {
+		if r.owner == qname {
+			if nsecNoData(records, qname, qtype) != nil {
+				return synthesis{}
+			}
+			return synthesis{rcode: dnsmessage.RCodeSuccess, proof: proofSets(set(r.owner))}
+		}
+	}
+	cover, ok := nsecCovering(records, qname)
+	if !ok {
+		return synthesis{}
+	}
+	wildcard := "*." + cover.closestEncloser(qname)
+	if entry := z.live(denialKey{wildcard, qtype}, now); entry != nil {
+		return synthesis{rcode: dnsmessage.RCodeSuccess, proof: proofSets(set(cover.owner)), wildcard: entry}
+	}
+	for _, r := range records {
+		if r.owner == wildcard {
+			if nsecNoData(records, qname, qtype) != nil {
+				// the wildcard has the type, but we haven't kept its data
+				return synthesis{}
+			}
+			return synthesis{rcode: dnsmessage.RCodeSuccess, proof: proofSets(set(cover.owner), set(wildcard))}
+		}
+	}
+	wildcardCover, ok := nsecCovering(records, wildcard)
+	if !ok {
+		return synthesis{}
+	}
+	return synthesis{rcode: dnsmessage.RCodeNameError, proof: proofSets(set(cover.owner), set(wildcardCover.owner))}
+}
+
+// fromNSEC3 does the same for NSEC3 zones. Opt-out ranges may hide
+// unsigned delegations and are never used (RFC 8198 section 5.1).
+func (z *denialZone) fromNSEC3(records []nsec3Record, zone, qname string, qtype dnsmessage.Type, now time.Time) synthesis {
+	proof, insecure := newNSEC3Proof(records, zone)
+	if insecure || proof == nil {
+		return synthesis{}
+	}
+	set := func(r nsec3Record) *denialSet {
+		owner := strings.ToLower(base32Hex.EncodeToString(r.hash)) + "." + strings.TrimPrefix(zone, ".")
+		return z.live(denialKey{owner, typeNSEC3}, now)
+	}
+	if r, ok := proof.matching(qname); ok {
+		if insecure, err := proof.noData(qname, qtype); err != nil || insecure {
+			return synthesis{}
+		}
+		return synthesis{rcode: dnsmessage.RCodeSuccess, proof: proofSets(set(r))}
+	}
+	ce, cover, err := proof.closestEncloser(qname)
+	if err != nil || cover.Flags&nsec3OptOut != 0 {
+		return synthesis{}
+	}
+	encloser, _ := proof.matching(ce)
+	if ce != zone && encloser.Types.has(dnsmessage.TypeNS) && !encloser.Types.has(dnsmessage.TypeSOA) {
+		// the name is below a delegation to a zone we know nothing about
+		return synthesis{}
+	}
+	wildcard := "*." + ce
+	if entry := z.live(denialKey{wildcard, qtype}, now); entry != nil {
+		return synthesis{rcode: dnsmessage.RCodeSuccess, proof: proofSets(set(cover)), wildcard: entry}
+	}
+	if r, ok := proof.matching(wildcard); ok {
+		if r.Types.has(qtype) || r.Types.has(dnsmessage.TypeCNAME) {
+			return synthesis{}
+		}
+		return synthesis{rcode: dnsmessage.RCodeSuccess, proof: proofSets(set(encloser), set(cover), set(r))}
+	}
+	wildcardCover, ok := proof.covering(wildcard)
+	if !ok {
+		return synthesis{}
+	}
+	return synthesis{rcode: dnsmessage.RCodeNameError, proof: proofSets(set(encloser), set(cover), set(wildcardCover))}
+}
+
+// proofSets drops duplicates: one record often covers both the name and the
+// wildcard.
+func proofSets(sets ...*denialSet) []*denialSet {
+	var kept []*denialSet
+	for _, set := range sets {
+		duplicate := false
+		for _, k := range kept {
+			duplicate = duplicate || k == set
+		}
+		if set != nil && !duplicate {
+			kept = append(kept, set)
+		}
+	}
+	return kept
+}
+
+// countedDown copies rrs with their TTLs counted down to the entry's expiry.
+func countedDown(rrs []dnsmessage.Resource, expiry, now time.Time) []dnsmessage.Resource {
+	remaining := uint32(expiry.Sub(now) / time.Second)
+	copied := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		rr.Header.TTL = min(rr.Header.TTL, remaining)
+		copied[i] = rr
+	}
+	return copied
+}
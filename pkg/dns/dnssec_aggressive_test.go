@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// countQueries makes zone count the queries it answers.
+func countQueries(zone *testZone) *atomic.Int64 {
+	var n atomic.Int64
+	zone.tamper = func(*dnsmessage.Message) { n.Add(1) }
+	return &n
+}
+
+func mustResolve(t *testing.T, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+	response, err := resolve(testQuestion(name, qtype))
+	if err != nil {
+		t.Fatalf("resolve %s: %s", name, err)
+	}
+	return response
+}
+
+func TestAggressiveNSEC(t *testing.T) {
+	var com, example, exampleNet *atomic.Int64
+	useSignedHierarchy(t, func(h *signedHierarchy) {
+		com, example, exampleNet = countQueries(h.com), countQueries(h.example), countQueries(h.exampleNet)
+	})
+
+	tests := []struct {
+		learn     string
+		learnType dnsmessage.Type
+		name      string
+		qtype     dnsmessage.Type
+		rcode     dnsmessage.RCode
+		server    *atomic.Int64
+	}{
+		{"nope.com.", dnsmessage.TypeA, "random-label.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, com},                   // NSEC NXDOMAIN
+		{"www.example.com.", dnsmessage.TypeAAAA, "www.example.com.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, example},       // NSEC NODATA
+		{"foo.example.com.", dnsmessage.TypeTXT, "bar.example.com.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, example},       // wildcard
+		{"nope.example.net.", dnsmessage.TypeA, "nope.example.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeNameError, exampleNet}, // NSEC3 NXDOMAIN
+	}
+	for _, test := range tests {
+		if response := mustResolve(t, test.learn, test.learnType); !response.Header.AuthenticData {
+			t.Fatalf("%s: expected a secure answer to learn from", test.learn)
+		}
+		queries, synthesized := test.server.Load(), DNSSECResults().Synthesized
+
+		response := mustResolve(t, test.name, test.qtype)
+		if response.Header.RCode != test.rcode || !response.Header.AuthenticData {
+			t.Fatalf("%s %s: got %s AD=%v, want %s with AD", test.name, rfc.RecordType(test.qtype),
+				rcodeString(response.Header.RCode), response.Header.AuthenticData, rcodeString(test.rcode))
+		}
+		if test.server.Load() != queries || DNSSECResults().Synthesized != synthesized+1 {
+			t.Fatalf("%s %s: not synthesised from the validated denial records", test.name, rfc.RecordType(test.qtype))
+		}
+		if len(response.Authorities) == 0 {
+			t.Fatalf("%s %s: no proof in the authority section", test.name, rfc.RecordType(test.qtype))
+		}
+	}
+
+	response := mustResolve(t, "bar.example.com.", dnsmessage.TypeTXT)
+	if len(response.Answers) != 2 || response.Answers[0].Header.Name.String() != "bar.example.com." ||
+		response.Answers[0].Body.(*dnsmessage.TXTResource).TXT[0] != "wildcard" {
+		t.Fatalf("unexpected wildcard expansion %+v", response.Answers)
+	}
+
+	// names that do exist are still asked about
+	queries := example.Load()
+	if response := mustResolve(t, "www.example.com.", dnsmessage.TypeA); len(response.Answers) == 0 || example.Load() == queries {
+		t.Fatalf("www.example.com A was not resolved upstream")
+	}
+}
+
+func TestAggressiveNSECDisabled(t *testing.T) {
+	var com *atomic.Int64
+	useSignedHierarchy(t, func(h *signedHierarchy) { com = countQueries(h.com) })
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.DNSSEC = true
+		cfg.TrustAnchors = []string{signerFor(t, ".", algRSASHA256).anchor()}
+		cfg.AggressiveNSEC = false
+	})
+
+	mustResolve(t, "nope.com.", dnsmessage.TypeA)
+	queries := com.Load()
+	if response := mustResolve(t, "random-label.com.", dnsmessage.TypeA); response.Header.RCode != dnsmessage.RCodeNameError || com.Load() == queries {
+		t.Fatalf("expected NXDOMAIN from upstream with aggressive NSEC off")
+	}
+}
+
+func TestAggressiveNSECExpires(t *testing.T) {
+	useSignedHierarchy(t, nil)
+	mustResolve(t, "nope.com.", dnsmessage.TypeA)
+
+	question := testQuestion("random-label.com.", dnsmessage.TypeA)
+	if aggressiveNSEC.synthesize(question, time.Now()) == nil {
+		t.Fatalf("expected a synthesised NXDOMAIN")
+	}
+	// the test zones have a negative TTL of 300 seconds
+	if aggressiveNSEC.synthesize(question, time.Now().Add(301*time.Second)) != nil {
+		t.Fatalf("denial records used past the negative TTL")
+	}
+}
@@ -0,0 +1,370 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rootTrustAnchors are the DS records of the root zone KSKs published by
+// IANA (https://data.iana.org/root-anchors/): KSK-2017 and KSK-2024.
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// trustAnchor is what we trust a zone's keys by, without asking its parent:
+// DS records, DNSKEY records, or both.
+type trustAnchor struct {
+	zone string
+	ds   []ds
+	keys []dnskey
+}
+
+// trusts reports whether key, published by the anchored zone, is one of the
+// anchored keys or matches one of the anchored DS records.
+func (a trustAnchor) trusts(key dnskey) bool {
+	for _, d := range a.ds {
+		if d.matches(a.zone, key) {
+			return true
+		}
+	}
+	for _, k := range a.keys {
+		if k.Flags&^dnskeyRevoke == key.Flags&^dnskeyRevoke && k.Algorithm == key.Algorithm &&
+			string(k.PublicKey) == string(key.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustAnchors reads DS or DNSKEY records in master file format, one
+// per entry, e.g. ". IN DS 20326 8 2 E06D44B8...". TTL and class are
+// optional. Anchors for the same zone are merged.
+func parseTrustAnchors(entries []string) (map[string]trustAnchor, error) {
+	anchors := make(map[string]trustAnchor)
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		zone := canonicalName(fields[0])
+		fields = fields[1:]
+		if len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				fields = fields[1:] // TTL
+			}
+		}
+		if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+			fields = fields[1:]
+		}
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("trust anchor %q: too few fields", entry)
+		}
+		anchor := anchors[zone]
+		anchor.zone = zone
+		switch strings.ToUpper(fields[0]) {
+		case "DS":
+			d, err := parseDSText(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("trust anchor %q: %w", entry, err)
+			}
+			anchor.ds = append(anchor.ds, d)
+		case "DNSKEY":
+			k, err := parseDNSKEYText(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("trust anchor %q: %w", entry, err)
+			}
+			anchor.keys = append(anchor.keys, k)
+		default:
+			return nil, fmt.Errorf("trust anchor %q: type must be DS or DNSKEY", entry)
+		}
+		anchors[zone] = anchor
+	}
+	return anchors, nil
+}
+
+// parseDSText reads the RDATA fields of a DS record: key tag, algorithm,
+// digest type and the hex digest, which may be split over several fields.
+func parseDSText(fields []string) (ds, error) {
+	tag, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return ds{}, fmt.Errorf("key tag: %w", err)
+	}
+	alg, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return ds{}, fmt.Errorf("algorithm: %w", err)
+	}
+	digestType, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return ds{}, fmt.Errorf("digest type: %w", err)
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return ds{}, fmt.Errorf("digest: %w", err)
+	}
+	return ds{KeyTag: uint16(tag), Algorithm: uint8(alg), DigestType: uint8(digestType), Digest: digest}, nil
+}
+
+// parseDNSKEYText reads the RDATA fields of a DNSKEY record: flags,
+// protocol, algorithm and the base64 public key.
+func parseDNSKEYText(fields []string) (dnskey, error) {
+	flags, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return dnskey{}, fmt.Errorf("flags: %w", err)
+	}
+	protocol, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return dnskey{}, fmt.Errorf("protocol: %w", err)
+	}
+	alg, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return dnskey{}, fmt.Errorf("algorithm: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return dnskey{}, fmt.Errorf("public key: %w", err)
+	}
+	return dnskey{Flags: uint16(flags), Protocol: uint8(protocol), Algorithm: uint8(alg), PublicKey: key}, nil
+}
+
+// loadTrustAnchorFile reads trust anchors from path: either DS and DNSKEY
+// records in master file format, one per line, or the root-anchors.xml
+// file IANA publishes.
+func loadTrustAnchorFile(path string, now time.Time) (map[string]trustAnchor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("<")) {
+		return parseRootAnchorsXML(trimmed, now)
+	}
+	return parseTrustAnchors(strings.Split(string(data), "\n"))
+}
+
+// rootAnchorsXML is the layout of https://data.iana.org/root-anchors/root-anchors.xml.
+type rootAnchorsXML struct {
+	Zone       string `xml:"Zone"`
+	KeyDigests []struct {
+		ValidFrom  string `xml:"validFrom,attr"`
+		ValidUntil string `xml:"validUntil,attr"`
+		KeyTag     uint16 `xml:"KeyTag"`
+		Algorithm  uint8  `xml:"Algorithm"`
+		DigestType uint8  `xml:"DigestType"`
+		Digest     string `xml:"Digest"`
+	} `xml:"KeyDigest"`
+}
+
+// parseRootAnchorsXML keeps the key digests that are valid at now: past
+// their validFrom and, if they have one, before their validUntil.
+func parseRootAnchorsXML(data []byte, now time.Time) (map[string]trustAnchor, error) {
+	var doc rootAnchorsXML
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("root anchors XML: %w", err)
+	}
+	zone := canonicalName(doc.Zone)
+	anchor := trustAnchor{zone: zone}
+	for _, kd := range doc.KeyDigests {
+		from, err := time.Parse(time.RFC3339, kd.ValidFrom)
+		if err != nil {
+			return nil, fmt.Errorf("root anchors XML: key %d validFrom: %w", kd.KeyTag, err)
+		}
+		if now.Before(from) {
+			continue
+		}
+		if kd.ValidUntil != "" {
+			until, err := time.Parse(time.RFC3339, kd.ValidUntil)
+			if err != nil {
+				return nil, fmt.Errorf("root anchors XML: key %d validUntil: %w", kd.KeyTag, err)
+			}
+			if !now.Before(until) {
+				continue
+			}
+		}
+		digest, err := hex.DecodeString(strings.TrimSpace(kd.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("root anchors XML: key %d digest: %w", kd.KeyTag, err)
+		}
+		anchor.ds = append(anchor.ds, ds{KeyTag: kd.KeyTag, Algorithm: kd.Algorithm, DigestType: kd.DigestType, Digest: digest})
+	}
+	if len(anchor.ds) == 0 {
+		return nil, fmt.Errorf("root anchors XML: no key digest valid at %s", now.Format(time.RFC3339))
+	}
+	return map[string]trustAnchor{zone: anchor}, nil
+}
+
+// anchorStore holds the trust anchors in use: the configured ones, the keys
+// tracked through rollovers (RFC 5011) and the negative trust anchors
+// (RFC 7646) that switch validation off below a name.
+type anchorStore struct {
+	mu         sync.Mutex
+	configured map[string]trustAnchor
+	tracked    map[string][]*trackedKey
+	statePath  string // where tracked keys are kept, empty disables RFC 5011
+	refreshTTL map[string]uint32
+	negative   map[string]time.Time // name -> expiry, zero for none
+}
+
+var trustAnchors = &anchorStore{
+	tracked:    make(map[string][]*trackedKey),
+	refreshTTL: make(map[string]uint32),
+	negative:   make(map[string]time.Time),
+}
+
+// anchorConfig is what anchorStore.set installs, read from a config
+// before anything of it is applied.
+type anchorConfig struct {
+	configured map[string]trustAnchor
+	tracked    map[string][]*trackedKey
+	statePath  string
+	negative   map[string]time.Time
+}
+
+// loadAnchors reads the trust anchors cfg configures, from its files too.
+func loadAnchors(cfg Config, now time.Time) (anchorConfig, error) {
+	configured, err := parseTrustAnchors(cfg.TrustAnchors)
+	if err != nil {
+		return anchorConfig{}, err
+	}
+	if cfg.TrustAnchorFile != "" {
+		if configured, err = loadTrustAnchorFile(cfg.TrustAnchorFile, now); err != nil {
+			return anchorConfig{}, fmt.Errorf("trust anchor file: %w", err)
+		}
+	}
+	tracked := make(map[string][]*trackedKey)
+	if cfg.TrustAnchorStateFile != "" {
+		if tracked, err = loadAnchorState(cfg.TrustAnchorStateFile); err != nil {
+			return anchorConfig{}, fmt.Errorf("trust anchor state: %w", err)
+		}
+	}
+	negative := make(map[string]time.Time)
+	for _, name := range cfg.NegativeTrustAnchors {
+		negative[canonicalName(name)] = time.Time{}
+	}
+	return anchorConfig{configured, tracked, cfg.TrustAnchorStateFile, negative}, nil
+}
+
+// set installs the anchors loadAnchors read. Negative trust anchors added
+// at run time are replaced by the configured ones.
+func (s *anchorStore) set(a anchorConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configured, s.tracked, s.statePath, s.negative = a.configured, a.tracked, a.statePath, a.negative
+	s.refreshTTL = make(map[string]uint32)
+}
+
+// anchorFor returns the anchor for zone, if it has one. Once RFC 5011
+// tracking knows the zone's keys, those replace the configured anchor.
+func (s *anchorStore) anchorFor(zone string) (trustAnchor, bool) {
+	zone = canonicalName(zone)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keys := s.tracked[zone]; len(keys) > 0 {
+		anchor := trustAnchor{zone: zone}
+		for _, k := range keys {
+			if k.trusted() {
+				anchor.keys = append(anchor.keys, k.key)
+			}
+		}
+		return anchor, true
+	}
+	anchor, ok := s.configured[zone]
+	return anchor, ok
+}
+
+// zones lists the anchored zones.
+func (s *anchorStore) zones() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for zone := range s.configured {
+		seen[zone] = true
+	}
+	for zone := range s.tracked {
+		seen[zone] = true
+	}
+	zones := make([]string, 0, len(seen))
+	for zone := range seen {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// negativeFor reports whether name is at or below a negative trust anchor
+// that has not expired.
+func (s *anchorStore) negativeFor(name string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nta, expires := range s.negative {
+		if isSubdomain(name, nta) && (expires.IsZero() || now.Before(expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// NegativeTrustAnchor is a domain DNSSEC validation is switched off for.
+type NegativeTrustAnchor struct {
+	Name    string     `json:"name"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// NegativeTrustAnchors lists the negative trust anchors in force.
+func NegativeTrustAnchors() []NegativeTrustAnchor {
+	s := trustAnchors
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ntas := make([]NegativeTrustAnchor, 0, len(s.negative))
+	for name, expires := range s.negative {
+		if !expires.IsZero() && !now.Before(expires) {
+			continue
+		}
+		nta := NegativeTrustAnchor{Name: name}
+		if !expires.IsZero() {
+			nta.Expires = &expires
+		}
+		ntas = append(ntas, nta)
+	}
+	sort.Slice(ntas, func(i, j int) bool { return ntas[i].Name < ntas[j].Name })
+	return ntas
+}
+
+// AddNegativeTrustAnchor stops validating name and everything below it for
+// lifetime, or until removed when lifetime is zero. Cached answers for those
+// names are dropped so the change shows at once.
+func AddNegativeTrustAnchor(name string, lifetime time.Duration) {
+	var expires time.Time
+	if lifetime > 0 {
+		expires = time.Now().Add(lifetime)
+	}
+	trustAnchors.mu.Lock()
+	trustAnchors.negative[canonicalName(name)] = expires
+	trustAnchors.mu.Unlock()
+	resolverCache.Flush(name, true)
+	infof("negative trust anchor for %s added", canonicalName(name))
+}
+
+// RemoveNegativeTrustAnchor validates name again. It reports whether there
+// was such an anchor.
+func RemoveNegativeTrustAnchor(name string) bool {
+	trustAnchors.mu.Lock()
+	_, ok := trustAnchors.negative[canonicalName(name)]
+	delete(trustAnchors.negative, canonicalName(name))
+	trustAnchors.mu.Unlock()
+	if ok {
+		// insecure answers cached meanwhile must be validated again
+		resolverCache.Flush(name, true)
+		infof("negative trust anchor for %s removed", canonicalName(name))
+	}
+	return ok
+}
@@ -0,0 +1,252 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testRootAnchorsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<TrustAnchor id="E9724F53-1851-4F86-85E5-F1392102940B" source="http://data.iana.org/root-anchors/root-anchors.xml">
+<Zone>.</Zone>
+<KeyDigest id="Kjqmt7v" validFrom="2010-07-15T00:00:00+00:00" validUntil="2019-01-11T00:00:00+00:00">
+<KeyTag>19036</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>49AAC11D7B6F6446702E54A1607371607A1A41855200FD2CE1CDDE32F24E8FB5</Digest>
+</KeyDigest>
+<KeyDigest id="Klajeyz" validFrom="2017-02-02T00:00:00+00:00">
+<KeyTag>20326</KeyTag>
+<Algorithm>8</Algorithm>
+<DigestType>2</DigestType>
+<Digest>E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D</Digest>
+</KeyDigest>
+</TrustAnchor>`
+
+func TestParseRootAnchorsXML(t *testing.T) {
+	tests := []struct {
+		now  string
+		tags []uint16
+	}{
+		{"2015-01-01T00:00:00Z", []uint16{19036}},
+		{"2018-01-01T00:00:00Z", []uint16{19036, 20326}},
+		{"2026-01-01T00:00:00Z", []uint16{20326}},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		anchors, err := parseRootAnchorsXML([]byte(testRootAnchorsXML), now)
+		if err != nil {
+			t.Fatalf("%s: %s", test.now, err)
+		}
+		var tags []uint16
+		for _, d := range anchors["."].ds {
+			tags = append(tags, d.KeyTag)
+		}
+		if len(tags) != len(test.tags) || tags[0] != test.tags[0] || tags[len(tags)-1] != test.tags[len(test.tags)-1] {
+			t.Fatalf("%s: got key tags %v, want %v", test.now, tags, test.tags)
+		}
+	}
+	if _, err := parseRootAnchorsXML([]byte(testRootAnchorsXML), time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Fatalf("expected an error when no key digest is valid yet")
+	}
+}
+
+func TestLoadTrustAnchorFile(t *testing.T) {
+	dir := t.TempDir()
+	records := filepath.Join(dir, "anchors.txt")
+	if err := os.WriteFile(records, []byte("; root KSK-2017\n"+rootTrustAnchors[0]+"\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	xmlFile := filepath.Join(dir, "root-anchors.xml")
+	if err := os.WriteFile(xmlFile, []byte(testRootAnchorsXML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{records, xmlFile} {
+		anchors, err := loadTrustAnchorFile(path, time.Now())
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if len(anchors["."].ds) != 1 || anchors["."].ds[0].KeyTag != 20326 {
+			t.Fatalf("%s: unexpected anchors %+v", path, anchors)
+		}
+	}
+}
+
+func TestConfigureBadAnchorFileChangesNothing(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	cfg := CurrentConfig()
+	cfg.Forwarders = []Forwarder{{Address: "192.0.2.53"}}
+	cfg.AuthZones = nil
+	cfg.TrustAnchorFile = filepath.Join(t.TempDir(), "missing.xml")
+	if err := Configure(cfg); err == nil {
+		t.Fatalf("Configure accepted a missing trust anchor file")
+	}
+	if forwarders.enabled() || len(CurrentConfig().Forwarders) != 0 {
+		t.Fatalf("a config that failed to load left its forwarders running")
+	}
+}
+
+// dnskeySet is the root DNSKEY RRset holding the keys of signers, signed by
+// each of them.
+func dnskeySet(signers ...*testSigner) *rrset {
+	var records []dnsmessage.Resource
+	for _, s := range signers {
+		records = append(records, unknownRR(".", typeDNSKEY, 172800, s.key.rdata()))
+	}
+	all := records
+	for _, s := range signers {
+		all = append(all, s.rrsig(records))
+	}
+	return rrsetsOf(all)[0]
+}
+
+func trustedTags(s *anchorStore) map[uint16]bool {
+	anchor, _ := s.anchorFor(".")
+	tags := make(map[uint16]bool)
+	for _, key := range anchor.keys {
+		tags[key.keyTag()] = true
+	}
+	return tags
+}
+
+func TestRFC5011Rollover(t *testing.T) {
+	oldKey := signerFor(t, ".", algED25519)
+	// a second root key; the zone name of the signer only goes into its RRSIGs
+	newKey := *signerFor(t, "rollover.", algED25519)
+	newKey.zone = "."
+	revoked := *oldKey
+	revoked.key.Flags |= dnskeyRevoke
+
+	statePath := filepath.Join(t.TempDir(), "anchors.json")
+	s := &anchorStore{
+		configured: map[string]trustAnchor{".": {zone: ".", ds: []ds{oldKey.ds()}}},
+		tracked:    make(map[string][]*trackedKey),
+		statePath:  statePath,
+		refreshTTL: make(map[string]uint32),
+		negative:   make(map[string]time.Time),
+	}
+	// the test RRSIGs are only valid around the real time, where the
+	// revocation has to be checked
+	now := time.Now().Add(-32 * 24 * time.Hour)
+
+	s.observe(".", dnskeySet(oldKey), now)
+	if tags := trustedTags(s); len(tags) != 1 || !tags[oldKey.key.keyTag()] {
+		t.Fatalf("configured key not tracked as trusted: %v", tags)
+	}
+
+	s.observe(".", dnskeySet(oldKey, &newKey), now.Add(24*time.Hour))
+	if tags := trustedTags(s); tags[newKey.key.keyTag()] {
+		t.Fatalf("new key trusted before its hold-down")
+	}
+	s.observe(".", dnskeySet(oldKey, &newKey), now.Add(31*24*time.Hour))
+	if tags := trustedTags(s); len(tags) != 2 {
+		t.Fatalf("new key not trusted after its hold-down: %v", tags)
+	}
+
+	tracked, err := loadAnchorState(statePath)
+	if err != nil {
+		t.Fatalf("loadAnchorState: %s", err)
+	}
+	if len(tracked["."]) != 2 || tracked["."][1].State != keyValid || tracked["."][1].key.keyTag() != newKey.key.keyTag() {
+		t.Fatalf("state file does not hold both keys as valid: %+v", tracked["."])
+	}
+
+	s.observe(".", dnskeySet(&revoked, &newKey), now.Add(32*24*time.Hour))
+	if tags := trustedTags(s); len(tags) != 1 || !tags[newKey.key.keyTag()] {
+		t.Fatalf("revoked key still trusted: %v", tags)
+	}
+	s.observe(".", dnskeySet(&newKey), now.Add(63*24*time.Hour))
+	if len(s.tracked["."]) != 1 {
+		t.Fatalf("revoked key not removed after its hold-down: %+v", s.tracked["."])
+	}
+	if interval := s.refreshInterval(); interval != 24*time.Hour {
+		t.Fatalf("refresh interval %s, want half the DNSKEY TTL", interval)
+	}
+}
+
+func TestRFC5011ForgetsVanishedKey(t *testing.T) {
+	oldKey := signerFor(t, ".", algED25519)
+	newKey := *signerFor(t, "rollover.", algED25519)
+	newKey.zone = "."
+	s := &anchorStore{
+		configured: map[string]trustAnchor{".": {zone: ".", keys: []dnskey{oldKey.key}}},
+		tracked:    make(map[string][]*trackedKey),
+		statePath:  filepath.Join(t.TempDir(), "anchors.json"),
+		refreshTTL: make(map[string]uint32),
+	}
+	now := time.Now()
+	s.observe(".", dnskeySet(oldKey, &newKey), now)
+	s.observe(".", dnskeySet(oldKey), now.Add(time.Hour))
+	if len(s.tracked["."]) != 1 || s.tracked["."][0].State != keyValid {
+		t.Fatalf("pending key not forgotten: %+v", s.tracked["."])
+	}
+}
+
+func TestTrustAnchorStateFromValidation(t *testing.T) {
+	useSignedHierarchy(t, nil)
+	statePath := filepath.Join(t.TempDir(), "anchors.json")
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.DNSSEC = true
+		cfg.TrustAnchors = []string{signerFor(t, ".", algRSASHA256).anchor()}
+		cfg.TrustAnchorStateFile = statePath
+	})
+
+	if response := validatedQuery(t, "www.example.com.", dnsmessage.TypeA); !response.Header.AuthenticData {
+		t.Fatalf("expected a secure answer")
+	}
+	keys := TrustAnchorKeys()
+	if len(keys) != 1 || keys[0].Zone != "." || keys[0].State != keyValid {
+		t.Fatalf("unexpected tracked keys %+v", keys)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Fatalf("state file not written: %s", err)
+	}
+}
+
+func TestNegativeTrustAnchor(t *testing.T) {
+	useSignedHierarchy(t, func(h *signedHierarchy) {
+		h.example.tamper = func(msg *dnsmessage.Message) {
+			// replace rather than modify the body, which the zone shares
+			for i, rr := range msg.Answers {
+				if _, ok := rr.Body.(*dnsmessage.AResource); ok {
+					msg.Answers[i].Body = &dnsmessage.AResource{A: [4]byte{203, 0, 113, 66}}
+				}
+			}
+		}
+	})
+
+	AddNegativeTrustAnchor("example.com", time.Hour)
+	if ntas := NegativeTrustAnchors(); len(ntas) != 1 || ntas[0].Name != "example.com." || ntas[0].Expires == nil {
+		t.Fatalf("unexpected negative trust anchors %+v", ntas)
+	}
+	response := validatedQuery(t, "www.example.com.", dnsmessage.TypeA)
+	if response.Header.RCode != dnsmessage.RCodeSuccess || response.Header.AuthenticData || len(response.Answers) == 0 {
+		t.Fatalf("expected an unvalidated answer below the negative trust anchor, got %s AD=%v",
+			rcodeString(response.Header.RCode), response.Header.AuthenticData)
+	}
+	// names outside it are still validated
+	if response := validatedQuery(t, "www.example.net.", dnsmessage.TypeA); !response.Header.AuthenticData {
+		t.Fatalf("expected a secure answer outside the negative trust anchor")
+	}
+
+	if !RemoveNegativeTrustAnchor("example.com.") {
+		t.Fatalf("RemoveNegativeTrustAnchor found nothing to remove")
+	}
+	if response := validatedQuery(t, "www.example.com.", dnsmessage.TypeA); response.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("expected SERVFAIL once the negative trust anchor is gone, got %s", rcodeString(response.Header.RCode))
+	}
+}
+
+func TestNegativeTrustAnchorExpires(t *testing.T) {
+	s := &anchorStore{negative: map[string]time.Time{"example.com.": time.Now().Add(time.Minute)}}
+	if !s.negativeFor("www.example.com.", time.Now()) || s.negativeFor("example.net.", time.Now()) {
+		t.Fatalf("negative trust anchor does not cover the right names")
+	}
+	if s.negativeFor("www.example.com.", time.Now().Add(2*time.Minute)) {
+		t.Fatalf("negative trust anchor outlived its lifetime")
+	}
+}
@@ -0,0 +1,362 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Authenticated denial of existence: NSEC (RFC 4035 section 5.4) lists the
+// next name in the zone, so a gap between two names proves nothing lives
+// there. NSEC3 (RFC 5155) does the same over hashes of the names.
+
+var (
+	errNoDenial      = errors.New("no proof of non-existence")
+	errWildcardProof = errors.New("no proof that the wildcard does not exist")
+)
+
+// maxNSEC3Iterations is the point past which NSEC3 answers are treated as
+// insecure instead of hashing (RFC 9276 section 3.2).
+const maxNSEC3Iterations = 150
+
+// canonicalCompare orders names the way RFC 4034 section 6.1 does: label by
+// label from the right, case-insensitively, as raw bytes.
+func canonicalCompare(a, b string) int {
+	la := strings.Split(strings.TrimSuffix(canonicalName(a), "."), ".")
+	lb := strings.Split(strings.TrimSuffix(canonicalName(b), "."), ".")
+	if la[0] == "" {
+		la = nil
+	}
+	if lb[0] == "" {
+		lb = nil
+	}
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// commonAncestor returns the longest name both a and b sit below or at.
+func commonAncestor(a, b string) string {
+	a, b = canonicalName(a), canonicalName(b)
+	for n := min(countLabels(a), countLabels(b)); n > 0; n-- {
+		if lastLabels(a, n) == lastLabels(b, n) {
+			return lastLabels(a, n)
+		}
+	}
+	return "."
+}
+
+// parent strips the first label of name.
+func parent(name string) string {
+	if n := countLabels(name); n > 1 {
+		return lastLabels(canonicalName(name), n-1)
+	}
+	return "."
+}
+
+type nsecRecord struct {
+	owner string
+	nsec
+}
+
+func nsecRecords(sets []*rrset) []nsecRecord {
+	var records []nsecRecord
+	for _, set := range sets {
+		if set.rrtype != typeNSEC {
+			continue
+		}
+		for _, rr := range set.records {
+			if n, err := parseNSEC(unknownData(rr)); err == nil {
+				records = append(records, nsecRecord{owner: set.name, nsec: n})
+			}
+		}
+	}
+	return records
+}
+
+// covers reports whether name falls strictly between the NSEC owner and
+// its next name, the last NSEC of a zone wrapping round to the apex.
+func (r nsecRecord) covers(name string) bool {
+	if canonicalCompare(r.owner, r.NextDomain) >= 0 {
+		return canonicalCompare(r.owner, name) < 0 || canonicalCompare(name, r.NextDomain) < 0
+	}
+	return canonicalCompare(r.owner, name) < 0 && canonicalCompare(name, r.NextDomain) < 0
+}
+
+// delegation reports whether this is the parent side NSEC of a zone cut,
+// which says nothing about names below the cut (RFC 6840 section 4.1).
+func (r nsecRecord) delegation() bool {
+	return r.Types.has(dnsmessage.TypeNS) && !r.Types.has(dnsmessage.TypeSOA)
+}
+
+// nsecCovering returns the NSEC that proves name does not exist.
+func nsecCovering(records []nsecRecord, name string) (nsecRecord, bool) {
+	for _, r := range records {
+		if r.covers(name) && !(r.delegation() && isSubdomain(name, r.owner)) {
+			return r, true
+		}
+	}
+	return nsecRecord{}, false
+}
+
+// closestEncloser derives the closest existing ancestor of name from the
+// NSEC covering it.
+func (r nsecRecord) closestEncloser(name string) string {
+	ce := commonAncestor(name, r.owner)
+	if next := commonAncestor(name, r.NextDomain); countLabels(next) > countLabels(ce) {
+		ce = next
+	}
+	return ce
+}
+
+func nsecNameError(records []nsecRecord, qname string) error {
+	cover, ok := nsecCovering(records, qname)
+	if !ok {
+		return errNoDenial
+	}
+	if _, ok := nsecCovering(records, "*."+cover.closestEncloser(qname)); !ok {
+		return errWildcardProof
+	}
+	return nil
+}
+
+func nsecNoData(records []nsecRecord, qname string, qtype dnsmessage.Type) error {
+	for _, r := range records {
+		if strings.EqualFold(r.owner, canonicalName(qname)) {
+			if r.Types.has(qtype) || r.Types.has(dnsmessage.TypeCNAME) {
+				return errNoDenial
+			}
+			if qtype != typeDS && r.delegation() {
+				// the parent side of a cut knows nothing about the child's data
+				return errNoDenial
+			}
+			return nil
+		}
+	}
+	// a wildcard matched the name but lacks the type
+	cover, ok := nsecCovering(records, qname)
+	if !ok {
+		return errNoDenial
+	}
+	wildcard := "*." + cover.closestEncloser(qname)
+	for _, r := range records {
+		if strings.EqualFold(r.owner, wildcard) && !r.Types.has(qtype) && !r.Types.has(dnsmessage.TypeCNAME) {
+			return nil
+		}
+	}
+	return errNoDenial
+}
+
+type nsec3Record struct {
+	hash []byte // decoded first label of the owner
+	nsec3
+}
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func nsec3Records(sets []*rrset) []nsec3Record {
+	var records []nsec3Record
+	for _, set := range sets {
+		if set.rrtype != typeNSEC3 {
+			continue
+		}
+		label, _, _ := strings.Cut(set.name, ".")
+		hash, err := base32Hex.DecodeString(strings.ToUpper(label))
+		if err != nil {
+			continue
+		}
+		for _, rr := range set.records {
+			if n, err := parseNSEC3(unknownData(rr)); err == nil {
+				records = append(records, nsec3Record{hash: hash, nsec3: n})
+			}
+		}
+	}
+	return records
+}
+
+// nsec3Hash is the iterated, salted SHA-1 of RFC 5155 section 5.
+func nsec3Hash(name string, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write(nameWire(name))
+	h.Write(salt)
+	sum := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(salt)
+		sum = h.Sum(sum[:0])
+	}
+	return sum
+}
+
+func (r nsec3Record) matches(hash []byte) bool {
+	return bytes.Equal(r.hash, hash)
+}
+
+func (r nsec3Record) covers(hash []byte) bool {
+	if bytes.Compare(r.hash, r.NextHashed) >= 0 {
+		return bytes.Compare(r.hash, hash) < 0 || bytes.Compare(hash, r.NextHashed) < 0
+	}
+	return bytes.Compare(r.hash, hash) < 0 && bytes.Compare(hash, r.NextHashed) < 0
+}
+
+// nsec3Proof answers questions about names against one set of NSEC3
+// records, hashing each name once with the zone's parameters.
+type nsec3Proof struct {
+	records []nsec3Record
+	zone    string
+}
+
+// newNSEC3Proof returns nil with insecure set when the records use hashing
+// we will not do: an unknown algorithm or too many iterations.
+func newNSEC3Proof(records []nsec3Record, zone string) (proof *nsec3Proof, insecure bool) {
+	if len(records) == 0 {
+		return nil, false
+	}
+	first := records[0]
+	if first.HashAlgorithm != 1 || first.Iterations > maxNSEC3Iterations {
+		return nil, true
+	}
+	kept := records[:0:0]
+	for _, r := range records {
+		if r.HashAlgorithm == first.HashAlgorithm && r.Iterations == first.Iterations && bytes.Equal(r.Salt, first.Salt) {
+			kept = append(kept, r)
+		}
+	}
+	return &nsec3Proof{records: kept, zone: zone}, false
+}
+
+func (p *nsec3Proof) hash(name string) []byte {
+	return nsec3Hash(name, p.records[0].Iterations, p.records[0].Salt)
+}
+
+func (p *nsec3Proof) matching(name string) (nsec3Record, bool) {
+	hash := p.hash(name)
+	for _, r := range p.records {
+		if r.matches(hash) {
+			return r, true
+		}
+	}
+	return nsec3Record{}, false
+}
+
+func (p *nsec3Proof) covering(name string) (nsec3Record, bool) {
+	hash := p.hash(name)
+	for _, r := range p.records {
+		if r.covers(hash) {
+			return r, true
+		}
+	}
+	return nsec3Record{}, false
+}
+
+// closestEncloser runs the proof of RFC 5155 section 8.3: the closest
+// encloser of name exists, and the name one label below it, towards name,
+// does not. The record covering that next closer name is returned too.
+func (p *nsec3Proof) closestEncloser(name string) (ce string, cover nsec3Record, err error) {
+	name = canonicalName(name)
+	for candidate := name; isSubdomain(candidate, p.zone); candidate = parent(candidate) {
+		if _, ok := p.matching(candidate); ok {
+			if candidate == name {
+				return "", nsec3Record{}, errNoDenial
+			}
+			nextCloser := lastLabels(name, countLabels(candidate)+1)
+			if cover, ok := p.covering(nextCloser); ok {
+				return candidate, cover, nil
+			}
+			return "", nsec3Record{}, errNoDenial
+		}
+		if candidate == "." {
+			break
+		}
+	}
+	return "", nsec3Record{}, errNoDenial
+}
+
+// nameError proves qname does not exist. A covering record with the opt-out
+// flag leaves room for unsigned delegations, so the answer is only insecure.
+func (p *nsec3Proof) nameError(qname string) (insecure bool, err error) {
+	ce, cover, err := p.closestEncloser(qname)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := p.covering("*." + ce); !ok {
+		return false, errWildcardProof
+	}
+	return cover.Flags&nsec3OptOut != 0, nil
+}
+
+func (p *nsec3Proof) noData(qname string, qtype dnsmessage.Type) (insecure bool, err error) {
+	if r, ok := p.matching(qname); ok {
+		if r.Types.has(qtype) || r.Types.has(dnsmessage.TypeCNAME) {
+			return false, errNoDenial
+		}
+		return false, nil
+	}
+	ce, cover, err := p.closestEncloser(qname)
+	if err != nil {
+		return false, err
+	}
+	if qtype == typeDS && cover.Flags&nsec3OptOut != 0 {
+		// an opt-out span may hide an unsigned delegation (RFC 5155 section 8.6)
+		return true, nil
+	}
+	if r, ok := p.matching("*." + ce); ok && !r.Types.has(qtype) && !r.Types.has(dnsmessage.TypeCNAME) {
+		return false, nil
+	}
+	return false, errNoDenial
+}
+
+// denial checks the negative answer for qname/qtype in a validated
+// authority section.
+func denial(sets []*rrset, zone, qname string, qtype dnsmessage.Type, nameError bool) (insecure bool, err error) {
+	if records := nsecRecords(sets); len(records) > 0 {
+		if nameError {
+			return false, nsecNameError(records, qname)
+		}
+		return false, nsecNoData(records, qname, qtype)
+	}
+	proof, insecure := newNSEC3Proof(nsec3Records(sets), zone)
+	if insecure {
+		return true, nil
+	}
+	if proof == nil {
+		return false, errNoDenial
+	}
+	if nameError {
+		return proof.nameError(qname)
+	}
+	return proof.noData(qname, qtype)
+}
+
+// wildcardExpansion checks that an answer synthesised from a wildcard with
+// the given number of labels was legitimate: the name asked for must not
+// exist itself.
+func wildcardExpansion(sets []*rrset, zone, qname string, labels uint8) (insecure bool, err error) {
+	if records := nsecRecords(sets); len(records) > 0 {
+		if _, ok := nsecCovering(records, qname); !ok {
+			return false, errNoDenial
+		}
+		return false, nil
+	}
+	proof, insecure := newNSEC3Proof(nsec3Records(sets), zone)
+	if insecure {
+		return true, nil
+	}
+	if proof == nil {
+		return false, errNoDenial
+	}
+	nextCloser := lastLabels(canonicalName(qname), int(labels)+1)
+	cover, ok := proof.covering(nextCloser)
+	if !ok {
+		return false, errNoDenial
+	}
+	return cover.Flags&nsec3OptOut != 0, nil
+}
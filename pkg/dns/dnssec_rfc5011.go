@@ -0,0 +1,296 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RFC 5011 lets a zone roll its key signing keys without anybody editing
+// trust anchors by hand: a new KSK that keeps showing up in the DNSKEY RRset,
+// signed by a key we already trust, becomes trusted itself after a 30 day
+// hold-down, and a key published with the REVOKE bit and signed by itself
+// stops being trusted at once. What we learn is written to the state file so
+// it survives restarts.
+
+// Hold-down timers (RFC 5011 section 2.4.1 and 2.4.2).
+const (
+	addHoldDown    = 30 * 24 * time.Hour
+	removeHoldDown = 30 * 24 * time.Hour
+)
+
+// Key states (RFC 5011 section 4).
+const (
+	keyAddPend = "AddPend"
+	keyValid   = "Valid"
+	keyMissing = "Missing"
+	keyRevoked = "Revoked"
+)
+
+// trackedKey is one KSK of an anchored zone as RFC 5011 sees it.
+type trackedKey struct {
+	Key      string    `json:"key"`   // DNSKEY RDATA in master file format
+	State    string    `json:"state"` // AddPend, Valid, Missing or Revoked
+	HoldDown time.Time `json:"hold_down,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+
+	key dnskey
+}
+
+func newTrackedKey(key dnskey, state string, now time.Time) *trackedKey {
+	return &trackedKey{Key: dnskeyText(key), State: state, LastSeen: now, key: key}
+}
+
+func dnskeyText(key dnskey) string {
+	return fmt.Sprintf("%d %d %d %s", key.Flags, key.Protocol, key.Algorithm, base64.StdEncoding.EncodeToString(key.PublicKey))
+}
+
+// trusted reports whether the key may anchor validation: a key that went
+// missing stays trusted in case it comes back.
+func (k *trackedKey) trusted() bool {
+	return k.State == keyValid || k.State == keyMissing
+}
+
+// same reports whether key is this key, whatever its REVOKE bit says.
+func (k *trackedKey) same(key dnskey) bool {
+	return k.key.Algorithm == key.Algorithm && k.key.Flags&^dnskeyRevoke == key.Flags&^dnskeyRevoke &&
+		string(k.key.PublicKey) == string(key.PublicKey)
+}
+
+// selfSigned reports whether key signed set itself, which RFC 5011 requires
+// before a revocation is believed.
+func selfSigned(set *rrset, key dnskey, now time.Time) bool {
+	for _, sig := range set.sigs {
+		if sig.KeyTag != key.keyTag() || sig.Algorithm != key.Algorithm || !sig.validAt(now) {
+			continue
+		}
+		data, err := signedData(sig, set.records)
+		if err == nil && key.verify(data, sig.Signature) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// observe runs the RFC 5011 state machine over a DNSKEY RRset of an
+// anchored zone that has just been validated.
+func (s *anchorStore) observe(zone string, set *rrset, now time.Time) {
+	zone = canonicalName(zone)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statePath == "" {
+		return
+	}
+	var keys []dnskey
+	ttl := ^uint32(0)
+	for _, rr := range set.records {
+		if key, err := parseDNSKEY(unknownData(rr)); err == nil && key.Flags&dnskeySEP != 0 {
+			keys = append(keys, key)
+		}
+		ttl = min(ttl, rr.Header.TTL)
+	}
+	s.refreshTTL[zone] = ttl
+
+	tracked, changed := s.tracked[zone], false
+	if len(tracked) == 0 {
+		// first sight: the keys the configured anchor vouches for start out trusted
+		anchor := s.configured[zone]
+		for _, key := range keys {
+			if key.Flags&dnskeyRevoke == 0 && anchor.trusts(key) {
+				tracked = append(tracked, newTrackedKey(key, keyValid, now))
+			}
+		}
+		changed = true
+	}
+	seen := make(map[*trackedKey]bool)
+	for _, key := range keys {
+		var k *trackedKey
+		for _, t := range tracked {
+			if t.same(key) {
+				k = t
+			}
+		}
+		if key.Flags&dnskeyRevoke != 0 {
+			if k != nil && k.State != keyRevoked && selfSigned(set, key, now) {
+				warnf("key %d of trust anchor %s revoked", k.key.keyTag(), zone)
+				k.State, k.HoldDown, changed = keyRevoked, now.Add(removeHoldDown), true
+			}
+			if k != nil {
+				seen[k], k.LastSeen = true, now
+			}
+			continue
+		}
+		if k == nil {
+			k = newTrackedKey(key, keyAddPend, now)
+			k.HoldDown = now.Add(addHoldDown)
+			tracked, changed = append(tracked, k), true
+			infof("new key %d for trust anchor %s, trusted from %s", key.keyTag(), zone, k.HoldDown.Format(time.RFC3339))
+		}
+		seen[k], k.LastSeen = true, now
+		switch {
+		case k.State == keyAddPend && !now.Before(k.HoldDown):
+			infof("key %d of trust anchor %s is now trusted", key.keyTag(), zone)
+			k.State, k.HoldDown, changed = keyValid, time.Time{}, true
+		case k.State == keyMissing:
+			k.State, changed = keyValid, true
+		}
+	}
+	kept := tracked[:0]
+	for _, k := range tracked {
+		switch {
+		case seen[k]:
+		case k.State == keyValid:
+			k.State, changed = keyMissing, true
+		case k.State == keyAddPend:
+			// gone before its hold-down ran out: forget it
+			changed = true
+			continue
+		}
+		if k.State == keyRevoked && !now.Before(k.HoldDown) {
+			changed = true
+			continue
+		}
+		kept = append(kept, k)
+	}
+	s.tracked[zone] = kept
+	if changed {
+		if err := s.saveLocked(); err != nil {
+			errorf("saving trust anchor state to %s failed: %s", s.statePath, err)
+		}
+	}
+}
+
+type anchorStateFile struct {
+	Version int                      `json:"version"`
+	Zones   map[string][]*trackedKey `json:"zones"`
+}
+
+// loadAnchorState reads the tracked keys. A missing file just means nothing
+// has been tracked yet.
+func loadAnchorState(path string) (map[string][]*trackedKey, error) {
+	tracked := make(map[string][]*trackedKey)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tracked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state anchorStateFile
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", state.Version)
+	}
+	for zone, keys := range state.Zones {
+		for _, k := range keys {
+			if k.key, err = parseDNSKEYText(strings.Fields(k.Key)); err != nil {
+				return nil, fmt.Errorf("%s: %w", zone, err)
+			}
+		}
+		tracked[canonicalName(zone)] = keys
+	}
+	return tracked, nil
+}
+
+func (s *anchorStore) saveLocked() error {
+	data, err := json.MarshalIndent(anchorStateFile{Version: 1, Zones: s.tracked}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.statePath), filepath.Base(s.statePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.statePath)
+}
+
+// refreshInterval is how often anchored zones are queried actively (RFC
+// 5011 section 2.3): half the DNSKEY TTL, but no less than an hour and no
+// more than 15 days.
+func (s *anchorStore) refreshInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	interval := 15 * 24 * time.Hour
+	if len(s.refreshTTL) == 0 {
+		interval = time.Hour
+	}
+	for _, ttl := range s.refreshTTL {
+		interval = min(interval, time.Duration(ttl)*time.Second/2)
+	}
+	return max(interval, time.Hour)
+}
+
+// TrustAnchorKey is the admin view of a tracked key.
+type TrustAnchorKey struct {
+	Zone     string     `json:"zone"`
+	KeyTag   uint16     `json:"key_tag"`
+	State    string     `json:"state"`
+	HoldDown *time.Time `json:"hold_down,omitempty"`
+	LastSeen time.Time  `json:"last_seen"`
+}
+
+// TrustAnchorKeys lists the keys RFC 5011 tracking knows about.
+func TrustAnchorKeys() []TrustAnchorKey {
+	s := trustAnchors
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []TrustAnchorKey
+	for zone, tracked := range s.tracked {
+		for _, k := range tracked {
+			key := TrustAnchorKey{Zone: zone, KeyTag: k.key.keyTag(), State: k.State, LastSeen: k.LastSeen}
+			if !k.HoldDown.IsZero() {
+				holdDown := k.HoldDown
+				key.HoldDown = &holdDown
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// MaintainTrustAnchors queries the DNSKEY RRsets of all anchored zones at
+// the RFC 5011 refresh interval, so rollovers are noticed even when no
+// client asks about those zones. It returns when stop is closed.
+func MaintainTrustAnchors(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(trustAnchors.refreshInterval()):
+		}
+		refreshTrustAnchors()
+	}
+}
+
+func refreshTrustAnchors() {
+	for _, zone := range trustAnchors.zones() {
+		name, err := dnsmessage.NewName(zone)
+		if err != nil {
+			continue
+		}
+		// skip the key cache so the keys really are fetched again
+		dnssecKeys.drop(zone)
+		response, err := dnsQuery(getRootServers(), dnsmessage.Question{Name: name, Type: typeDNSKEY, Class: dnsmessage.ClassINET}, nil)
+		if err != nil {
+			warnf("trust anchor refresh for %s failed: %s", zone, err)
+		} else if response.Header.RCode != dnsmessage.RCodeSuccess {
+			warnf("trust anchor refresh for %s: %s", zone, rcodeString(response.Header.RCode))
+		}
+	}
+}
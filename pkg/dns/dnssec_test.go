@@ -0,0 +1,739 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCanonicalOrder(t *testing.T) {
+	// RFC 4034 section 6.1
+	ordered := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "*.z.example.",
+	}
+	for i := 0; i+1 < len(ordered); i++ {
+		if canonicalCompare(ordered[i], ordered[i+1]) >= 0 {
+			t.Fatalf("%s should sort before %s", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155 appendix A
+	salt, _ := hex.DecodeString("aabbccdd")
+	for name, want := range map[string]string{
+		"example.":   "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.": "35mthgpgcu1qg68fab165klnsnk3dpvl",
+	} {
+		if got := strings.ToLower(base32Hex.EncodeToString(nsec3Hash(name, 12, salt))); got != want {
+			t.Fatalf("hash of %s is %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	anchors, err := parseTrustAnchors(append(rootTrustAnchors, "example. 3600 IN DNSKEY 257 3 15 l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4="))
+	if err != nil {
+		t.Fatalf("parseTrustAnchors: %s", err)
+	}
+	if len(anchors["."].ds) != 2 || anchors["."].ds[0].KeyTag != 20326 || len(anchors["example."].keys) != 1 {
+		t.Fatalf("unexpected anchors %+v", anchors)
+	}
+	if _, err := parseTrustAnchors([]string{". IN A 192.0.2.1 x y"}); err == nil {
+		t.Fatalf("expected an error for a non DS/DNSKEY anchor")
+	}
+}
+
+// testSigner holds a zone's single signing key.
+type testSigner struct {
+	zone string
+	key  dnskey
+	sign func(data []byte) []byte
+}
+
+var (
+	testSignersMu sync.Mutex
+	testSigners   = map[string]*testSigner{}
+)
+
+// signerFor returns the key of zone, generating it once per test binary:
+// RSA keys take a while to make.
+func signerFor(t *testing.T, zone string, alg uint8) *testSigner {
+	t.Helper()
+	testSignersMu.Lock()
+	defer testSignersMu.Unlock()
+	key := fmt.Sprintf("%s/%d", zone, alg)
+	if s, ok := testSigners[key]; ok {
+		return s
+	}
+	s := &testSigner{zone: zone, key: dnskey{Flags: dnskeyZone | dnskeySEP, Protocol: 3, Algorithm: alg}}
+	switch alg {
+	case algRSASHA256:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey: %s", err)
+		}
+		s.key.PublicKey = append([]byte{3, 1, 0, 1}, priv.N.Bytes()...)
+		s.sign = func(data []byte) []byte {
+			digest := sha256.Sum256(data)
+			sig, _ := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+			return sig
+		}
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, hash := elliptic.P256(), func(b []byte) []byte { d := sha256.Sum256(b); return d[:] }
+		if alg == algECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), func(b []byte) []byte { d := sha512.Sum384(b); return d[:] }
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %s", err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		s.key.PublicKey = append(priv.X.FillBytes(make([]byte, size)), priv.Y.FillBytes(make([]byte, size))...)
+		s.sign = func(data []byte) []byte {
+			r, ss, _ := ecdsa.Sign(rand.Reader, priv, hash(data))
+			return append(r.FillBytes(make([]byte, size)), ss.FillBytes(make([]byte, size))...)
+		}
+	case algED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %s", err)
+		}
+		s.key.PublicKey = pub
+		s.sign = func(data []byte) []byte { return ed25519.Sign(priv, data) }
+	}
+	testSigners[key] = s
+	return s
+}
+
+func (s *testSigner) ds() ds {
+	return ds{KeyTag: s.key.keyTag(), Algorithm: s.key.Algorithm, DigestType: digestSHA256, Digest: dsDigest(digestSHA256, s.zone, s.key)}
+}
+
+// anchor is the signer's DS in trust anchor format.
+func (s *testSigner) anchor() string {
+	d := s.ds()
+	return fmt.Sprintf("%s IN DS %d %d %d %X", s.zone, d.KeyTag, d.Algorithm, d.DigestType, d.Digest)
+}
+
+// rrsig signs rrs, which share owner and type, valid from an hour ago to an
+// hour from now.
+func (s *testSigner) rrsig(rrs []dnsmessage.Resource) dnsmessage.Resource {
+	owner := rrs[0].Header.Name.String()
+	labels := countLabels(owner)
+	if strings.HasPrefix(owner, "*.") {
+		labels--
+	}
+	now := uint32(time.Now().Unix())
+	rdata := binary.BigEndian.AppendUint16(nil, uint16(rrs[0].Header.Type))
+	rdata = append(rdata, s.key.Algorithm, byte(labels))
+	rdata = binary.BigEndian.AppendUint32(rdata, rrs[0].Header.TTL)
+	rdata = binary.BigEndian.AppendUint32(rdata, now+3600)
+	rdata = binary.BigEndian.AppendUint32(rdata, now-3600)
+	rdata = binary.BigEndian.AppendUint16(rdata, s.key.keyTag())
+	rdata = append(rdata, nameWire(s.zone)...)
+	sig, err := parseRRSIG(rdata)
+	if err != nil {
+		panic(err)
+	}
+	data, err := signedData(sig, rrs)
+	if err != nil {
+		panic(err)
+	}
+	return unknownRR(owner, typeRRSIG, rrs[0].Header.TTL, append(rdata, s.sign(data)...))
+}
+
+func unknownRR(name string, t dnsmessage.Type, ttl uint32, data []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: t, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.UnknownResource{Type: t, Data: data},
+	}
+}
+
+func encodeBitmap(types []dnsmessage.Type) []byte {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	var bitmap []byte
+	for i := 0; i < len(types); {
+		window := byte(types[i] >> 8)
+		bits := make([]byte, 32)
+		n := 0
+		for ; i < len(types) && byte(types[i]>>8) == window; i++ {
+			bit := int(types[i] & 0xff)
+			bits[bit/8] |= 0x80 >> (bit % 8)
+			n = bit/8 + 1
+		}
+		bitmap = append(bitmap, window, byte(n))
+		bitmap = append(bitmap, bits[:n]...)
+	}
+	return bitmap
+}
+
+// testCut is a delegation out of a test zone; signer is nil for an unsigned
+// child.
+type testCut struct {
+	child, ns string
+	glue      [4]byte
+	signer    *testSigner
+}
+
+// testZone is a stand-in authoritative server for one zone, signed with
+// NSEC or NSEC3 when it has a signer.
+type testZone struct {
+	name    string
+	signer  *testSigner
+	nsec3   bool
+	records []dnsmessage.Resource
+	cuts    []testCut
+
+	// tamper, if set, edits every reply just before it is sent.
+	tamper func(msg *dnsmessage.Message)
+}
+
+func newTestZone(name string, signer *testSigner, records ...dnsmessage.Resource) *testZone {
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns." + strings.TrimPrefix(name, ".")), MBox: dnsmessage.MustNewName("hostmaster." + strings.TrimPrefix(name, ".")),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 300,
+		},
+	}
+	z := &testZone{name: name, signer: signer, records: append([]dnsmessage.Resource{soa}, records...)}
+	if signer != nil {
+		z.records = append(z.records, unknownRR(name, typeDNSKEY, 3600, signer.key.rdata()))
+	}
+	return z
+}
+
+func (z *testZone) delegate(child, ns string, glue [4]byte, signer *testSigner) *testZone {
+	z.cuts = append(z.cuts, testCut{child: child, ns: ns, glue: glue, signer: signer})
+	return z
+}
+
+func (z *testZone) cut(name string) *testCut {
+	for i := range z.cuts {
+		if canonicalName(z.cuts[i].child) == name {
+			return &z.cuts[i]
+		}
+	}
+	return nil
+}
+
+func (z *testZone) rrset(name string, t dnsmessage.Type) []dnsmessage.Resource {
+	var rrs []dnsmessage.Resource
+	for _, rr := range z.records {
+		if canonicalName(rr.Header.Name.String()) == name && rr.Header.Type == t {
+			rrs = append(rrs, rr)
+		}
+	}
+	if cut := z.cut(name); cut != nil && t == typeDS && cut.signer != nil {
+		rrs = append(rrs, unknownRR(name, typeDS, 3600, cut.signer.ds().rdata()))
+	}
+	return rrs
+}
+
+func (z *testZone) withSigs(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+	if z.signer == nil || len(rrs) == 0 {
+		return rrs
+	}
+	return append(rrs, z.signer.rrsig(rrs))
+}
+
+// owners lists the names in the zone in canonical order.
+func (z *testZone) owners() []string {
+	seen := map[string]bool{canonicalName(z.name): true}
+	for _, rr := range z.records {
+		seen[canonicalName(rr.Header.Name.String())] = true
+	}
+	for _, cut := range z.cuts {
+		seen[canonicalName(cut.child)] = true
+	}
+	var owners []string
+	for name := range seen {
+		owners = append(owners, name)
+	}
+	sort.Slice(owners, func(i, j int) bool { return canonicalCompare(owners[i], owners[j]) < 0 })
+	return owners
+}
+
+func (z *testZone) typesAt(name string) []dnsmessage.Type {
+	seen := map[dnsmessage.Type]bool{typeRRSIG: true}
+	if !z.nsec3 {
+		seen[typeNSEC] = true
+	}
+	for _, rr := range z.records {
+		if canonicalName(rr.Header.Name.String()) == name {
+			seen[rr.Header.Type] = true
+		}
+	}
+	if cut := z.cut(name); cut != nil {
+		seen[dnsmessage.TypeNS] = true
+		seen[typeDS] = cut.signer != nil
+	}
+	var types []dnsmessage.Type
+	for t, ok := range seen {
+		if ok {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (z *testZone) exists(name string) bool {
+	for _, owner := range z.owners() {
+		if owner == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *testZone) closestEncloser(name string) string {
+	for !z.exists(name) && name != canonicalName(z.name) {
+		name = parent(name)
+	}
+	return name
+}
+
+// denialAt is the NSEC or NSEC3 record of an existing name.
+func (z *testZone) denialAt(name string) []dnsmessage.Resource {
+	if z.signer == nil {
+		return nil
+	}
+	if z.nsec3 {
+		hashes := z.hashes()
+		hash := string(nsec3Hash(name, 0, nil))
+		for i, h := range hashes {
+			if h.hash == hash {
+				return z.withSigs([]dnsmessage.Resource{z.nsec3RR(h, hashes[(i+1)%len(hashes)])})
+			}
+		}
+		return nil
+	}
+	owners := z.owners()
+	for i, owner := range owners {
+		if owner == name {
+			next := owners[(i+1)%len(owners)]
+			data := append(nameWire(next), encodeBitmap(z.typesAt(owner))...)
+			return z.withSigs([]dnsmessage.Resource{unknownRR(owner, typeNSEC, 300, data)})
+		}
+	}
+	return nil
+}
+
+// denialCovering is the NSEC or NSEC3 record whose span holds name.
+func (z *testZone) denialCovering(name string) []dnsmessage.Resource {
+	if z.signer == nil {
+		return nil
+	}
+	if z.nsec3 {
+		hashes := z.hashes()
+		hash := string(nsec3Hash(name, 0, nil))
+		prev := hashes[len(hashes)-1]
+		for _, h := range hashes {
+			if h.hash > hash {
+				break
+			}
+			prev = h
+		}
+		return z.denialAt(prev.name)
+	}
+	owners := z.owners()
+	prev := owners[len(owners)-1]
+	for _, owner := range owners {
+		if canonicalCompare(owner, name) > 0 {
+			break
+		}
+		prev = owner
+	}
+	return z.denialAt(prev)
+}
+
+type testHash struct{ name, hash string }
+
+func (z *testZone) hashes() []testHash {
+	var hashes []testHash
+	for _, owner := range z.owners() {
+		hashes = append(hashes, testHash{owner, string(nsec3Hash(owner, 0, nil))})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].hash < hashes[j].hash })
+	return hashes
+}
+
+func (z *testZone) nsec3RR(h, next testHash) dnsmessage.Resource {
+	data := []byte{1, 0, 0, 0, 0, byte(len(next.hash))}
+	data = append(data, next.hash...)
+	data = append(data, encodeBitmap(z.typesAt(h.name))...)
+	owner := strings.ToLower(base32Hex.EncodeToString([]byte(h.hash))) + "." + strings.TrimPrefix(z.name, ".")
+	return unknownRR(owner, typeNSEC3, 300, data)
+}
+
+func (z *testZone) handler(query dnsmessage.Message) dnsmessage.Message {
+	msg := z.answer(query.Questions[0])
+	if z.tamper != nil {
+		z.tamper(&msg)
+	}
+	return msg
+}
+
+func (z *testZone) answer(q dnsmessage.Question) dnsmessage.Message {
+	name := canonicalName(q.Name.String())
+	var msg dnsmessage.Message
+	for _, cut := range z.cuts {
+		if !isSubdomain(name, cut.child) || (q.Type == typeDS && name == canonicalName(cut.child)) {
+			continue
+		}
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(cut.child), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName(cut.ns)},
+		}}
+		if cut.signer != nil {
+			msg.Authorities = append(msg.Authorities, z.withSigs(z.rrset(canonicalName(cut.child), typeDS))...)
+		} else {
+			msg.Authorities = append(msg.Authorities, z.denialAt(canonicalName(cut.child))...)
+		}
+		msg.Additionals = []dnsmessage.Resource{testA(cut.ns, 3600, cut.glue)}
+		return msg
+	}
+
+	msg.Header.Authoritative = true
+	soa := z.withSigs(z.rrset(canonicalName(z.name), dnsmessage.TypeSOA))
+	if rrs := z.rrset(name, q.Type); len(rrs) > 0 {
+		msg.Answers = z.withSigs(rrs)
+		return msg
+	}
+	if z.exists(name) {
+		msg.Authorities = append(soa, z.denialAt(name)...)
+		return msg
+	}
+	ce := z.closestEncloser(name)
+	nextCloser := lastLabels(name, countLabels(ce)+1)
+	if rrs := z.rrset("*."+ce, q.Type); len(rrs) > 0 {
+		for _, rr := range z.withSigs(rrs) {
+			rr.Header.Name = dnsmessage.MustNewName(name)
+			msg.Answers = append(msg.Answers, rr)
+		}
+		msg.Authorities = z.denialCovering(nextCloser)
+		return msg
+	}
+	msg.Authorities = soa
+	if z.nsec3 {
+		msg.Authorities = append(msg.Authorities, z.denialAt(ce)...)
+		msg.Authorities = append(msg.Authorities, z.denialCovering(nextCloser)...)
+	} else {
+		msg.Authorities = append(msg.Authorities, z.denialCovering(name)...)
+	}
+	if z.exists("*." + ce) {
+		// the wildcard is there, just not with this type
+		msg.Authorities = append(msg.Authorities, z.denialAt("*."+ce)...)
+		return msg
+	}
+	msg.Header.RCode = dnsmessage.RCodeNameError
+	msg.Authorities = append(msg.Authorities, z.denialCovering("*."+ce)...)
+	return msg
+}
+
+func testTXT(name string, txt string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.TXTResource{TXT: []string{txt}},
+	}
+}
+
+// signedHierarchy is a small signed tree on loopback:
+//
+//	.            127.0.0.1  RSA/SHA-256, NSEC
+//	com.         127.0.0.2  ECDSA P-384, NSEC
+//	example.com. 127.0.0.3  ECDSA P-256, NSEC, with a wildcard
+//	net.         127.0.0.4  Ed25519, NSEC3
+//	example.net. 127.0.0.5  Ed25519, NSEC3
+//	org.         127.0.0.6  unsigned
+type signedHierarchy struct {
+	root, com, example, net, exampleNet, org *testZone
+}
+
+// useSignedHierarchy starts the servers once setup, if given, has adjusted
+// the zones.
+func useSignedHierarchy(t *testing.T, setup func(h *signedHierarchy)) *signedHierarchy {
+	t.Helper()
+	rootKey := signerFor(t, ".", algRSASHA256)
+	comKey := signerFor(t, "com.", algECDSAP384SHA384)
+	exampleKey := signerFor(t, "example.com.", algECDSAP256SHA256)
+	netKey := signerFor(t, "net.", algED25519)
+	exampleNetKey := signerFor(t, "example.net.", algED25519)
+
+	h := &signedHierarchy{
+		root: newTestZone(".", rootKey).
+			delegate("com.", "a.gtld-servers.com.", [4]byte{127, 0, 0, 2}, comKey).
+			delegate("net.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 4}, netKey).
+			delegate("org.", "a0.org.afilias-nst.info.", [4]byte{127, 0, 0, 6}, nil),
+		com: newTestZone("com.", comKey).
+			delegate("example.com.", "ns1.example.com.", [4]byte{127, 0, 0, 3}, exampleKey),
+		example: newTestZone("example.com.", exampleKey,
+			testA("www.example.com.", 300, [4]byte{192, 0, 2, 1}),
+			testTXT("*.example.com.", "wildcard")),
+		net: newTestZone("net.", netKey).
+			delegate("example.net.", "ns1.example.net.", [4]byte{127, 0, 0, 5}, exampleNetKey),
+		exampleNet: newTestZone("example.net.", exampleNetKey,
+			testA("www.example.net.", 300, [4]byte{192, 0, 2, 2})),
+		org: newTestZone("org.", nil, testA("www.example.org.", 300, [4]byte{192, 0, 2, 3})),
+	}
+	h.net.nsec3 = true
+	h.exampleNet.nsec3 = true
+	if setup != nil {
+		setup(h)
+	}
+
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": h.root.handler,
+		"127.0.0.2": h.com.handler,
+		"127.0.0.3": h.example.handler,
+		"127.0.0.4": h.net.handler,
+		"127.0.0.5": h.exampleNet.handler,
+		"127.0.0.6": h.org.handler,
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.DNSSEC = true
+		cfg.TrustAnchors = []string{rootKey.anchor()}
+	})
+	return h
+}
+
+func validatedQuery(t *testing.T, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+	response, err := dnsQuery(getRootServers(), testQuestion(name, qtype), nil)
+	if err != nil {
+		t.Fatalf("dnsQuery %s: %s", name, err)
+	}
+	return response
+}
+
+func TestDNSSECSecureAnswers(t *testing.T) {
+	useSignedHierarchy(t, nil)
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+	}{
+		{"www.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess},    // positive, NSEC zones
+		{"www.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess}, // NODATA
+		{"nope.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess},   // wildcard NODATA
+		{"foo.example.com.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess},  // wildcard expansion
+		{"www.example.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess},    // positive, NSEC3 zones
+		{"www.example.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess}, // NSEC3 NODATA
+		{"nope.example.net.", dnsmessage.TypeA, dnsmessage.RCodeNameError}, // NSEC3 NXDOMAIN
+		{"nope.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError},         // NSEC NXDOMAIN
+		{"a.b.nope.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError},     // deeper NXDOMAIN
+		{"example.com.", typeDNSKEY, dnsmessage.RCodeSuccess},              // the keys themselves
+	}
+	for _, test := range tests {
+		response := validatedQuery(t, test.name, test.qtype)
+		if response.Header.RCode != test.rcode || !response.Header.AuthenticData {
+			t.Fatalf("%s %s: rcode %s, AD %v; want %s with AD", test.name, rfc.RecordType(test.qtype),
+				rcodeString(response.Header.RCode), response.Header.AuthenticData, rcodeString(test.rcode))
+		}
+	}
+	if stats := DNSSECResults(); stats.Secure < uint64(len(tests)) {
+		t.Fatalf("secure counter not updated: %+v", stats)
+	}
+}
+
+func TestDNSSECInsecureDelegation(t *testing.T) {
+	useSignedHierarchy(t, nil)
+
+	response := validatedQuery(t, "www.example.org.", dnsmessage.TypeA)
+	if response.Header.RCode != dnsmessage.RCodeSuccess || response.Header.AuthenticData || len(response.Answers) != 1 {
+		t.Fatalf("expected an insecure answer without AD, got %+v", response)
+	}
+}
+
+func TestDNSSECBogus(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  dnsmessage.Type
+		tamper func(h *signedHierarchy)
+	}{
+		{"forged address", "www.example.com.", dnsmessage.TypeA, func(h *signedHierarchy) {
+			h.example.tamper = func(msg *dnsmessage.Message) {
+				for _, rr := range msg.Answers {
+					if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+						a.A = [4]byte{203, 0, 113, 66}
+					}
+				}
+			}
+		}},
+		{"stripped signatures", "www.example.com.", dnsmessage.TypeA, func(h *signedHierarchy) {
+			h.example.tamper = func(msg *dnsmessage.Message) {
+				if len(msg.Answers) > 0 && msg.Answers[0].Header.Type == dnsmessage.TypeA {
+					msg.Answers = msg.Answers[:1]
+				}
+			}
+		}},
+		{"NXDOMAIN without proof", "nope.example.net.", dnsmessage.TypeA, func(h *signedHierarchy) {
+			h.exampleNet.tamper = func(msg *dnsmessage.Message) {
+				if msg.Header.RCode == dnsmessage.RCodeNameError {
+					msg.Authorities = msg.Authorities[:2]
+				}
+			}
+		}},
+		{"unsigned delegation without proof", "www.example.org.", dnsmessage.TypeA, func(h *signedHierarchy) {
+			h.root.tamper = func(msg *dnsmessage.Message) {
+				if !msg.Header.Authoritative {
+					msg.Authorities = msg.Authorities[:1]
+				}
+			}
+		}},
+		{"DS not matching the child's key", "www.example.com.", dnsmessage.TypeA, func(h *signedHierarchy) {
+			h.example.signer = signerFor(t, "example.com.", algED25519)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useSignedHierarchy(t, test.tamper)
+			before := DNSSECResults().Bogus
+
+			response := validatedQuery(t, test.qname, test.qtype)
+			if response.Header.RCode != dnsmessage.RCodeServerFailure || response.Header.AuthenticData {
+				t.Fatalf("expected SERVFAIL, got %s AD=%v", rcodeString(response.Header.RCode), response.Header.AuthenticData)
+			}
+			opt := findOPT(response.Additionals)
+			if opt == nil || len(opt.Body.(*dnsmessage.OPTResource).Options) != 1 ||
+				binary.BigEndian.Uint16(opt.Body.(*dnsmessage.OPTResource).Options[0].Data) != edeDNSSECBogus {
+				t.Fatalf("expected an Extended DNS Error DNSSEC Bogus")
+			}
+			if DNSSECResults().Bogus != before+1 {
+				t.Fatalf("bogus counter not updated")
+			}
+		})
+	}
+}
+
+func TestDNSSECCheckingDisabled(t *testing.T) {
+	useSignedHierarchy(t, func(h *signedHierarchy) {
+		h.example.tamper = func(msg *dnsmessage.Message) {
+			// a copy: the zone signs every answer afresh from its records
+			answers := append([]dnsmessage.Resource(nil), msg.Answers...)
+			for i, rr := range answers {
+				if rr.Header.Type == dnsmessage.TypeA {
+					answers[i].Body = &dnsmessage.AResource{A: [4]byte{203, 0, 113, 66}}
+				}
+			}
+			msg.Answers = answers
+		}
+	})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	query := func(checkingDisabled bool) *dnsmessage.Message {
+		t.Helper()
+		packed, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 11, RecursionDesired: true, CheckingDisabled: checkingDisabled},
+			Questions: []dnsmessage.Question{question},
+		}).Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		reply, err := respond(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, packed, true)
+		if err != nil || reply == nil {
+			t.Fatalf("respond: %+v, %v", reply, err)
+		}
+		return reply
+	}
+
+	// with CD set the client does its own validation and gets the answer
+	reply := query(true)
+	if reply.Header.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != 1 ||
+		reply.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{203, 0, 113, 66} {
+		t.Fatalf("got %+v, want the unvalidated answer with CD set", reply)
+	}
+	if !reply.Header.CheckingDisabled || !reply.Header.RecursionDesired || !reply.Header.RecursionAvailable || reply.Header.AuthenticData {
+		t.Fatalf("got header %+v, want CD, RD and RA without AD", reply.Header)
+	}
+	if _, ok := resolverCache.Get(question); ok {
+		t.Fatalf("an answer that was not validated was cached")
+	}
+	if reply := query(false); reply.Header.RCode != dnsmessage.RCodeServerFailure || reply.Header.CheckingDisabled {
+		t.Fatalf("got %s CD=%v without CD, want SERVFAIL", rcodeString(reply.Header.RCode), reply.Header.CheckingDisabled)
+	}
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	useSignedHierarchy(t, nil)
+	response := validatedQuery(t, "www.example.com.", dnsmessage.TypeA)
+
+	plain := *response
+	stripDNSSEC(&plain, dnsmessage.TypeA, false, false)
+	if len(plain.Answers) != 1 || plain.Header.AuthenticData {
+		t.Fatalf("a client without DO should get neither RRSIGs nor AD: %+v", plain)
+	}
+	withDO := *response
+	stripDNSSEC(&withDO, dnsmessage.TypeA, true, false)
+	if len(withDO.Answers) != 2 || !withDO.Header.AuthenticData {
+		t.Fatalf("a DO client should get the RRSIG and AD: %+v", withDO)
+	}
+	if len(response.Answers) != 2 {
+		t.Fatalf("stripping must not touch the original message")
+	}
+}
+
+func TestUDPAnswerTruncatedToPayloadSize(t *testing.T) {
+	useSignedHierarchy(t, nil)
+	// the root's RSA key and its signature are over 512 octets together
+	question := testQuestion(".", typeDNSKEY)
+	query := func(size uint16) *dnsmessage.Message {
+		t.Helper()
+		opt := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(".")}, Body: &dnsmessage.OPTResource{}}
+		opt.Header.SetEDNS0(int(size), dnsmessage.RCodeSuccess, true)
+		packed, err := (&dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: 12, RecursionDesired: true},
+			Questions:   []dnsmessage.Question{question},
+			Additionals: []dnsmessage.Resource{opt},
+		}).Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		reply, err := respond(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, packed, true)
+		if err != nil || reply == nil {
+			t.Fatalf("respond: %+v, %v", reply, err)
+		}
+		return reply
+	}
+
+	reply := query(512)
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	if len(packed) > 512 || !reply.Header.Truncated || len(reply.Answers) != 0 {
+		t.Fatalf("got %d octets, TC=%v, %d answers, want it truncated to 512", len(packed), reply.Header.Truncated, len(reply.Answers))
+	}
+	if len(reply.Questions) != 1 || reply.Questions[0] != question || findOPT(reply.Additionals) == nil {
+		t.Fatalf("a truncated reply should keep the question and the OPT: %+v", reply)
+	}
+
+	reply = query(1232)
+	if packed, err = reply.Pack(); err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	if len(packed) > 1232 || reply.Header.Truncated || len(reply.Answers) != 2 {
+		t.Fatalf("got %d octets, TC=%v, %d answers, want the signed keys", len(packed), reply.Header.Truncated, len(reply.Answers))
+	}
+}
@@ -0,0 +1,413 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The validator follows the chain of trust top-down alongside the iterative
+// walk in dnsQuery: it starts with the keys of an anchored zone (normally
+// the root), checks every referral's DS RRset, or the proof that there is
+// none, with the keys of the zone that handed it out, fetches the child's
+// DNSKEY RRset and checks it against those DS records. The final answer is
+// checked with the keys of the zone that gave it.
+//
+// A zone is secure while that chain is unbroken, insecure from the first
+// delegation proven to be unsigned, and bogus as soon as any check fails.
+// Secure answers get the AD bit, bogus ones become SERVFAIL.
+
+// DNSSECStats counts validation outcomes of final answers.
+// Synthesized counts answers made up from validated NSEC and NSEC3 records
+// (RFC 8198) without asking upstream.
+type DNSSECStats struct {
+	Secure      uint64 `json:"secure"`
+	Insecure    uint64 `json:"insecure"`
+	Bogus       uint64 `json:"bogus"`
+	Synthesized uint64 `json:"synthesized"`
+}
+
+var dnssecCounters struct {
+	secure, insecure, bogus, synthesized atomic.Uint64
+}
+
+// DNSSECResults returns the DNSSEC outcome counters.
+func DNSSECResults() DNSSECStats {
+	return DNSSECStats{
+		Secure:      dnssecCounters.secure.Load(),
+		Insecure:    dnssecCounters.insecure.Load(),
+		Bogus:       dnssecCounters.bogus.Load(),
+		Synthesized: dnssecCounters.synthesized.Load(),
+	}
+}
+
+// keyCache holds DNSKEY RRsets that have been validated, so each zone's keys
+// are fetched and checked once per TTL rather than on every lookup.
+type keyCache struct {
+	mu    sync.Mutex
+	zones map[string]validatedKeys
+}
+
+type validatedKeys struct {
+	keys    []dnskey
+	expires time.Time
+}
+
+var dnssecKeys = &keyCache{zones: make(map[string]validatedKeys)}
+
+func (c *keyCache) get(zone string, now time.Time) ([]dnskey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.zones[canonicalName(zone)]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.keys, true
+}
+
+func (c *keyCache) put(zone string, keys []dnskey, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zones[canonicalName(zone)] = validatedKeys{keys: keys, expires: expires}
+}
+
+// drop forgets the keys of zone.
+func (c *keyCache) drop(zone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.zones, canonicalName(zone))
+}
+
+func (c *keyCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zones = make(map[string]validatedKeys)
+}
+
+// validator tracks the chain of trust for one dnsQuery walk. A nil
+// validator means validation is switched off; all methods accept it.
+type validator struct {
+	trace      *Trace
+	now        time.Time
+	aggressive bool // keep validated denial records for RFC 8198
+
+	zone string   // zone whose servers we are talking to
+	keys []dnskey // validated keys of zone, nil while insecure
+	err  error    // set once the chain turned out bogus
+}
+
+func newValidator(trace *Trace) *validator {
+	cfg := runningConfig()
+	if !cfg.DNSSEC {
+		return nil
+	}
+	return &validator{trace: trace, now: time.Now(), aggressive: cfg.AggressiveNSEC}
+}
+
+func (v *validator) failed() bool {
+	return v != nil && v.err != nil
+}
+
+func (v *validator) fail(err error) {
+	v.err = err
+	warnf("DNSSEC validation failed: %s", err)
+}
+
+func (v *validator) insecure(zone string) {
+	if v.keys != nil {
+		debugf("DNSSEC: %s is an unsigned zone", zone)
+	}
+	v.zone, v.keys = canonicalName(zone), nil
+}
+
+// enter moves the chain down to zone, served by servers. records are what
+// the parent gave us along with the delegation: the DS RRset or the NSEC or
+// NSEC3 records proving it absent, with their signatures.
+func (v *validator) enter(zone string, servers []net.IP, records []dnsmessage.Resource) {
+	if v == nil || v.err != nil {
+		return
+	}
+	if trustAnchors.negativeFor(zone, v.now) {
+		debugf("DNSSEC: %s has a negative trust anchor", zone)
+		v.insecure(zone)
+		return
+	}
+	if anchor, ok := trustAnchors.anchorFor(zone); ok {
+		v.loadKeys(zone, servers, anchor, true)
+		return
+	}
+	if v.keys == nil {
+		v.insecure(zone)
+		return
+	}
+	sets := rrsetsOf(records)
+	for _, set := range sets {
+		if set.rrtype != typeDS || set.name != canonicalName(zone) {
+			continue
+		}
+		if _, err := set.verify(v.zone, v.keys, v.now); err != nil {
+			v.fail(fmt.Errorf("DS for %s: %w", zone, err))
+			return
+		}
+		anchor := trustAnchor{zone: canonicalName(zone)}
+		for _, rr := range set.records {
+			if d, err := parseDS(unknownData(rr)); err == nil {
+				anchor.ds = append(anchor.ds, d)
+			}
+		}
+		v.loadKeys(zone, servers, anchor, false)
+		return
+	}
+	insecure, err := denial(v.validated(sets), v.zone, zone, typeDS, false)
+	if err != nil {
+		v.fail(fmt.Errorf("delegation to %s has neither DS nor proof of its absence: %w", zone, err))
+		return
+	}
+	if insecure {
+		debugf("DNSSEC: delegation to %s is covered by NSEC3 opt-out", zone)
+	}
+	v.insecure(zone)
+}
+
+// loadKeys fetches the DNSKEY RRset of zone and keeps it if a key trusted by
+// anchor signed it. A DS set naming only algorithms or digests we don't
+// implement makes the zone insecure (RFC 4035 section 5.2). Freshly fetched
+// keys of a configured trust anchor feed RFC 5011 tracking.
+func (v *validator) loadKeys(zone string, servers []net.IP, anchor trustAnchor, anchored bool) {
+	usable := len(anchor.keys) > 0
+	for _, d := range anchor.ds {
+		usable = usable || d.supported()
+	}
+	if anchored && len(anchor.keys) == 0 && len(anchor.ds) == 0 {
+		// every key RFC 5011 knew of was revoked
+		v.fail(fmt.Errorf("no trusted key left for %s", zone))
+		return
+	}
+	if !usable {
+		v.insecure(zone)
+		return
+	}
+	keys, set, err := fetchKeys(zone, servers, anchor, v.now, v.trace)
+	if err != nil {
+		v.fail(fmt.Errorf("DNSKEY for %s: %w", zone, err))
+		return
+	}
+	if anchored && set != nil {
+		trustAnchors.observe(zone, set, v.now)
+	}
+	v.zone, v.keys = canonicalName(zone), keys
+}
+
+// fetchKeys returns the validated keys of zone, and the DNSKEY RRset they
+// came in unless they were cached.
+func fetchKeys(zone string, servers []net.IP, anchor trustAnchor, now time.Time, trace *Trace) ([]dnskey, *rrset, error) {
+	if keys, ok := dnssecKeys.get(zone, now); ok {
+		return keys, nil, nil
+	}
+	name, err := dnsmessage.NewName(canonicalName(zone))
+	if err != nil {
+		return nil, nil, err
+	}
+	p, _, err := outgoingDnsQuery(servers, dnsmessage.Question{Name: name, Type: typeDNSKEY, Class: dnsmessage.ClassINET}, trace)
+	if err != nil {
+		return nil, nil, err
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, set := range rrsetsOf(answers) {
+		if set.rrtype != typeDNSKEY || set.name != canonicalName(zone) {
+			continue
+		}
+		var keys, trusted []dnskey
+		ttl := ^uint32(0)
+		for _, rr := range set.records {
+			key, err := parseDNSKEY(unknownData(rr))
+			if err != nil {
+				continue
+			}
+			keys = append(keys, key)
+			if anchor.trusts(key) {
+				trusted = append(trusted, key)
+			}
+			ttl = min(ttl, rr.Header.TTL)
+		}
+		if len(trusted) == 0 {
+			return nil, nil, errors.New("no key matches the DS records")
+		}
+		if _, err := set.verify(zone, trusted, now); err != nil {
+			return nil, nil, err
+		}
+		dnssecKeys.put(zone, keys, now.Add(time.Duration(ttl)*time.Second))
+		return keys, set, nil
+	}
+	return nil, nil, errors.New("no DNSKEY RRset in answer")
+}
+
+// validated keeps the sets signed by the current zone's keys.
+func (v *validator) validated(sets []*rrset) []*rrset {
+	var kept []*rrset
+	for _, set := range sets {
+		if _, err := set.verify(v.zone, v.keys, v.now); err == nil {
+			kept = append(kept, set)
+		} else {
+			debugf("DNSSEC: ignoring %s", err)
+		}
+	}
+	return kept
+}
+
+// signer returns the zone that signed the answer RRsets, if any did.
+func signer(sets []*rrset) string {
+	for _, set := range sets {
+		for _, sig := range set.sigs {
+			return canonicalName(sig.SignerName)
+		}
+	}
+	return ""
+}
+
+// check validates a final answer from servers. It reports whether the
+// answer is secure; an error means it is bogus.
+func (v *validator) check(question dnsmessage.Question, servers []net.IP, msg *dnsmessage.Message) (bool, error) {
+	if v == nil {
+		return false, nil
+	}
+	if trustAnchors.negativeFor(question.Name.String(), v.now) {
+		return false, nil
+	}
+	answerSets := rrsetsOf(msg.Answers)
+	if s := signer(answerSets); s != "" && s != v.zone && v.keys != nil && isSubdomain(s, v.zone) {
+		// the servers also host a zone further down: continue the chain
+		// into it through its DS RRset
+		v.descend(s, servers)
+	}
+	if v.err != nil {
+		return false, v.err
+	}
+	if v.keys == nil {
+		return false, nil
+	}
+	authoritySets := v.validated(rrsetsOf(msg.Authorities))
+	secure := true
+	for _, set := range answerSets {
+		sig, err := set.verify(v.zone, v.keys, v.now)
+		if err != nil {
+			return false, err
+		}
+		if set.expanded(sig) {
+			insecure, err := wildcardExpansion(authoritySets, v.zone, set.name, sig.Labels)
+			if err != nil {
+				return false, fmt.Errorf("wildcard answer for %s: %w", set.name, err)
+			}
+			if !insecure && v.aggressive {
+				aggressiveNSEC.learnWildcard(v.zone, set, sig, msg.Answers, v.now)
+			}
+			secure = secure && !insecure
+		}
+	}
+	if secure && v.aggressive {
+		aggressiveNSEC.learn(v.zone, authoritySets, msg.Authorities, v.now)
+	}
+	if len(answerSets) > 0 {
+		return secure, nil
+	}
+	nameError := msg.Header.RCode == dnsmessage.RCodeNameError
+	insecure, err := denial(authoritySets, v.zone, question.Name.String(), question.Type, nameError)
+	if err != nil {
+		return false, fmt.Errorf("%s for %s: %w", rcodeString(msg.Header.RCode), questionString(question), err)
+	}
+	if !insecure && v.aggressive {
+		aggressiveNSEC.learn(v.zone, authoritySets, msg.Authorities, v.now)
+	}
+	return !insecure, nil
+}
+
+func (v *validator) descend(zone string, servers []net.IP) {
+	name, err := dnsmessage.NewName(zone)
+	if err != nil {
+		v.fail(err)
+		return
+	}
+	p, _, err := outgoingDnsQuery(servers, dnsmessage.Question{Name: name, Type: typeDS, Class: dnsmessage.ClassINET}, v.trace)
+	if err != nil {
+		v.fail(fmt.Errorf("DS for %s: %w", zone, err))
+		return
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		v.fail(err)
+		return
+	}
+	authorities, err := p.AllAuthorities()
+	if err != nil {
+		v.fail(err)
+		return
+	}
+	v.enter(zone, servers, append(answers, authorities...))
+}
+
+// finish applies the validation result to msg: the AD bit for secure
+// answers, SERVFAIL with an Extended DNS Error for bogus ones.
+func (v *validator) finish(question dnsmessage.Question, servers []net.IP, msg *dnsmessage.Message) *dnsmessage.Message {
+	if v == nil {
+		return msg
+	}
+	secure, err := v.check(question, servers, msg)
+	if err != nil {
+		if v.err == nil {
+			v.fail(err)
+		}
+		return v.bogus()
+	}
+	if secure {
+		dnssecCounters.secure.Add(1)
+		msg.Header.AuthenticData = true
+	} else {
+		dnssecCounters.insecure.Add(1)
+	}
+	return msg
+}
+
+// bogus is the answer to give once the chain of trust is broken.
+func (v *validator) bogus() *dnsmessage.Message {
+	dnssecCounters.bogus.Add(1)
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure}}
+	addEDE(msg, edeDNSSECBogus, v.err.Error())
+	return msg
+}
+
+// stripDNSSEC tailors a response to a client that did not ask for DNSSEC
+// records (no DO bit, RFC 3225): signatures and denial records go unless
+// they were the question. The AD bit is only given to clients that set DO
+// or AD themselves (RFC 6840 section 5.7).
+func stripDNSSEC(msg *dnsmessage.Message, qtype dnsmessage.Type, dnssecOK, authenticData bool) {
+	if !dnssecOK && !authenticData {
+		msg.Header.AuthenticData = false
+	}
+	if dnssecOK {
+		return
+	}
+	strip := func(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+		kept := make([]dnsmessage.Resource, 0, len(rrs))
+		for _, rr := range rrs {
+			switch rr.Header.Type {
+			case typeRRSIG, typeNSEC, typeNSEC3:
+				if rr.Header.Type != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	msg.Answers = strip(msg.Answers)
+	msg.Authorities = strip(msg.Authorities)
+	msg.Additionals = strip(msg.Additionals)
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS over HTTPS (RFC 8484): a wire format query either POSTed as an
+// application/dns-message body or sent base64url encoded in the dns
+// parameter of a GET, which HTTP caches can keep. The reply goes back in
+// wire format, with a Cache-Control lifetime no longer than its records'.
+
+const dohMediaType = "application/dns-message"
+
+// maxDoHMessage is the largest query we read, the most a DNS message can be.
+const maxDoHMessage = 65535
+
+var (
+	errMissingDNSParam = errors.New("missing dns parameter")
+	errDoHMediaType    = errors.New("content type must be " + dohMediaType)
+)
+
+// NewDoHHandler serves DNS over HTTPS at /dns-query and the JSON API at
+// /resolve.
+func NewDoHHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dns-query", func(w http.ResponseWriter, r *http.Request) {
+		param := r.URL.Query().Get("dns")
+		if param == "" && r.URL.Query().Has("name") && strings.Contains(r.Header.Get("Accept"), jsonMediaType) {
+			handleJSONResolve(w, r)
+			return
+		}
+		if param == "" {
+			http.Error(w, errMissingDNSParam.Error(), http.StatusBadRequest)
+			return
+		}
+		// the parameter is unpadded base64url, but be lenient about padding
+		query, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			http.Error(w, "dns parameter is not base64url: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveDoH(w, r, query)
+	})
+	mux.HandleFunc("POST /dns-query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, errDoHMediaType.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDoHMessage))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		serveDoH(w, r, query)
+	})
+	mux.HandleFunc("GET /resolve", handleJSONResolve)
+	return mux
+}
+
+func serveDoH(w http.ResponseWriter, r *http.Request, query []byte) {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, err := respond(addr, query, false)
+	if err != nil {
+		http.Error(w, "malformed DNS query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if response == nil {
+		// the ACL drops this client's queries
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		errorf("packing reply to %s failed: %s", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(packed)))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge(response)))
+	w.Write(packed)
+}
+
+// maxAge is how long an HTTP cache may keep response (RFC 8484 section
+// 5.1): the smallest TTL of its answers, or for a negative answer the
+// negative caching TTL of the SOA (RFC 2308). Anything else is not cached.
+func maxAge(response *dnsmessage.Message) uint32 {
+	if len(response.Answers) > 0 {
+		ttl := ^uint32(0)
+		for _, rr := range response.Answers {
+			ttl = min(ttl, rr.Header.TTL)
+		}
+		return ttl
+	}
+	for _, rr := range response.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return min(rr.Header.TTL, soa.MinTTL)
+		}
+	}
+	return 0
+}
+
+// NewDoHServer is the HTTPS server for the DNS over HTTPS handler, speaking
+// HTTP/2 as well as HTTP/1.1 if http2 is set.
+func NewDoHServer(addr string, http2 bool) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           NewDoHHandler(),
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Duration(runningConfig().TLSIdleTimeout),
+	}
+	if !http2 {
+		// a non-nil, empty map turns off the automatic HTTP/2 support
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv
+}
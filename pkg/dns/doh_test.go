@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startTestDoH serves DNS over HTTPS on a loopback port and returns its
+// base URL and a client trusting it.
+func startTestDoH(t *testing.T, http2 bool) (string, *http.Client) {
+	t.Helper()
+	certFile, keyFile, pool := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	srv := NewDoHServer("", http2)
+	go srv.ServeTLS(l, certFile, keyFile)
+	t.Cleanup(func() { srv.Close() })
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+	return "https://" + l.Addr().String(), client
+}
+
+func packedQuery(t *testing.T, question dnsmessage.Question) []byte {
+	t.Helper()
+	// RFC 8484 asks for ID 0, which keeps GET URLs cacheable
+	query := dnsmessage.Message{Header: dnsmessage.Header{RecursionDesired: true}, Questions: []dnsmessage.Question{question}}
+	buf, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	return buf
+}
+
+func readDoHReply(t *testing.T, resp *http.Response) dnsmessage.Message {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != dohMediaType {
+		t.Fatalf("got %s with content type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %s", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(body); err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	return msg
+}
+
+func TestDoHGetAndPost(t *testing.T) {
+	for _, http2 := range []bool{true, false} {
+		useTestConfig(t, func(cfg *Config) {})
+		question := testQuestion("www.example.com.", dnsmessage.TypeA)
+		resolverCache.Set(question, answerFor(question))
+		url, client := startTestDoH(t, http2)
+		query := packedQuery(t, question)
+
+		resp, err := client.Get(url + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query))
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		if wantMajor := map[bool]int{true: 2, false: 1}[http2]; resp.ProtoMajor != wantMajor {
+			t.Fatalf("http2 %v: spoke %s", http2, resp.Proto)
+		}
+		if got := resp.Header.Get("Cache-Control"); got != "max-age=300" {
+			t.Fatalf("Cache-Control %q", got)
+		}
+		if reply := readDoHReply(t, resp); len(reply.Answers) != 1 || reply.Header.ID != 0 {
+			t.Fatalf("unexpected GET reply %+v", reply)
+		}
+
+		resp, err = client.Post(url+"/dns-query", dohMediaType, bytes.NewReader(query))
+		if err != nil {
+			t.Fatalf("POST: %s", err)
+		}
+		if reply := readDoHReply(t, resp); len(reply.Answers) != 1 {
+			t.Fatalf("unexpected POST reply %+v", reply)
+		}
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	url, client := startTestDoH(t, true)
+	query := packedQuery(t, testQuestion("www.example.com.", dnsmessage.TypeA))
+
+	for _, tc := range []struct {
+		name   string
+		do     func() (*http.Response, error)
+		status int
+	}{
+		{"no dns parameter", func() (*http.Response, error) { return client.Get(url + "/dns-query") }, http.StatusBadRequest},
+		{"not base64url", func() (*http.Response, error) { return client.Get(url + "/dns-query?dns=a+b/c") }, http.StatusBadRequest},
+		{"not a DNS message", func() (*http.Response, error) { return client.Get(url + "/dns-query?dns=AAAA") }, http.StatusBadRequest},
+		{"wrong media type", func() (*http.Response, error) {
+			return client.Post(url+"/dns-query", "application/octet-stream", bytes.NewReader(query))
+		}, http.StatusUnsupportedMediaType},
+	} {
+		resp, err := tc.do()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: got %s, want %d", tc.name, resp.Status, tc.status)
+		}
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+		Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns1.example.com."), MBox: dnsmessage.MustNewName("hostmaster.example.com."), MinTTL: 60},
+	}
+	for _, tc := range []struct {
+		name     string
+		response dnsmessage.Message
+		want     uint32
+	}{
+		{"answers", dnsmessage.Message{Answers: []dnsmessage.Resource{testA("a.example.com.", 300, [4]byte{}), testA("a.example.com.", 120, [4]byte{1})}}, 120},
+		{"negative", dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}, Authorities: []dnsmessage.Resource{soa}}, 60},
+		{"servfail", dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}, 0},
+	} {
+		if got := maxAge(&tc.response); got != tc.want {
+			t.Fatalf("%s: max-age %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+//go:build doq
+
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/quic"
+)
+
+// DNS over QUIC (RFC 9250): every query gets a bidirectional stream of its
+// own, carrying one length-prefixed message each way, after which both
+// sides close their end. The message ID must be zero, QUIC already tells
+// the answers apart. A peer breaking these rules has its whole connection
+// closed with DOQ_PROTOCOL_ERROR.
+//
+// The QUIC implementation never accepts 0-RTT data, so no query is ever
+// answered before the handshake has completed and replaying one is not
+// possible (RFC 9250 section 4.5).
+//
+// golang.org/x/net/quic is still experimental, its API may change under us,
+// so all of this is only built with -tags doq. It and the x/crypto and
+// x/sys packages it needs are not vendored: build with -mod=mod.
+
+// DoQ error codes (RFC 9250 section 4.3).
+const (
+	doqNoError          = 0x0
+	doqInternalError    = 0x1
+	doqProtocolError    = 0x2
+	doqRequestCancelled = 0x3
+	doqExcessiveLoad    = 0x4
+	doqUnspecifiedError = 0x5
+)
+
+// ListenQUIC opens the DNS over QUIC endpoint on the UDP address addr with
+// the certificate and key in the given PEM files.
+func ListenQUIC(addr, certFile, keyFile string) (*quic.Endpoint, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return quic.Listen("udp", addr, &quic.Config{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+			NextProtos:   []string{"doq"},
+		},
+		MaxBidiRemoteStreams: maxPipelined,
+		MaxUniRemoteStreams:  -1, // DoQ has no use for them
+		MaxIdleTimeout:       time.Duration(runningConfig().TLSIdleTimeout),
+	})
+}
+
+// ServeQUIC answers DNS over QUIC connections from e until it is closed.
+func ServeQUIC(e *quic.Endpoint) error {
+	for {
+		conn, err := e.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveQUICConn(conn)
+	}
+}
+
+// serveQUICConn answers the queries on conn, each in its own goroutine,
+// until the connection is closed or times out.
+func serveQUICConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go serveQUICStream(conn, stream)
+	}
+}
+
+func serveQUICStream(conn *quic.Conn, stream *quic.Stream) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(runningConfig().TLSIdleTimeout))
+	defer cancel()
+	stream.SetReadContext(ctx)
+	stream.SetWriteContext(ctx)
+
+	// the client ends its side of the stream after the query, so anything
+	// but exactly one message before that is a protocol error
+	data, err := io.ReadAll(io.LimitReader(stream, 2+maxDoHMessage+1))
+	if err != nil {
+		debugf("query stream from %s: %s", conn.RemoteAddr(), err)
+		stream.Reset(doqRequestCancelled)
+		return
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		doqProtocolFailure(conn, "stream does not hold exactly one message")
+		return
+	}
+	query := data[2:]
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		doqProtocolFailure(conn, "malformed message")
+		return
+	}
+	if header.ID != 0 {
+		doqProtocolFailure(conn, "message ID is not 0")
+		return
+	}
+	response, err := respond(net.UDPAddrFromAddrPort(conn.RemoteAddr()), query, false)
+	if err != nil {
+		doqProtocolFailure(conn, "malformed message")
+		return
+	}
+	if response == nil {
+		// the ACL drops this client's queries
+		stream.Reset(doqUnspecifiedError)
+		return
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		errorf("packing reply to %s failed: %s", conn.RemoteAddr(), err)
+		stream.Reset(doqInternalError)
+		return
+	}
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	if _, err := stream.Write(append(framed, packed...)); err != nil {
+		debugf("write to %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	stream.CloseWrite()
+}
+
+func doqProtocolFailure(conn *quic.Conn, reason string) {
+	debugf("closing DoQ connection from %s: %s", conn.RemoteAddr(), reason)
+	conn.Abort(&quic.ApplicationError{Code: doqProtocolError, Reason: reason})
+}
@@ -0,0 +1,117 @@
+//go:build doq
+
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/quic"
+)
+
+// dialTestQUIC serves DNS over QUIC on a loopback port and returns a client
+// connection to it.
+func dialTestQUIC(t *testing.T) *quic.Conn {
+	t.Helper()
+	certFile, keyFile, pool := writeTestCert(t)
+	server, err := ListenQUIC("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("ListenQUIC: %s", err)
+	}
+	go ServeQUIC(server)
+	client, err := quic.Listen("udp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("client endpoint: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		client.Close(ctx)
+		server.Close(ctx)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.Dial(ctx, "udp", server.LocalAddr().String(), &quic.Config{
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", NextProtos: []string{"doq"}, MinVersion: tls.VersionTLS13},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	return conn
+}
+
+// exchangeQUIC sends one query on a stream of its own and reads the reply.
+func exchangeQUIC(conn *quic.Conn, query dnsmessage.Message) (dnsmessage.Message, error) {
+	var reply dnsmessage.Message
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		return reply, err
+	}
+	stream.SetReadContext(ctx)
+	stream.SetWriteContext(ctx)
+	buf, err := query.Pack()
+	if err != nil {
+		return reply, err
+	}
+	if _, err := stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(buf))), buf...)); err != nil {
+		return reply, err
+	}
+	stream.CloseWrite()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return reply, err
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return reply, errors.New("stream does not hold exactly one message")
+	}
+	return reply, reply.Unpack(data[2:])
+}
+
+func TestQUICQueries(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	www, mail := testQuestion("www.example.com.", dnsmessage.TypeA), testQuestion("mail.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+	resolverCache.Set(mail, answerFor(mail))
+	conn := dialTestQUIC(t)
+
+	// one stream per query, several on one connection at once
+	results := make(chan error, 2)
+	for _, question := range []dnsmessage.Question{www, mail} {
+		go func() {
+			reply, err := exchangeQUIC(conn, dnsmessage.Message{Header: dnsmessage.Header{RecursionDesired: true}, Questions: []dnsmessage.Question{question}})
+			if err == nil && (reply.Header.ID != 0 || len(reply.Answers) != 1 || reply.Answers[0].Header.Name != question.Name) {
+				err = errors.New("unexpected reply for " + question.Name.String())
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("exchange: %s", err)
+		}
+	}
+}
+
+func TestQUICNonZeroIDIsProtocolError(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(question, answerFor(question))
+	conn := dialTestQUIC(t)
+
+	if _, err := exchangeQUIC(conn, dnsmessage.Message{Header: dnsmessage.Header{ID: 7}, Questions: []dnsmessage.Question{question}}); err == nil {
+		t.Fatalf("query with ID 7 answered")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Wait(ctx); !errors.Is(err, &quic.ApplicationError{Code: doqProtocolError}) {
+		t.Fatalf("connection closed with %v, want DOQ_PROTOCOL_ERROR", err)
+	}
+}
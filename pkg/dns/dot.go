@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS over TLS (RFC 7858): the TCP framing of RFC 7766, each message
+// preceded by its length as two octets, inside a TLS 1.3 session. A client
+// keeps its connection open and may send many queries without waiting for
+// the answers; those are resolved concurrently and answered in whatever
+// order they finish, matched up by their IDs. A connection that has nothing
+// in flight and sends nothing for the configured idle timeout is closed.
+
+// maxPipelined bounds the queries of one connection resolved at once; past
+// it we stop reading until one of them is answered.
+const maxPipelined = 64
+
+// ListenTLS opens the DNS over TLS listener on addr with the certificate
+// and key in the given PEM files.
+func ListenTLS(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{"dot"}, // RFC 7858 ALPN
+	})
+}
+
+// ServeTLS answers DNS over TLS connections from l until it is closed.
+func ServeTLS(l net.Listener) error {
+	return serveStreams(l)
+}
+
+// ServeTCP answers DNS over plain TCP (RFC 7766) from l until it is
+// closed. Zone transfers go this way, or over TLS (RFC 9103).
+func ServeTCP(l net.Listener) error {
+	return serveStreams(l)
+}
+
+func serveStreams(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go serveStream(conn)
+	}
+}
+
+// serveStream answers the length-prefixed queries on conn until the client
+// closes it or goes idle.
+func serveStream(conn net.Conn) {
+	defer conn.Close()
+	var (
+		inFlight sync.WaitGroup
+		writeMu  sync.Mutex
+	)
+	// answer what is in flight before the connection goes
+	defer inFlight.Wait()
+	slots := make(chan struct{}, maxPipelined)
+	idle := time.Duration(runningConfig().TLSIdleTimeout)
+	for {
+		// the first read also runs the TLS handshake under this deadline
+		if err := conn.SetReadDeadline(time.Now().Add(idle)); err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			if !errors.Is(err, io.EOF) {
+				debugf("closing connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			debugf("closing connection from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		slots <- struct{}{}
+		inFlight.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				inFlight.Done()
+			}()
+			if transferQuery(query) {
+				// the messages of a transfer go out back to back
+				writeMu.Lock()
+				defer writeMu.Unlock()
+				err := authZones.transfer(addrIP(conn.RemoteAddr()), query, func(msg *dnsmessage.Message) error {
+					return writeMessage(conn, msg, idle)
+				})
+				if err != nil {
+					debugf("transfer to %s failed: %s", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			reply, err := respond(conn.RemoteAddr(), query, false)
+			if err != nil {
+				debugf("bad query from %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+			if reply == nil {
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if err := writeMessage(conn, reply, idle); err != nil {
+				debugf("reply to %s failed: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// writeMessage packs msg and writes it to conn, giving up after timeout.
+func writeMessage(conn net.Conn, msg *dnsmessage.Message, timeout time.Duration) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	return writeFrame(conn, packed)
+}
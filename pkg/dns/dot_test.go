@@ -0,0 +1,168 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to PEM files and returns their paths and a pool trusting the certificate.
+func writeTestCert(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// startTestTLS serves DNS over TLS on a loopback port and returns its
+// address and a pool trusting its certificate.
+func startTestTLS(t *testing.T) (string, *x509.CertPool) {
+	t.Helper()
+	certFile, keyFile, pool := writeTestCert(t)
+	l, err := ListenTLS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("ListenTLS: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ServeTLS(l)
+	return l.Addr().String(), pool
+}
+
+func framedQuery(t *testing.T, id uint16, question dnsmessage.Question) []byte {
+	t.Helper()
+	query := dnsmessage.Message{Header: dnsmessage.Header{ID: id, RecursionDesired: true}, Questions: []dnsmessage.Question{question}}
+	buf, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(buf))), buf...)
+}
+
+func readFramed(t *testing.T, conn net.Conn) dnsmessage.Message {
+	t.Helper()
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatalf("read length: %s", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read message: %s", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	return msg
+}
+
+func TestTLSPipelinedQueries(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	www, mail := testQuestion("www.example.com.", dnsmessage.TypeA), testQuestion("mail.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+	resolverCache.Set(mail, answerFor(mail))
+	addr, pool := startTestTLS(t)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", NextProtos: []string{"dot"}})
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	if state := conn.ConnectionState(); state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != "dot" {
+		t.Fatalf("negotiated version %x protocol %q", state.Version, state.NegotiatedProtocol)
+	}
+
+	// both queries go out before either answer is read, then one more on
+	// the same connection
+	if _, err := conn.Write(append(framedQuery(t, 1, www), framedQuery(t, 2, mail)...)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	answered := map[uint16]string{}
+	for i := 0; i < 2; i++ {
+		reply := readFramed(t, conn)
+		answered[reply.Header.ID] = reply.Questions[0].Name.String()
+	}
+	if answered[1] != "www.example.com." || answered[2] != "mail.example.com." {
+		t.Fatalf("unexpected answers %v", answered)
+	}
+	if _, err := conn.Write(framedQuery(t, 3, www)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if reply := readFramed(t, conn); reply.Header.ID != 3 || len(reply.Answers) != 1 {
+		t.Fatalf("unexpected reply on the reused connection %+v", reply)
+	}
+}
+
+func TestTLSIdleTimeout(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) { cfg.TLSIdleTimeout = Duration(100 * time.Millisecond) })
+	addr, pool := startTestTLS(t)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection not closed, read returned %v", err)
+	}
+}
+
+func TestTLSRefusesOldVersions(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	addr, pool := startTestTLS(t)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("TLS 1.2 handshake succeeded")
+	}
+}
@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsUDPSize is the payload size we advertise in our OPT records. We only
+// ever read 512 bytes per datagram, so that is all we can promise.
+const ednsUDPSize = 512
+
+// ednsUpstreamSize is the payload size we advertise to authoritative
+// servers and read replies with, the DNS flag day 2020 default that avoids
+// IP fragmentation. DNSSEC answers rarely fit in 512 bytes.
+const ednsUpstreamSize = 1232
+
+// ednsOptionEDE is the EDNS0 option code of Extended DNS Errors (RFC 8914).
+const ednsOptionEDE = 15
+
+// Extended DNS Error info codes (RFC 8914 section 4)
+const (
+	edeStaleAnswer uint16 = 3  // answer served from expired cache data
+	edeDNSSECBogus uint16 = 6  // DNSSEC validation failed
+	edeProhibited  uint16 = 18 // the client is not allowed to query
+)
+
+// findOPT returns the OPT pseudo-record among rrs, if there is one.
+func findOPT(rrs []dnsmessage.Resource) *dnsmessage.Resource {
+	for i := range rrs {
+		if rrs[i].Header.Type == dnsmessage.TypeOPT {
+			return &rrs[i]
+		}
+	}
+	return nil
+}
+
+// withoutOPT returns rrs minus the OPT pseudo-record, leaving rrs alone.
+func withoutOPT(rrs []dnsmessage.Resource) []dnsmessage.Resource {
+	kept := make([]dnsmessage.Resource, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+func newOPT() dnsmessage.Resource {
+	opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	opt.Header.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false)
+	return opt
+}
+
+// upstreamOPT is the OPT record of our queries to nameservers, with the DO
+// bit (RFC 3225) set when we validate.
+func upstreamOPT(dnssecOK bool) dnsmessage.Resource {
+	opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+	opt.Header.SetEDNS0(ednsUpstreamSize, dnsmessage.RCodeSuccess, dnssecOK)
+	return opt
+}
+
+// addEDE attaches an Extended DNS Error to msg, adding an OPT record when the
+// message has none yet. The OPT is stripped again by finalizeEDNS if the
+// client did not speak EDNS.
+func addEDE(msg *dnsmessage.Message, code uint16, text string) {
+	opt := findOPT(msg.Additionals)
+	if opt == nil {
+		msg.Additionals = append(msg.Additionals, newOPT())
+		opt = &msg.Additionals[len(msg.Additionals)-1]
+	}
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	data = append(data, text...)
+	// never append to an options slice that may be shared with the cache
+	old := opt.Body.(*dnsmessage.OPTResource).Options
+	options := append(append([]dnsmessage.Option(nil), old...), dnsmessage.Option{Code: ednsOptionEDE, Data: data})
+	opt.Body = &dnsmessage.OPTResource{Options: options}
+}
+
+// udpPayloadSize is how large a UDP response to a client may be: what its
+// OPT record advertises (RFC 6891 section 6.2.5), 512 octets without EDNS,
+// and never more than ednsUpstreamSize, to stay clear of fragmentation.
+func udpPayloadSize(opt *dnsmessage.Resource) int {
+	if opt == nil {
+		return 512
+	}
+	return min(max(int(opt.Header.Class), 512), ednsUpstreamSize)
+}
+
+// truncateUDP makes msg fit in size octets. The additional records other
+// than the OPT go first; if that is not enough the answer and authority
+// sections go too and TC is set, so the client asks again over TCP
+// (RFC 2181 section 9).
+func truncateUDP(msg *dnsmessage.Message, size int) error {
+	packed, err := msg.Pack()
+	if err != nil || len(packed) <= size {
+		return err
+	}
+	var opt []dnsmessage.Resource
+	if rr := findOPT(msg.Additionals); rr != nil {
+		opt = []dnsmessage.Resource{*rr}
+	}
+	msg.Additionals = opt
+	if packed, err = msg.Pack(); err != nil || len(packed) <= size {
+		return err
+	}
+	msg.Answers, msg.Authorities = nil, nil
+	msg.Header.Truncated = true
+	return nil
+}
+
+// finalizeEDNS makes the response follow RFC 6891: an OPT record goes back
+// only to clients that sent one, and those always get one, with the DO bit
+// echoed (RFC 3225).
+func finalizeEDNS(msg *dnsmessage.Message, clientEDNS, dnssecOK bool) {
+	if !clientEDNS {
+		msg.Additionals = withoutOPT(msg.Additionals)
+		return
+	}
+	opt := findOPT(msg.Additionals)
+	if opt == nil {
+		msg.Additionals = append(msg.Additionals, newOPT())
+		opt = &msg.Additionals[len(msg.Additionals)-1]
+	}
+	if dnssecOK {
+		opt.Header.TTL |= 1 << 15
+	}
+}
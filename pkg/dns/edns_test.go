@@ -0,0 +1,22 @@
+package dns
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFinalizeEDNS(t *testing.T) {
+	msg := &dnsmessage.Message{}
+	addEDE(msg, edeStaleAnswer, "")
+	finalizeEDNS(msg, false, false)
+	if len(msg.Additionals) != 0 {
+		t.Fatalf("OPT must not be sent to a client without EDNS")
+	}
+
+	msg = &dnsmessage.Message{}
+	finalizeEDNS(msg, true, false)
+	if findOPT(msg.Additionals) == nil {
+		t.Fatalf("EDNS clients must get an OPT record back")
+	}
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Record is a resource record in presentation form, the way it would appear
+// in a zone file or in `dig` output. It is what the admin API hands out.
+type Record struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+// String renders the record as a single master file line.
+func (r Record) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", r.Name, r.TTL, r.Class, r.Type, r.Data)
+}
+
+func recordOf(r dnsmessage.Resource) Record {
+	rec := rfcRecord(r)
+	return Record{
+		Name:  rec.Name,
+		Type:  rec.Type.String(),
+		Class: rec.Class.String(),
+		TTL:   rec.TTL,
+		Data:  rec.PresentationData(),
+	}
+}
+
+func recordsOf(rrs []dnsmessage.Resource) []Record {
+	records := make([]Record, 0, len(rrs))
+	for _, rr := range rrs {
+		records = append(records, recordOf(rr))
+	}
+	return records
+}
+
+func rcodeString(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// parseType reads a type mnemonic or number, used for query parameters.
+func parseType(s string) (dnsmessage.Type, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return dnsmessage.TypeA, nil
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		if v, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return dnsmessage.Type(v), nil
+		}
+	}
+	if v, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return dnsmessage.Type(v), nil
+	}
+	for t := dnsmessage.Type(1); t < 300; t++ {
+		if rfc.RecordType(t).String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
@@ -0,0 +1,341 @@
+package dns
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	mrand "math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// In forwarding mode every question goes, with RD set, to one of the
+// configured upstream resolvers instead of being chased down from the root.
+// A forwarder that fails forwardMaxFailures times in a row is marked down
+// and only asked again when none is up, until a health check, an NS query
+// for the root, gets an answer from it.
+//
+// The answers are taken as the forwarders give them, our own DNSSEC
+// validation only applies when we iterate.
+
+// Forwarding strategies.
+const (
+	ForwardSequential = "sequential" // in the configured order
+	ForwardRandom     = "random"     // in a random order for every query
+	ForwardFastest    = "fastest"    // lowest smoothed round trip time first
+	ForwardParallel   = "parallel"   // all at once, the first answer wins
+)
+
+// forwardMaxFailures is how many failed queries in a row mark a forwarder
+// down.
+const forwardMaxFailures = 3
+
+var errNoForwarders = errors.New("no forwarders configured")
+
+// ForwarderStats is what we know about one forwarder.
+type ForwarderStats struct {
+	Zone                string    `json:"zone,omitempty"` // set for forward zones
+	Address             string    `json:"address"`
+	Transport           string    `json:"transport"`
+	Healthy             bool      `json:"healthy"`
+	Queries             uint64    `json:"queries"`
+	Failures            uint64    `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	SRTT                Duration  `json:"srtt"`
+	LastCheck           time.Time `json:"last_check,omitempty"`
+}
+
+type upstream struct {
+	transport upstreamTransport
+	stats     ForwarderStats // guarded by the pool's mutex
+}
+
+// forwarderPool is a set of forwarders asked in turn: those of forwarding
+// mode, or those of one forward zone.
+type forwarderPool struct {
+	mu        sync.Mutex
+	zone      string
+	strategy  string
+	upstreams []*upstream
+}
+
+var forwarders = &forwarderPool{}
+
+func newForwarderPool(zone, strategy string, list []Forwarder) *forwarderPool {
+	p := &forwarderPool{}
+	p.configure(zone, strategy, list)
+	return p
+}
+
+// configure replaces the forwarders with list, all of them considered up.
+func (p *forwarderPool) configure(zone, strategy string, list []Forwarder) {
+	upstreams := make([]*upstream, 0, len(list))
+	for _, f := range list {
+		transport, err := newTransport(f)
+		if err != nil {
+			// validate has already turned such a config down
+			continue
+		}
+		stats := ForwarderStats{Zone: zone, Address: f.Address, Transport: f.Transport, Healthy: true}
+		if stats.Transport == "" {
+			stats.Transport = TransportUDP
+		}
+		upstreams = append(upstreams, &upstream{transport: transport, stats: stats})
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.zone = zone
+	p.strategy = strategy
+	p.upstreams = upstreams
+}
+
+func (p *forwarderPool) enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.upstreams) > 0
+}
+
+// order lists the forwarders to try for one query, those up first in the
+// order the strategy asks for, then those down as a last resort.
+func (p *forwarderPool) order() (string, []*upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up, down []*upstream
+	for _, u := range p.upstreams {
+		if u.stats.Healthy {
+			up = append(up, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	switch p.strategy {
+	case ForwardRandom:
+		mrand.Shuffle(len(up), func(i, j int) { up[i], up[j] = up[j], up[i] })
+	case ForwardFastest:
+		// never measured counts as fastest, so every forwarder gets tried
+		sort.SliceStable(up, func(i, j int) bool { return up[i].stats.SRTT < up[j].stats.SRTT })
+	}
+	return p.strategy, append(up, down...)
+}
+
+// record notes how a query to u went.
+func (p *forwarderPool) record(u *upstream, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.stats.Queries++
+	if err != nil {
+		u.stats.Failures++
+		u.stats.ConsecutiveFailures++
+		if u.stats.Healthy && u.stats.ConsecutiveFailures >= forwardMaxFailures {
+			warnf("forwarder %s is down: %s", u.transport, err)
+			u.stats.Healthy = false
+		}
+		return
+	}
+	if !u.stats.Healthy {
+		infof("forwarder %s is up again", u.transport)
+	}
+	u.stats.Healthy = true
+	u.stats.ConsecutiveFailures = 0
+	if u.stats.SRTT == 0 {
+		u.stats.SRTT = Duration(rtt)
+	} else {
+		u.stats.SRTT = (u.stats.SRTT*7 + Duration(rtt)) / 8
+	}
+}
+
+// forwardResult is the reply of one forwarder, err set if it is not an
+// answer we can use.
+type forwardResult struct {
+	response *dnsmessage.Message
+	err      error
+}
+
+// forward asks the forwarders of p for question, with the CD bit set to
+// checkingDisabled.
+func (p *forwarderPool) forward(question dnsmessage.Question, trace *Trace, checkingDisabled bool) (*dnsmessage.Message, error) {
+	strategy, candidates := p.order()
+	if len(candidates) == 0 {
+		return nil, errNoForwarders
+	}
+	id, err := queryID()
+	if err != nil {
+		return nil, err
+	}
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true, CheckingDisabled: checkingDisabled},
+		Questions: []dnsmessage.Question{question},
+	}
+	if cfg := runningConfig(); cfg.DNSSEC || cfg.DNSCookies {
+		message.Additionals = []dnsmessage.Resource{upstreamOPT(cfg.DNSSEC)}
+	}
+
+	var last forwardResult
+	if strategy == ForwardParallel {
+		results := make(chan forwardResult, len(candidates))
+		for _, u := range candidates {
+			go func() { results <- p.forwardTo(u, message, trace) }()
+		}
+		for range candidates {
+			if last = <-results; last.err == nil {
+				return last.response, nil
+			}
+		}
+	} else {
+		for _, u := range candidates {
+			if last = p.forwardTo(u, message, trace); last.err == nil {
+				return last.response, nil
+			}
+		}
+	}
+	if last.response != nil {
+		// every forwarder failed, pass on what the last one said
+		return last.response, nil
+	}
+	return nil, fmt.Errorf("failed to get an answer from %d forwarders: %s", len(candidates), last.err)
+}
+
+// forwardTo sends message to u. SERVFAIL and REFUSED count as failures, so
+// the next forwarder gets asked.
+//
+// Forwarded answers are not validated here. The forwarder's AD bit is passed
+// on only if it was asked with DO and answered over TLS or HTTPS; over plain
+// DNS anyone on the path could have set it. Its OPT record is dropped, the
+// client gets one of ours.
+func (p *forwarderPool) forwardTo(u *upstream, message dnsmessage.Message, trace *Trace) forwardResult {
+	started := time.Now()
+	answer, err := u.transport.exchange(message)
+	rtt := time.Since(started)
+	step := TraceStep{Server: u.transport.String(), Question: questionString(message.Questions[0]), RTT: Duration(rtt)}
+	var result forwardResult
+	if err == nil {
+		var reply dnsmessage.Message
+		if err = reply.Unpack(answer); err == nil {
+			step.RCode = rcodeString(reply.Header.RCode)
+			step.Answers = recordsOf(reply.Answers)
+			secure := reply.Header.AuthenticData && u.transport.authenticated()
+			if opt := findOPT(message.Additionals); opt == nil || !opt.Header.DNSSECAllowed() {
+				secure = false
+			}
+			result.response = &dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true, RCode: reply.Header.RCode, AuthenticData: secure},
+				Answers:     reply.Answers,
+				Authorities: reply.Authorities,
+				Additionals: withoutOPT(reply.Additionals),
+			}
+			if rcode := reply.Header.RCode; rcode == dnsmessage.RCodeServerFailure || rcode == dnsmessage.RCodeRefused {
+				err = fmt.Errorf("forwarder answered %s", rcodeString(rcode))
+			}
+		}
+	}
+	if err != nil {
+		warnf("query to forwarder %s failed: %s", u.transport, err)
+		step.Error = err.Error()
+	}
+	trace.add(step)
+	p.record(u, rtt, err)
+	result.err = err
+	return result
+}
+
+// allForwarders lists the forwarders of forwarding mode and of every
+// forward zone.
+func allForwarders() []*forwarderPool {
+	return append([]*forwarderPool{forwarders}, zoneRoutes.pools()...)
+}
+
+// checkForwarders asks every forwarder for the NS records of the root, or
+// of its forward zone, marking those that answer up and counting a failure
+// against the others.
+func checkForwarders() {
+	var wg sync.WaitGroup
+	for _, p := range allForwarders() {
+		p.mu.Lock()
+		upstreams := append([]*upstream(nil), p.upstreams...)
+		zone := p.zone
+		p.mu.Unlock()
+		if zone == "" {
+			zone = "."
+		}
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+		for _, u := range upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id, err := queryID()
+				if err != nil {
+					return
+				}
+				p.forwardTo(u, dnsmessage.Message{
+					Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+					Questions: []dnsmessage.Question{question},
+				}, nil)
+				p.mu.Lock()
+				u.stats.LastCheck = time.Now()
+				p.mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// MaintainForwarders health checks the forwarders every
+// forward_health_interval until stop is closed.
+func MaintainForwarders(stop <-chan struct{}) {
+	for {
+		interval := time.Duration(runningConfig().ForwardHealthInterval)
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		checkForwarders()
+	}
+}
+
+// ForwarderResults returns the state of every forwarder, those of forward
+// zones included.
+func ForwarderResults() []ForwarderStats {
+	results := []ForwarderStats{}
+	for _, p := range allForwarders() {
+		p.mu.Lock()
+		for _, u := range p.upstreams {
+			results = append(results, u.stats)
+		}
+		p.mu.Unlock()
+	}
+	return results
+}
+
+// queryID picks a random message ID for an outgoing query.
+func queryID() (uint16, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<16))
+	if err != nil {
+		return 0, err
+	}
+	return uint16(n.Int64()), nil
+}
+
+// recurse resolves question upstream: the way the forward or stub zone
+// holding it says, else through the forwarders in forwarding mode, else
+// from the root. checkingDisabled is the CD bit of the client's query: the
+// answer is not validated, and forwarders are asked with CD set.
+func recurse(question dnsmessage.Question, trace *Trace, checkingDisabled bool) (*dnsmessage.Message, error) {
+	if route := zoneRoutes.lookup(question.Name.String()); route != nil {
+		if route.forwarders != nil {
+			return route.forwarders.forward(question, trace, checkingDisabled)
+		}
+		return dnsQueryFrom(route.zone, route.servers, question, trace, checkingDisabled)
+	}
+	if forwarders.enabled() {
+		return forwarders.forward(question, trace, checkingDisabled)
+	}
+	return dnsQueryFrom(".", getRootServers(), question, trace, checkingDisabled)
+}
@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// useTestForwarders runs a stand-in resolver per handler, on 127.0.0.1,
+// 127.0.0.2 and so on, and forwards to them in that order.
+func useTestForwarders(t *testing.T, strategy string, handlers ...testHandler) {
+	t.Helper()
+	servers := make(map[string]testHandler)
+	for i, handler := range handlers {
+		servers[net.IPv4(127, 0, 0, byte(i+1)).String()] = handler
+	}
+	startTestServers(t, servers)
+	useTestConfig(t, func(cfg *Config) {
+		for i := range handlers {
+			cfg.Forwarders = append(cfg.Forwarders, Forwarder{Address: net.JoinHostPort(net.IPv4(127, 0, 0, byte(i+1)).String(), dnsPort)})
+		}
+		cfg.ForwardStrategy = strategy
+	})
+}
+
+// recursiveAnswer answers A queries with ip, and only recursive ones.
+func recursiveAnswer(ip [4]byte, queries *atomic.Int32) testHandler {
+	return func(query dnsmessage.Message) dnsmessage.Message {
+		if queries != nil {
+			queries.Add(1)
+		}
+		if !query.Header.RecursionDesired {
+			return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused}}
+		}
+		return dnsmessage.Message{
+			Header:  dnsmessage.Header{RecursionAvailable: true},
+			Answers: []dnsmessage.Resource{testA(query.Questions[0].Name.String(), 300, ip)},
+		}
+	}
+}
+
+func refusing(queries *atomic.Int32) testHandler {
+	return func(query dnsmessage.Message) dnsmessage.Message {
+		queries.Add(1)
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused}}
+	}
+}
+
+func TestForwardSequentialFailover(t *testing.T) {
+	var refused, answered atomic.Int32
+	useTestForwarders(t, ForwardSequential, refusing(&refused), recursiveAnswer([4]byte{192, 0, 2, 2}, &answered))
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+
+	response, err := resolve(question)
+	if err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+	if len(response.Answers) != 1 || rfcRecord(response.Answers[0]).PresentationData() != "192.0.2.2" {
+		t.Fatalf("unexpected answers %v", response.Answers)
+	}
+	trace := NewTrace(question)
+	for i := 0; i < forwardMaxFailures-1; i++ {
+		if _, err := recurse(question, trace, false); err != nil {
+			t.Fatalf("recurse: %s", err)
+		}
+	}
+	if len(trace.Steps) != 2*(forwardMaxFailures-1) || trace.Steps[0].RCode != "REFUSED" || trace.Steps[1].RCode != "NOERROR" {
+		t.Fatalf("unexpected trace %+v", trace.Steps)
+	}
+
+	// the first forwarder is down now and not asked any more
+	stats := ForwarderResults()
+	if stats[0].Healthy || stats[0].ConsecutiveFailures != forwardMaxFailures || !stats[1].Healthy || stats[1].Queries != forwardMaxFailures {
+		t.Fatalf("unexpected forwarder stats %+v", stats)
+	}
+	if _, err := recurse(question, nil, false); err != nil {
+		t.Fatalf("recurse: %s", err)
+	}
+	if n := refused.Load(); n != forwardMaxFailures {
+		t.Fatalf("forwarder that is down asked %d times, want %d", n, forwardMaxFailures)
+	}
+}
+
+func TestForwardAllDown(t *testing.T) {
+	var refused atomic.Int32
+	useTestForwarders(t, ForwardSequential, refusing(&refused))
+	response, err := recurse(testQuestion("www.example.com.", dnsmessage.TypeA), nil, false)
+	if err != nil {
+		t.Fatalf("recurse: %s", err)
+	}
+	if response.Header.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("got %s, want the forwarder's REFUSED passed on", rcodeString(response.Header.RCode))
+	}
+}
+
+func TestForwardParallelFirstWins(t *testing.T) {
+	slow := recursiveAnswer([4]byte{192, 0, 2, 1}, nil)
+	useTestForwarders(t, ForwardParallel,
+		func(query dnsmessage.Message) dnsmessage.Message {
+			time.Sleep(200 * time.Millisecond)
+			return slow(query)
+		},
+		recursiveAnswer([4]byte{192, 0, 2, 2}, nil))
+
+	started := time.Now()
+	response, err := recurse(testQuestion("www.example.com.", dnsmessage.TypeA), nil, false)
+	if err != nil {
+		t.Fatalf("recurse: %s", err)
+	}
+	if len(response.Answers) != 1 || rfcRecord(response.Answers[0]).PresentationData() != "192.0.2.2" {
+		t.Fatalf("got %v, want the faster forwarder's answer", response.Answers)
+	}
+	if elapsed := time.Since(started); elapsed >= 200*time.Millisecond {
+		t.Fatalf("waited %s for the slow forwarder", elapsed)
+	}
+}
+
+func TestForwardStrategyOrder(t *testing.T) {
+	useTestForwarders(t, ForwardFastest, recursiveAnswer([4]byte{192, 0, 2, 1}, nil), recursiveAnswer([4]byte{192, 0, 2, 2}, nil), recursiveAnswer([4]byte{192, 0, 2, 3}, nil))
+	forwarders.mu.Lock()
+	forwarders.upstreams[0].stats.SRTT = Duration(30 * time.Millisecond)
+	forwarders.upstreams[1].stats.SRTT = Duration(10 * time.Millisecond)
+	forwarders.upstreams[2].stats.SRTT = Duration(20 * time.Millisecond)
+	forwarders.upstreams[1].stats.Healthy = false
+	forwarders.mu.Unlock()
+
+	_, order := forwarders.order()
+	var got []string
+	for _, u := range order {
+		got = append(got, u.stats.Address[:9])
+	}
+	// fastest first among those up, the one down last
+	if len(got) != 3 || got[0] != "127.0.0.3" || got[1] != "127.0.0.1" || got[2] != "127.0.0.2" {
+		t.Fatalf("got order %v", got)
+	}
+}
+
+func TestForwarderHealthCheck(t *testing.T) {
+	var up atomic.Bool
+	answer := recursiveAnswer([4]byte{192, 0, 2, 1}, nil)
+	useTestForwarders(t, ForwardSequential, func(query dnsmessage.Message) dnsmessage.Message {
+		if !up.Load() {
+			return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+		}
+		return answer(query)
+	})
+
+	for i := 0; i < forwardMaxFailures; i++ {
+		checkForwarders()
+	}
+	if stats := ForwarderResults(); stats[0].Healthy || stats[0].LastCheck.IsZero() {
+		t.Fatalf("failing forwarder still up: %+v", stats)
+	}
+	up.Store(true)
+	checkForwarders()
+	if stats := ForwarderResults(); !stats[0].Healthy || stats[0].ConsecutiveFailures != 0 {
+		t.Fatalf("recovered forwarder still down: %+v", stats)
+	}
+}
+
+func TestForwardConfigValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ForwardStrategy = "round-robin"
+	if err := cfg.validate(); err == nil {
+		t.Fatalf("unknown forward_strategy accepted")
+	}
+	cfg = DefaultConfig()
+	cfg.Forwarders = []Forwarder{{Address: "resolver.example.net"}}
+	if err := cfg.validate(); err == nil {
+		t.Fatalf("forwarder without an IP address accepted")
+	}
+}
+
+// cannedTransport answers every query with reply.
+type cannedTransport struct {
+	reply  dnsmessage.Message
+	secure bool
+}
+
+func (c cannedTransport) exchange(message dnsmessage.Message) ([]byte, error) {
+	reply := c.reply
+	reply.Header.ID, reply.Header.Response = message.Header.ID, true
+	reply.Questions = message.Questions
+	return reply.Pack()
+}
+
+func (c cannedTransport) authenticated() bool {
+	return c.secure
+}
+
+func (c cannedTransport) String() string {
+	return "canned"
+}
+
+func TestForwardKeepsAdditionalsAndTrustedAD(t *testing.T) {
+	question := testQuestion("example.com.", dnsmessage.TypeMX)
+	opt := newOPT()
+	opt.Header.SetEDNS0(ednsUpstreamSize, dnsmessage.RCodeSuccess, true)
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{AuthenticData: true, RecursionAvailable: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.example.com.")},
+		}},
+		Additionals: []dnsmessage.Resource{testA("mail.example.com.", 300, [4]byte{192, 0, 2, 25}), opt},
+	}
+	query := func(dnssecOK, secure bool) *dnsmessage.Message {
+		t.Helper()
+		message := dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: 7, RecursionDesired: true},
+			Questions:   []dnsmessage.Question{question},
+			Additionals: []dnsmessage.Resource{upstreamOPT(dnssecOK)},
+		}
+		p := &forwarderPool{}
+		result := p.forwardTo(&upstream{transport: cannedTransport{reply: reply, secure: secure}}, message, nil)
+		if result.err != nil {
+			t.Fatalf("forwardTo: %s", result.err)
+		}
+		return result.response
+	}
+
+	response := query(true, true)
+	if len(response.Additionals) != 1 || response.Additionals[0].Header.Type != dnsmessage.TypeA {
+		t.Fatalf("got additionals %v, want the glue without the OPT", recordsOf(response.Additionals))
+	}
+	if !response.Header.AuthenticData {
+		t.Fatalf("AD of a forwarder asked with DO over an authenticated channel was dropped")
+	}
+	if query(true, false).Header.AuthenticData {
+		t.Fatalf("AD over plain DNS was believed")
+	}
+	if query(false, true).Header.AuthenticData {
+		t.Fatalf("AD was believed from a forwarder not asked with DO")
+	}
+}
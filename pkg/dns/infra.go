@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServerStats is what we know about one nameserver we have talked to.
+// SRTT is the smoothed round trip time, weighted 7/8 old and 1/8 new sample
+// the same way TCP (RFC 6298) and most resolvers do it.
+type ServerStats struct {
+	Address  string    `json:"address"`
+	Queries  uint64    `json:"queries"`
+	Timeouts uint64    `json:"timeouts"`
+	Errors   uint64    `json:"errors"`
+	SRTT     Duration  `json:"srtt"`
+	LastRTT  Duration  `json:"last_rtt"`
+	LastUsed time.Time `json:"last_used"`
+
+	// CaseInsensitive is set once the server has been seen answering with
+	// the query name in a different case, so 0x20 is not used with it.
+	CaseInsensitive bool `json:"case_insensitive"`
+}
+
+type infraCache struct {
+	mu      sync.Mutex
+	servers map[string]*ServerStats
+}
+
+var infra = &infraCache{servers: make(map[string]*ServerStats)}
+
+func (i *infraCache) record(server net.IP, rtt time.Duration, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key := server.String()
+	stats, ok := i.servers[key]
+	if !ok {
+		stats = &ServerStats{Address: key}
+		i.servers[key] = stats
+	}
+	stats.Queries++
+	stats.LastUsed = time.Now()
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			stats.Timeouts++
+		} else {
+			stats.Errors++
+		}
+		return
+	}
+	stats.LastRTT = Duration(rtt)
+	if stats.SRTT == 0 {
+		stats.SRTT = Duration(rtt)
+	} else {
+		stats.SRTT = (stats.SRTT*7 + Duration(rtt)) / 8
+	}
+}
+
+func (i *infraCache) markCaseInsensitive(server net.IP) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key := server.String()
+	stats, ok := i.servers[key]
+	if !ok {
+		stats = &ServerStats{Address: key}
+		i.servers[key] = stats
+	}
+	if !stats.CaseInsensitive {
+		infof("%s does not preserve query name case, disabling 0x20 for it", key)
+	}
+	stats.CaseInsensitive = true
+}
+
+func (i *infraCache) caseInsensitive(server net.IP) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	stats, ok := i.servers[server.String()]
+	return ok && stats.CaseInsensitive
+}
+
+func (i *infraCache) snapshot() []ServerStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	stats := make([]ServerStats, 0, len(i.servers))
+	for _, s := range i.servers {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(a, b int) bool { return stats[a].Address < stats[b].Address })
+	return stats
+}
+
+// InfraStats returns the RTT statistics of every nameserver contacted so far.
+func InfraStats() []ServerStats {
+	return infra.snapshot()
+}
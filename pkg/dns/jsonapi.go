@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The JSON API answers GET /resolve?name=&type= in the schema of Google's
+// and Cloudflare's public resolvers, for web tooling that would rather not
+// handle wire format. Cloudflare's spelling, /dns-query?name= with an
+// Accept of application/dns-json, works too. The query goes through the
+// same pipeline as every other one, so the ACL and the cache apply.
+
+const jsonMediaType = "application/dns-json"
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonResponse is a reply in the Google/Cloudflare JSON schema.
+type jsonResponse struct {
+	Status    dnsmessage.RCode `json:"Status"`
+	TC        bool             `json:"TC"`
+	RD        bool             `json:"RD"`
+	RA        bool             `json:"RA"`
+	AD        bool             `json:"AD"`
+	CD        bool             `json:"CD"`
+	Question  []jsonQuestion   `json:"Question"`
+	Answer    []jsonRecord     `json:"Answer,omitempty"`
+	Authority []jsonRecord     `json:"Authority,omitempty"`
+	Comment   string           `json:"Comment,omitempty"`
+}
+
+// handleJSONResolve serves one JSON query. Besides name and type it takes
+// cd and do, the CD flag and the DO bit of the query, as 1/true or 0/false.
+func handleJSONResolve(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	name := params.Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, errMissingName)
+		return
+	}
+	qname, err := dnsmessage.NewName(canonicalName(name))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	qtype, err := parseType(params.Get("type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true, CheckingDisabled: flagParam(params.Get("cd"))},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	// always EDNS, so Extended DNS Errors come back for the comment
+	opt := newOPT()
+	opt.Header.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, flagParam(params.Get("do")))
+	query.Additionals = []dnsmessage.Resource{opt}
+	packed, err := query.Pack()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	response, err := respond(addr, packed, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if response == nil {
+		writeError(w, http.StatusForbidden, errors.New(http.StatusText(http.StatusForbidden)))
+		return
+	}
+	result := jsonResponse{
+		Status:    response.Header.RCode,
+		TC:        response.Header.Truncated,
+		RD:        response.Header.RecursionDesired,
+		RA:        response.Header.RecursionAvailable,
+		AD:        response.Header.AuthenticData,
+		CD:        response.Header.CheckingDisabled,
+		Question:  []jsonQuestion{{Name: qname.String(), Type: uint16(qtype)}},
+		Answer:    jsonRecords(response.Answers),
+		Authority: jsonRecords(response.Authorities),
+	}
+	if text := edeText(response); text != "" {
+		result.Comment = text
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge(response)))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, http.StatusOK, result)
+}
+
+func flagParam(s string) bool {
+	v, _ := strconv.ParseBool(s)
+	return v
+}
+
+func jsonRecords(rrs []dnsmessage.Resource) []jsonRecord {
+	var records []jsonRecord
+	for _, rr := range rrs {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		rec := rfcRecord(rr)
+		records = append(records, jsonRecord{Name: rec.Name, Type: uint16(rec.Type), TTL: rec.TTL, Data: rec.PresentationData()})
+	}
+	return records
+}
+
+// edeText is the Extended DNS Error of response as text, empty if it has
+// none.
+func edeText(response *dnsmessage.Message) string {
+	opt := findOPT(response.Additionals)
+	if opt == nil {
+		return ""
+	}
+	body, ok := opt.Body.(*dnsmessage.OPTResource)
+	if !ok {
+		return ""
+	}
+	for _, o := range body.Options {
+		if o.Code == ednsOptionEDE && len(o.Data) >= 2 {
+			text := fmt.Sprintf("EDE %d", int(o.Data[0])<<8|int(o.Data[1]))
+			if len(o.Data) > 2 {
+				text += ": " + string(o.Data[2:])
+			}
+			return text
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func getJSON(t *testing.T, req *http.Request) jsonResponse {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %s", req.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", req.URL, resp.Status)
+	}
+	var result jsonResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	return result
+}
+
+func TestJSONResolve(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {
+		cfg.ACL = []ACLRule{{Networks: []string{"127.0.0.0/8", "::1"}, Action: ACLCacheOnly}}
+	})
+	www := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+	missing := testQuestion("missing.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(missing, &dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns1.example.com."), MBox: dnsmessage.MustNewName("hostmaster.example.com."), Serial: 7, MinTTL: 60},
+		}},
+	})
+	srv := httptest.NewServer(NewDoHHandler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/resolve?name=www.example.com&type=A&cd=1", nil)
+	got := getJSON(t, req)
+	// a cache-only client may not have us recurse, so no RA
+	if got.Status != dnsmessage.RCodeSuccess || !got.RD || got.RA || !got.CD || len(got.Question) != 1 || got.Question[0].Name != "www.example.com." || got.Question[0].Type != 1 {
+		t.Fatalf("unexpected header or question %+v", got)
+	}
+	if len(got.Answer) != 1 || got.Answer[0] != (jsonRecord{Name: "www.example.com.", Type: 1, TTL: got.Answer[0].TTL, Data: "192.0.2.1"}) {
+		t.Fatalf("unexpected answer %+v", got.Answer)
+	}
+
+	// Cloudflare's spelling of the same
+	req, _ = http.NewRequest("GET", srv.URL+"/dns-query?name=missing.example.com&type=1", nil)
+	req.Header.Set("Accept", jsonMediaType)
+	got = getJSON(t, req)
+	if got.Status != dnsmessage.RCodeNameError || len(got.Answer) != 0 || len(got.Authority) != 1 ||
+		got.Authority[0].Data != "ns1.example.com. hostmaster.example.com. 7 0 0 0 60" {
+		t.Fatalf("unexpected NXDOMAIN %+v", got)
+	}
+
+	// not in the cache, so a cache-only client is refused, and told why
+	req, _ = http.NewRequest("GET", srv.URL+"/resolve?name=other.example.com&type=AAAA", nil)
+	got = getJSON(t, req)
+	if got.Status != dnsmessage.RCodeRefused || got.Comment != "EDE 18" {
+		t.Fatalf("unexpected refusal %+v", got)
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL+"/resolve?type=A", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("query without a name got %s", resp.Status)
+	}
+}
+
+func TestRFCRecord(t *testing.T) {
+	for _, tc := range []struct {
+		rr   dnsmessage.Resource
+		want string
+	}{
+		{dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.example.com.")},
+		}, "10 mail.example.com."},
+		{dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.TXTResource{TXT: []string{"v=spf1 -all", `say "hi"`}},
+		}, `"v=spf1 -all" "say \"hi\""`},
+		{dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("_sip._udp.example.com."), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.SRVResource{Priority: 1, Weight: 2, Port: 5060, Target: dnsmessage.MustNewName("sip.example.com.")},
+		}, "1 2 5060 sip.example.com."},
+	} {
+		if got := rfcRecord(tc.rr).PresentationData(); got != tc.want {
+			t.Fatalf("%s: got %q, want %q", rfc.RecordType(tc.rr.Header.Type), got, tc.want)
+		}
+		// the admin API, traces and the cache listing render records alike
+		if got := recordOf(tc.rr); got.Data != tc.want || got.Type != rfc.RecordType(tc.rr.Header.Type).String() || got.Class != "IN" {
+			t.Fatalf("recordOf got %+v, want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel controls how chatty the resolver is. It can be changed at runtime
+// through the admin API without restarting the server.
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LevelInfo))
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLogLevel turns "debug", "info", "warn" or "error" into a LogLevel.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+func SetLogLevel(l LogLevel) {
+	logLevel.Store(int32(l))
+}
+
+func GetLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+func logf(level LogLevel, format string, args ...any) {
+	if level < GetLogLevel() {
+		return
+	}
+	fmt.Printf("["+level.String()+"] "+format+"\n", args...)
+}
+
+func debugf(format string, args ...any) { logf(LevelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(LevelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(LevelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(LevelError, format, args...) }
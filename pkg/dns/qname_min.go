@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// QNAME minimisation (RFC 9156): a server for zone only gets to see the
+// query name up to one label below zone, so the root learns "com." and not
+// "www.example.com.". The full question is only sent once we reach the
+// servers that answer for it.
+
+// QNAME minimisation modes, see Config.QnameMinimisation.
+const (
+	MinimiseOff     = "off"
+	MinimiseRelaxed = "relaxed"
+	MinimiseStrict  = "strict"
+)
+
+// maxMinimiseCount caps how many minimised queries one question may cost,
+// RFC 9156 section 2.3 MAX_MINIMISE_COUNT. Names deeper than that are sent
+// in full once the budget is spent.
+const maxMinimiseCount = 10
+
+// qnameMinimiser decides what dnsQuery sends at each step of the walk.
+type qnameMinimiser struct {
+	question dnsmessage.Question
+	mode     string
+	labels   int // labels in the full query name
+	revealed int // labels shown to servers so far
+	sent     int // minimised queries made
+}
+
+func newQnameMinimiser(question dnsmessage.Question, mode string) *qnameMinimiser {
+	return &qnameMinimiser{question: question, mode: mode, labels: countLabels(question.Name.String())}
+}
+
+// next returns the question to send to the servers for zone and whether it
+// is a minimised one.
+func (m *qnameMinimiser) next(zone string) (dnsmessage.Question, bool) {
+	if m.mode == MinimiseOff || m.sent >= maxMinimiseCount {
+		return m.question, false
+	}
+	if reveal := countLabels(zone) + 1; reveal > m.revealed {
+		m.revealed = reveal
+	}
+	if m.revealed >= m.labels {
+		return m.question, false
+	}
+	name, err := dnsmessage.NewName(lastLabels(m.question.Name.String(), m.revealed))
+	if err != nil {
+		return m.question, false
+	}
+	m.sent++
+	// RFC 9156 section 2.1 suggests type A: NS queries trip up more
+	// middleboxes and broken servers than address queries do
+	return dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, true
+}
+
+// reveal shows one more label to the current servers, used when they are
+// authoritative for the minimised name or it is an empty non-terminal.
+func (m *qnameMinimiser) reveal() {
+	m.revealed++
+}
+
+// fallBack handles a server that choked on a minimised query. In relaxed
+// mode the rest of the walk sends the full name and true is returned; in
+// strict mode the failure stands.
+func (m *qnameMinimiser) fallBack(reason string) bool {
+	if m.mode != MinimiseRelaxed {
+		return false
+	}
+	debugf("minimised query for %s failed (%s), sending the full name", m.question.Name.String(), reason)
+	m.mode = MinimiseOff
+	return true
+}
+
+// countLabels returns the number of labels in name, zero for the root.
+func countLabels(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
+
+// lastLabels returns the rightmost n labels of name as a fully qualified
+// name, keeping their case.
+func lastLabels(name string, n int) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	if n >= len(labels) {
+		return strings.TrimSuffix(name, ".") + "."
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
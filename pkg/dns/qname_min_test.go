@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestLastLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"www.Example.com.", 1, "com."},
+		{"www.Example.com.", 2, "Example.com."},
+		{"www.Example.com.", 3, "www.Example.com."},
+		{"www.Example.com.", 5, "www.Example.com."},
+	}
+	for _, test := range tests {
+		if got := lastLabels(test.name, test.n); got != test.want {
+			t.Fatalf("lastLabels(%q, %d) = %q, want %q", test.name, test.n, got, test.want)
+		}
+	}
+	if countLabels(".") != 0 || countLabels("www.example.com.") != 3 {
+		t.Fatalf("countLabels miscounts")
+	}
+}
+
+// queryLog remembers which names each test server was asked about.
+type queryLog struct {
+	mu    sync.Mutex
+	names map[string][]string
+}
+
+func (l *queryLog) wrap(server string, handler testHandler) testHandler {
+	return func(query dnsmessage.Message) dnsmessage.Message {
+		l.mu.Lock()
+		l.names[server] = append(l.names[server], canonicalName(query.Questions[0].Name.String()))
+		l.mu.Unlock()
+		return handler(query)
+	}
+}
+
+func (l *queryLog) seen(server string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.names[server]...)
+}
+
+// useMinimisationHierarchy is useTestHierarchy with every query logged and
+// the com. server replaced by comHandler when it is not nil.
+func useMinimisationHierarchy(t *testing.T, mode string, comHandler testHandler) *queryLog {
+	t.Helper()
+	if comHandler == nil {
+		comHandler = referralTo("example.com.", "ns1.example.com.", [4]byte{127, 0, 0, 3})
+	}
+	log := &queryLog{names: make(map[string][]string)}
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": log.wrap("root", referralTo("com.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 2})),
+		"127.0.0.2": log.wrap("com", comHandler),
+		"127.0.0.3": log.wrap("example", func(query dnsmessage.Message) dnsmessage.Message {
+			q := query.Questions[0]
+			if canonicalName(q.Name.String()) != "www.example.com." {
+				return dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true}}
+			}
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+			}
+		}),
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.QnameMinimisation = mode
+	})
+	return log
+}
+
+func TestQnameMinimisationHidesFullName(t *testing.T) {
+	log := useMinimisationHierarchy(t, MinimiseStrict, nil)
+
+	response, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), nil)
+	if err != nil {
+		t.Fatalf("dnsQuery error: %s", err)
+	}
+	if len(response.Answers) != 1 || rfcRecord(response.Answers[0]).PresentationData() != "192.0.2.1" {
+		t.Fatalf("unexpected answers %v", response.Answers)
+	}
+	if seen := log.seen("root"); len(seen) != 1 || seen[0] != "com." {
+		t.Fatalf("root saw %v, want only com.", seen)
+	}
+	if seen := log.seen("com"); len(seen) != 1 || seen[0] != "example.com." {
+		t.Fatalf("com server saw %v, want only example.com.", seen)
+	}
+	if seen := log.seen("example"); len(seen) != 1 || seen[0] != "www.example.com." {
+		t.Fatalf("example.com server saw %v", seen)
+	}
+}
+
+func TestQnameMinimisationOff(t *testing.T) {
+	log := useMinimisationHierarchy(t, MinimiseOff, nil)
+
+	if _, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), nil); err != nil {
+		t.Fatalf("dnsQuery error: %s", err)
+	}
+	if seen := log.seen("root"); len(seen) != 1 || seen[0] != "www.example.com." {
+		t.Fatalf("root saw %v, want the full name", seen)
+	}
+}
+
+// brokenCom answers NXDOMAIN for every name it is not given in full, like
+// servers that do not understand empty non-terminals.
+func brokenCom(query dnsmessage.Message) dnsmessage.Message {
+	if canonicalName(query.Questions[0].Name.String()) != "www.example.com." {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}
+	}
+	return referralTo("example.com.", "ns1.example.com.", [4]byte{127, 0, 0, 3})(query)
+}
+
+func TestQnameMinimisationRelaxedFallsBack(t *testing.T) {
+	log := useMinimisationHierarchy(t, MinimiseRelaxed, brokenCom)
+
+	response, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), nil)
+	if err != nil {
+		t.Fatalf("dnsQuery error: %s", err)
+	}
+	if response.Header.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 1 {
+		t.Fatalf("expected an answer after falling back, got %v", response)
+	}
+	if seen := log.seen("com"); len(seen) != 2 || seen[1] != "www.example.com." {
+		t.Fatalf("com server saw %v, want a minimised query then the full name", seen)
+	}
+}
+
+func TestQnameMinimisationStrictTrustsNXDOMAIN(t *testing.T) {
+	log := useMinimisationHierarchy(t, MinimiseStrict, brokenCom)
+
+	response, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), nil)
+	if err != nil {
+		t.Fatalf("dnsQuery error: %s", err)
+	}
+	if response.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("expected NXDOMAIN in strict mode, got %v", response.Header.RCode)
+	}
+	if seen := log.seen("com"); len(seen) != 1 {
+		t.Fatalf("com server saw %v, want a single minimised query", seen)
+	}
+}
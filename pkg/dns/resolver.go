@@ -1,56 +1,252 @@
 package dns
 
 import (
-	"bufio"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"strings"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
 const ROOT_SERVERS = "198.41.0.4,199.9.14.201,192.33.4.12,199.7.91.13,192.203.230.10,192.5.5.241,192.112.36.4,198.97.190.53"
 
+// dnsPort is the port nameservers are contacted on; tests point it at local stand-ins.
+var dnsPort = "53"
+
 func HandlePacket(pc net.PacketConn, addr net.Addr, buf []byte) {
 	if err := handlePacket(pc, addr, buf); err != nil {
-		fmt.Printf("read error from %s: %s", addr.String(), err)
+		errorf("read error from %s: %s", addr.String(), err)
 	}
 }
 func handlePacket(pc net.PacketConn, addr net.Addr, buf []byte) error {
+	response, err := respond(addr, buf, true)
+	if err != nil || response == nil {
+		return err
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = pc.WriteTo(packed, addr)
+	return err
+}
+
+// respond runs one query from addr through the resolver and returns the
+// reply, nil when there is none to send. Rate limiting only applies to udp,
+// the one transport whose source addresses can be spoofed.
+func respond(addr net.Addr, buf []byte, udp bool) (*dnsmessage.Message, error) {
 	p := dnsmessage.Parser{}
 	header, err := p.Start(buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	question, err := p.Question()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	response, err := dnsQuery(getRootServers(), question)
+	if header.OpCode == opcodeNotify {
+		response := authZones.notified(addrIP(addr), question)
+		response.Header.ID = header.ID
+		return response, nil
+	}
+	opt, err := queryOPT(&p)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	dnssecOK := opt != nil && opt.Header.DNSSECAllowed()
+	cfg, client, now := runningConfig(), addrIP(addr), time.Now()
+	cookie, verified, err := cookies.checkClient(cfg, client, opt, now)
+	var (
+		response  *dnsmessage.Message
+		recursion bool // whether the client may have us recurse
+	)
+	if err != nil {
+		debugf("%s from %s", err, addr)
+		response = formErr(question)
+	} else if isTransfer(question.Type) {
+		// transfers are served over TCP, see serveStream
+		response = authZones.datagramTransfer(client, question)
+	} else {
+		action, view := cfg.aclFor(client)
+		recursion = action == ACLAllow
+		response, err = answerClient(question, action, view, header.CheckingDisabled)
+		if err != nil {
+			return nil, err
+		}
+		if response == nil {
+			debugf("dropped query from %s", addr)
+			return nil, nil
+		}
 	}
 	response.Header.ID = header.ID
-	responseBuff, err := response.Pack()
+	response.Header.RecursionDesired = header.RecursionDesired
+	response.Header.RecursionAvailable = recursion
+	response.Header.CheckingDisabled = header.CheckingDisabled
+	// fresh answers come without it, and the client matches the reply,
+	// a slipped one too, to its query by it
+	response.Questions = []dnsmessage.Question{question}
+	// a valid server cookie proves the source address is not spoofed
+	if udp && !verified {
+		switch responseLimiter.check(client, question, response, now) {
+		case rrlDrop:
+			return nil, nil
+		case rrlSlip:
+			response = slipped(response)
+		}
+	}
+	stripDNSSEC(response, question.Type, dnssecOK, header.AuthenticData)
+	finalizeEDNS(response, opt != nil, dnssecOK)
+	if cookie != nil {
+		cookies.addCookie(response, client, cookie, now)
+	}
+	if udp {
+		if err := truncateUDP(response, udpPayloadSize(opt)); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// queryOPT returns the OPT record in the rest of the query, nil if the
+// client does not speak EDNS.
+func queryOPT(p *dnsmessage.Parser) (*dnsmessage.Resource, error) {
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	additionals, err := p.AllAdditionals()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return findOPT(additionals), nil
+}
+
+// resolveUnchecked answers a query with the CD bit set (RFC 4035 section
+// 3.2.2): from the cache, which never holds an answer that failed
+// validation, or else upstream without validating. An answer that was not
+// validated is not cached.
+func resolveUnchecked(question dnsmessage.Question) (*dnsmessage.Message, error) {
+	if !runningConfig().DNSSEC {
+		return resolve(question)
+	}
+	if cached, ok := resolverCache.Get(question); ok {
+		debugf("cache hit %s", questionString(question))
+		return cached, nil
+	}
+	return recurse(question, nil, true)
+}
+
+// resolve answers from the cache when it can and asks upstream otherwise.
+func resolve(question dnsmessage.Question) (*dnsmessage.Message, error) {
+	if cached, ok, prefetch := resolverCache.lookup(question); ok {
+		debugf("cache hit %s", questionString(question))
+		if prefetch {
+			go prefetchQuestion(question)
+		}
+		return cached, nil
 	}
-	_, err = pc.WriteTo(responseBuff, addr)
+	if cfg := runningConfig(); cfg.DNSSEC && cfg.AggressiveNSEC {
+		if synthesized := aggressiveNSEC.synthesize(question, time.Now()); synthesized != nil {
+			debugf("synthesised %s from validated NSEC records", questionString(question))
+			return synthesized, nil
+		}
+	}
+	if stale, retry, ok := resolverCache.stale(question); ok {
+		return resolveWithStale(question, stale, retry), nil
+	}
+	response, err := recurse(question, nil, false)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	resolverCache.Set(question, response)
+	return response, nil
+}
+
+type resolution struct {
+	response *dnsmessage.Message
+	err      error
+}
+
+// resolveWithStale implements RFC 8767 for a question we hold expired data
+// for: a fresh answer is used if upstream delivers one within the client
+// response timer, otherwise the client gets the stale answer while the
+// lookup carries on in the background and refreshes the cache.
+func resolveWithStale(question dnsmessage.Question, stale *dnsmessage.Message, retry bool) *dnsmessage.Message {
+	if !retry {
+		// upstream failed very recently or another client's refresh is
+		// under way, don't hammer it
+		return staleAnswer(stale)
+	}
+	result := make(chan resolution, 1)
+	go func() {
+		defer resolverCache.refreshDone(question)
+		response, err := recurse(question, nil, false)
+		if err == nil && response.Header.RCode == dnsmessage.RCodeServerFailure {
+			err = fmt.Errorf("upstream answered %s", rcodeString(response.Header.RCode))
+		}
+		if err != nil {
+			warnf("refresh of stale %s failed: %s", questionString(question), err)
+			resolverCache.refreshFailed(question)
+		} else {
+			resolverCache.Set(question, response)
+		}
+		result <- resolution{response, err}
+	}()
+
+	select {
+	case r := <-result:
+		if r.err == nil {
+			return r.response
+		}
+	case <-time.After(time.Duration(runningConfig().StaleClientTimeout)):
+		debugf("serving stale %s while refresh continues", questionString(question))
+	}
+	return staleAnswer(stale)
+}
+
+func staleAnswer(stale *dnsmessage.Message) *dnsmessage.Message {
+	resolverCache.servedStale()
+	addEDE(stale, edeStaleAnswer, "")
+	return stale
+}
+
+// prefetchQuestion refreshes a popular cache entry before it expires so no
+// client has to wait for the full iterative lookup.
+func prefetchQuestion(question dnsmessage.Question) {
+	debugf("prefetching %s", questionString(question))
+	defer resolverCache.prefetchDone(question)
+	response, err := recurse(question, nil, false)
+	if err != nil {
+		warnf("prefetch of %s failed: %s", questionString(question), err)
+		return
 	}
-	return nil
+	resolverCache.Set(question, response)
 }
+
 func getRootServers() []net.IP {
 	rootservers := []net.IP{}
-	for _, rootserver := range strings.Split(ROOT_SERVERS, ",") {
+	for _, rootserver := range runningConfig().RootServers {
 		rootservers = append(rootservers, net.ParseIP(rootserver))
 	}
 	return rootservers
 }
 
+// maxIterations bounds the number of upstream queries dnsQuery makes while
+// walking down from the root for a single question. It was 3, too few once
+// a lookup has to follow several referrals and chase glueless nameservers.
+const maxIterations = 20
+
 /*
 MESSAGES Format
 
@@ -70,49 +266,129 @@ into 5 sections (some of which are empty in certain cases) shown below:
 	|      Additional     | RRs holding additional information
 	+---------------------+
 */
-func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Message, error) {
-	fmt.Printf("Questions %v \n", question)
-	for i := 0; i < 3; i++ {
-		dnsAnswer, header, err := outgoingDnsQuery(servers, question)
+func dnsQuery(servers []net.IP, question dnsmessage.Question, trace *Trace) (*dnsmessage.Message, error) {
+	return dnsQueryFrom(".", servers, question, trace, false)
+}
+
+// dnsQueryFrom iterates from servers authoritative for zone, the root
+// servers or those of a stub zone. With checkingDisabled the answer is not
+// validated.
+func dnsQueryFrom(zone string, servers []net.IP, question dnsmessage.Question, trace *Trace, checkingDisabled bool) (*dnsmessage.Message, error) {
+	debugf("Questions %v", question)
+	// zone is what the servers we are about to ask are authoritative for;
+	// every referral and every record we accept has to sit inside it.
+	minimiser := newQnameMinimiser(question, runningConfig().QnameMinimisation)
+	validator := newValidator(trace)
+	if checkingDisabled {
+		validator = nil
+	}
+	validator.enter(zone, servers, nil)
+	if validator.failed() {
+		return validator.bogus(), nil
+	}
+	for i := 0; i < maxIterations; i++ {
+		sent, minimised := minimiser.next(zone)
+		dnsAnswer, header, err := outgoingDnsQuery(servers, sent, trace)
 		if err != nil {
+			if minimised && minimiser.fallBack(err.Error()) {
+				continue
+			}
 			return nil, err
 		}
 		parsedAnswers, err := dnsAnswer.AllAnswers()
 		if err != nil {
 			return nil, err
 		}
-		// take it as dns query like if we already Authoritative we will simply return from here
-		if header.Authoritative {
-			return &dnsmessage.Message{
-				Header:  dnsmessage.Header{Response: true},
-				Answers: parsedAnswers,
-			}, nil
+		restoreCase(parsedAnswers, sent.Name)
+		trace.annotate(func(step *TraceStep) { step.Answers = recordsOf(parsedAnswers) })
+		if minimised && header.RCode != dnsmessage.RCodeSuccess {
+			// RFC 8020: nothing exists below a name that doesn't exist
+			if header.RCode == dnsmessage.RCodeNameError && minimiser.mode == MinimiseStrict {
+				authorities, err := dnsAnswer.AllAuthorities()
+				if err != nil {
+					return nil, err
+				}
+				// proving the shorter name absent proves the full one absent too
+				return validator.finish(sent, servers, &dnsmessage.Message{
+					Header:      dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+					Authorities: inBailiwick(authorities, zone),
+				}), nil
+			}
+			if minimiser.fallBack(rcodeString(header.RCode)) {
+				continue
+			}
+			return &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: header.RCode}}, nil
+		}
+		if minimised && header.Authoritative {
+			// the same servers are authoritative for the next label too
+			minimiser.reveal()
+			continue
 		}
 		authorities, err := dnsAnswer.AllAuthorities()
 		if err != nil {
 			return nil, err
 		}
+		restoreCase(authorities, sent.Name)
+		// take it as dns query like if we already Authoritative we will simply return from here
+		if header.Authoritative {
+			return validator.finish(question, servers, &dnsmessage.Message{
+				Header:      dnsmessage.Header{Response: true, RCode: header.RCode},
+				Answers:     inBailiwick(parsedAnswers, zone),
+				Authorities: inBailiwick(authorities, zone),
+			}), nil
+		}
+		if len(authorities) == 0 && minimised {
+			if minimiser.fallBack("empty non-authoritative answer") {
+				continue
+			}
+			return nil, fmt.Errorf("no referral for %s from zone %s", sent.Name.String(), zone)
+		}
 		if len(authorities) == 0 {
-			return &dnsmessage.Message{
+			return validator.finish(question, servers, &dnsmessage.Message{
 				Header: dnsmessage.Header{
 					RCode: dnsmessage.RCodeNameError,
 				},
-			}, nil
+			}), nil
 		}
-		nameservers := make([]string, len(authorities))
+		nameservers, referral := []string{}, ""
 
-		for k, authority := range authorities {
+		for _, authority := range authorities {
 			if authority.Header.Type == dnsmessage.TypeNS {
+				owner := authority.Header.Name.String()
+				if referral == "" {
+					if !isReferral(owner, zone, question.Name.String()) {
+						if isSubdomain(zone, owner) {
+							// the zone's own NS set, not a delegation
+							continue
+						}
+						warnf("ignoring out-of-bailiwick referral to %s from zone %s", owner, zone)
+						continue
+					}
+					referral = owner
+				}
+				if !strings.EqualFold(owner, referral) {
+					continue
+				}
 				// ==== confusing part ====
 				/*
 					-> The (*dnsmessage.NSResource) part is a type assertion.
 					-> It asserts that the Body field of authority is of type *dnsmessage.NSResource, which is a pointer to a dnsmessage.NSResource struct.
 					-> If this type assertion fails (i.e., Body is not of type *dnsmessage.NSResource), the program will panic unless handled safely.
 				*/
-				nameservers[k] = authority.Body.(*dnsmessage.NSResource).NS.String()
+				nameservers = append(nameservers, authority.Body.(*dnsmessage.NSResource).NS.String())
 
 			}
 		}
+		if len(nameservers) == 0 && minimised {
+			// no delegation at this label: an empty non-terminal or a name
+			// inside the same zone, show the servers one more label
+			minimiser.reveal()
+			continue
+		}
+		if len(nameservers) == 0 {
+			return nil, fmt.Errorf("no usable referral for %s from zone %s", question.Name.String(), zone)
+		}
+		trace.annotate(func(step *TraceStep) { step.Referral = nameservers })
 		additionals, err := dnsAnswer.AllAdditionals()
 		if err != nil {
 			return nil, err
@@ -121,9 +397,11 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 		servers = []net.IP{}
 
 		for _, additional := range additionals {
-			if additional.Header.Type == dnsmessage.TypeA {
+			// glue from outside the zone we asked could point anywhere, so
+			// it is skipped and those nameservers get looked up on their own
+			if additional.Header.Type == dnsmessage.TypeA && isSubdomain(additional.Header.Name.String(), zone) {
 				for _, nameserver := range nameservers {
-					if additional.Header.Name.String() == nameserver {
+					if strings.EqualFold(additional.Header.Name.String(), nameserver) {
 						newResolverServersFound = true
 						servers = append(servers, additional.Body.(*dnsmessage.AResource).A[:])
 					}
@@ -137,9 +415,9 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 						Name:  dnsmessage.MustNewName(nameserver),
 						Type:  dnsmessage.TypeA,
 						Class: dnsmessage.ClassINET,
-					})
+					}, trace)
 					if err != nil {
-						fmt.Printf("warning: lookup of nameserver %s failed: %err\n", nameserver, err)
+						warnf("lookup of nameserver %s failed: %s", nameserver, err)
 					} else {
 						newResolverServersFound = true
 						for _, answer := range response.Answers {
@@ -152,6 +430,11 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 				}
 			}
 		}
+		validator.enter(referral, servers, authorities)
+		if validator.failed() {
+			return validator.bogus(), nil
+		}
+		zone = referral
 	}
 	return &dnsmessage.Message{
 		Header: dnsmessage.Header{
@@ -159,7 +442,7 @@ func dnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Messa
 		},
 	}, nil
 }
-func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessage.Parser, *dnsmessage.Header, error) {
+func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question, trace *Trace) (*dnsmessage.Parser, *dnsmessage.Header, error) {
 	max := ^uint16(0)
 	randomNumber, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
 	if err != nil {
@@ -183,55 +466,46 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 		// A Question is a DNS query.
 		Questions: []dnsmessage.Question{question},
 	}
-	// Pack packs a full Message.
-	buf, err := message.Pack()
-	if err != nil {
-		return nil, nil, err
+	if cfg := runningConfig(); cfg.DNSSEC || cfg.DNSCookies {
+		message.Additionals = []dnsmessage.Resource{upstreamOPT(cfg.DNSSEC)}
 	}
-	var conn net.Conn
+	var answer []byte
 	for _, server := range servers {
-		// Dial connects to the address on the named network.
-		// Examples:
-		//
-		//	Dial("tcp", "golang.org:http")
-		//	Dial("tcp", "192.0.2.1:http")
-		//	Dial("tcp", "198.51.100.1:80")
-		//	Dial("udp", "[2001:db8::1]:domain")
-		//	Dial("udp", "[fe80::1%lo0]:53") <-
-		//	Dial("tcp", ":80")
-		//
-		conn, err = net.Dial("udp", server.String()+":53")
-		if err == nil {
-			break
-		}
-	}
-	if conn == nil {
-		return nil, nil, fmt.Errorf("failed to make connection to server %s", err)
-	}
-	// Write "writes" data to the connection.
-	// Write can be made to time out and return an error after a fixed
-	// time limit; see SetDeadline and SetWriteDeadline.
-	_, err = conn.Write(buf)
-	if err != nil {
-		return nil, nil, err
+		if !useCaseRandomization(server) {
+			answer, err = queryServer(server, message, false, trace)
+		} else {
+			sent := message
+			sent.Questions = []dnsmessage.Question{question}
+			sent.Questions[0].Name = randomizeCase(question.Name)
+			answer, err = queryServer(server, sent, true, trace)
+			if errors.Is(err, errCaseMismatch) {
+				// the server does not echo the name exactly, remember
+				// that and ask again the plain way
+				infra.markCaseInsensitive(server)
+				answer, err = queryServer(server, message, false, trace)
+			}
+		}
+		if err != nil {
+			warnf("query to %s failed: %s", server, err)
+			continue
+		}
+		break
 	}
-	// UDP messages    512 octets or less
-	answer := make([]byte, 512) // size limit of udp - message packet is 512
-	// NewReader returns a new [Reader] whose buffer has the default size.
-	n, err := bufio.NewReader(conn).Read(answer)
-	if err != nil {
-		return nil, nil, err
+	if answer == nil {
+		return nil, nil, fmt.Errorf("failed to get an answer from %d servers: %s", len(servers), err)
 	}
 
-	conn.Close() // no need of connection any more
-
 	// A Parser allows incrementally parsing a DNS message.
 	var p dnsmessage.Parser
 	//  Start parses the header and enables the parsing of Questions.
-	header, err := p.Start(answer[:n])
+	header, err := p.Start(answer)
 	if err != nil {
 		return nil, nil, fmt.Errorf("parser start error: %s", err)
 	}
+	trace.annotate(func(step *TraceStep) {
+		step.RCode = rcodeString(header.RCode)
+		step.Authoritative = header.Authoritative
+	})
 	questions, err := p.AllQuestions()
 	if err != nil {
 		return nil, nil, err
@@ -246,3 +520,168 @@ func outgoingDnsQuery(servers []net.IP, question dnsmessage.Question) (*dnsmessa
 	}
 	return &p, &header, nil
 }
+
+// queryServer sends message to one server and records how that went in the
+// infrastructure stats and the trace.
+func queryServer(server net.IP, message dnsmessage.Message, exactCase bool, trace *Trace) ([]byte, error) {
+	question := message.Questions[0]
+	started := time.Now()
+	answer, err := sendCookieQuery(server, dnsPort, message, exactCase)
+	rtt := time.Since(started)
+	infra.record(server, rtt, err)
+	step := TraceStep{Server: server.String(), Question: questionString(question), RTT: Duration(rtt)}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	trace.add(step)
+	return answer, err
+}
+
+// sendCookieQuery sends message to server on port, asking again if the
+// server answers BADCOOKIE.
+func sendCookieQuery(server net.IP, port string, message dnsmessage.Message, exactCase bool) ([]byte, error) {
+	answer, err := sendQuery(server, port, message, exactCase, false)
+	if err == nil && badCookie(answer) {
+		// the reply carried a fresh server cookie; ask again with it, and
+		// over TCP if the server still does not like it (RFC 7873 section 5.3)
+		debugf("%s sent BADCOOKIE, retrying with its server cookie", server)
+		answer, err = sendQuery(server, port, message, exactCase, false)
+		if err == nil && badCookie(answer) {
+			answer, err = sendQuery(server, port, message, exactCase, true)
+		}
+	}
+	return answer, err
+}
+
+// sendQuery sends message to server on port with our cookie for it, over
+// UDP unless useTCP or the reply comes back truncated.
+func sendQuery(server net.IP, port string, message dnsmessage.Message, exactCase, useTCP bool) ([]byte, error) {
+	message = cookies.withCookie(message, server)
+	// Pack packs a full Message.
+	buf, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if !useTCP {
+		answer, err := exchange(server, port, buf, message.Header.ID, message.Questions[0], exactCase)
+		if err != nil || !truncated(answer) {
+			return answer, err
+		}
+		debugf("reply from %s truncated, retrying over TCP", server)
+	}
+	return exchangeTCP(server, port, buf, message.Header.ID, message.Questions[0], exactCase)
+}
+
+// exchange sends one packed query to server on port from a fresh random port and
+// waits up to the configured query timeout for the matching reply. Datagrams
+// from other addresses, or with the wrong ID or question, are counted and
+// ignored while we keep waiting for the real one.
+//
+// With exactCase the reply must repeat the question name letter for letter;
+// a reply that only differs in case ends the exchange with errCaseMismatch.
+func exchange(server net.IP, port string, query []byte, id uint16, question dnsmessage.Question, exactCase bool) ([]byte, error) {
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	to := &net.UDPAddr{IP: server, Port: portNum}
+	conn, err := listenRandomPort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open socket for server %s: %s", server, err)
+	}
+	defer conn.Close() // no need of connection any more once we return
+
+	// Without a deadline a server that never answers would block this
+	// goroutine forever.
+	if err := conn.SetDeadline(time.Now().Add(time.Duration(runningConfig().QueryTimeout))); err != nil {
+		return nil, err
+	}
+	// WriteTo can be made to time out and return an error after a fixed
+	// time limit; see SetDeadline and SetWriteDeadline.
+	if _, err := conn.WriteTo(query, to); err != nil {
+		return nil, err
+	}
+	// UDP messages    512 octets or less, or what we advertised with EDNS
+	answer := make([]byte, ednsUpstreamSize)
+	for {
+		n, from, err := conn.ReadFrom(answer)
+		if err != nil {
+			return nil, err
+		}
+		if !sameSource(from, to) {
+			warnf("discarding reply from %s, query went to %s", from, to)
+			continue
+		}
+		if err := matchResponse(answer[:n], id, question, exactCase); err != nil {
+			warnf("discarding reply from %s: %s", from, err)
+			if errors.Is(err, errCaseMismatch) {
+				return nil, err
+			}
+			continue
+		}
+		if err := cookies.accept(server, answer[:n], true); err != nil {
+			warnf("discarding reply from %s: %s", from, err)
+			continue
+		}
+		return answer[:n], nil
+	}
+}
+
+// truncated reports whether the TC bit is set in a packed message.
+func truncated(msg []byte) bool {
+	return len(msg) > 2 && msg[2]&0x02 != 0
+}
+
+// exchangeTCP sends query over TCP (RFC 7766), for answers too big for a
+// datagram. Each message is preceded by its length as two octets.
+func exchangeTCP(server net.IP, port string, query []byte, id uint16, question dnsmessage.Question, exactCase bool) ([]byte, error) {
+	timeout := time.Duration(runningConfig().QueryTimeout)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server.String(), port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	answer, err := exchangeStream(conn, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := matchResponse(answer, id, question, exactCase); err != nil {
+		return nil, err
+	}
+	if err := cookies.accept(server, answer, false); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// exchangeStream writes query to a stream connection and reads one message
+// back, each preceded by its length as two octets.
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	if err := writeFrame(conn, query); err != nil {
+		return nil, err
+	}
+	return readFrame(conn)
+}
+
+// writeFrame writes msg to a stream connection, preceded by its length.
+func writeFrame(conn net.Conn, msg []byte) error {
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := conn.Write(append(framed, msg...))
+	return err
+}
+
+// readFrame reads one length-prefixed message from a stream connection.
+func readFrame(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
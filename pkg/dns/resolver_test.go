@@ -5,6 +5,8 @@ import (
 	"math/big"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -89,7 +91,7 @@ func TestOutgoingDnsQuery(t *testing.T) {
 	rootServers := strings.Split(ROOT_SERVERS, ",")
 
 	servers := []net.IP{net.ParseIP(rootServers[0])}
-	dnsAnswer, header, err := outgoingDnsQuery(servers, question)
+	dnsAnswer, header, err := outgoingDnsQuery(servers, question, nil)
 	if err != nil {
 		t.Fatalf("outgoingDnsQuery error: %s", err)
 	}
@@ -114,3 +116,237 @@ func TestOutgoingDnsQuery(t *testing.T) {
 		t.Fatalf("No answers received")
 	}
 }
+
+// testHandler scripts the reply of a stand-in nameserver.
+type testHandler func(query dnsmessage.Message) dnsmessage.Message
+
+// startTestServers runs one stand-in nameserver per loopback address, all on
+// the same port, and points the resolver at that port for the test.
+func startTestServers(t *testing.T, handlers map[string]testHandler) {
+	t.Helper()
+	var port string
+	for ip, handler := range handlers {
+		addr := net.JoinHostPort(ip, "0")
+		if port != "" {
+			addr = net.JoinHostPort(ip, port)
+		}
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatalf("listen %s: %s", addr, err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		if port == "" {
+			_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		}
+		go serveTestHandler(pc, handler)
+	}
+	oldPort := dnsPort
+	dnsPort = port
+	t.Cleanup(func() { dnsPort = oldPort })
+}
+
+func serveTestHandler(pc net.PacketConn, handler testHandler) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		reply := handler(query)
+		reply.Header.ID = query.Header.ID
+		reply.Header.Response = true
+		reply.Questions = query.Questions
+		packed, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(packed, addr)
+	}
+}
+
+// useTestHierarchy builds a tiny DNS tree on loopback: a root at 127.0.0.1
+// delegating com. to 127.0.0.2, which delegates example.com. to 127.0.0.3.
+// The example.com. server answers www.example.com. A with 192.0.2.1.
+func useTestHierarchy(t *testing.T) {
+	t.Helper()
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": referralTo("com.", "a.gtld-servers.net.", [4]byte{127, 0, 0, 2}),
+		"127.0.0.2": referralTo("example.com.", "ns1.example.com.", [4]byte{127, 0, 0, 3}),
+		"127.0.0.3": func(query dnsmessage.Message) dnsmessage.Message {
+			q := query.Questions[0]
+			if q.Name.String() != "www.example.com." || q.Type != dnsmessage.TypeA {
+				return dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true, RCode: dnsmessage.RCodeNameError}}
+			}
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+			}
+		},
+	})
+	useTestConfig(t, func(cfg *Config) { cfg.RootServers = []string{"127.0.0.1"} })
+}
+
+// useTestConfig applies a tweaked default config and a fresh cache for the
+// duration of the test.
+func useTestConfig(t *testing.T, tweak func(cfg *Config)) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.QueryTimeout = Duration(500 * time.Millisecond)
+	tweak(&cfg)
+	old := CurrentConfig()
+	oldCache, oldCookies := resolverCache, cookies
+	resolverCache, cookies = NewCache(), newCookieJar()
+	if err := Configure(cfg); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+	t.Cleanup(func() {
+		resolverCache, cookies = oldCache, oldCookies
+		Configure(old)
+	})
+}
+
+func TestRunningConfigIsNotCopied(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) { cfg.RootServers = []string{"192.0.2.53"} })
+	if allocs := testing.AllocsPerRun(100, func() { _ = runningConfig().QueryTimeout }); allocs != 0 {
+		t.Fatalf("reading the running config allocated %v times per query", allocs)
+	}
+	// the admin API still gets a copy of its own
+	cfg := CurrentConfig()
+	cfg.RootServers[0] = "198.51.100.53"
+	if got := runningConfig().RootServers[0]; got != "192.0.2.53" {
+		t.Fatalf("changing a copy changed the running config to %s", got)
+	}
+}
+
+func referralTo(zone, ns string, glue [4]byte) testHandler {
+	return func(query dnsmessage.Message) dnsmessage.Message {
+		return dnsmessage.Message{
+			Authorities: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(zone), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 172800},
+				Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName(ns)},
+			}},
+			Additionals: []dnsmessage.Resource{testA(ns, 172800, glue)},
+		}
+	}
+}
+
+func testA(name string, ttl uint32, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
+
+func testQuestion(name string, qtype dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+}
+
+func TestDnsQueryLocalHierarchy(t *testing.T) {
+	useTestHierarchy(t)
+
+	trace := NewTrace(testQuestion("www.example.com.", dnsmessage.TypeA))
+	response, err := dnsQuery(getRootServers(), testQuestion("www.example.com.", dnsmessage.TypeA), trace)
+	if err != nil {
+		t.Fatalf("dnsQuery error: %s", err)
+	}
+	if len(response.Answers) != 1 || rfcRecord(response.Answers[0]).PresentationData() != "192.0.2.1" {
+		t.Fatalf("unexpected answers %v", response.Answers)
+	}
+	if len(trace.Steps) != 3 {
+		t.Fatalf("expected 3 trace steps, got %d", len(trace.Steps))
+	}
+	if trace.Steps[0].Referral[0] != "a.gtld-servers.net." || !trace.Steps[2].Authoritative {
+		t.Fatalf("unexpected trace %+v", trace.Steps)
+	}
+}
+
+func TestResolveServesStale(t *testing.T) {
+	useTestHierarchy(t)
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	if _, err := resolve(question); err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+
+	// the record expires and every nameserver becomes unreachable
+	now := time.Now().Add(301 * time.Second)
+	resolverCache.now = func() time.Time { return now }
+	dnsPort = "1"
+
+	response, err := resolve(question)
+	if err != nil {
+		t.Fatalf("expected a stale answer, got error: %s", err)
+	}
+	if len(response.Answers) != 1 || response.Answers[0].Header.TTL != staleAnswerTTL {
+		t.Fatalf("unexpected stale answers %v", response.Answers)
+	}
+	opt := findOPT(response.Additionals)
+	if opt == nil {
+		t.Fatalf("expected an OPT record carrying the EDE")
+	}
+	options := opt.Body.(*dnsmessage.OPTResource).Options
+	if len(options) != 1 || options[0].Code != ednsOptionEDE || options[0].Data[1] != byte(edeStaleAnswer) {
+		t.Fatalf("expected a Stale Answer EDE, got %v", options)
+	}
+	if stale := resolverCache.Stats().Stale; stale != 1 {
+		t.Fatalf("expected 1 stale answer counted, got %d", stale)
+	}
+
+	// past the stale window the entry is gone for good
+	now = now.Add(25 * time.Hour)
+	if _, err := resolve(question); err == nil {
+		t.Fatalf("expected resolution to fail once the stale window has passed")
+	}
+}
+
+func TestResolveStaleRefreshesOnce(t *testing.T) {
+	var queries atomic.Int32
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": func(query dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			time.Sleep(200 * time.Millisecond)
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 2})},
+			}
+		},
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.QnameMinimisation = MinimiseOff
+		cfg.StaleClientTimeout = Duration(10 * time.Millisecond)
+	})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(question, &dnsmessage.Message{Answers: []dnsmessage.Resource{testA("www.example.com.", 60, [4]byte{192, 0, 2, 1})}})
+	now := time.Now().Add(61 * time.Second)
+	resolverCache.now = func() time.Time { return now }
+
+	// clients piling onto the stale entry share one refresh
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := resolve(question); err != nil {
+				t.Errorf("resolve: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if cached, ok := resolverCache.Get(question); ok && cached.Answers[0].Header.TTL == 300 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale entry was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("got %d queries upstream for one stale entry, want 1", n)
+	}
+}
@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Names under a forward zone are sent, with RD set, to that zone's own
+// forwarders; names under a stub zone are resolved iteratively starting at
+// the zone's nameservers rather than at the root. Either way the most
+// specific zone holding the name wins, so consul. can be forwarded while
+// everything else is iterated, or corp.internal. stubbed while
+// lab.corp.internal. is forwarded somewhere else again.
+
+// ForwardZone sends the names under Name to its own forwarders.
+type ForwardZone struct {
+	Name       string      `json:"name"`
+	Forwarders []Forwarder `json:"forwarders"`
+	Strategy   string      `json:"strategy"` // as forward_strategy, which it defaults to
+}
+
+// StubZone resolves the names under Name iteratively, starting at the
+// zone's nameservers instead of the root.
+type StubZone struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers"` // IP addresses of the zone's nameservers
+}
+
+// zoneRoute is where the names under zone go: forwarders for a forward
+// zone, servers for a stub zone.
+type zoneRoute struct {
+	zone       string
+	forwarders *forwarderPool
+	servers    []net.IP
+}
+
+type routeTable struct {
+	mu     sync.RWMutex
+	routes map[string]*zoneRoute // by canonical zone name
+}
+
+var zoneRoutes = &routeTable{}
+
+// validateZoneRoutes checks the forward and stub zones of c.
+func (c Config) validateZoneRoutes() error {
+	seen := make(map[string]bool)
+	zone := func(name string) error {
+		if _, err := dnsmessage.NewName(canonicalName(name)); err != nil {
+			return fmt.Errorf("zone %q: %w", name, err)
+		}
+		if seen[canonicalName(name)] {
+			return fmt.Errorf("zone %s is routed twice", canonicalName(name))
+		}
+		seen[canonicalName(name)] = true
+		return nil
+	}
+	for _, fz := range c.ForwardZones {
+		if err := zone(fz.Name); err != nil {
+			return err
+		}
+		if len(fz.Forwarders) == 0 {
+			return fmt.Errorf("forward zone %s has no forwarders", fz.Name)
+		}
+		for _, f := range fz.Forwarders {
+			if _, err := newTransport(f); err != nil {
+				return fmt.Errorf("forward zone %s: %w", fz.Name, err)
+			}
+		}
+		switch fz.Strategy {
+		case "", ForwardSequential, ForwardRandom, ForwardFastest, ForwardParallel:
+		default:
+			return fmt.Errorf("forward zone %s: strategy must be sequential, random, fastest or parallel, not %q", fz.Name, fz.Strategy)
+		}
+	}
+	for _, sz := range c.StubZones {
+		if err := zone(sz.Name); err != nil {
+			return err
+		}
+		if len(sz.Servers) == 0 {
+			return fmt.Errorf("stub zone %s has no servers", sz.Name)
+		}
+		for _, server := range sz.Servers {
+			if net.ParseIP(server) == nil {
+				return fmt.Errorf("stub zone %s: server %q is not an IP address", sz.Name, server)
+			}
+		}
+	}
+	return nil
+}
+
+// configure replaces the routes with the forward and stub zones of cfg.
+func (t *routeTable) configure(cfg Config) {
+	routes := make(map[string]*zoneRoute)
+	for _, fz := range cfg.ForwardZones {
+		zone, strategy := canonicalName(fz.Name), fz.Strategy
+		if strategy == "" {
+			strategy = cfg.ForwardStrategy
+		}
+		routes[zone] = &zoneRoute{zone: zone, forwarders: newForwarderPool(zone, strategy, fz.Forwarders)}
+	}
+	for _, sz := range cfg.StubZones {
+		route := &zoneRoute{zone: canonicalName(sz.Name)}
+		for _, server := range sz.Servers {
+			route.servers = append(route.servers, net.ParseIP(server))
+		}
+		routes[route.zone] = route
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = routes
+}
+
+// lookup returns the route of the longest zone name holds, nil if none
+// does.
+func (t *routeTable) lookup(name string) *zoneRoute {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.routes) == 0 {
+		return nil
+	}
+	name = canonicalName(name)
+	for {
+		if route, ok := t.routes[name]; ok {
+			return route
+		}
+		if name == "." {
+			return nil
+		}
+		if i := strings.Index(name, "."); i < len(name)-1 {
+			name = name[i+1:]
+		} else {
+			name = "."
+		}
+	}
+}
+
+// pools returns the forwarders of every forward zone, ordered by zone.
+func (t *routeTable) pools() []*forwarderPool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var pools []*forwarderPool
+	for _, route := range t.routes {
+		if route.forwarders != nil {
+			pools = append(pools, route.forwarders)
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].zone < pools[j].zone })
+	return pools
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// authoritativeAnswer answers every A query with ip, as the server for the
+// name, and only iterative ones.
+func authoritativeAnswer(ip [4]byte) testHandler {
+	return func(query dnsmessage.Message) dnsmessage.Message {
+		if query.Header.RecursionDesired {
+			return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeRefused}}
+		}
+		return dnsmessage.Message{
+			Header:  dnsmessage.Header{Authoritative: true},
+			Answers: []dnsmessage.Resource{testA(query.Questions[0].Name.String(), 300, ip)},
+		}
+	}
+}
+
+func TestZoneRoutes(t *testing.T) {
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": authoritativeAnswer([4]byte{192, 0, 2, 1}),  // the root
+		"127.0.0.2": recursiveAnswer([4]byte{192, 0, 2, 2}, nil), // the Consul agent
+		"127.0.0.3": authoritativeAnswer([4]byte{192, 0, 2, 3}),  // corp.internal.'s nameserver
+		"127.0.0.4": recursiveAnswer([4]byte{192, 0, 2, 4}, nil), // the lab's resolver
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.ForwardZones = []ForwardZone{
+			{Name: "consul", Forwarders: []Forwarder{{Address: net.JoinHostPort("127.0.0.2", dnsPort)}}},
+			{Name: "lab.corp.internal.", Forwarders: []Forwarder{{Address: net.JoinHostPort("127.0.0.4", dnsPort)}}},
+		}
+		cfg.StubZones = []StubZone{{Name: "Corp.Internal.", Servers: []string{"127.0.0.3"}}}
+	})
+
+	for name, want := range map[string]string{
+		"www.example.com.":           "192.0.2.1",
+		"notconsul.":                 "192.0.2.1",
+		"consul.":                    "192.0.2.2",
+		"web.service.consul.":        "192.0.2.2",
+		"www.corp.internal.":         "192.0.2.3",
+		"dc1.ad.corp.internal.":      "192.0.2.3",
+		"host.lab.corp.internal.":    "192.0.2.4",
+		"host.notlab.corp.internal.": "192.0.2.3",
+	} {
+		response, err := resolve(testQuestion(name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatalf("resolve %s: %s", name, err)
+		}
+		if len(response.Answers) != 1 || rfcRecord(response.Answers[0]).PresentationData() != want {
+			t.Fatalf("%s: got %v, want %s", name, response.Answers, want)
+		}
+	}
+	if stats := ForwarderResults(); len(stats) != 2 || stats[0].Zone != "consul." || stats[1].Zone != "lab.corp.internal." {
+		t.Fatalf("unexpected forwarder stats %+v", stats)
+	}
+}
+
+func TestZoneRoutesValidation(t *testing.T) {
+	for _, tweak := range []func(cfg *Config){
+		func(cfg *Config) {
+			cfg.StubZones = []StubZone{{Name: "corp.internal", Servers: []string{"10.0.0.1"}}}
+			cfg.ForwardZones = []ForwardZone{{Name: "CORP.internal.", Forwarders: []Forwarder{{Address: "10.0.0.2"}}}}
+		},
+		func(cfg *Config) { cfg.StubZones = []StubZone{{Name: "corp.internal"}} },
+		func(cfg *Config) {
+			cfg.StubZones = []StubZone{{Name: "corp.internal", Servers: []string{"dc1.corp.internal"}}}
+		},
+		func(cfg *Config) { cfg.ForwardZones = []ForwardZone{{Name: "consul"}} },
+		func(cfg *Config) {
+			cfg.ForwardZones = []ForwardZone{{Name: "consul", Forwarders: []Forwarder{{Address: "127.0.0.1:8600"}}, Strategy: "any"}}
+		},
+	} {
+		cfg := DefaultConfig()
+		tweak(&cfg)
+		if err := cfg.validate(); err == nil {
+			t.Fatalf("config accepted: forward zones %+v, stub zones %+v", cfg.ForwardZones, cfg.StubZones)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Response Rate Limiting keeps the UDP server from being used to reflect and
+// amplify traffic at a spoofed victim. Identical responses going to the same
+// client netblock draw from one token bucket: answers by name and type,
+// NXDOMAIN by the zone it came from, other errors per netblock. Once a
+// bucket is empty replies are dropped, except that every slip-th one goes
+// out truncated, so a real client behind the netblock retries over TCP while
+// a victim gets nothing larger than the query it never sent.
+
+// maxRRLBuckets bounds the bucket table. Buckets that have been full again
+// for a while are dropped as we go; past the bound the least recently
+// charged one makes room, as a flood of spoofed sources fills it with
+// buckets that are all fresh.
+const maxRRLBuckets = 100000
+
+// RRLStats counts rate limiting decisions.
+type RRLStats struct {
+	Buckets int    `json:"buckets"`
+	Allowed uint64 `json:"allowed"`
+	Dropped uint64 `json:"dropped"`
+	Slipped uint64 `json:"slipped"`
+	Exempt  uint64 `json:"exempt"`
+}
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+type rrlKey struct {
+	netblock string
+	kind     byte // 'a' answer, 'n' NXDOMAIN, 'e' error
+	name     string
+	qtype    dnsmessage.Type
+}
+
+type rrlBucket struct {
+	key     rrlKey
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[rrlKey]*list.Element
+	lru     *list.List // of *rrlBucket, the most recently charged first
+	limit   int        // maxRRLBuckets, smaller in tests
+
+	responses, errors float64 // per second, zero disables
+	window            time.Duration
+	slip              int
+	v4Mask, v6Mask    net.IPMask
+	exempt            []*net.IPNet
+
+	allowed, dropped, slipped, exempted atomic.Uint64
+}
+
+var responseLimiter = &rateLimiter{buckets: make(map[rrlKey]*list.Element), lru: list.New(), limit: maxRRLBuckets}
+
+func (l *rateLimiter) configure(cfg Config) {
+	exempt, _ := parseNets(cfg.RRLExempt)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets, l.lru, l.limit = make(map[rrlKey]*list.Element), list.New(), maxRRLBuckets
+	l.responses, l.errors = float64(cfg.RRLResponsesPerSecond), float64(cfg.RRLErrorsPerSecond)
+	if l.errors == 0 {
+		l.errors = l.responses
+	}
+	l.window, l.slip = time.Duration(cfg.RRLWindow), cfg.RRLSlip
+	l.v4Mask = net.CIDRMask(cfg.RRLIPv4Prefix, 8*net.IPv4len)
+	l.v6Mask = net.CIDRMask(cfg.RRLIPv6Prefix, 8*net.IPv6len)
+	l.exempt = exempt
+}
+
+// addrIP returns the IP of a client address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// key classifies response to client into the bucket it is charged to.
+func (l *rateLimiter) key(client net.IP, question dnsmessage.Question, response *dnsmessage.Message) rrlKey {
+	key := rrlKey{}
+	if ip4 := client.To4(); ip4 != nil {
+		key.netblock = ip4.Mask(l.v4Mask).String()
+	} else {
+		key.netblock = client.Mask(l.v6Mask).String()
+	}
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		key.kind, key.name, key.qtype = 'a', canonicalName(question.Name.String()), question.Type
+	case dnsmessage.RCodeNameError:
+		// a flood of random names in one zone is one stream of NXDOMAINs
+		key.kind, key.name = 'n', canonicalName(question.Name.String())
+		for _, rr := range response.Authorities {
+			if rr.Header.Type == dnsmessage.TypeSOA {
+				key.name = canonicalName(rr.Header.Name.String())
+			}
+		}
+	default:
+		key.kind = 'e'
+	}
+	return key
+}
+
+// check decides what to do with response to client.
+func (l *rateLimiter) check(client net.IP, question dnsmessage.Question, response *dnsmessage.Message, now time.Time) rrlAction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.responses == 0 || client == nil {
+		return rrlSend
+	}
+	for _, n := range l.exempt {
+		if n.Contains(client) {
+			l.exempted.Add(1)
+			return rrlSend
+		}
+	}
+	key := l.key(client, question, response)
+	rate := l.responses
+	if key.kind != 'a' {
+		rate = l.errors
+	}
+	l.expire(now)
+	var bucket *rrlBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*rrlBucket)
+	} else {
+		if len(l.buckets) >= l.limit {
+			l.remove(l.lru.Back())
+		}
+		bucket = &rrlBucket{key: key, tokens: rate, last: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+	}
+	// refill, but let a flood run up a debt of at most one window, so it
+	// stays limited for that long after it stops
+	bucket.tokens = min(rate, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		l.allowed.Add(1)
+		return rrlSend
+	}
+	bucket.tokens = max(bucket.tokens-1, -rate*l.window.Seconds())
+	bucket.dropped++
+	if l.slip > 0 && bucket.dropped%l.slip == 0 {
+		l.slipped.Add(1)
+		return rrlSlip
+	}
+	l.dropped.Add(1)
+	return rrlDrop
+}
+
+// expire forgets the buckets that have been full again for a while. They
+// are at the back of the list, so this only looks at the ones it drops.
+// Called with l.mu held.
+func (l *rateLimiter) expire(now time.Time) {
+	for elem := l.lru.Back(); elem != nil && now.Sub(elem.Value.(*rrlBucket).last) > l.window+time.Second; elem = l.lru.Back() {
+		l.remove(elem)
+	}
+}
+
+// remove drops the bucket of elem. Called with l.mu held.
+func (l *rateLimiter) remove(elem *list.Element) {
+	delete(l.buckets, elem.Value.(*rrlBucket).key)
+	l.lru.Remove(elem)
+}
+
+// slipped is the truncated reply sent in place of a rate limited one.
+func slipped(response *dnsmessage.Message) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: response.Header.ID, Response: true, Truncated: true, RecursionAvailable: response.Header.RecursionAvailable},
+		Questions: response.Questions,
+	}
+}
+
+// RRLResults returns the rate limiting counters.
+func RRLResults() RRLStats {
+	l := responseLimiter
+	l.mu.Lock()
+	buckets := len(l.buckets)
+	l.mu.Unlock()
+	return RRLStats{
+		Buckets: buckets,
+		Allowed: l.allowed.Load(),
+		Dropped: l.dropped.Load(),
+		Slipped: l.slipped.Load(),
+		Exempt:  l.exempted.Load(),
+	}
+}
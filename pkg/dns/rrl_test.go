@@ -0,0 +1,240 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testLimiter(t *testing.T, tweak func(cfg *Config)) *rateLimiter {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.RRLResponsesPerSecond = 5
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+	l := &rateLimiter{}
+	l.configure(cfg)
+	return l
+}
+
+func answerFor(question dnsmessage.Question) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{testA(question.Name.String(), 300, [4]byte{192, 0, 2, 1})},
+	}
+}
+
+func TestRRLLimitsIdenticalResponses(t *testing.T) {
+	l := testLimiter(t, nil)
+	now := time.Now()
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	client := net.ParseIP("192.0.2.10")
+
+	var actions []rrlAction
+	for i := 0; i < 9; i++ {
+		actions = append(actions, l.check(client, question, answerFor(question), now))
+	}
+	want := []rrlAction{rrlSend, rrlSend, rrlSend, rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i := range want {
+		if actions[i] != want[i] {
+			t.Fatalf("responses got %v, want %v", actions, want)
+		}
+	}
+
+	// the same /24 shares the bucket, other netblocks and other answers don't
+	if l.check(net.ParseIP("192.0.2.99"), question, answerFor(question), now) == rrlSend {
+		t.Fatalf("a neighbour in the same /24 was not limited")
+	}
+	if l.check(net.ParseIP("198.51.100.1"), question, answerFor(question), now) != rrlSend {
+		t.Fatalf("another netblock was limited")
+	}
+	other := testQuestion("mail.example.com.", dnsmessage.TypeA)
+	if l.check(client, other, answerFor(other), now) != rrlSend {
+		t.Fatalf("a different response was limited")
+	}
+
+	// the debt run up by the flood has to be paid off first
+	if l.check(client, question, answerFor(question), now.Add(time.Second)) == rrlSend {
+		t.Fatalf("flood forgiven after a second")
+	}
+	if l.check(client, question, answerFor(question), now.Add(5*time.Second)) != rrlSend {
+		t.Fatalf("bucket did not refill")
+	}
+
+	stats := RRLStats{Allowed: l.allowed.Load(), Dropped: l.dropped.Load(), Slipped: l.slipped.Load()}
+	if stats.Allowed != 8 || stats.Dropped != 3 || stats.Slipped != 3 {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+}
+
+func TestRRLNXDOMAINByZone(t *testing.T) {
+	l := testLimiter(t, func(cfg *Config) { cfg.RRLErrorsPerSecond = 2; cfg.RRLSlip = 0 })
+	now := time.Now()
+	client := net.ParseIP("2001:db8::1")
+	nxdomain := func(name string) (dnsmessage.Question, *dnsmessage.Message) {
+		return testQuestion(name, dnsmessage.TypeA), &dnsmessage.Message{
+			Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("hostmaster.example.com."), MinTTL: 300},
+			}},
+		}
+	}
+	var sent int
+	for _, name := range []string{"a1.example.com.", "b2.example.com.", "c3.example.com.", "d4.example.com."} {
+		question, response := nxdomain(name)
+		// another address in the same /56
+		if l.check(client, question, response, now) == rrlSend {
+			sent++
+		}
+		if l.check(net.ParseIP("2001:db8:0:ff::2"), question, response, now) == rrlSend {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Fatalf("random names in one zone sent %d NXDOMAINs, want 2", sent)
+	}
+}
+
+func TestRRLExemptAndDisabled(t *testing.T) {
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	now := time.Now()
+
+	l := testLimiter(t, func(cfg *Config) { cfg.RRLExempt = []string{"192.0.2.0/24"} })
+	off := testLimiter(t, func(cfg *Config) { cfg.RRLResponsesPerSecond = 0 })
+	for i := 0; i < 20; i++ {
+		if l.check(net.ParseIP("192.0.2.1"), question, answerFor(question), now) != rrlSend {
+			t.Fatalf("exempt client was limited")
+		}
+		if off.check(net.ParseIP("198.51.100.1"), question, answerFor(question), now) != rrlSend {
+			t.Fatalf("client limited with rate limiting off")
+		}
+	}
+	if l.exempted.Load() != 20 {
+		t.Fatalf("exempt counter %d, want 20", l.exempted.Load())
+	}
+}
+
+// recordingConn keeps the replies handlePacket writes.
+type recordingConn struct {
+	MockPacketConn
+	mu      sync.Mutex
+	replies []dnsmessage.Message
+}
+
+func (c *recordingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(p); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies = append(c.replies, msg)
+	return len(p), nil
+}
+
+func TestHandlePacketRateLimited(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RRLResponsesPerSecond = 2
+		cfg.RRLSlip = 1
+	})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(question, answerFor(question))
+
+	query := dnsmessage.Message{Header: dnsmessage.Header{ID: 42, RecursionDesired: true}, Questions: []dnsmessage.Question{question}}
+	buf, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	before := RRLResults()
+	conn := &recordingConn{}
+	for i := 0; i < 3; i++ {
+		if err := handlePacket(conn, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}, buf); err != nil {
+			t.Fatalf("handlePacket: %s", err)
+		}
+	}
+	if len(conn.replies) != 3 {
+		t.Fatalf("got %d replies, want 3", len(conn.replies))
+	}
+	last := conn.replies[2]
+	if !last.Header.Truncated || last.Header.ID != 42 || len(last.Answers) != 0 || conn.replies[1].Header.Truncated {
+		t.Fatalf("expected the third reply to be slipped, got %+v", conn.replies)
+	}
+	if stats := RRLResults(); stats.Allowed-before.Allowed != 2 || stats.Slipped-before.Slipped != 1 {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+}
+
+func TestSlippedFreshAnswerHasQuestion(t *testing.T) {
+	startTestServers(t, map[string]testHandler{
+		"127.0.0.1": func(query dnsmessage.Message) dnsmessage.Message {
+			return dnsmessage.Message{
+				Header:  dnsmessage.Header{Authoritative: true},
+				Answers: []dnsmessage.Resource{testA("www.example.com.", 300, [4]byte{192, 0, 2, 1})},
+			}
+		},
+	})
+	useTestConfig(t, func(cfg *Config) {
+		cfg.RootServers = []string{"127.0.0.1"}
+		cfg.QnameMinimisation = MinimiseOff
+		cfg.RRLResponsesPerSecond = 1
+		cfg.RRLSlip = 1
+	})
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+	query := dnsmessage.Message{Header: dnsmessage.Header{ID: 42, RecursionDesired: true}, Questions: []dnsmessage.Question{question}}
+	buf, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	conn := &recordingConn{}
+	for i := 0; i < 3; i++ {
+		// every answer fresh from upstream, not from the cache
+		resolverCache.Flush("", true)
+		if err := handlePacket(conn, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5353}, buf); err != nil {
+			t.Fatalf("handlePacket: %s", err)
+		}
+	}
+	slips := 0
+	for _, reply := range conn.replies {
+		if len(reply.Questions) != 1 || reply.Questions[0] != question {
+			t.Fatalf("reply %+v does not carry the question", reply)
+		}
+		if reply.Header.Truncated {
+			slips++
+		}
+	}
+	if slips == 0 {
+		t.Fatalf("no reply was slipped: %+v", conn.replies)
+	}
+}
+
+func TestRRLBoundsBuckets(t *testing.T) {
+	l := testLimiter(t, nil)
+	l.limit = 100
+	now := time.Now()
+	question := testQuestion("www.example.com.", dnsmessage.TypeA)
+
+	// every source of a spoofed flood is new: the oldest buckets make room
+	for i := 0; i < 1000; i++ {
+		client := net.IPv4(10, byte(i>>8), byte(i), 1)
+		if l.check(client, question, answerFor(question), now) != rrlSend {
+			t.Fatalf("the first response to %s was limited", client)
+		}
+		if len(l.buckets) > l.limit || l.lru.Len() != len(l.buckets) {
+			t.Fatalf("%d buckets, %d in the list, past the limit of %d", len(l.buckets), l.lru.Len(), l.limit)
+		}
+	}
+
+	// idle buckets go without waiting for the table to fill
+	l.check(net.ParseIP("192.0.2.1"), question, answerFor(question), now.Add(l.window+2*time.Second))
+	if len(l.buckets) != 1 {
+		t.Fatalf("%d buckets left after they all went idle, want 1", len(l.buckets))
+	}
+}
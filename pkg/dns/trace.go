@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Trace records every upstream exchange made while resolving one question,
+// so an operator can see the path from the root down to the answer.
+// A nil *Trace is valid and records nothing.
+type Trace struct {
+	mu       sync.Mutex
+	Question string      `json:"question"`
+	Steps    []TraceStep `json:"steps"`
+}
+
+type TraceStep struct {
+	Server        string   `json:"server"`
+	Question      string   `json:"question"`
+	RTT           Duration `json:"rtt"`
+	RCode         string   `json:"rcode,omitempty"`
+	Authoritative bool     `json:"authoritative"`
+	Answers       []Record `json:"answers,omitempty"`
+	Referral      []string `json:"referral,omitempty"` // NS names handed to us
+	Error         string   `json:"error,omitempty"`
+}
+
+func NewTrace(question dnsmessage.Question) *Trace {
+	return &Trace{Question: questionString(question)}
+}
+
+func (t *Trace) add(step TraceStep) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Steps = append(t.Steps, step)
+}
+
+// annotate lets the caller fill in what it learned from the latest step.
+func (t *Trace) annotate(f func(step *TraceStep)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.Steps) > 0 {
+		f(&t.Steps[len(t.Steps)-1])
+	}
+}
+
+func questionString(q dnsmessage.Question) string {
+	return q.Name.String() + " " + rfc.RecordClass(q.Class).String() + " " + rfc.RecordType(q.Type).String()
+}
@@ -0,0 +1,327 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Queries forwarded to an upstream resolver can go out as plain DNS, over
+// TLS (RFC 7858) or over HTTPS (RFC 8484), chosen per forwarder. Encrypted
+// upstreams are authenticated by their certificate, or by a pinned SPKI
+// hash where there is no certificate a public CA would vouch for (the
+// out-of-band key-pinned profile of RFC 7858 section 4.2). Connections to
+// them are kept open and reused.
+
+// Forwarder transports.
+const (
+	TransportUDP   = "udp"   // plain DNS, TCP when the reply is truncated
+	TransportTLS   = "tls"   // DNS over TLS
+	TransportHTTPS = "https" // DNS over HTTPS
+)
+
+// Forwarder is an upstream recursive resolver queries can be sent to.
+type Forwarder struct {
+	// Address is an IP address with an optional port (53 for udp, 853
+	// for tls), or for https the URL of the DoH endpoint.
+	Address   string `json:"address"`
+	Transport string `json:"transport"` // udp (the default), tls or https
+
+	// ServerName is sent as SNI and checked against the certificate,
+	// instead of the address.
+	ServerName string `json:"server_name"`
+
+	// SPKIPins are base64 SHA-256 hashes of SubjectPublicKeyInfos. If any
+	// is set the server's own certificate, the first it presents, must
+	// carry one of them; it then need not chain to a trusted CA nor match
+	// ServerName. A pinned CA or intermediate key is not enough.
+	SPKIPins []string `json:"spki_pins"`
+}
+
+// upstreamRootCAs verifies upstream certificates, the system roots if nil;
+// tests point it at their own certificate.
+var upstreamRootCAs *x509.CertPool
+
+// maxIdleUpstreamConns is how many connections to one encrypted upstream
+// are kept open between queries.
+const maxIdleUpstreamConns = 4
+
+// upstreamIdleTimeout is how long an idle DoH connection is kept.
+const upstreamIdleTimeout = 30 * time.Second
+
+var (
+	errUnknownTransport = errors.New("transport must be udp, tls or https")
+	errSPKIPin          = errors.New("server certificate does not match the pinned SPKI hashes")
+	errDoHStatus        = errors.New("DoH server did not answer with a DNS message")
+)
+
+// upstreamTransport carries queries to one forwarder.
+type upstreamTransport interface {
+	// exchange sends message and returns the packed reply to it.
+	exchange(message dnsmessage.Message) ([]byte, error)
+	// authenticated tells whether the channel proves the replies come
+	// from the forwarder, so that its AD bit can be believed (RFC 4035
+	// section 4.9.3 and RFC 6840 section 5.8).
+	authenticated() bool
+	String() string
+}
+
+// newTransport sets up the transport f asks for.
+func newTransport(f Forwarder) (upstreamTransport, error) {
+	pins, err := parseSPKIPins(f.SPKIPins)
+	if err != nil {
+		return nil, err
+	}
+	switch f.Transport {
+	case "", TransportUDP:
+		ip, port, err := splitUpstreamAddr(f.Address, "53")
+		if err != nil {
+			return nil, err
+		}
+		return &udpTransport{ip: ip, port: port}, nil
+	case TransportTLS:
+		ip, port, err := splitUpstreamAddr(f.Address, "853")
+		if err != nil {
+			return nil, err
+		}
+		serverName := f.ServerName
+		if serverName == "" {
+			serverName = ip.String()
+		}
+		return &tlsTransport{
+			addr:   net.JoinHostPort(ip.String(), port),
+			config: upstreamTLSConfig(serverName, pins, "dot"),
+			idle:   make(chan *tls.Conn, maxIdleUpstreamConns),
+		}, nil
+	case TransportHTTPS:
+		u, err := url.Parse(f.Address)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("forwarder %q is not an https URL", f.Address)
+		}
+		return &httpsTransport{
+			url: u.String(),
+			client: &http.Client{Transport: &http.Transport{
+				TLSClientConfig:     upstreamTLSConfig(f.ServerName, pins),
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleUpstreamConns,
+				IdleConnTimeout:     upstreamIdleTimeout,
+			}},
+		}, nil
+	default:
+		return nil, fmt.Errorf("forwarder %s: %w", f.Address, errUnknownTransport)
+	}
+}
+
+// splitUpstreamAddr splits an IP address with an optional port.
+func splitUpstreamAddr(addr, defaultPort string) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "", fmt.Errorf("forwarder %q is not an IP address", addr)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return nil, "", fmt.Errorf("forwarder %q: %w", addr, err)
+	}
+	return ip, port, nil
+}
+
+func parseSPKIPins(pins []string) ([][]byte, error) {
+	hashes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("SPKI pin %q is not a base64 SHA-256 hash", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// upstreamTLSConfig is the client side TLS configuration for an encrypted
+// upstream. An empty serverName leaves it to the HTTP client to fill in.
+func upstreamTLSConfig(serverName string, pins [][]byte, nextProtos ...string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    upstreamRootCAs,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+	}
+	if len(pins) > 0 {
+		// the pin is what authenticates the server, the chain may be
+		// self-signed and is not looked at
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkSPKIPins(cs.PeerCertificates, pins)
+		}
+	}
+	return cfg
+}
+
+// checkSPKIPins accepts a chain whose leaf has a public key hashing to one
+// of pins. Only the leaf counts: the handshake proves the server holds its
+// key, while anyone can send along a copy of some other certificate.
+func checkSPKIPins(chain []*x509.Certificate, pins [][]byte) error {
+	if len(chain) == 0 {
+		return errSPKIPin
+	}
+	hash := sha256.Sum256(chain[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(hash[:], pin) {
+			return nil
+		}
+	}
+	return errSPKIPin
+}
+
+// udpTransport is plain DNS with cookies, as spoken to authoritative
+// servers.
+type udpTransport struct {
+	ip   net.IP
+	port string
+}
+
+func (t *udpTransport) exchange(message dnsmessage.Message) ([]byte, error) {
+	return sendCookieQuery(t.ip, t.port, message, false)
+}
+
+func (t *udpTransport) authenticated() bool {
+	return false
+}
+
+func (t *udpTransport) String() string {
+	return net.JoinHostPort(t.ip.String(), t.port)
+}
+
+// tlsTransport is DNS over TLS, one query at a time on each connection.
+type tlsTransport struct {
+	addr   string
+	config *tls.Config
+	idle   chan *tls.Conn // open connections waiting for the next query
+}
+
+func (t *tlsTransport) exchange(message dnsmessage.Message) ([]byte, error) {
+	query, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(runningConfig().QueryTimeout)
+	for {
+		conn, reused, err := t.conn(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		answer, err := exchangeStream(conn, query)
+		if err != nil {
+			conn.Close()
+			if reused {
+				// the server may have closed it while it sat idle
+				debugf("idle connection to %s failed: %s", t, err)
+				continue
+			}
+			return nil, err
+		}
+		if err := matchResponse(answer, message.Header.ID, message.Questions[0], false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		t.release(conn)
+		return answer, nil
+	}
+}
+
+// conn returns an idle connection if there is one, a new one otherwise.
+func (t *tlsTransport) conn(timeout time.Duration) (*tls.Conn, bool, error) {
+	select {
+	case conn := <-t.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", t.addr, t.config)
+	return conn, false, err
+}
+
+func (t *tlsTransport) release(conn *tls.Conn) {
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (t *tlsTransport) authenticated() bool {
+	return true
+}
+
+func (t *tlsTransport) String() string {
+	return "tls://" + t.addr
+}
+
+// httpsTransport is DNS over HTTPS; the HTTP client pools the connections,
+// and with HTTP/2 several queries share one.
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpsTransport) exchange(message dnsmessage.Message) ([]byte, error) {
+	// ID 0 as RFC 8484 recommends, HTTP tells the replies apart
+	message.Header.ID = 0
+	query, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(runningConfig().QueryTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != dohMediaType {
+		return nil, fmt.Errorf("%w: %s", errDoHStatus, resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHMessage))
+	if err != nil {
+		return nil, err
+	}
+	if err := matchResponse(answer, 0, message.Questions[0], false); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+func (t *httpsTransport) authenticated() bool {
+	return true
+}
+
+func (t *httpsTransport) String() string {
+	return t.url
+}
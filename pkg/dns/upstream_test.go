@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func useUpstreamRootCAs(t *testing.T, pool *x509.CertPool) {
+	old := upstreamRootCAs
+	upstreamRootCAs = pool
+	t.Cleanup(func() { upstreamRootCAs = old })
+}
+
+// forwardedQuery asks upstream for question and checks it got the cached
+// test answer.
+func forwardedQuery(t *testing.T, upstream upstreamTransport, question dnsmessage.Question) {
+	t.Helper()
+	answer, err := upstream.exchange(dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	})
+	if err != nil {
+		t.Fatalf("exchange with %s: %s", upstream, err)
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(answer); err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if len(reply.Answers) != 1 || reply.Answers[0].Header.Name != question.Name {
+		t.Fatalf("unexpected reply from %s: %+v", upstream, reply)
+	}
+}
+
+// spkiPin is the pin of the certificate the TLS server at addr presents.
+func spkiPin(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	hash := sha256.Sum256(conn.ConnectionState().PeerCertificates[0].RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestTLSTransport(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	www := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+	addr, pool := startTestTLS(t)
+	useUpstreamRootCAs(t, pool)
+
+	upstream, err := newTransport(Forwarder{Address: addr, Transport: TransportTLS})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	forwardedQuery(t, upstream, www)
+	forwardedQuery(t, upstream, www)
+	if idle := len(upstream.(*tlsTransport).idle); idle != 1 {
+		t.Fatalf("%d idle connections after two queries, want the one reused", idle)
+	}
+
+	// the certificate is valid for localhost, and only that
+	upstream, _ = newTransport(Forwarder{Address: addr, Transport: TransportTLS, ServerName: "localhost"})
+	forwardedQuery(t, upstream, www)
+	upstream, _ = newTransport(Forwarder{Address: addr, Transport: TransportTLS, ServerName: "dns.example.net"})
+	if _, err := upstream.exchange(dnsmessage.Message{Questions: []dnsmessage.Question{www}}); err == nil {
+		t.Fatalf("certificate accepted for the wrong server name")
+	}
+}
+
+func TestTLSTransportSPKIPinning(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	www := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+	addr, _ := startTestTLS(t)
+	pin := spkiPin(t, addr)
+
+	// not signed by any CA we trust, but pinned
+	upstream, err := newTransport(Forwarder{Address: addr, Transport: TransportTLS, SPKIPins: []string{pin}})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	forwardedQuery(t, upstream, www)
+
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	upstream, _ = newTransport(Forwarder{Address: addr, Transport: TransportTLS, SPKIPins: []string{other}})
+	if _, err := upstream.exchange(dnsmessage.Message{Questions: []dnsmessage.Question{www}}); err == nil {
+		t.Fatalf("server accepted without a matching pin")
+	}
+}
+
+func TestHTTPSTransport(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	www, mail := testQuestion("www.example.com.", dnsmessage.TypeA), testQuestion("mail.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+	resolverCache.Set(mail, answerFor(mail))
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(NewDoHHandler())
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	useUpstreamRootCAs(t, pool)
+
+	upstream, err := newTransport(Forwarder{Address: srv.URL + "/dns-query", Transport: TransportHTTPS})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	for _, question := range []dnsmessage.Question{www, mail, www} {
+		forwardedQuery(t, upstream, question)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("%d connections for three queries, want one", n)
+	}
+
+	upstream, _ = newTransport(Forwarder{Address: srv.URL + "/nowhere", Transport: TransportHTTPS})
+	if _, err := upstream.exchange(dnsmessage.Message{Questions: []dnsmessage.Question{www}}); err == nil {
+		t.Fatalf("404 taken for an answer")
+	}
+}
+
+// testCertificate returns a self-signed certificate for name and its key.
+func testCertificate(t *testing.T, name string) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	return der, key
+}
+
+func TestTLSTransportSPKIPinOnlyLeaf(t *testing.T) {
+	useTestConfig(t, func(cfg *Config) {})
+	www := testQuestion("www.example.com.", dnsmessage.TypeA)
+	resolverCache.Set(www, answerFor(www))
+
+	// a server holding an unrelated key sends a copy of the pinned
+	// certificate after its own
+	pinnedDER, _ := testCertificate(t, "dns.example.net")
+	leafDER, leafKey := testCertificate(t, "attacker.example")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER, pinnedDER}, PrivateKey: leafKey}},
+	})
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ServeTLS(l)
+
+	pinned, err := x509.ParseCertificate(pinnedDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	upstream, err := newTransport(Forwarder{Address: l.Addr().String(), Transport: TransportTLS,
+		SPKIPins: []string{base64.StdEncoding.EncodeToString(hash[:])}})
+	if err != nil {
+		t.Fatalf("newTransport: %s", err)
+	}
+	if _, err := upstream.exchange(dnsmessage.Message{Questions: []dnsmessage.Question{www}}); !errors.Is(err, errSPKIPin) {
+		t.Fatalf("got %v, want %v", err, errSPKIPin)
+	}
+
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSPKIPins([]*x509.Certificate{pinned, leaf}, [][]byte{hash[:]}); err != nil {
+		t.Fatalf("pinned leaf refused: %s", err)
+	}
+}
+
+func TestNewTransportErrors(t *testing.T) {
+	for _, f := range []Forwarder{
+		{Address: "dns.example.net"},
+		{Address: "192.0.2.1:domain-ish"},
+		{Address: "192.0.2.1", Transport: "quic"},
+		{Address: "http://192.0.2.1/dns-query", Transport: TransportHTTPS},
+		{Address: "192.0.2.1", Transport: TransportTLS, SPKIPins: []string{"not base64!"}},
+		{Address: "192.0.2.1", Transport: TransportTLS, SPKIPins: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	} {
+		if _, err := newTransport(f); err == nil {
+			t.Fatalf("forwarder %+v accepted", f)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Off-path attackers (Kaminsky, 2008) poison caches by racing the real
+// server with forged replies. A forged reply only gets in if it comes from
+// the right address and port, hits the right destination port, and carries
+// the right ID and question. Randomising the source port and the ID gives
+// roughly 32 bits to guess instead of 16.
+
+// ValidationStats counts upstream replies that were thrown away.
+type ValidationStats struct {
+	SourceMismatch   uint64 `json:"source_mismatch"`   // came from an address we did not query
+	IDMismatch       uint64 `json:"id_mismatch"`       // wrong message ID
+	QuestionMismatch uint64 `json:"question_mismatch"` // question section differs from ours
+	CaseMismatch     uint64 `json:"case_mismatch"`     // 0x20: name came back in a different case
+	CookieMismatch   uint64 `json:"cookie_mismatch"`   // wrong or missing DNS cookie
+	Malformed        uint64 `json:"malformed"`         // could not be parsed or not a response
+}
+
+var validation struct {
+	sourceMismatch, idMismatch, questionMismatch, caseMismatch, cookieMismatch, malformed atomic.Uint64
+}
+
+// ResponseValidationStats returns the discarded reply counters.
+func ResponseValidationStats() ValidationStats {
+	return ValidationStats{
+		SourceMismatch:   validation.sourceMismatch.Load(),
+		IDMismatch:       validation.idMismatch.Load(),
+		QuestionMismatch: validation.questionMismatch.Load(),
+		CaseMismatch:     validation.caseMismatch.Load(),
+		CookieMismatch:   validation.cookieMismatch.Load(),
+		Malformed:        validation.malformed.Load(),
+	}
+}
+
+var (
+	errIDMismatch       = errors.New("response ID does not match query")
+	errQuestionMismatch = errors.New("response question does not match query")
+	errNotResponse      = errors.New("message is not a response")
+	errCaseMismatch     = errors.New("response question name differs in case from query")
+)
+
+// matchResponse checks that answer is the reply to the query with the given
+// ID and question. With exactCase the name has to match letter for letter.
+func matchResponse(answer []byte, id uint16, question dnsmessage.Question, exactCase bool) error {
+	var p dnsmessage.Parser
+	header, err := p.Start(answer)
+	if err != nil {
+		validation.malformed.Add(1)
+		return err
+	}
+	if !header.Response {
+		validation.malformed.Add(1)
+		return errNotResponse
+	}
+	if header.ID != id {
+		validation.idMismatch.Add(1)
+		return errIDMismatch
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		validation.malformed.Add(1)
+		return err
+	}
+	if len(questions) != 1 || !sameQuestion(questions[0], question) {
+		validation.questionMismatch.Add(1)
+		return errQuestionMismatch
+	}
+	if exactCase && questions[0].Name.String() != question.Name.String() {
+		validation.caseMismatch.Add(1)
+		return errCaseMismatch
+	}
+	return nil
+}
+
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+// sameSource reports whether a reply came from the address and port the
+// query was sent to.
+func sameSource(from net.Addr, to *net.UDPAddr) bool {
+	udp, ok := from.(*net.UDPAddr)
+	if !ok || !udp.IP.Equal(to.IP) || udp.Port != to.Port {
+		validation.sourceMismatch.Add(1)
+		return false
+	}
+	return true
+}
+
+// randomPortAttempts bounds how often we try to bind a random port before
+// letting the kernel pick one.
+const randomPortAttempts = 10
+
+// listenRandomPort opens a UDP socket on a port picked uniformly from the
+// unprivileged range, so every query leaves from a fresh, unpredictable port.
+func listenRandomPort() (net.PacketConn, error) {
+	for i := 0; i < randomPortAttempts; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(65536-1024))
+		if err != nil {
+			return nil, err
+		}
+		pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", 1024+n.Int64()))
+		if err == nil {
+			return pc, nil
+		}
+	}
+	return net.ListenPacket("udp", ":0")
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestExchangeDiscardsForgedReplies answers every query with three forgeries
+// (one from another port, one with the wrong ID, one for another question)
+// ahead of the genuine reply.
+func TestExchangeDiscardsForgedReplies(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer server.Close()
+	attacker, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer attacker.Close()
+
+	_, port, _ := net.SplitHostPort(server.LocalAddr().String())
+	oldPort := dnsPort
+	dnsPort = port
+	defer func() { dnsPort = oldPort }()
+
+	go func() {
+		buf := make([]byte, 512)
+		n, client, err := server.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+		reply := func(id uint16, question dnsmessage.Question, ip [4]byte) []byte {
+			msg := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+				Questions: []dnsmessage.Question{question},
+				Answers:   []dnsmessage.Resource{testA(question.Name.String(), 300, ip)},
+			}
+			packed, _ := msg.Pack()
+			return packed
+		}
+		q := query.Questions[0]
+		attacker.WriteTo(reply(query.Header.ID, q, [4]byte{6, 6, 6, 6}), client)
+		server.WriteTo(reply(query.Header.ID+1, q, [4]byte{6, 6, 6, 6}), client)
+		server.WriteTo(reply(query.Header.ID, testQuestion("evil.example.", dnsmessage.TypeA), [4]byte{6, 6, 6, 6}), client)
+		server.WriteTo(reply(query.Header.ID, q, [4]byte{192, 0, 2, 1}), client)
+	}()
+
+	before := ResponseValidationStats()
+	dnsAnswer, _, err := outgoingDnsQuery([]net.IP{net.ParseIP("127.0.0.1")}, testQuestion("www.example.com.", dnsmessage.TypeA), nil)
+	if err != nil {
+		t.Fatalf("outgoingDnsQuery: %s", err)
+	}
+	answers, err := dnsAnswer.AllAnswers()
+	if err != nil {
+		t.Fatalf("AllAnswers: %s", err)
+	}
+	if len(answers) != 1 || rfcRecord(answers[0]).PresentationData() != "192.0.2.1" {
+		t.Fatalf("a forged reply got through: %v", answers)
+	}
+
+	after := ResponseValidationStats()
+	if after.SourceMismatch-before.SourceMismatch != 1 ||
+		after.IDMismatch-before.IDMismatch != 1 ||
+		after.QuestionMismatch-before.QuestionMismatch != 1 {
+		t.Fatalf("forgeries not counted: before %+v after %+v", before, after)
+	}
+}
+
+func TestListenRandomPortVaries(t *testing.T) {
+	ports := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		pc, err := listenRandomPort()
+		if err != nil {
+			t.Fatalf("listenRandomPort: %s", err)
+		}
+		_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+		ports[port] = true
+		pc.Close()
+	}
+	if len(ports) < 2 {
+		t.Fatalf("source ports are not random: %v", ports)
+	}
+}
@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Master files are read and written by message/rfc, for the zones we serve
+// as for the cache dump; these convert its records to and from dnsmessage.
+
+// parseZoneFile reads the master file at path with origin as the initial
+// $ORIGIN.
+func parseZoneFile(path, origin string) ([]dnsmessage.Resource, error) {
+	records, err := rfc.ParseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]dnsmessage.Resource, 0, len(records))
+	for _, rec := range records {
+		if rec.Class != rfc.ClassIN {
+			return nil, fmt.Errorf("%s %s: class %s, only IN is supported", rec.Name, rec.Type, rec.Class)
+		}
+		r, err := resourceOf(rec)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", rec.Name, rec.Type, err)
+		}
+		resources = append(resources, r)
+	}
+	return resources, nil
+}
+
+// resourceOf converts rec from its message/rfc form.
+func resourceOf(rec rfc.ResourceRecord) (dnsmessage.Resource, error) {
+	var err error
+	name := func(s string) dnsmessage.Name {
+		n, nameErr := dnsmessage.NewName(s)
+		if err == nil {
+			err = nameErr
+		}
+		return n
+	}
+	r := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{
+		Name:  name(rec.Name),
+		Type:  dnsmessage.Type(rec.Type),
+		Class: dnsmessage.Class(rec.Class),
+		TTL:   rec.TTL,
+	}}
+	switch d := rec.RData.(type) {
+	case rfc.RDataA:
+		ip := net.ParseIP(d.Address).To4()
+		if ip == nil {
+			return r, fmt.Errorf("%q is not an IPv4 address", d.Address)
+		}
+		r.Body = &dnsmessage.AResource{A: [4]byte(ip)}
+	case rfc.RDataAAAA:
+		ip := net.ParseIP(d.Address)
+		if ip == nil {
+			return r, fmt.Errorf("%q is not an IPv6 address", d.Address)
+		}
+		r.Body = &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}
+	case rfc.RDataNS:
+		r.Body = &dnsmessage.NSResource{NS: name(d.NsdName)}
+	case rfc.RDataCNAME:
+		r.Body = &dnsmessage.CNAMEResource{CNAME: name(d.CName)}
+	case rfc.RDataPTR:
+		r.Body = &dnsmessage.PTRResource{PTR: name(d.PtrDName)}
+	case rfc.RDataMX:
+		r.Body = &dnsmessage.MXResource{Pref: d.Preference, MX: name(d.Exchange)}
+	case rfc.RDataSRV:
+		r.Body = &dnsmessage.SRVResource{Priority: d.Priority, Weight: d.Weight, Port: d.Port, Target: name(d.Target)}
+	case rfc.RDataSOA:
+		r.Body = &dnsmessage.SOAResource{NS: name(d.MName), MBox: name(d.RName), Serial: d.Serial,
+			Refresh: d.Refresh, Retry: d.Retry, Expire: d.Expire, MinTTL: d.Minimum}
+	case rfc.RDataTXT:
+		txt, txtErr := d.Strings()
+		if txtErr != nil {
+			return r, txtErr
+		}
+		r.Body = &dnsmessage.TXTResource{TXT: txt}
+	case rfc.RDataDS:
+		r.Body = &dnsmessage.UnknownResource{Type: typeDS,
+			Data: ds{KeyTag: d.KeyTag, Algorithm: d.Algorithm, DigestType: d.DigestType, Digest: d.Digest}.rdata()}
+	case rfc.RDataDNSKEY:
+		r.Body = &dnsmessage.UnknownResource{Type: typeDNSKEY,
+			Data: dnskey{Flags: d.Flags, Protocol: d.Protocol, Algorithm: d.Algorithm, PublicKey: d.PublicKey}.rdata()}
+	case rfc.RDataUnknown:
+		r.Body = &dnsmessage.UnknownResource{Type: r.Header.Type, Data: d.Data}
+	default:
+		return r, fmt.Errorf("no RDATA conversion for %T", rec.RData)
+	}
+	return r, err
+}
+
+// rdataText is the RDATA of types message/rfc has no type for, in
+// presentation format.
+type rdataText string
+
+func (d rdataText) String() string {
+	return string(d)
+}
+
+// rfcRecord converts rr to its message/rfc form.
+func rfcRecord(rr dnsmessage.Resource) rfc.ResourceRecord {
+	rec := rfc.ResourceRecord{
+		Name:     rr.Header.Name.String(),
+		Type:     rfc.RecordType(rr.Header.Type),
+		Class:    rfc.RecordClass(rr.Header.Class),
+		TTL:      rr.Header.TTL,
+		RDLength: rr.Header.Length,
+	}
+	switch b := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		rec.RData = rfc.RDataA{Address: net.IP(b.A[:]).String()}
+	case *dnsmessage.AAAAResource:
+		rec.RData = rfc.RDataAAAA{Address: net.IP(b.AAAA[:]).String()}
+	case *dnsmessage.NSResource:
+		rec.RData = rfc.RDataNS{NsdName: b.NS.String()}
+	case *dnsmessage.CNAMEResource:
+		rec.RData = rfc.RDataCNAME{CName: b.CNAME.String()}
+	case *dnsmessage.PTRResource:
+		rec.RData = rfc.RDataPTR{PtrDName: b.PTR.String()}
+	case *dnsmessage.MXResource:
+		rec.RData = rfc.RDataMX{Preference: b.Pref, Exchange: b.MX.String()}
+	case *dnsmessage.SRVResource:
+		rec.RData = rfc.RDataSRV{Priority: b.Priority, Weight: b.Weight, Port: b.Port, Target: b.Target.String()}
+	case *dnsmessage.SOAResource:
+		rec.RData = rfc.RDataSOA{MName: b.NS.String(), RName: b.MBox.String(), Serial: b.Serial,
+			Refresh: b.Refresh, Retry: b.Retry, Expire: b.Expire, Minimum: b.MinTTL}
+	case *dnsmessage.TXTResource:
+		rec.RData = rfc.NewRDataTXT(b.TXT...)
+	case *dnsmessage.UnknownResource:
+		rec.RData = rfc.RDataUnknown{Data: b.Data}
+		switch b.Type {
+		case typeDS:
+			if d, err := parseDS(b.Data); err == nil {
+				rec.RData = rfc.RDataDS{KeyTag: d.KeyTag, Algorithm: d.Algorithm, DigestType: d.DigestType, Digest: d.Digest}
+			}
+		case typeDNSKEY:
+			if k, err := parseDNSKEY(b.Data); err == nil {
+				rec.RData = rfc.RDataDNSKEY{Flags: k.Flags, Protocol: k.Protocol, Algorithm: k.Algorithm, PublicKey: k.PublicKey}
+			}
+		default:
+			// RRSIG, NSEC and NSEC3 read better as text than in hex
+			if s, ok := dnssecText(b); ok {
+				rec.RData = s
+			}
+		}
+	case nil:
+	default:
+		// OPT, which has no presentation format
+		rec.RData = rdataText(fmt.Sprintf("%v", b))
+	}
+	return rec
+}
+
+// dnssecText renders the DNSSEC records message/rfc has no type for in
+// their RFC 4034 and RFC 5155 presentation formats.
+func dnssecText(b *dnsmessage.UnknownResource) (rdataText, bool) {
+	switch b.Type {
+	case typeRRSIG:
+		if s, err := parseRRSIG(b.Data); err == nil {
+			const stamp = "20060102150405"
+			return rdataText(fmt.Sprintf("%s %d %d %d %s %s %d %s %s", rfc.RecordType(s.TypeCovered), s.Algorithm, s.Labels, s.OriginalTTL,
+				time.Unix(int64(s.Expiration), 0).UTC().Format(stamp), time.Unix(int64(s.Inception), 0).UTC().Format(stamp),
+				s.KeyTag, s.SignerName, base64.StdEncoding.EncodeToString(s.Signature))), true
+		}
+	case typeNSEC:
+		if n, err := parseNSEC(b.Data); err == nil {
+			return rdataText(strings.TrimSpace(n.NextDomain + " " + typesString(n.Types))), true
+		}
+	case typeNSEC3:
+		if n, err := parseNSEC3(b.Data); err == nil {
+			salt := "-"
+			if len(n.Salt) > 0 {
+				salt = strings.ToUpper(hex.EncodeToString(n.Salt))
+			}
+			return rdataText(strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", n.HashAlgorithm, n.Flags, n.Iterations, salt,
+				base32Hex.EncodeToString(n.NextHashed), typesString(n.Types)))), true
+		}
+	}
+	return "", false
+}
+
+func typesString(bitmap typeBitmap) string {
+	var names []string
+	for _, t := range bitmap.types() {
+		names = append(names, rfc.RecordType(t).String())
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,227 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The journal of a zone keeps the differences between its last serials so
+// that secondaries can be brought up to date by IXFR (RFC 1995) rather than
+// a full AXFR. On disk it is a master file holding the differences one
+// after the other, each laid out as in an IXFR: the old SOA, the records
+// deleted, the new SOA, the records added.
+
+// maxJournalDiffs bounds the differences a journal keeps; a secondary
+// further behind gets an AXFR.
+const maxJournalDiffs = 100
+
+// zoneDiff is the change from one serial of a zone to the next. Deleted
+// starts with the old SOA, Added with the new one.
+type zoneDiff struct {
+	Deleted []dnsmessage.Resource
+	Added   []dnsmessage.Resource
+}
+
+type zoneJournal struct {
+	mu    sync.Mutex
+	path  string // "" keeps the journal in memory only
+	diffs []zoneDiff
+}
+
+// loadJournal reads the journal at path. A missing file is an empty
+// journal.
+func loadJournal(path string) (*zoneJournal, error) {
+	j := &zoneJournal{path: path}
+	if path == "" {
+		return j, nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	records, err := parseZoneFile(path, ".")
+	if err != nil {
+		return nil, fmt.Errorf("journal: %w", err)
+	}
+	if j.diffs, err = splitDiffs(records); err != nil {
+		return nil, fmt.Errorf("journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// add appends d to the journal and writes it out. A difference that does
+// not follow on from the last one starts the journal over.
+func (j *zoneJournal) add(d zoneDiff) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if n := len(j.diffs); n > 0 && soaSerial(j.diffs[n-1].Added[0]) != soaSerial(d.Deleted[0]) {
+		j.diffs = nil
+	}
+	j.diffs = append(j.diffs, d)
+	if len(j.diffs) > maxJournalDiffs {
+		j.diffs = append([]zoneDiff(nil), j.diffs[len(j.diffs)-maxJournalDiffs:]...)
+	}
+	if j.path == "" {
+		return nil
+	}
+	var records []dnsmessage.Resource
+	for _, d := range j.diffs {
+		records = append(records, d.Deleted...)
+		records = append(records, d.Added...)
+	}
+	return writeZoneFile(j.path, records)
+}
+
+// since returns the differences that take a zone from serial from to
+// serial to, false if the journal does not reach back that far.
+func (j *zoneJournal) since(from, to uint32) ([]zoneDiff, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i, d := range j.diffs {
+		if soaSerial(d.Deleted[0]) != from {
+			continue
+		}
+		chain := j.diffs[i:]
+		if soaSerial(chain[len(chain)-1].Added[0]) != to {
+			return nil, false
+		}
+		return append([]zoneDiff(nil), chain...), true
+	}
+	return nil, false
+}
+
+// splitDiffs reads differences laid out one after the other as in an IXFR.
+func splitDiffs(records []dnsmessage.Resource) ([]zoneDiff, error) {
+	var diffs []zoneDiff
+	for _, r := range records {
+		n := len(diffs)
+		if r.Header.Type == dnsmessage.TypeSOA {
+			if n == 0 || len(diffs[n-1].Added) > 0 {
+				diffs = append(diffs, zoneDiff{Deleted: []dnsmessage.Resource{r}})
+			} else {
+				diffs[n-1].Added = []dnsmessage.Resource{r}
+			}
+			continue
+		}
+		switch {
+		case n == 0:
+			return nil, errors.New("difference does not start with an SOA")
+		case len(diffs[n-1].Added) > 0:
+			diffs[n-1].Added = append(diffs[n-1].Added, r)
+		default:
+			diffs[n-1].Deleted = append(diffs[n-1].Deleted, r)
+		}
+	}
+	if n := len(diffs); n > 0 && len(diffs[n-1].Added) == 0 {
+		return nil, errors.New("difference without a new SOA")
+	}
+	return diffs, nil
+}
+
+// diffZones returns what changed from old to new.
+func diffZones(old, new *authZone) zoneDiff {
+	d := zoneDiff{
+		Deleted: []dnsmessage.Resource{old.soa},
+		Added:   []dnsmessage.Resource{new.soa},
+	}
+	oldKeys, newKeys := recordKeys(old), recordKeys(new)
+	for _, r := range old.records[1:] {
+		if !newKeys[recordKey(r)] {
+			d.Deleted = append(d.Deleted, r)
+		}
+	}
+	for _, r := range new.records[1:] {
+		if !oldKeys[recordKey(r)] {
+			d.Added = append(d.Added, r)
+		}
+	}
+	return d
+}
+
+// apply returns the zone d turns z into.
+func (z *authZone) apply(d zoneDiff) (*authZone, error) {
+	if from := soaSerial(d.Deleted[0]); from != z.serial() {
+		return nil, fmt.Errorf("zone %s: difference from serial %d applied to serial %d", z.origin, from, z.serial())
+	}
+	deleted := make(map[string]bool, len(d.Deleted))
+	for _, r := range d.Deleted[1:] {
+		deleted[recordKey(r)] = true
+	}
+	records := []dnsmessage.Resource{d.Added[0]}
+	for _, r := range z.records[1:] {
+		if !deleted[recordKey(r)] {
+			records = append(records, r)
+		}
+	}
+	records = append(records, d.Added[1:]...)
+	return newAuthZone(z.origin, records)
+}
+
+func recordKeys(z *authZone) map[string]bool {
+	keys := make(map[string]bool, len(z.records))
+	for _, r := range z.records {
+		keys[recordKey(r)] = true
+	}
+	return keys
+}
+
+// recordKey tells records apart the way a zone does: by owner, whatever
+// its case, type, TTL and RDATA.
+func recordKey(r dnsmessage.Resource) string {
+	rec := fileRecord(r)
+	rec.Name = canonicalName(rec.Name)
+	return rec.String()
+}
+
+// soaSerial returns the serial of an SOA record, 0 for anything else.
+func soaSerial(r dnsmessage.Resource) uint32 {
+	if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+		return soa.Serial
+	}
+	return 0
+}
+
+// serialNewer compares serials the way RFC 1982 says: a is newer than b if
+// it is less than half the serial space ahead of it.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// fileRecord converts rr to its message/rfc form for a master file we read
+// back: types without a presentation form of their own are written in the
+// generic one.
+func fileRecord(rr dnsmessage.Resource) rfc.ResourceRecord {
+	rec := rfcRecord(rr)
+	if _, ok := rec.RData.(rdataText); ok {
+		if u, ok := rr.Body.(*dnsmessage.UnknownResource); ok {
+			rec.RData = rfc.RDataUnknown{Data: u.Data}
+		}
+	}
+	return rec
+}
+
+// writeZoneFile replaces the master file at path with records.
+func writeZoneFile(path string, records []dnsmessage.Resource) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	converted := make([]rfc.ResourceRecord, 0, len(records))
+	for _, r := range records {
+		converted = append(converted, fileRecord(r))
+	}
+	if err := rfc.WriteZone(tmp, converted); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
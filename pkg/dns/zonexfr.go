@@ -0,0 +1,584 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Zone transfers: we serve AXFR (RFC 5936) and IXFR (RFC 1995) of our zones
+// over TCP to the clients allow_transfer names, and NOTIFY (RFC 1996) the
+// secondaries listed when a zone gets a new serial. For a zone with
+// primaries we are the secondary: its SOA is checked with them every
+// refresh interval, and right away when one of them sends a NOTIFY, and a
+// newer serial is transferred, by IXFR when we have a copy to bring up to
+// date. A copy that could not be refreshed for the expire interval is no
+// longer answered from.
+
+const (
+	opcodeNotify = dnsmessage.OpCode(4) // RFC 1996
+	rcodeNotAuth = dnsmessage.RCode(9)  // not authoritative for the zone, RFC 2136
+
+	typeIXFR = dnsmessage.Type(251)
+
+	// transferMessageSize is about how much of a transfer goes in one
+	// message.
+	transferMessageSize = 16 << 10
+	transferTimeout     = 30 * time.Second
+
+	// retryUnknown is how soon a secondary that has never had the zone
+	// tries its primaries again; once it has the SOA says.
+	retryUnknown = time.Minute
+
+	notifyTimeout  = 2 * time.Second
+	notifyAttempts = 3
+)
+
+// ZoneStats reports on one authoritative zone.
+type ZoneStats struct {
+	Name      string `json:"name"`
+	Secondary bool   `json:"secondary"`
+	Serial    uint32 `json:"serial"`
+	Records   int    `json:"records"`
+	Expired   bool   `json:"expired"` // a secondary without a live copy
+	AXFR      uint64 `json:"axfr"`    // transfers served
+	IXFR      uint64 `json:"ixfr"`
+	Transfers uint64 `json:"transfers"` // taken from a primary
+	Notifies  uint64 `json:"notifies"`  // received from a primary
+}
+
+type zoneCounters struct {
+	axfr, ixfr, transfers, notifies uint64
+}
+
+// ZoneResults returns the state of the authoritative zones.
+func ZoneResults() []ZoneStats {
+	authZones.mu.RLock()
+	defer authZones.mu.RUnlock()
+	results := []ZoneStats{}
+	for origin, sz := range authZones.zones {
+		z := sz.current()
+		stats := ZoneStats{Name: origin, Secondary: sz.secondary(), Expired: z == nil}
+		if z != nil {
+			stats.Serial, stats.Records = z.serial(), len(z.records)
+		}
+		sz.mu.Lock()
+		stats.AXFR, stats.IXFR = sz.counters.axfr, sz.counters.ixfr
+		stats.Transfers, stats.Notifies = sz.counters.transfers, sz.counters.notifies
+		sz.mu.Unlock()
+		results = append(results, stats)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// timers returns the refresh, retry and expire intervals of the SOA.
+func (z *authZone) timers() (refresh, retry, expire time.Duration) {
+	soa := z.soa.Body.(*dnsmessage.SOAResource)
+	return time.Duration(soa.Refresh) * time.Second, time.Duration(soa.Retry) * time.Second,
+		time.Duration(soa.Expire) * time.Second
+}
+
+func isTransfer(t dnsmessage.Type) bool {
+	return t == dnsmessage.TypeAXFR || t == typeIXFR
+}
+
+// transferQuery reports whether query asks for a zone transfer.
+func transferQuery(query []byte) bool {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return false
+	}
+	question, err := p.Question()
+	return err == nil && isTransfer(question.Type)
+}
+
+// transfer answers the AXFR or IXFR query from client with the messages
+// send writes to its connection.
+func (s *zoneStore) transfer(client net.IP, query []byte, send func(*dnsmessage.Message) error) error {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return err
+	}
+	if len(msg.Questions) != 1 {
+		return send(&dnsmessage.Message{Header: dnsmessage.Header{ID: msg.Header.ID, Response: true, RCode: dnsmessage.RCodeFormatError}})
+	}
+	question := msg.Questions[0]
+	reply := func(rcode dnsmessage.RCode) *dnsmessage.Message {
+		return &dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: msg.Header.ID, Response: true, RCode: rcode},
+			Questions: []dnsmessage.Question{question},
+		}
+	}
+	origin := canonicalName(question.Name.String())
+	sz := s.served(origin)
+	if sz == nil {
+		return send(reply(rcodeNotAuth))
+	}
+	if !sz.mayTransfer(client) {
+		debugf("refused %s of %s to %s", rfc.RecordType(question.Type), origin, client)
+		refused := reply(dnsmessage.RCodeRefused)
+		addEDE(refused, edeProhibited, "")
+		return send(refused)
+	}
+	z := sz.current()
+	if z == nil {
+		return send(reply(dnsmessage.RCodeServerFailure))
+	}
+
+	var records []dnsmessage.Resource
+	incremental := false
+	if question.Type == typeIXFR {
+		if len(msg.Authorities) == 0 || msg.Authorities[0].Header.Type != dnsmessage.TypeSOA {
+			return send(reply(dnsmessage.RCodeFormatError))
+		}
+		serial := soaSerial(msg.Authorities[0])
+		if !serialNewer(z.serial(), serial) {
+			// up to date
+			records, incremental = []dnsmessage.Resource{z.soa}, true
+		} else if diffs, ok := sz.journal.since(serial, z.serial()); ok {
+			records, incremental = []dnsmessage.Resource{z.soa}, true
+			for _, d := range diffs {
+				records = append(records, d.Deleted...)
+				records = append(records, d.Added...)
+			}
+			records = append(records, z.soa)
+		}
+	}
+	if records == nil {
+		// an AXFR, or an IXFR the journal does not reach back for
+		records = append(append([]dnsmessage.Resource(nil), z.records...), z.soa)
+	}
+	sz.mu.Lock()
+	if incremental {
+		sz.counters.ixfr++
+	} else {
+		sz.counters.axfr++
+	}
+	sz.mu.Unlock()
+	debugf("transferring %s serial %d to %s, %d records", origin, z.serial(), client, len(records))
+
+	out, size := reply(dnsmessage.RCodeSuccess), 0
+	out.Header.Authoritative = true
+	for _, r := range records {
+		n := recordSize(r)
+		if len(out.Answers) > 0 && size+n > transferMessageSize {
+			if err := send(out); err != nil {
+				return err
+			}
+			out, size = reply(dnsmessage.RCodeSuccess), 0
+			out.Header.Authoritative = true
+		}
+		out.Answers = append(out.Answers, r)
+		size += n
+	}
+	return send(out)
+}
+
+// recordSize is about the size r takes in a message.
+func recordSize(r dnsmessage.Resource) int {
+	packed, err := (&dnsmessage.Message{Answers: []dnsmessage.Resource{r}}).Pack()
+	if err != nil {
+		return transferMessageSize
+	}
+	return len(packed)
+}
+
+// datagramTransfer answers a transfer query that did not come over TCP: a
+// client allowed to transfer the zone gets a truncated answer sending it
+// there, with the SOA for an IXFR (RFC 1995 section 2).
+func (s *zoneStore) datagramTransfer(client net.IP, question dnsmessage.Question) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	sz := s.served(canonicalName(question.Name.String()))
+	switch {
+	case sz == nil:
+		msg.Header.RCode = rcodeNotAuth
+	case !sz.mayTransfer(client):
+		msg.Header.RCode = dnsmessage.RCodeRefused
+		addEDE(msg, edeProhibited, "")
+	default:
+		msg.Header.Authoritative, msg.Header.Truncated = true, true
+		if z := sz.current(); z != nil && question.Type == typeIXFR {
+			msg.Answers = []dnsmessage.Resource{z.soa}
+		}
+	}
+	return msg
+}
+
+// notified answers a NOTIFY from client, refreshing the zone when the
+// client is one of its primaries.
+func (s *zoneStore) notified(client net.IP, question dnsmessage.Question) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, OpCode: opcodeNotify, Authoritative: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	origin := canonicalName(question.Name.String())
+	sz := s.served(origin)
+	if sz == nil || !sz.secondary() {
+		msg.Header.RCode = rcodeNotAuth
+		return msg
+	}
+	if !sz.fromPrimary(client) {
+		debugf("ignoring NOTIFY for %s from %s, not a primary", origin, client)
+		msg.Header.RCode = dnsmessage.RCodeRefused
+		return msg
+	}
+	infof("NOTIFY for zone %s from %s", origin, client)
+	sz.mu.Lock()
+	sz.refreshAt = time.Time{}
+	sz.counters.notifies++
+	sz.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return msg
+}
+
+func (sz *servedZone) fromPrimary(client net.IP) bool {
+	for _, primary := range sz.config.Primaries {
+		if ip, _, err := splitServerAddr(primary); err == nil && ip.Equal(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintainZones keeps the secondary zones up to date with their primaries
+// until stop is closed.
+func MaintainZones(stop <-chan struct{}) {
+	authZones.maintain(stop)
+}
+
+func (s *zoneStore) maintain(stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(time.Until(s.refreshDue(time.Now())))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// refreshDue refreshes the secondary zones whose time has come and returns
+// when the next one is due.
+func (s *zoneStore) refreshDue(now time.Time) time.Time {
+	s.mu.RLock()
+	var secondaries []*servedZone
+	for _, sz := range s.zones {
+		if sz.secondary() {
+			secondaries = append(secondaries, sz)
+		}
+	}
+	s.mu.RUnlock()
+	next := now.Add(time.Hour)
+	for _, sz := range secondaries {
+		sz.mu.Lock()
+		due := sz.refreshAt
+		sz.mu.Unlock()
+		if !due.After(now) {
+			sz.refresh()
+			sz.mu.Lock()
+			due = sz.refreshAt
+			sz.mu.Unlock()
+		}
+		if due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// refresh brings sz up to date with the first of its primaries that
+// answers, and schedules the next check.
+func (sz *servedZone) refresh() {
+	origin := canonicalName(sz.config.Name)
+	var err error
+	for _, primary := range sz.config.Primaries {
+		if err = sz.pull(primary); err == nil {
+			return
+		}
+		warnf("zone %s: transfer from %s failed: %s", origin, primary, err)
+	}
+	sz.mu.Lock()
+	defer sz.mu.Unlock()
+	retry := retryUnknown
+	if sz.data != nil {
+		_, retry, _ = sz.data.timers()
+	}
+	sz.refreshAt = time.Now().Add(retry)
+}
+
+// pull checks the SOA of primary and transfers the zone if it has a newer
+// serial than ours.
+func (sz *servedZone) pull(primary string) error {
+	ip, port, err := splitServerAddr(primary)
+	if err != nil {
+		return err
+	}
+	name, err := dnsmessage.NewName(canonicalName(sz.config.Name))
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), transferTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+
+	sz.mu.Lock()
+	current := sz.data
+	sz.mu.Unlock()
+	soa, err := askPrimary(conn, dnsmessage.Question{Name: name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}, nil)
+	if err != nil {
+		return err
+	}
+	if len(soa) == 0 || len(soa[0].Answers) == 0 || soa[0].Answers[0].Header.Type != dnsmessage.TypeSOA {
+		return errors.New("no SOA in the answer")
+	}
+	if current != nil && !serialNewer(soaSerial(soa[0].Answers[0]), current.serial()) {
+		sz.refreshed(current)
+		return nil
+	}
+
+	question := dnsmessage.Question{Name: name, Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}
+	var authorities []dnsmessage.Resource
+	if current != nil {
+		question.Type, authorities = typeIXFR, []dnsmessage.Resource{current.soa}
+	}
+	messages, err := askPrimary(conn, question, authorities)
+	if err != nil {
+		return err
+	}
+	var records []dnsmessage.Resource
+	for _, msg := range messages {
+		records = append(records, msg.Answers...)
+	}
+	full, diffs, _, err := parseTransfer(records)
+	if err != nil {
+		return err
+	}
+
+	z, journaled := current, diffs
+	switch {
+	case full != nil:
+		if z, err = newAuthZone(sz.config.Name, full); err != nil {
+			return err
+		}
+		if current != nil {
+			journaled = []zoneDiff{diffZones(current, z)}
+		}
+	case diffs != nil:
+		for _, d := range diffs {
+			if z, err = z.apply(d); err != nil {
+				return err
+			}
+		}
+	default:
+		// a lone SOA: nothing newer to give
+		sz.refreshed(current)
+		return nil
+	}
+	if current != nil && !serialNewer(z.serial(), current.serial()) {
+		return fmt.Errorf("transferred serial %d is not newer than %d", z.serial(), current.serial())
+	}
+	for _, d := range journaled {
+		if err := sz.journal.add(d); err != nil {
+			warnf("zone %s: journal: %s", z.origin, err)
+		}
+	}
+	if sz.config.File != "" {
+		if err := writeZoneFile(sz.config.File, z.records); err != nil {
+			warnf("zone %s: saving to %s: %s", z.origin, sz.config.File, err)
+		}
+	}
+	kind := "AXFR"
+	if full == nil {
+		kind = "IXFR"
+	}
+	infof("transferred zone %s, serial %d, from %s by %s", z.origin, z.serial(), primary, kind)
+	sz.mu.Lock()
+	sz.data = z
+	sz.counters.transfers++
+	sz.mu.Unlock()
+	sz.refreshed(z)
+	sendNotify(sz, z.soa)
+	return nil
+}
+
+// refreshed restarts the refresh and expire timers of sz, whose primary
+// has just confirmed z.
+func (sz *servedZone) refreshed(z *authZone) {
+	refresh, _, expire := z.timers()
+	now := time.Now()
+	sz.mu.Lock()
+	sz.refreshAt, sz.expireAt = now.Add(refresh), now.Add(expire)
+	sz.mu.Unlock()
+}
+
+// askPrimary sends question to the primary on conn and reads the answer,
+// all the messages of it for a transfer.
+func askPrimary(conn net.Conn, question dnsmessage.Question, authorities []dnsmessage.Resource) ([]dnsmessage.Message, error) {
+	id, err := queryID()
+	if err != nil {
+		return nil, err
+	}
+	query, err := (&dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id},
+		Questions:   []dnsmessage.Question{question},
+		Authorities: authorities,
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, query); err != nil {
+		return nil, err
+	}
+	var (
+		messages []dnsmessage.Message
+		records  []dnsmessage.Resource
+	)
+	for {
+		answer, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(answer); err != nil {
+			return nil, err
+		}
+		if msg.Header.ID != id || !msg.Header.Response {
+			return nil, errors.New("answer does not match the query")
+		}
+		if msg.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("primary answered %s", rcodeString(msg.Header.RCode))
+		}
+		messages = append(messages, msg)
+		if !isTransfer(question.Type) {
+			return messages, nil
+		}
+		records = append(records, msg.Answers...)
+		if question.Type == typeIXFR && len(records) == 1 {
+			// a lone SOA: we are up to date
+			return messages, nil
+		}
+		if _, _, done, err := parseTransfer(records); done || err != nil {
+			return messages, err
+		}
+	}
+}
+
+// parseTransfer reads the records of an AXFR or IXFR answer: the whole
+// zone, or the differences to apply to ours. It is not done until the
+// closing SOA is in.
+func parseTransfer(records []dnsmessage.Resource) (full []dnsmessage.Resource, diffs []zoneDiff, done bool, err error) {
+	if len(records) == 0 {
+		return nil, nil, false, nil
+	}
+	if records[0].Header.Type != dnsmessage.TypeSOA {
+		return nil, nil, false, errors.New("transfer does not start with an SOA")
+	}
+	if len(records) == 1 {
+		return nil, nil, false, nil
+	}
+	serial := soaSerial(records[0])
+	if records[1].Header.Type == dnsmessage.TypeSOA && soaSerial(records[1]) != serial {
+		// incremental: the SOAs alternate between the old and the new
+		// serial of each difference, until the closing one
+		open := false
+		for i := 1; i < len(records); i++ {
+			if records[i].Header.Type != dnsmessage.TypeSOA {
+				continue
+			}
+			if !open && soaSerial(records[i]) == serial {
+				if i != len(records)-1 {
+					return nil, nil, false, errors.New("records after the end of the transfer")
+				}
+				diffs, err := splitDiffs(records[1:i])
+				return nil, diffs, err == nil, err
+			}
+			open = !open
+		}
+		return nil, nil, false, nil
+	}
+	if records[len(records)-1].Header.Type != dnsmessage.TypeSOA {
+		return nil, nil, false, nil
+	}
+	return records[:len(records)-1], nil, true, nil
+}
+
+// sendNotify tells the secondaries of sz that it is now at the serial of
+// soa.
+func sendNotify(sz *servedZone, soa dnsmessage.Resource) {
+	for _, secondary := range sz.config.Notify {
+		go notify(secondary, soa)
+	}
+}
+
+func notify(secondary string, soa dnsmessage.Resource) {
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		if err = notifyOnce(secondary, soa); err == nil {
+			debugf("sent NOTIFY for %s serial %d to %s", soa.Header.Name, soaSerial(soa), secondary)
+			return
+		}
+	}
+	warnf("NOTIFY for %s to %s failed: %s", soa.Header.Name, secondary, err)
+}
+
+func notifyOnce(secondary string, soa dnsmessage.Resource) error {
+	ip, port, err := splitServerAddr(secondary)
+	if err != nil {
+		return err
+	}
+	id, err := queryID()
+	if err != nil {
+		return err
+	}
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, OpCode: opcodeNotify, Authoritative: true},
+		Questions: []dnsmessage.Question{{Name: soa.Header.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}},
+		Answers:   []dnsmessage.Resource{soa},
+	}).Pack()
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil || header.ID != id || !header.Response || header.OpCode != opcodeNotify {
+			continue
+		}
+		if header.RCode != dnsmessage.RCodeSuccess {
+			return fmt.Errorf("secondary answered %s", rcodeString(header.RCode))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,262 @@
+package dns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manzil-infinity180/dns-server-resolver/message/rfc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// servePrimary serves the global zones over TCP, as the primary of a
+// transfer test, and returns the address.
+func servePrimary(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ServeTCP(l)
+	return l.Addr().String()
+}
+
+// serveNotifies answers the NOTIFY messages sent to the returned address
+// from store.
+func serveNotifies(t *testing.T, store *zoneStore) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := p.Question()
+			if err != nil {
+				continue
+			}
+			reply := store.notified(addrIP(addr), question)
+			reply.Header.ID = header.ID
+			if packed, err := reply.Pack(); err == nil {
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// addressOf returns the first address store answers for name, "" if none.
+func addressOf(store *zoneStore, name string) string {
+	msg := store.answer(testQuestion(name, dnsmessage.TypeA))
+	if msg == nil || len(msg.Answers) == 0 {
+		return ""
+	}
+	a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok {
+		return ""
+	}
+	return net.IP(a.A[:]).String()
+}
+
+func TestZoneTransferToSecondary(t *testing.T) {
+	dir := t.TempDir()
+	primaryFile, secondaryFile := filepath.Join(dir, "primary.db"), filepath.Join(dir, "secondary.db")
+	journal := filepath.Join(dir, "primary.jnl")
+	if err := os.WriteFile(primaryFile, []byte(exampleZone), 0o644); err != nil {
+		t.Fatalf("write zone: %s", err)
+	}
+
+	secondary := newZoneStore()
+	notifyAddr := serveNotifies(t, secondary)
+	useTestConfig(t, func(cfg *Config) {
+		cfg.AuthZones = []AuthZone{{Name: "example.com", File: primaryFile, Journal: journal,
+			AllowTransfer: []string{"127.0.0.0/8"}, Notify: []string{notifyAddr}}}
+	})
+	primaryAddr := servePrimary(t)
+
+	secondaryZones := []AuthZone{{Name: "example.com", Primaries: []string{primaryAddr}, File: secondaryFile}}
+	zones, err := secondary.load(secondaryZones)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	secondary.set(zones)
+	if msg := secondary.answer(testQuestion("www.example.com.", dnsmessage.TypeA)); msg == nil || msg.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("secondary without a copy answered %v, want SERVFAIL", msg)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go secondary.maintain(stop)
+
+	waitFor(t, "the AXFR", func() bool { return addressOf(secondary, "www.example.com.") == "192.0.2.80" })
+	if stats := ZoneResults(); len(stats) != 1 || stats[0].AXFR != 1 || stats[0].IXFR != 0 {
+		t.Fatalf("got primary stats %+v, want one AXFR", stats)
+	}
+	sz := secondary.served("example.com.")
+	if got, want := len(sz.current().records), len(authZones.served("example.com.").current().records); got != want {
+		t.Fatalf("secondary has %d records, primary %d", got, want)
+	}
+
+	// a new serial reaches the secondary by NOTIFY and IXFR
+	updated := strings.NewReplacer("hostmaster 1 ", "hostmaster 2 ", "192.0.2.80", "192.0.2.81").Replace(exampleZone) +
+		"new\t\tA\t192.0.2.1\n"
+	if err := os.WriteFile(primaryFile, []byte(updated), 0o644); err != nil {
+		t.Fatalf("write zone: %s", err)
+	}
+	admin := httptest.NewServer(NewAdminHandler())
+	defer admin.Close()
+	reloadZones := func() int {
+		t.Helper()
+		resp, err := http.Post(admin.URL+"/zones/reload", "", nil)
+		if err != nil {
+			t.Fatalf("POST /zones/reload: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := reloadZones(); status != http.StatusOK {
+		t.Fatalf("POST /zones/reload: got %d", status)
+	}
+	waitFor(t, "the IXFR", func() bool {
+		return addressOf(secondary, "www.example.com.") == "192.0.2.81" && addressOf(secondary, "new.example.com.") == "192.0.2.1"
+	})
+	if stats := ZoneResults(); stats[0].Serial != 2 || stats[0].AXFR != 1 || stats[0].IXFR != 1 {
+		t.Fatalf("got primary stats %+v, want one AXFR and one IXFR", stats)
+	}
+	sz.mu.Lock()
+	counters := sz.counters
+	sz.mu.Unlock()
+	if counters.transfers != 2 || counters.notifies != 1 {
+		t.Fatalf("got secondary counters %+v, want 2 transfers and 1 NOTIFY", counters)
+	}
+
+	j, err := loadJournal(journal)
+	if err != nil {
+		t.Fatalf("loadJournal: %s", err)
+	}
+	if len(j.diffs) != 1 || len(j.diffs[0].Deleted) != 2 || len(j.diffs[0].Added) != 3 {
+		t.Fatalf("got journal %+v, want the old www deleted and two records added", j.diffs)
+	}
+	if _, ok := j.since(1, 2); !ok {
+		t.Fatalf("journal does not take serial 1 to 2")
+	}
+
+	// a zone file that does not load leaves the zone as it was
+	if err := os.WriteFile(primaryFile, []byte("@ IN A not-an-address\n"), 0o644); err != nil {
+		t.Fatalf("write zone: %s", err)
+	}
+	if status := reloadZones(); status != http.StatusInternalServerError {
+		t.Fatalf("POST /zones/reload of a broken zone: got %d", status)
+	}
+	if got := addressOf(authZones, "new.example.com."); got != "192.0.2.1" {
+		t.Fatalf("primary answered %q for new.example.com. after a failed reload", got)
+	}
+
+	// a restarted secondary answers from its saved copy
+	restarted := newZoneStore()
+	zones, err = restarted.load(secondaryZones)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	restarted.set(zones)
+	if got := addressOf(restarted, "new.example.com."); got != "192.0.2.1" {
+		t.Fatalf("restarted secondary answered %q for new.example.com.", got)
+	}
+}
+
+func TestZoneTransferRefused(t *testing.T) {
+	useTestZone(t)
+	transfer := func(client string, question dnsmessage.Question, authorities ...dnsmessage.Resource) []dnsmessage.Message {
+		t.Helper()
+		query, err := (&dnsmessage.Message{Header: dnsmessage.Header{ID: 7}, Questions: []dnsmessage.Question{question}, Authorities: authorities}).Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		var messages []dnsmessage.Message
+		err = authZones.transfer(net.ParseIP(client), query, func(msg *dnsmessage.Message) error {
+			messages = append(messages, *msg)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("transfer: %s", err)
+		}
+		return messages
+	}
+
+	axfr := testQuestion("example.com.", dnsmessage.TypeAXFR)
+	if got := transfer("127.0.0.1", axfr); len(got) != 1 || got[0].Header.RCode != dnsmessage.RCodeRefused || got[0].Header.ID != 7 {
+		t.Fatalf("got %+v, want the AXFR refused without allow_transfer", got)
+	}
+	if got := transfer("127.0.0.1", testQuestion("example.net.", dnsmessage.TypeAXFR)); len(got) != 1 || got[0].Header.RCode != rcodeNotAuth {
+		t.Fatalf("got %+v, want NOTAUTH for a zone we do not have", got)
+	}
+
+	cfg := CurrentConfig()
+	cfg.AuthZones[0].AllowTransfer = []string{"192.0.2.0/24"}
+	if err := Configure(cfg); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+	if got := transfer("127.0.0.1", axfr); len(got) != 1 || got[0].Header.RCode != dnsmessage.RCodeRefused {
+		t.Fatalf("got %+v, want the AXFR refused outside allow_transfer", got)
+	}
+	// no journal for serial 0: the IXFR is answered with the whole zone
+	soa := authZones.served("example.com.").current().soa
+	old := soa
+	old.Body = &dnsmessage.SOAResource{NS: soa.Body.(*dnsmessage.SOAResource).NS, MBox: soa.Body.(*dnsmessage.SOAResource).MBox}
+	got := transfer("192.0.2.1", testQuestion("example.com.", typeIXFR), old)
+	var records []dnsmessage.Resource
+	for _, msg := range got {
+		records = append(records, msg.Answers...)
+	}
+	full, diffs, done, err := parseTransfer(records)
+	if err != nil || !done || diffs != nil || len(full) != len(authZones.served("example.com.").current().records) {
+		t.Fatalf("got %d records, %v, done %v, %v; want an AXFR", len(full), diffs, done, err)
+	}
+	if got := transfer("192.0.2.1", testQuestion("example.com.", typeIXFR), soa); len(got) != 1 || len(got[0].Answers) != 1 {
+		t.Fatalf("got %+v, want the SOA alone for an IXFR that is up to date", got)
+	}
+
+	// not over UDP, and NOTIFY only for the zones we are secondary for
+	for _, tc := range []struct {
+		opcode dnsmessage.OpCode
+		qtype  dnsmessage.Type
+		rcode  dnsmessage.RCode
+	}{
+		{0, dnsmessage.TypeAXFR, dnsmessage.RCodeRefused},
+		{opcodeNotify, dnsmessage.TypeSOA, rcodeNotAuth},
+	} {
+		query, err := (&dnsmessage.Message{Header: dnsmessage.Header{ID: 9, OpCode: tc.opcode}, Questions: []dnsmessage.Question{testQuestion("example.com.", tc.qtype)}}).Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		reply, err := respond(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, query, true)
+		if err != nil || reply == nil || reply.Header.RCode != tc.rcode || reply.Header.ID != 9 {
+			t.Fatalf("opcode %d %s: got %+v, %v; want %s", tc.opcode, rfc.RecordType(tc.qtype), reply, err, rcodeString(tc.rcode))
+		}
+	}
+}